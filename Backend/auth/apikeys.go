@@ -0,0 +1,568 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Jonathanpatta/rplace/cache"
+	"github.com/Jonathanpatta/rplace/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scopes an API key can be given.
+const (
+	ScopeRead  = "read"
+	ScopePlace = "place"
+	ScopeAdmin = "admin"
+)
+
+// APIKeyPrefix starts every API key, which tells them apart from other
+// bearer credentials.
+const APIKeyPrefix = "rpk_"
+
+const (
+	apiKeySk = "APIKEY"
+	// DefaultAPIKeyRate is the limit, in requests a minute, of keys created
+	// without one.
+	DefaultAPIKeyRate = 60
+	maxAPIKeyRate     = 6000
+	maxAPIKeyName     = 64
+)
+
+var (
+	ErrInvalidAPIKey = errors.New("invalid API key")
+	ErrUnknownScope  = errors.New("unknown scope")
+)
+
+// APIKey is a named credential for bots and integrations. Only a hash of
+// its secret is kept.
+type APIKey struct {
+	Id        string   `json:"id" dynamodbav:"id"`
+	Name      string   `json:"name" dynamodbav:"name"`
+	Owner     string   `json:"owner" dynamodbav:"owner"`
+	Scopes    []string `json:"scopes" dynamodbav:"scopes,stringset"`
+	RateLimit int      `json:"rate_limit" dynamodbav:"rate_limit"`
+	CreatedAt int64    `json:"created_at" dynamodbav:"created_at"`
+	ExpiresAt int64    `json:"expires_at,omitempty" dynamodbav:"expires_at,omitempty"`
+	LastUsed  int64    `json:"last_used,omitempty" dynamodbav:"last_used"`
+	Hash      string   `json:"-" dynamodbav:"hash"`
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *APIKey) expired(now time.Time) bool {
+	return k.ExpiresAt != 0 && now.Unix() > k.ExpiresAt
+}
+
+// NewAPIKey is what a key is created from.
+type NewAPIKey struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// RateLimit is in requests a minute. DefaultAPIKeyRate applies when it
+	// is left out.
+	RateLimit int `json:"rate_limit,omitempty"`
+	// ExpiresIn is in seconds. Keys without it do not expire.
+	ExpiresIn int64 `json:"expires_in,omitempty"`
+}
+
+func (n *NewAPIKey) Validate() error {
+	n.Name = strings.TrimSpace(n.Name)
+	if n.Name == "" || len(n.Name) > maxAPIKeyName {
+		return fmt.Errorf("name must be 1 to %d characters", maxAPIKeyName)
+	}
+	if len(n.Scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+	seen := make(map[string]bool)
+	var scopes []string
+	for _, scope := range n.Scopes {
+		if scope != ScopeRead && scope != ScopePlace && scope != ScopeAdmin {
+			return fmt.Errorf("%w %q", ErrUnknownScope, scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	n.Scopes = scopes
+	if n.RateLimit < 0 || n.RateLimit > maxAPIKeyRate {
+		return fmt.Errorf("rate_limit must be between 0 and %d", maxAPIKeyRate)
+	}
+	if n.ExpiresIn < 0 {
+		return errors.New("expires_in must not be negative")
+	}
+	return nil
+}
+
+// CreatedAPIKey is returned once, when a key is created. The key itself
+// cannot be read back later.
+type CreatedAPIKey struct {
+	Key    string `json:"key"`
+	APIKey APIKey `json:"api_key"`
+}
+
+// APIKeys keeps API keys under APIKEY#<id>, with a pointer in the USER#
+// partition of the owner to list them by. Looked up keys are cached like
+// tokens and evicted when revoked.
+type APIKeys struct {
+	DbCli     *dynamodb.Client
+	TableName *string
+	Cache     *cache.Client
+	// Limiter holds the per key rate limits when set.
+	Limiter *ratelimit.Limiter
+}
+
+func NewAPIKeys(DbCli *dynamodb.Client, tableName *string, c *cache.Client) *APIKeys {
+	return &APIKeys{
+		DbCli:     DbCli,
+		TableName: tableName,
+		Cache:     c,
+	}
+}
+
+func apiKeyPk(id string) string {
+	return "APIKEY#" + id
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// splitAPIKey splits a key of the form rpk_<id>_<secret>.
+func splitAPIKey(key string) (string, string, bool) {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(key, APIKeyPrefix), "_", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// Create mints a key for owner.
+func (a *APIKeys) Create(ctx context.Context, owner string, n *NewAPIKey) (*CreatedAPIKey, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	_, err = rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	key := APIKey{
+		Id:        hex.EncodeToString(id),
+		Name:      n.Name,
+		Owner:     owner,
+		Scopes:    n.Scopes,
+		RateLimit: n.RateLimit,
+		CreatedAt: now.Unix(),
+	}
+	if key.RateLimit == 0 {
+		key.RateLimit = DefaultAPIKeyRate
+	}
+	if n.ExpiresIn > 0 {
+		key.ExpiresAt = now.Unix() + n.ExpiresIn
+	}
+	encodedSecret := base64.RawURLEncoding.EncodeToString(secret)
+	key.Hash = hashSecret(encodedSecret)
+
+	item, err := attributevalue.MarshalMap(key)
+	if err != nil {
+		return nil, err
+	}
+	item["PK"] = &types.AttributeValueMemberS{Value: apiKeyPk(key.Id)}
+	item["SK"] = &types.AttributeValueMemberS{Value: apiKeySk}
+
+	pointer := map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: "USER#" + owner},
+		"SK": &types.AttributeValueMemberS{Value: apiKeyPk(key.Id)},
+		"id": &types.AttributeValueMemberS{Value: key.Id},
+	}
+	if key.ExpiresAt != 0 {
+		pointer["expires_at"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(key.ExpiresAt, 10)}
+	}
+
+	_, err = a.DbCli.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Put: &types.Put{TableName: a.TableName, Item: item}},
+			{Put: &types.Put{TableName: a.TableName, Item: pointer}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &CreatedAPIKey{
+		Key:    APIKeyPrefix + key.Id + "_" + encodedSecret,
+		APIKey: key,
+	}, nil
+}
+
+func (a *APIKeys) Get(ctx context.Context, id string) (*APIKey, error) {
+	out, err := a.DbCli.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: a.TableName,
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: apiKeyPk(id)},
+			"SK": &types.AttributeValueMemberS{Value: apiKeySk},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out.Item == nil {
+		return nil, ErrInvalidAPIKey
+	}
+
+	var key APIKey
+	err = attributevalue.UnmarshalMap(out.Item, &key)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// Authenticate checks a key and takes a request from its rate limit. Keys
+// that are unknown, revoked or expired give ErrInvalidAPIKey, and keys over
+// their limit a *ratelimit.LimitedError. A key whose owner is no longer an
+// admin comes back without the admin scope.
+func (a *APIKeys) Authenticate(ctx context.Context, presented string) (*APIKey, error) {
+	id, secret, ok := splitAPIKey(presented)
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+
+	var key APIKey
+	err := ErrInvalidAPIKey
+	if a.Cache != nil {
+		err = a.Cache.Get(apiKeyPk(id), &key)
+	}
+	if err != nil {
+		stored, err := a.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		key = *stored
+		if a.Cache != nil {
+			a.Cache.Put(apiKeyPk(id), key)
+		}
+	}
+
+	now := time.Now()
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(key.Hash)) != 1 || key.expired(now) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	if a.Limiter != nil {
+		rate := key.RateLimit
+		if rate == 0 {
+			rate = DefaultAPIKeyRate
+		}
+		allowed, wait, err := a.Limiter.Store.Take("apikey#"+key.Id, ratelimit.PerMinute(rate, rate), now)
+		if err == nil && !allowed {
+			return nil, &ratelimit.LimitedError{RetryAfter: wait}
+		}
+	}
+
+	err = a.touch(ctx, &key, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// The admin scope lasts only as long as its owner is an admin.
+	if key.HasScope(ScopeAdmin) {
+		admin, err := a.ownerAdmin(ctx, key.Owner, now)
+		if err != nil {
+			return nil, err
+		}
+		if !admin {
+			scopes := make([]string, 0, len(key.Scopes))
+			for _, scope := range key.Scopes {
+				if scope != ScopeAdmin {
+					scopes = append(scopes, scope)
+				}
+			}
+			key.Scopes = scopes
+		}
+	}
+	return &key, nil
+}
+
+// ownerCheck is whether the owner of admin keys was an admin when last
+// looked up.
+type ownerCheck struct {
+	Admin     bool
+	CheckedAt int64
+}
+
+func ownerCheckKey(owner string) string {
+	return "APIKEYOWNER#" + owner
+}
+
+// ownerAdmin reports whether owner is an admin, going by its account. The
+// answer is cached for touchInterval, which bounds how long admin keys
+// outlast the admin rights of their owner.
+func (a *APIKeys) ownerAdmin(ctx context.Context, owner string, now time.Time) (bool, error) {
+	var check ownerCheck
+	if a.Cache != nil && a.Cache.Get(ownerCheckKey(owner), &check) == nil && now.Unix()-check.CheckedAt < int64(touchInterval/time.Second) {
+		return check.Admin, nil
+	}
+
+	users, err := getUsers(ctx, a.DbCli, a.TableName, owner)
+	if err != nil {
+		return false, err
+	}
+	check = ownerCheck{Admin: len(users) == 1 && users[0].Admin, CheckedAt: now.Unix()}
+	if a.Cache != nil {
+		a.Cache.Put(ownerCheckKey(owner), check)
+	}
+	return check.Admin, nil
+}
+
+// touch records a use of key at most once every touchInterval. A key
+// revoked through another instance is found out here.
+func (a *APIKeys) touch(ctx context.Context, key *APIKey, now time.Time) error {
+	if now.Unix()-key.LastUsed < int64(touchInterval/time.Second) {
+		return nil
+	}
+
+	_, err := a.DbCli.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: a.TableName,
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: apiKeyPk(key.Id)},
+			"SK": &types.AttributeValueMemberS{Value: apiKeySk},
+		},
+		UpdateExpression:    aws.String("SET last_used = :now"),
+		ConditionExpression: aws.String("attribute_exists(PK)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		if a.Cache != nil {
+			a.Cache.Delete(apiKeyPk(key.Id))
+		}
+		return ErrInvalidAPIKey
+	}
+	if err != nil {
+		return err
+	}
+
+	key.LastUsed = now.Unix()
+	if a.Cache != nil {
+		a.Cache.Put(apiKeyPk(key.Id), *key)
+	}
+	return nil
+}
+
+// Revoke deletes a key and evicts it from the cache.
+func (a *APIKeys) Revoke(ctx context.Context, key *APIKey) error {
+	if a.Cache != nil {
+		a.Cache.Delete(apiKeyPk(key.Id))
+	}
+
+	_, err := a.DbCli.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Delete: &types.Delete{
+				TableName: a.TableName,
+				Key: map[string]types.AttributeValue{
+					"PK": &types.AttributeValueMemberS{Value: apiKeyPk(key.Id)},
+					"SK": &types.AttributeValueMemberS{Value: apiKeySk},
+				},
+			}},
+			{Delete: &types.Delete{
+				TableName: a.TableName,
+				Key: map[string]types.AttributeValue{
+					"PK": &types.AttributeValueMemberS{Value: "USER#" + key.Owner},
+					"SK": &types.AttributeValueMemberS{Value: apiKeyPk(key.Id)},
+				},
+			}},
+		},
+	})
+	return err
+}
+
+// List returns the keys of owner, newest first. Expired keys are left out.
+func (a *APIKeys) List(ctx context.Context, owner string) ([]APIKey, error) {
+	keys := []APIKey{}
+	now := time.Now()
+	paginator := dynamodb.NewQueryPaginator(a.DbCli, &dynamodb.QueryInput{
+		TableName:              a.TableName,
+		KeyConditionExpression: aws.String("#PK = :user AND begins_with(#SK, :prefix)"),
+		ExpressionAttributeNames: map[string]string{
+			"#PK": "PK",
+			"#SK": "SK",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":user":   &types.AttributeValueMemberS{Value: "USER#" + owner},
+			":prefix": &types.AttributeValueMemberS{Value: "APIKEY#"},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			id, ok := item["id"].(*types.AttributeValueMemberS)
+			if !ok {
+				continue
+			}
+			key, err := a.Get(ctx, id.Value)
+			if errors.Is(err, ErrInvalidAPIKey) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if !key.expired(now) {
+				keys = append(keys, *key)
+			}
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt > keys[j].CreatedAt
+	})
+	return keys, nil
+}
+
+// Caller is who a key or session route is called by.
+type Caller struct {
+	Id    string
+	Admin bool
+	// APIKey is set when the caller authenticated with an API key, which
+	// cannot be used to manage keys.
+	APIKey bool
+	// Token is the opaque token the caller authenticated with, if it did
+	// with one.
+	Token string
+}
+
+func (s *Server) caller(w http.ResponseWriter, r *http.Request) (Caller, bool) {
+	var c Caller
+	var ok bool
+	if s.Caller != nil {
+		c, ok = s.Caller(r)
+	}
+	if !ok || c.Id == "" {
+		http.Error(w, "not authenticated", http.StatusUnauthorized)
+		return Caller{}, false
+	}
+	if c.APIKey {
+		http.Error(w, "API keys cannot manage credentials", http.StatusForbidden)
+		return Caller{}, false
+	}
+	return c, true
+}
+
+func (s *Server) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.caller(w, r)
+	if !ok {
+		return
+	}
+
+	var n NewAPIKey
+	err := json.NewDecoder(r.Body).Decode(&n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = n.Validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, scope := range n.Scopes {
+		if scope == ScopeAdmin && !c.Admin {
+			http.Error(w, "only admins can create admin keys", http.StatusForbidden)
+			return
+		}
+	}
+
+	created, err := s.APIKeys.Create(r.Context(), c.Id, &n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJson(w, http.StatusCreated, created)
+}
+
+// GetAPIKeys lists the caller's keys. Admins can list another user's with
+// ?owner=.
+func (s *Server) GetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.caller(w, r)
+	if !ok {
+		return
+	}
+
+	owner := c.Id
+	if requested := r.URL.Query().Get("owner"); requested != "" && requested != c.Id {
+		if !c.Admin {
+			http.Error(w, "admin only", http.StatusForbidden)
+			return
+		}
+		owner = requested
+	}
+
+	keys, err := s.APIKeys.List(r.Context(), owner)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, http.StatusOK, keys)
+}
+
+// RevokeAPIKey revokes one of the caller's keys, or any key for admins.
+func (s *Server) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.caller(w, r)
+	if !ok {
+		return
+	}
+
+	key, err := s.APIKeys.Get(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, ErrInvalidAPIKey) || (err == nil && key.Owner != c.Id && !c.Admin) {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = s.APIKeys.Revoke(r.Context(), key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"github.com/Jonathanpatta/rplace/cache"
+	"github.com/Jonathanpatta/rplace/internal/dynamotest"
+	"github.com/Jonathanpatta/rplace/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"testing"
+	"time"
+)
+
+func putAccount(t *testing.T, table *dynamotest.StandIn, username string, admin bool) {
+	t.Helper()
+	_, err := table.Client().PutItem(context.Background(), &dynamodb.PutItemInput{
+		TableName: aws.String("Place-Clone"),
+		Item: map[string]types.AttributeValue{
+			"PK":             &types.AttributeValueMemberS{Value: "USER#" + username},
+			"SK":             &types.AttributeValueMemberS{Value: "1"},
+			"username":       &types.AttributeValueMemberS{Value: username},
+			"hashedpassword": &types.AttributeValueMemberS{Value: ""},
+			"admin":          &types.AttributeValueMemberBOOL{Value: admin},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPIKeyOwnerAdmin(t *testing.T) {
+	table := dynamotest.Start()
+	defer table.Close()
+	c, err := cache.NewClient(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.DbCli.Close()
+	keys := NewAPIKeys(table.Client(), aws.String("Place-Clone"), c)
+
+	putAccount(t, table, "root", true)
+	putAccount(t, table, "former", true)
+	putAccount(t, table, "alice", false)
+
+	ctx := context.Background()
+	now := time.Now()
+	tests := []struct {
+		owner string
+		admin bool
+	}{
+		{"root", true},
+		{"former", true},
+		{"alice", false},
+		{"nobody", false},
+	}
+	for _, test := range tests {
+		admin, err := keys.ownerAdmin(ctx, test.owner, now)
+		if err != nil || admin != test.admin {
+			t.Fatalf("%s: got %v, %v, want %v", test.owner, admin, err, test.admin)
+		}
+	}
+
+	// Losing admin rights reaches the keys once the cached answer is
+	// checked again.
+	putAccount(t, table, "former", false)
+	if admin, _ := keys.ownerAdmin(ctx, "former", now.Add(time.Second)); !admin {
+		t.Fatal("cached answer was not used")
+	}
+	if admin, _ := keys.ownerAdmin(ctx, "former", now.Add(touchInterval)); admin {
+		t.Fatal("former admin still an admin")
+	}
+}
+
+func TestAPIKeyAuthenticate(t *testing.T) {
+	table := dynamotest.Start()
+	defer table.Close()
+	c, err := cache.NewClient(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.DbCli.Close()
+	keys := NewAPIKeys(table.Client(), aws.String("Place-Clone"), c)
+	ctx := context.Background()
+
+	putAccount(t, table, "root", true)
+	putAccount(t, table, "former", true)
+	putAccount(t, table, "alice", false)
+	create := func(owner string, scopes ...string) string {
+		created, err := keys.Create(ctx, owner, &NewAPIKey{Name: "bot", Scopes: scopes})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return created.Key
+	}
+	rootKey := create("root", ScopeAdmin, ScopeRead)
+	formerKey := create("former", ScopeAdmin, ScopeRead)
+	aliceKey := create("alice", ScopeRead, ScopePlace)
+	revokedKey := create("alice", ScopeRead)
+
+	revoked, err := keys.Authenticate(ctx, revokedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = keys.Revoke(ctx, revoked)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The former admin loses the rights after the key was created.
+	putAccount(t, table, "former", false)
+
+	tests := []struct {
+		name   string
+		key    string
+		err    error
+		owner  string
+		scopes []string
+	}{
+		{"admin key", rootKey, nil, "root", []string{ScopeAdmin, ScopeRead}},
+		{"admin key of a former admin", formerKey, nil, "former", []string{ScopeRead}},
+		{"plain key", aliceKey, nil, "alice", []string{ScopeRead, ScopePlace}},
+		{"revoked key", revokedKey, ErrInvalidAPIKey, "", nil},
+		{"wrong secret", aliceKey[:len(aliceKey)-2] + "xx", ErrInvalidAPIKey, "", nil},
+		{"unknown key", APIKeyPrefix + "0000000000000000_secret", ErrInvalidAPIKey, "", nil},
+		{"malformed key", APIKeyPrefix + "nosecret", ErrInvalidAPIKey, "", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, err := keys.Authenticate(ctx, test.key)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got %v, want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if key.Owner != test.owner || len(key.Scopes) != len(test.scopes) {
+				t.Fatalf("got %+v", key)
+			}
+			for _, scope := range test.scopes {
+				if !key.HasScope(scope) {
+					t.Fatalf("got scopes %v, want %v", key.Scopes, test.scopes)
+				}
+			}
+		})
+	}
+}
+
+func TestAPIKeyRateLimit(t *testing.T) {
+	table := dynamotest.Start()
+	defer table.Close()
+	keys := NewAPIKeys(table.Client(), aws.String("Place-Clone"), nil)
+	limiter, err := ratelimit.New(ratelimit.NewMemoryStore(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.Limiter = limiter
+	ctx := context.Background()
+
+	created, err := keys.Create(ctx, "alice", &NewAPIKey{Name: "bot", Scopes: []string{ScopeRead}, RateLimit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = keys.Authenticate(ctx, created.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = keys.Authenticate(ctx, created.Key)
+	var limited *ratelimit.LimitedError
+	if !errors.As(err, &limited) {
+		t.Fatalf("got %v, want the key limited", err)
+	}
+}
@@ -2,9 +2,15 @@ package auth
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/Jonathanpatta/rplace/broker"
+	"github.com/Jonathanpatta/rplace/cache"
+	"github.com/Jonathanpatta/rplace/challenge"
+	"github.com/Jonathanpatta/rplace/mailer"
+	"github.com/Jonathanpatta/rplace/ratelimit"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
@@ -13,22 +19,38 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 	"golang.org/x/crypto/bcrypt"
+	"log"
+	"math"
 	"net/http"
 	"strconv"
 	"time"
 )
 
 type Token struct {
-	PK        string `json:"PK,omitempty"`
-	Token     string `json:"token,omitempty"`
-	ValidTill int64  `json:"valid_till,omitempty"`
-	LastUsed  int64  `json:"last_used,omitempty"`
+	PK        string `json:"-" dynamodbav:"-"`
+	Token     string `json:"token,omitempty" dynamodbav:"token"`
+	Username  string `json:"username,omitempty" dynamodbav:"username"`
+	CreatedAt int64  `json:"created_at,omitempty" dynamodbav:"created_at"`
+	ValidTill int64  `json:"valid_till,omitempty" dynamodbav:"valid_till"`
+	LastUsed  int64  `json:"last_used,omitempty" dynamodbav:"last_used"`
 }
 
 func (t *Token) CreatePk() {
 	t.PK = "TOKEN#" + t.Token
 }
 
+// Session describes t to its owner, marking it as the one in use when it
+// is current.
+func (t *Token) Session(current string) Session {
+	return Session{
+		Id:        SessionId(t.Token),
+		CreatedAt: t.CreatedAt,
+		ValidTill: t.ValidTill,
+		LastUsed:  t.LastUsed,
+		Current:   t.Token == current,
+	}
+}
+
 func (t *Token) IsValid() bool {
 	now := time.Now().Unix()
 	if now > t.ValidTill {
@@ -48,10 +70,16 @@ func (t *Token) IsValid() bool {
 
 type User struct {
 	PK             string
+	SK             string
 	Username       string `json:"username,omitempty"`
 	Password       string `json:"password,omitempty"`
 	HashedPassword string `json:"hashed_password,omitempty"`
-	Token          Token
+	Email          string `json:"email,omitempty"`
+	EmailVerified  bool   `json:"email_verified,omitempty" dynamodbav:"email_verified"`
+	// Admin is set in the table by hand. It makes the access tokens of
+	// the account admin ones.
+	Admin bool `json:"-" dynamodbav:"admin"`
+	Token Token
 }
 
 func (u *User) CreatePk() {
@@ -62,13 +90,99 @@ type Server struct {
 	DbCli         *dynamodb.Client
 	SessionsStore *sessions.CookieStore
 	TableName     *string
+	// Challenges asks for a proof of work on registration when set.
+	Challenges *challenge.Issuer
+	Lockout    *Lockout
+	Tokens     *Tokens
+	// Signer issues JWT access tokens, which /auth/token hands out along
+	// with refresh tokens when it is set.
+	Signer  *Signer
+	Refresh *RefreshTokens
+	APIKeys *APIKeys
+	// OIDC are the OpenID Connect providers accounts can log in with, by
+	// name. Identities keeps which account each login belongs to.
+	OIDC       map[string]*OIDCProvider
+	Identities *Identities
+	// Caller tells who is calling the API key routes.
+	Caller func(r *http.Request) (Caller, bool)
+	// Limiter, when set, tells the client address recorded with a lockout.
+	Limiter *ratelimit.Limiter
+	// Identity names the admin behind a request, for the audit trail.
+	Identity func(r *http.Request) (id string, name string, ok bool)
+	// Mailer sends verification and password reset links. Without one
+	// they are only logged as dropped.
+	Mailer mailer.Mailer
+	// TokenSecret signs the tokens in those links.
+	TokenSecret []byte
+	// PublicURL is where the frontend is served, which the links point to.
+	PublicURL string
 }
 
 func NewServer(DbCli *dynamodb.Client, store *sessions.CookieStore) *Server {
+	tableName := aws.String("Place-Clone")
 	return &Server{
 		DbCli:         DbCli,
-		TableName:     aws.String("Place-Clone"),
+		TableName:     tableName,
 		SessionsStore: store,
+		Lockout:       NewLockout(DbCli, tableName),
+		Tokens:        NewTokens(DbCli, tableName, nil),
+		Refresh:       NewRefreshTokens(DbCli, tableName),
+		APIKeys:       NewAPIKeys(DbCli, tableName, nil),
+		OIDC:          make(map[string]*OIDCProvider),
+		Identities:    NewIdentities(DbCli, tableName),
+	}
+}
+
+// GetUsers returns the account items stored for username. Other items kept
+// in the USER# partition, such as faction membership, are filtered out.
+func (s *Server) GetUsers(ctx context.Context, username string) ([]User, error) {
+	return getUsers(ctx, s.DbCli, s.TableName, username)
+}
+
+func getUsers(ctx context.Context, DbCli *dynamodb.Client, tableName *string, username string) ([]User, error) {
+	user := User{Username: username}
+	user.CreatePk()
+
+	out, err := DbCli.Query(ctx, &dynamodb.QueryInput{
+		TableName:              tableName,
+		KeyConditionExpression: aws.String("#PK = :name"),
+		FilterExpression:       aws.String("attribute_exists(#hashedpassword)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":name": &types.AttributeValueMemberS{Value: user.PK},
+		},
+		ExpressionAttributeNames: map[string]string{
+			"#PK":             "PK",
+			"#hashedpassword": "hashedpassword",
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var users []User
+	err = attributevalue.UnmarshalListOfMaps(out.Items, &users)
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// reserveUsername is the transaction item that claims username for a new
+// account. Its key is fixed, so of two accounts created under the same name
+// at once only one gets it. The account items themselves are keyed by the
+// time they were created and cannot collide.
+func (s *Server) reserveUsername(username string) types.TransactWriteItem {
+	return types.TransactWriteItem{
+		Put: &types.Put{
+			TableName: s.TableName,
+			Item: map[string]types.AttributeValue{
+				"PK":       &types.AttributeValueMemberS{Value: "USER#" + username},
+				"SK":       &types.AttributeValueMemberS{Value: "USERNAME"},
+				"username": &types.AttributeValueMemberS{Value: username},
+			},
+			ConditionExpression: aws.String("attribute_not_exists(PK)"),
+		},
 	}
 }
 
@@ -80,6 +194,7 @@ func GenerateNewToken() *Token {
 	}
 }
 
+// IsValidUser checks the credentials in the body of r.
 func (s *Server) IsValidUser(r *http.Request) (User, error) {
 	var user User
 	err := json.NewDecoder(r.Body).Decode(&user)
@@ -87,95 +202,130 @@ func (s *Server) IsValidUser(r *http.Request) (User, error) {
 		return User{}, err
 	}
 
-	user.CreatePk()
+	return s.Login(r.Context(), user.Username, user.Password, s.clientIP(r))
+}
 
-	out, err := s.DbCli.Query(context.TODO(), &dynamodb.QueryInput{
-		TableName:              s.TableName,
-		KeyConditionExpression: aws.String("#PK = :name"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":name": &types.AttributeValueMemberS{Value: user.PK},
-		},
-		ExpressionAttributeNames: map[string]string{
-			"#PK": "PK",
-		},
-	})
+// Login checks a username and password. Wrong passwords and unknown
+// usernames both give ErrInvalidCredentials, take as long and count
+// towards a lockout, which is reported as a LockedError.
+func (s *Server) Login(ctx context.Context, username string, password string, ip string) (User, error) {
+	now := time.Now()
+	failures, err := s.Lockout.Check(ctx, username, now)
 	if err != nil {
 		return User{}, err
 	}
 
-	var users []User
-	err = attributevalue.UnmarshalListOfMaps(out.Items, &users)
+	users, err := s.GetUsers(ctx, username)
 	if err != nil {
 		return User{}, err
 	}
-	if len(users) != 1 {
-		return User{}, errors.New("unique user not returned")
+
+	hash := decoyHash()
+	if len(users) == 1 {
+		hash = []byte(users[0].HashedPassword)
 	}
-	err = bcrypt.CompareHashAndPassword([]byte(users[0].HashedPassword), []byte(user.Password))
+	err = bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if err != nil || len(users) != 1 {
+		err = s.Lockout.Fail(ctx, failures, ip, now)
+		if err != nil {
+			return User{}, err
+		}
+		return User{}, ErrInvalidCredentials
+	}
+
+	err = s.Lockout.Succeed(ctx, failures)
 	if err != nil {
 		return User{}, err
 	}
-
 	return users[0], nil
 }
 
+func (s *Server) clientIP(r *http.Request) string {
+	if s.Limiter != nil {
+		return s.Limiter.ClientIP(r)
+	}
+	return r.RemoteAddr
+}
+
+// writeLoginError answers a failed login, reporting whether there was one.
+func writeLoginError(w http.ResponseWriter, err error) bool {
+	var locked *LockedError
+	if errors.As(err, &locked) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds()))))
+		http.Error(w, locked.Error(), http.StatusTooManyRequests)
+		return true
+	}
+	if errors.Is(err, ErrInvalidCredentials) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return true
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	return false
+}
+
 func (s *Server) GenerateToken(w http.ResponseWriter, r *http.Request) {
 	user, err := s.IsValidUser(r)
+	if writeLoginError(w, err) {
+		return
+	}
+
+	token, err := s.Tokens.Issue(r.Context(), user.Username)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if user.Token.IsValid() {
-		tokenJson, err := json.Marshal(user.Token)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		fmt.Fprintln(w, tokenJson)
-	} else {
-		generatedNewToken := GenerateNewToken()
-		user.Token = *generatedNewToken
-
-		_, err = s.DbCli.PutItem(context.TODO(), &dynamodb.PutItemInput{
-			Item: map[string]types.AttributeValue{
-				"PK":         &types.AttributeValueMemberS{Value: "TOKEN#" + user.Token.Token},
-				"SK":         &types.AttributeValueMemberS{Value: strconv.Itoa(int(user.Token.ValidTill))},
-				"token":      &types.AttributeValueMemberS{Value: user.Token.Token},
-				"valid_till": &types.AttributeValueMemberN{Value: strconv.Itoa(int(user.Token.ValidTill))},
-				"last_used":  &types.AttributeValueMemberN{Value: strconv.Itoa(int(user.Token.LastUsed))},
-			},
-			TableName: s.TableName,
-		})
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	err = s.saveSession(w, r, token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		tokenStore, err := s.SessionsStore.Get(r, "Token")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	tokenJson, err := json.Marshal(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, string(tokenJson))
+}
 
-		tokenStore.Values["token"] = generatedNewToken
+// saveSession keeps token in the cookie session of a browser.
+func (s *Server) saveSession(w http.ResponseWriter, r *http.Request, token *Token) error {
+	// A cookie that no longer decodes still gives a fresh session, which
+	// is all that is needed here.
+	tokenStore, _ := s.SessionsStore.Get(r, SessionName)
+	tokenStore.Values["token"] = token.Token
+	tokenStore.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   int(token.ValidTill - time.Now().Unix()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	return tokenStore.Save(r, w)
+}
 
-		tokenJson, err := json.Marshal(user.Token)
+func (s *Server) Register(w http.ResponseWriter, r *http.Request) {
+	if s.Challenges != nil {
+		err := s.Challenges.Check(r.Context(), r.Header.Get(challenge.Header), challenge.ScopeRegister, false)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			challenge.WriteError(w, err)
 			return
 		}
-		fmt.Fprintln(w, string(tokenJson))
 	}
-}
 
-func (s *Server) Register(w http.ResponseWriter, r *http.Request) {
 	var user User
 	err := json.NewDecoder(r.Body).Decode(&user)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if user.Email != "" && ValidateEmail(user.Email) != nil {
+		http.Error(w, ErrInvalidEmail.Error(), http.StatusBadRequest)
+		return
+	}
 
 	bytes, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -185,50 +335,124 @@ func (s *Server) Register(w http.ResponseWriter, r *http.Request) {
 	user.HashedPassword = string(bytes)
 	user.CreatePk()
 
-	out, err := s.DbCli.Query(context.TODO(), &dynamodb.QueryInput{
-		TableName:              s.TableName,
-		KeyConditionExpression: aws.String("#PK = :name"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":name": &types.AttributeValueMemberS{Value: user.PK},
-		},
-		ExpressionAttributeNames: map[string]string{
-			"#PK": "PK",
-		},
-	})
-
+	users, err := s.GetUsers(context.TODO(), user.Username)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if len(out.Items) != 0 {
+	if len(users) != 0 {
 		http.Error(w, "user already exists", http.StatusInternalServerError)
 		return
 	}
 
-	_, err = s.DbCli.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		Item: map[string]types.AttributeValue{
-			"PK":             &types.AttributeValueMemberS{Value: user.PK},
-			"SK":             &types.AttributeValueMemberS{Value: strconv.Itoa(int(time.Now().Unix()))},
-			"username":       &types.AttributeValueMemberS{Value: user.Username},
-			"hashedpassword": &types.AttributeValueMemberS{Value: user.HashedPassword},
+	item := map[string]types.AttributeValue{
+		"PK":             &types.AttributeValueMemberS{Value: user.PK},
+		"SK":             &types.AttributeValueMemberS{Value: strconv.Itoa(int(time.Now().Unix()))},
+		"username":       &types.AttributeValueMemberS{Value: user.Username},
+		"hashedpassword": &types.AttributeValueMemberS{Value: user.HashedPassword},
+	}
+	if user.Email != "" {
+		item["email"] = &types.AttributeValueMemberS{Value: user.Email}
+		item["email_verified"] = &types.AttributeValueMemberBOOL{Value: false}
+	}
+
+	_, err = s.DbCli.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			s.reserveUsername(user.Username),
+			{
+				Put: &types.Put{
+					TableName: s.TableName,
+					Item:      item,
+				},
+			},
 		},
-		TableName: s.TableName,
 	})
+	if isConditionFailure(err) {
+		http.Error(w, "user already exists", http.StatusInternalServerError)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if user.Email != "" {
+		err = s.sendVerification(&user)
+		if err != nil {
+			log.Printf("could not send the verification email of %s: %s", user.Username, err.Error())
+		}
+	}
 }
 
 func (s *Server) Ping(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "Hello")
 }
 
+// DefaultLimits are the per IP limits of the routes that run bcrypt for
+// anyone who asks.
+var DefaultLimits = map[string]ratelimit.Limit{
+	"register":      ratelimit.PerHour(10, 5),
+	"generateToken": ratelimit.PerMinute(10, 10),
+	"token":         ratelimit.PerMinute(10, 10),
+	"refreshToken":  ratelimit.PerMinute(30, 10),
+	"verifyRequest": ratelimit.PerHour(5, 3),
+	"resetRequest":  ratelimit.PerHour(5, 3),
+	"verifyEmail":   ratelimit.PerMinute(10, 10),
+	"resetPassword": ratelimit.PerMinute(10, 10),
+	"changeRequest": ratelimit.PerHour(5, 3),
+	"changeEmail":   ratelimit.PerMinute(10, 10),
+	"oidcLogin":     ratelimit.PerMinute(20, 10),
+	"oidcCallback":  ratelimit.PerMinute(20, 10),
+}
+
 type Options struct {
 	DbCli *dynamodb.Client
 	Store *sessions.CookieStore
+	// Cache holds looked up tokens, which are evicted from it when revoked.
+	// It has to be the cache the middleware checks tokens against.
+	Cache *cache.Client
+	// Broker carries revoked tokens to the other instances, which evict
+	// them from their caches.
+	Broker broker.Broker
+	// Challenges asks for a proof of work on registration when set.
+	Challenges *challenge.Issuer
+	// Limiter limits the unauthenticated routes per client IP when set.
+	Limiter *ratelimit.Limiter
+	// Limits overrides DefaultLimits by route name.
+	Limits map[string]ratelimit.Limit
+	// Admin guards the account administration routes under /auth/admin,
+	// which are only mounted when it is set. It has to authenticate the
+	// caller and refuse anyone but admins.
+	Admin []mux.MiddlewareFunc
+	// Identity names the admin behind a request, for the audit trail.
+	Identity func(r *http.Request) (id string, name string, ok bool)
+	// Mailer sends verification and password reset links.
+	Mailer mailer.Mailer
+	// TokenSecret signs the links. Instances sharing a table need the same
+	// one; a random secret is used when it is empty.
+	TokenSecret []byte
+	// PublicURL is where the frontend is served, which the links point to.
+	PublicURL string
+	// Signer issues JWT access tokens. /auth/token and the key set at
+	// /.well-known/jwks.json are only mounted when it is set.
+	Signer *Signer
+	// Authenticated guards /auth/logout, /auth/sessions and the API key
+	// routes under /auth/keys, which are only mounted when it is set.
+	// Caller then has to tell who the authenticated caller is.
+	Authenticated []mux.MiddlewareFunc
+	Caller        func(r *http.Request) (Caller, bool)
+	// OIDC are the OpenID Connect providers accounts can log in with at
+	// /auth/oidc/{name}/login. Linking identities to existing accounts
+	// also needs Authenticated.
+	OIDC []*OIDCProvider
+}
+
+func (o *Options) limit(route string) ratelimit.Limit {
+	if limit, ok := o.Limits[route]; ok {
+		return limit
+	}
+	return DefaultLimits[route]
 }
 
 func NewRouter(DbCli *dynamodb.Client, store *sessions.CookieStore) *mux.Router {
@@ -242,11 +466,97 @@ func NewRouter(DbCli *dynamodb.Client, store *sessions.CookieStore) *mux.Router
 	return r
 }
 
-func AddSubrouter(o *Options, r *mux.Router) {
+func AddSubrouter(o *Options, r *mux.Router) error {
 	server := NewServer(o.DbCli, o.Store)
+	server.Challenges = o.Challenges
+	server.Limiter = o.Limiter
+	server.Identity = o.Identity
+	server.Mailer = o.Mailer
+	server.Tokens.Cache = o.Cache
+	server.Tokens.Broker = o.Broker
+	server.Signer = o.Signer
+	server.APIKeys.Cache = o.Cache
+	server.APIKeys.Limiter = o.Limiter
+	server.Caller = o.Caller
+	for _, p := range o.OIDC {
+		if !providerName.MatchString(p.Name) {
+			return fmt.Errorf("invalid identity provider name %q", p.Name)
+		}
+		if _, ok := server.OIDC[p.Name]; ok {
+			return fmt.Errorf("identity provider %q is configured twice", p.Name)
+		}
+		server.OIDC[p.Name] = p
+	}
+	server.PublicURL = o.PublicURL
+	server.TokenSecret = o.TokenSecret
+	if len(server.TokenSecret) == 0 {
+		server.TokenSecret = make([]byte, 32)
+		_, err := rand.Read(server.TokenSecret)
+		if err != nil {
+			return err
+		}
+	}
+	err := server.Tokens.RunRevocations(context.Background())
+	if err != nil {
+		return err
+	}
 	router := r.PathPrefix("/auth").Subrouter()
 
-	router.HandleFunc("/generateToken", server.GenerateToken).Methods("POST")
-	router.HandleFunc("/register", server.Register).Methods("POST")
+	router.Handle("/generateToken", o.Limiter.WrapFunc("generateToken", o.limit("generateToken"), server.GenerateToken)).Methods("POST")
+	router.Handle("/register", o.Limiter.WrapFunc("register", o.limit("register"), server.Register)).Methods("POST")
 	router.HandleFunc("/ping", server.Ping).Methods("GET")
+	if o.Signer != nil {
+		r.HandleFunc("/.well-known/jwks.json", o.Signer.GetJWKS).Methods("GET")
+		router.Handle("/token", o.Limiter.WrapFunc("token", o.limit("token"), server.IssueTokens)).Methods("POST")
+		router.Handle("/token/refresh", o.Limiter.WrapFunc("refreshToken", o.limit("refreshToken"), server.RefreshAccessToken)).Methods("POST")
+		router.HandleFunc("/token/revoke", server.RevokeRefreshToken).Methods("POST")
+	}
+	router.Handle("/email/verify/request", o.Limiter.WrapFunc("verifyRequest", o.limit("verifyRequest"), server.RequestVerification)).Methods("POST")
+	router.Handle("/email/verify", o.Limiter.WrapFunc("verifyEmail", o.limit("verifyEmail"), server.VerifyEmail)).Methods("POST")
+	router.Handle("/password/reset/request", o.Limiter.WrapFunc("resetRequest", o.limit("resetRequest"), server.RequestPasswordReset)).Methods("POST")
+	router.Handle("/password/reset", o.Limiter.WrapFunc("resetPassword", o.limit("resetPassword"), server.ResetPassword)).Methods("POST")
+	router.Handle("/email/change", o.Limiter.WrapFunc("changeEmail", o.limit("changeEmail"), server.ChangeEmail)).Methods("POST")
+
+	if len(o.OIDC) > 0 {
+		router.HandleFunc("/oidc", server.GetOIDCProviders).Methods("GET")
+		router.Handle("/oidc/{provider}/login", o.Limiter.WrapFunc("oidcLogin", o.limit("oidcLogin"), server.OIDCLogin)).Methods("GET")
+		router.Handle("/oidc/{provider}/callback", o.Limiter.WrapFunc("oidcCallback", o.limit("oidcCallback"), server.OIDCCallback)).Methods("GET")
+	}
+
+	if len(o.Authenticated) > 0 {
+		sessions := router.NewRoute().Subrouter()
+		sessions.Use(o.Authenticated...)
+
+		sessions.HandleFunc("/logout", server.Logout).Methods("POST", "OPTIONS")
+		sessions.HandleFunc("/sessions", server.GetSessions).Methods("GET", "OPTIONS")
+		sessions.HandleFunc("/sessions/{id}", server.RevokeSession).Methods("DELETE", "OPTIONS")
+		sessions.Handle("/email/change/request", o.Limiter.WrapFunc("changeRequest", o.limit("changeRequest"), server.RequestEmailChange)).Methods("POST", "OPTIONS")
+
+		keys := router.PathPrefix("/keys").Subrouter()
+		keys.Use(o.Authenticated...)
+
+		keys.HandleFunc("", server.GetAPIKeys).Methods("GET", "OPTIONS")
+		keys.HandleFunc("", server.CreateAPIKey).Methods("POST", "OPTIONS")
+		keys.HandleFunc("/{id}", server.RevokeAPIKey).Methods("DELETE", "OPTIONS")
+	}
+
+	if len(o.Authenticated) > 0 && len(o.OIDC) > 0 {
+		identities := router.PathPrefix("/identities").Subrouter()
+		identities.Use(o.Authenticated...)
+
+		identities.HandleFunc("", server.GetIdentities).Methods("GET", "OPTIONS")
+		identities.HandleFunc("/{provider}", server.UnlinkIdentity).Methods("DELETE", "OPTIONS")
+		identities.HandleFunc("/{provider}/link", server.OIDCLink).Methods("POST", "OPTIONS")
+	}
+
+	if len(o.Admin) == 0 {
+		return nil
+	}
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(o.Admin...)
+
+	admin.HandleFunc("/lockouts", server.GetLockouts).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/lockouts/{username}", server.UnlockAccount).Methods("DELETE", "OPTIONS")
+	admin.HandleFunc("/audit", server.GetAudit).Methods("GET", "OPTIONS")
+	return nil
 }
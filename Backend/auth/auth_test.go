@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"context"
+	"github.com/Jonathanpatta/rplace/internal/dynamotest"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/gorilla/sessions"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRegisterReservesUsername(t *testing.T) {
+	table := dynamotest.Start()
+	defer table.Close()
+	s := NewServer(table.Client(), sessions.NewCookieStore([]byte("0123456789abcdef0123456789abcdef")))
+
+	// Registrations racing for one name all pass the lookup before any of
+	// them stores its account.
+	const racers = 6
+	codes := make(chan int, racers)
+	var wg sync.WaitGroup
+	for i := 0; i < racers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/register", strings.NewReader(`{"username":"carol","password":"hunter22"}`))
+			s.Register(w, r)
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	created := 0
+	for code := range codes {
+		if code == http.StatusOK {
+			created++
+		}
+	}
+	if created != 1 {
+		t.Fatalf("%d registrations succeeded, want 1", created)
+	}
+	accounts := 0
+	for _, item := range table.Partition("USER#carol") {
+		if _, ok := item["hashedpassword"]; ok {
+			accounts++
+		}
+	}
+	if accounts != 1 {
+		t.Fatalf("got %d accounts for carol, want 1", accounts)
+	}
+}
+
+func TestOIDCFirstLoginSkipsReservedUsername(t *testing.T) {
+	o := newOIDCTest(t)
+
+	// A registration holds the name but has not stored its account yet.
+	_, err := o.table.Client().TransactWriteItems(context.Background(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{o.server.reserveUsername("alice")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o.login(o.browser(), "", "alice@example.com")
+	username := o.linkedTo("mock|alice")
+	if !strings.HasPrefix(username, "alice-") {
+		t.Fatalf("identity linked to %q, want a suffixed name", username)
+	}
+	if n := o.accounts("alice"); n != 0 {
+		t.Fatalf("got %d accounts for alice, want 0", n)
+	}
+	if n := o.accounts(username); n != 1 {
+		t.Fatalf("got %d accounts for %s, want 1", n, username)
+	}
+}
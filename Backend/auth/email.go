@@ -0,0 +1,610 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Jonathanpatta/rplace/mailer"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PurposeVerifyEmail   = "verify-email"
+	PurposeResetPassword = "reset-password"
+	PurposeChangeEmail   = "change-email"
+)
+
+const (
+	verifyTokenLifetime = 48 * time.Hour
+	resetTokenLifetime  = time.Hour
+	mailTimeout         = 30 * time.Second
+)
+
+var (
+	ErrInvalidEmail = errors.New("invalid email address")
+	ErrBadToken     = errors.New("the link is invalid or has expired")
+)
+
+// ValidateEmail checks that address is a single bare address, which also
+// keeps it from smuggling headers into a message.
+func ValidateEmail(address string) error {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Address != address || strings.ContainsAny(address, "\r\n") {
+		return ErrInvalidEmail
+	}
+	return nil
+}
+
+// EmailToken is what a signed link vouches for: that whoever holds it
+// received mail for Username, for Purpose, before Expires. Binding ties a
+// password reset link to the password it was sent for, and an address
+// change link to the address it replaces, so that every link sent before
+// stops working once the password or address changes.
+type EmailToken struct {
+	Purpose  string
+	Username string
+	Email    string
+	Expires  int64
+	Nonce    string
+	Binding  string `json:",omitempty"`
+}
+
+func (s *Server) signToken(payload string) string {
+	mac := hmac.New(sha256.New, s.TokenSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// passwordBinding is the Binding of reset links sent while the password
+// hash of an account is hash. It is signed so that a link tells nothing
+// about the hash.
+func (s *Server) passwordBinding(hash string) string {
+	return s.signToken("password#" + hash)
+}
+
+// emailBinding is the Binding of address change links sent while the
+// address of an account is email.
+func (s *Server) emailBinding(email string) string {
+	return s.signToken("email#" + email)
+}
+
+// IssueEmailToken signs a token for username. Each one can be redeemed
+// once.
+func (s *Server) IssueEmailToken(purpose string, username string, email string, lifetime time.Duration) (string, error) {
+	return s.issueEmailToken(EmailToken{
+		Purpose:  purpose,
+		Username: username,
+		Email:    email,
+	}, lifetime)
+}
+
+func (s *Server) issueEmailToken(t EmailToken, lifetime time.Duration) (string, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	t.Expires = time.Now().Add(lifetime).Unix()
+	t.Nonce = base64.RawURLEncoding.EncodeToString(nonce)
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + s.signToken(payload), nil
+}
+
+// ParseEmailToken checks the signature, purpose and expiry of a token
+// without redeeming it.
+func (s *Server) ParseEmailToken(token string, purpose string) (*EmailToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(s.signToken(parts[0])), []byte(parts[1])) {
+		return nil, ErrBadToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrBadToken
+	}
+
+	var t EmailToken
+	err = json.Unmarshal(data, &t)
+	if err != nil || t.Purpose != purpose || time.Now().Unix() > t.Expires {
+		return nil, ErrBadToken
+	}
+	return &t, nil
+}
+
+// redeem marks a token as used, failing with ErrBadToken if it already was.
+// The marker expires along with the token.
+func (s *Server) redeem(ctx context.Context, t *EmailToken) error {
+	_, err := s.DbCli.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: s.TableName,
+		Item: map[string]types.AttributeValue{
+			"PK":         &types.AttributeValueMemberS{Value: "EMAILTOKEN#" + t.Nonce},
+			"SK":         &types.AttributeValueMemberS{Value: t.Purpose},
+			"username":   &types.AttributeValueMemberS{Value: t.Username},
+			"expires_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(t.Expires, 10)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrBadToken
+	}
+	return err
+}
+
+// updateUser sets attributes on the account item of user.
+func (s *Server) updateUser(ctx context.Context, user *User, values map[string]types.AttributeValue) error {
+	var set []string
+	names := make(map[string]string)
+	expression := make(map[string]types.AttributeValue)
+	for name, value := range values {
+		set = append(set, "#"+name+" = :"+name)
+		names["#"+name] = name
+		expression[":"+name] = value
+	}
+
+	_, err := s.DbCli.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: s.TableName,
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: user.PK},
+			"SK": &types.AttributeValueMemberS{Value: user.SK},
+		},
+		UpdateExpression:          aws.String("SET " + strings.Join(set, ", ")),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: expression,
+	})
+	return err
+}
+
+// setPassword replaces the password hash of user, failing with ErrBadToken
+// if it changed since user was read, as it does when two reset links are
+// used at once.
+func (s *Server) setPassword(ctx context.Context, user *User, hash string) error {
+	_, err := s.DbCli.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: s.TableName,
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: user.PK},
+			"SK": &types.AttributeValueMemberS{Value: user.SK},
+		},
+		UpdateExpression:    aws.String("SET #hashedpassword = :hash"),
+		ConditionExpression: aws.String("#hashedpassword = :old"),
+		ExpressionAttributeNames: map[string]string{
+			"#hashedpassword": "hashedpassword",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":hash": &types.AttributeValueMemberS{Value: hash},
+			":old":  &types.AttributeValueMemberS{Value: user.HashedPassword},
+		},
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrBadToken
+	}
+	return err
+}
+
+// setEmail replaces the address of user with a verified one, failing with
+// ErrBadToken if it changed since user was read.
+func (s *Server) setEmail(ctx context.Context, user *User, email string) error {
+	condition := "#email = :old"
+	values := map[string]types.AttributeValue{
+		":email":    &types.AttributeValueMemberS{Value: email},
+		":verified": &types.AttributeValueMemberBOOL{Value: true},
+		":old":      &types.AttributeValueMemberS{Value: user.Email},
+	}
+	if user.Email == "" {
+		condition = "attribute_not_exists(#email)"
+		delete(values, ":old")
+	}
+
+	_, err := s.DbCli.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: s.TableName,
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: user.PK},
+			"SK": &types.AttributeValueMemberS{Value: user.SK},
+		},
+		UpdateExpression:    aws.String("SET #email = :email, #email_verified = :verified"),
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeNames: map[string]string{
+			"#email":          "email",
+			"#email_verified": "email_verified",
+		},
+		ExpressionAttributeValues: values,
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrBadToken
+	}
+	return err
+}
+
+// link builds the address a mailed token is redeemed at.
+func (s *Server) link(path string, token string) string {
+	return strings.TrimSuffix(s.PublicURL, "/") + path + "?token=" + url.QueryEscape(token)
+}
+
+// sendLater sends a message without holding up the request, so that how
+// long a request takes does not tell whether a message was sent.
+func (s *Server) sendLater(m *mailer.Message) {
+	if s.Mailer == nil {
+		log.Printf("no mailer configured, dropping mail to %s: %s", m.To, m.Subject)
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+		defer cancel()
+		err := s.Mailer.Send(ctx, m)
+		if err != nil {
+			log.Printf("could not send %q to %s: %s", m.Subject, m.To, err.Error())
+		}
+	}()
+}
+
+func (s *Server) sendVerification(user *User) error {
+	token, err := s.IssueEmailToken(PurposeVerifyEmail, user.Username, user.Email, verifyTokenLifetime)
+	if err != nil {
+		return err
+	}
+
+	s.sendLater(&mailer.Message{
+		To:      user.Email,
+		Subject: "Confirm your rplace email address",
+		Body: fmt.Sprintf("Hi %s,\n\nconfirm that this is your address by opening the link below within two days:\n\n%s\n\nIf you did not sign up for rplace, ignore this email.\n",
+			user.Username, s.link("/verify-email", token)),
+	})
+	return nil
+}
+
+type EmailRequest struct {
+	Username string `json:"username"`
+}
+
+type TokenRequest struct {
+	Token string `json:"token"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type ChangeEmailRequest struct {
+	Email string `json:"email"`
+}
+
+func (s *Server) findUser(ctx context.Context, username string) (*User, error) {
+	users, err := s.GetUsers(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) != 1 {
+		return nil, nil
+	}
+	return &users[0], nil
+}
+
+// RequestVerification mails a new verification link to the address of an
+// account that has not confirmed it yet. It answers the same whether or
+// not anything was sent.
+func (s *Server) RequestVerification(w http.ResponseWriter, r *http.Request) {
+	var req EmailRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.findUser(r.Context(), req.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if user != nil && user.Email != "" && !user.EmailVerified {
+		err = s.sendVerification(user)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req TokenRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t, err := s.ParseEmailToken(req.Token, PurposeVerifyEmail)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, err := s.findUser(r.Context(), t.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// A link mailed to an address the account has since moved away from
+	// confirms nothing.
+	if user == nil || user.Email != t.Email {
+		http.Error(w, ErrBadToken.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.redeem(r.Context(), t)
+	if errors.Is(err, ErrBadToken) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = s.updateUser(r.Context(), user, map[string]types.AttributeValue{
+		"email_verified": &types.AttributeValueMemberBOOL{Value: true},
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RequestPasswordReset mails a reset link to the confirmed address of an
+// account. It answers the same whether or not anything was sent.
+func (s *Server) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req EmailRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.findUser(r.Context(), req.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if user != nil && user.Email != "" && user.EmailVerified {
+		token, err := s.issueEmailToken(EmailToken{
+			Purpose:  PurposeResetPassword,
+			Username: user.Username,
+			Email:    user.Email,
+			Binding:  s.passwordBinding(user.HashedPassword),
+		}, resetTokenLifetime)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.sendLater(&mailer.Message{
+			To:      user.Email,
+			Subject: "Reset your rplace password",
+			Body: fmt.Sprintf("Hi %s,\n\nsomeone asked to reset the password of your account. Choose a new one by opening the link below within an hour:\n\n%s\n\nIf it was not you, ignore this email; your password stays as it is.\n",
+				user.Username, s.link("/reset-password", token)),
+		})
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ResetPassword sets a new password with a token from a reset email. The
+// account is logged out everywhere, and any lockout is lifted, since the
+// owner of the address has shown up. Reset links sent before stop working
+// along with the old password.
+func (s *Server) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req ResetPasswordRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Password == "" {
+		http.Error(w, "password is required", http.StatusBadRequest)
+		return
+	}
+
+	t, err := s.ParseEmailToken(req.Token, PurposeResetPassword)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, err := s.findUser(r.Context(), t.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if user == nil || user.Email != t.Email || !hmac.Equal([]byte(t.Binding), []byte(s.passwordBinding(user.HashedPassword))) {
+		http.Error(w, ErrBadToken.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = s.redeem(r.Context(), t)
+	if errors.Is(err, ErrBadToken) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = s.setPassword(r.Context(), user, string(hash))
+	if errors.Is(err, ErrBadToken) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = s.logoutEverywhere(r.Context(), user.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = s.liftLockout(r.Context(), user.Username)
+	if err != nil {
+		log.Printf("could not lift the lockout of %s after a password reset: %s", user.Username, err.Error())
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RequestEmailChange mails a link for adding or changing the address of
+// the caller's account to the new address. The account keeps its current
+// address until the link is opened.
+func (s *Server) RequestEmailChange(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.caller(w, r)
+	if !ok {
+		return
+	}
+
+	var req ChangeEmailRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ValidateEmail(req.Email) != nil {
+		http.Error(w, ErrInvalidEmail.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.findUser(r.Context(), c.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		http.Error(w, "account not found", http.StatusNotFound)
+		return
+	}
+	if user.Email == req.Email && user.EmailVerified {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	token, err := s.issueEmailToken(EmailToken{
+		Purpose:  PurposeChangeEmail,
+		Username: user.Username,
+		Email:    req.Email,
+		Binding:  s.emailBinding(user.Email),
+	}, verifyTokenLifetime)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.sendLater(&mailer.Message{
+		To:      req.Email,
+		Subject: "Confirm your new rplace email address",
+		Body: fmt.Sprintf("Hi %s,\n\nconfirm that your account should use this address by opening the link below within two days:\n\n%s\n\nIf you did not ask for this, ignore this email.\n",
+			user.Username, s.link("/change-email", token)),
+	})
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ChangeEmail sets the address of an account with a token from an address
+// change email, which also verifies it. The previous address, if it was
+// verified, is told of the change. Change links sent before stop working
+// along with the address they would have replaced.
+func (s *Server) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	var req TokenRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t, err := s.ParseEmailToken(req.Token, PurposeChangeEmail)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, err := s.findUser(r.Context(), t.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if user == nil || !hmac.Equal([]byte(t.Binding), []byte(s.emailBinding(user.Email))) {
+		http.Error(w, ErrBadToken.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.redeem(r.Context(), t)
+	if errors.Is(err, ErrBadToken) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = s.setEmail(r.Context(), user, t.Email)
+	if errors.Is(err, ErrBadToken) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if user.Email != "" && user.EmailVerified && user.Email != t.Email {
+		s.sendLater(&mailer.Message{
+			To:      user.Email,
+			Subject: "Your rplace email address was changed",
+			Body: fmt.Sprintf("Hi %s,\n\nyour account now uses %s instead of this address. If you did not make this change, contact the admins right away.\n",
+				user.Username, t.Email),
+		})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// liftLockout forgets the failed logins of username, recording it in the
+// audit trail only when there were any.
+func (s *Server) liftLockout(ctx context.Context, username string) error {
+	f, err := s.Lockout.Get(ctx, username)
+	if err != nil {
+		return err
+	}
+	if f.Failures == 0 && f.LockedUntil == 0 {
+		return nil
+	}
+	return s.Lockout.Unlock(ctx, username, "password-reset")
+}
@@ -0,0 +1,286 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"github.com/Jonathanpatta/rplace/internal/dynamotest"
+	"github.com/Jonathanpatta/rplace/mailer"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/gorilla/sessions"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newEmailTest(t *testing.T) (*Server, *dynamotest.StandIn) {
+	t.Helper()
+	table := dynamotest.Start()
+	t.Cleanup(table.Close)
+	s := NewServer(table.Client(), sessions.NewCookieStore([]byte("0123456789abcdef0123456789abcdef")))
+	s.TokenSecret = []byte("secret")
+	return s, table
+}
+
+// putEmailAccount stores an account for username with a password and an
+// address.
+func putEmailAccount(t *testing.T, s *Server, table *dynamotest.StandIn, username string, email string, verified bool) *User {
+	t.Helper()
+	putAccount(t, table, username, false)
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter22"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.updateUser(context.Background(), &User{PK: "USER#" + username, SK: "1"}, map[string]types.AttributeValue{
+		"hashedpassword": &types.AttributeValueMemberS{Value: string(hash)},
+		"email":          &types.AttributeValueMemberS{Value: email},
+		"email_verified": &types.AttributeValueMemberBOOL{Value: verified},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := s.findUser(context.Background(), username)
+	if err != nil || user == nil {
+		t.Fatalf("got %v, %v", user, err)
+	}
+	return user
+}
+
+func postToken(handler http.HandlerFunc, body string) int {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+	return w.Code
+}
+
+func TestParseEmailToken(t *testing.T) {
+	s, _ := newEmailTest(t)
+	other, _ := newEmailTest(t)
+	other.TokenSecret = []byte("other")
+
+	issue := func(s *Server, purpose string, lifetime time.Duration) string {
+		token, err := s.IssueEmailToken(purpose, "alice", "alice@example.com", lifetime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := issue(s, PurposeVerifyEmail, time.Hour)
+	payload := strings.Split(valid, ".")[0]
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", valid, true},
+		{"other purpose", issue(s, PurposeResetPassword, time.Hour), false},
+		{"expired", issue(s, PurposeVerifyEmail, -time.Minute), false},
+		{"signed with another secret", issue(other, PurposeVerifyEmail, time.Hour), false},
+		{"payload changed", payload + "x." + strings.Split(valid, ".")[1], false},
+		{"signature missing", payload, false},
+		{"signature of the payload", payload + "." + payload, false},
+		{"garbage", "...", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token, err := s.ParseEmailToken(test.token, PurposeVerifyEmail)
+			if test.ok && (err != nil || token.Username != "alice" || token.Email != "alice@example.com") {
+				t.Fatalf("got %+v, %v", token, err)
+			}
+			if !test.ok && !errors.Is(err, ErrBadToken) {
+				t.Fatalf("got %+v, %v, want %v", token, err, ErrBadToken)
+			}
+		})
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	s, table := newEmailTest(t)
+	putEmailAccount(t, s, table, "alice", "alice@example.com", false)
+
+	current, err := s.IssueEmailToken(PurposeVerifyEmail, "alice", "alice@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, err := s.IssueEmailToken(PurposeVerifyEmail, "alice", "old@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nobody, err := s.IssueEmailToken(PurposeVerifyEmail, "nobody", "nobody@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		code  int
+	}{
+		{"address moved away from", moved, http.StatusBadRequest},
+		{"no such account", nobody, http.StatusBadRequest},
+		{"current address", current, http.StatusNoContent},
+		{"used twice", current, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		code := postToken(s.VerifyEmail, `{"token":"`+test.token+`"}`)
+		if code != test.code {
+			t.Fatalf("%s: got %d, want %d", test.name, code, test.code)
+		}
+	}
+
+	user, err := s.findUser(context.Background(), "alice")
+	if err != nil || !user.EmailVerified {
+		t.Fatalf("got %+v, %v", user, err)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	s, table := newEmailTest(t)
+	user := putEmailAccount(t, s, table, "alice", "alice@example.com", true)
+
+	issue := func(user *User) string {
+		token, err := s.issueEmailToken(EmailToken{
+			Purpose:  PurposeResetPassword,
+			Username: user.Username,
+			Email:    user.Email,
+			Binding:  s.passwordBinding(user.HashedPassword),
+		}, resetTokenLifetime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	first := issue(user)
+	second := issue(user)
+	unbound, err := s.IssueEmailToken(PurposeResetPassword, "alice", "alice@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		code  int
+	}{
+		{"not bound to the password", unbound, http.StatusBadRequest},
+		{"first link", first, http.StatusNoContent},
+		{"first link again", first, http.StatusBadRequest},
+		// The password the second link was sent for is gone.
+		{"link sent before the reset", second, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		code := postToken(s.ResetPassword, `{"token":"`+test.token+`","password":"correct horse"}`)
+		if code != test.code {
+			t.Fatalf("%s: got %d, want %d", test.name, code, test.code)
+		}
+	}
+
+	user, err = s.findUser(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.HashedPassword), []byte("correct horse")) != nil {
+		t.Fatal("password was not changed")
+	}
+}
+
+// sentTo waits for a message to address and returns the token of the link
+// in it.
+func sentTo(t *testing.T, m *mailer.MemoryMailer, address string) (*mailer.Message, string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, msg := range m.Sent() {
+			if msg.To != address {
+				continue
+			}
+			token := ""
+			if i := strings.Index(msg.Body, "?token="); i >= 0 {
+				token, _ = url.QueryUnescape(strings.Fields(msg.Body[i+len("?token="):])[0])
+			}
+			return &msg, token
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("nothing was sent to %s", address)
+	return nil, ""
+}
+
+func TestChangeEmail(t *testing.T) {
+	s, table := newEmailTest(t)
+	sent := mailer.NewMemoryMailer()
+	s.Mailer = sent
+	s.Caller = func(r *http.Request) (Caller, bool) {
+		username := r.Header.Get("X-User")
+		return Caller{Id: username, APIKey: r.Header.Get("X-API-Key") != ""}, username != ""
+	}
+	putEmailAccount(t, s, table, "alice", "old@example.com", true)
+	putAccount(t, table, "bob", false)
+
+	request := func(username string, apiKey bool, email string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", strings.NewReader(`{"email":"`+email+`"}`))
+		r.Header.Set("X-User", username)
+		if apiKey {
+			r.Header.Set("X-API-Key", "rpk_key")
+		}
+		s.RequestEmailChange(w, r)
+		return w.Code
+	}
+	requests := []struct {
+		name     string
+		username string
+		apiKey   bool
+		email    string
+		code     int
+	}{
+		{"new address", "alice", false, "new@example.com", http.StatusAccepted},
+		{"another new address", "alice", false, "other@example.com", http.StatusAccepted},
+		{"first address", "bob", false, "bob@example.com", http.StatusAccepted},
+		{"same verified address", "alice", false, "old@example.com", http.StatusNoContent},
+		{"invalid address", "alice", false, "new@example.com\r\nBcc: x@example.com", http.StatusBadRequest},
+		{"with an API key", "alice", true, "new@example.com", http.StatusForbidden},
+		{"no account", "cognito:alice", false, "new@example.com", http.StatusNotFound},
+	}
+	for _, test := range requests {
+		if code := request(test.username, test.apiKey, test.email); code != test.code {
+			t.Fatalf("%s: got %d, want %d", test.name, code, test.code)
+		}
+	}
+	_, newToken := sentTo(t, sent, "new@example.com")
+	_, otherToken := sentTo(t, sent, "other@example.com")
+	_, bobToken := sentTo(t, sent, "bob@example.com")
+	if user, _ := s.findUser(context.Background(), "alice"); user.Email != "old@example.com" {
+		t.Fatalf("address changed to %s before the link was opened", user.Email)
+	}
+
+	changes := []struct {
+		name  string
+		token string
+		code  int
+	}{
+		{"new address", newToken, http.StatusNoContent},
+		{"used twice", newToken, http.StatusBadRequest},
+		// The address the other link was sent to replace is gone.
+		{"link sent before the change", otherToken, http.StatusBadRequest},
+		{"first address", bobToken, http.StatusNoContent},
+	}
+	for _, test := range changes {
+		if code := postToken(s.ChangeEmail, `{"token":"`+test.token+`"}`); code != test.code {
+			t.Fatalf("%s: got %d, want %d", test.name, code, test.code)
+		}
+	}
+
+	for username, email := range map[string]string{"alice": "new@example.com", "bob": "bob@example.com"} {
+		user, err := s.findUser(context.Background(), username)
+		if err != nil || user.Email != email || !user.EmailVerified {
+			t.Fatalf("got %+v, %v, want %s verified", user, err, email)
+		}
+	}
+	if notice, _ := sentTo(t, sent, "old@example.com"); !strings.Contains(notice.Body, "new@example.com") {
+		t.Fatalf("got notice %q", notice.Body)
+	}
+}
@@ -0,0 +1,368 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/gorilla/mux"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	identitySk     = "IDENTITY"
+	identityPrefix = "IDENTITY#"
+	maxUsername    = 24
+)
+
+var (
+	ErrIdentityLinked   = errors.New("the identity is linked to an account already, or the account has one from this provider")
+	ErrIdentityNotFound = errors.New("identity not found")
+	ErrLastIdentity     = errors.New("the account has no password, so its last identity cannot be unlinked")
+)
+
+// Identity links an account to its subject at an OpenID Connect provider.
+type Identity struct {
+	Username  string `json:"username" dynamodbav:"username"`
+	Provider  string `json:"provider" dynamodbav:"provider"`
+	Subject   string `json:"subject" dynamodbav:"subject"`
+	Email     string `json:"email,omitempty" dynamodbav:"email,omitempty"`
+	CreatedAt int64  `json:"created_at" dynamodbav:"created_at"`
+}
+
+func newIdentity(username string, provider string, claims *IDClaims) *Identity {
+	return &Identity{
+		Username:  username,
+		Provider:  provider,
+		Subject:   claims.Subject,
+		Email:     claims.Email,
+		CreatedAt: time.Now().Unix(),
+	}
+}
+
+func identityKey(provider string, subject string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: identityPrefix + provider + "#" + subject},
+		"SK": &types.AttributeValueMemberS{Value: identitySk},
+	}
+}
+
+// identityPointerKey is where an account keeps its identity at provider,
+// which allows one identity per provider and account.
+func identityPointerKey(username string, provider string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: "USER#" + username},
+		"SK": &types.AttributeValueMemberS{Value: identityPrefix + provider},
+	}
+}
+
+// Identities keeps the external identities accounts log in with. An
+// identity is found by provider and subject under its own partition, and
+// listed with the account under USER#.
+type Identities struct {
+	DbCli     *dynamodb.Client
+	TableName *string
+}
+
+func NewIdentities(DbCli *dynamodb.Client, tableName *string) *Identities {
+	return &Identities{
+		DbCli:     DbCli,
+		TableName: tableName,
+	}
+}
+
+// Find returns the identity of subject at provider, or nil when it is not
+// linked to any account.
+func (i *Identities) Find(ctx context.Context, provider string, subject string) (*Identity, error) {
+	out, err := i.DbCli.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      i.TableName,
+		Key:            identityKey(provider, subject),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	var found Identity
+	err = attributevalue.UnmarshalMap(out.Item, &found)
+	if err != nil {
+		return nil, err
+	}
+	return &found, nil
+}
+
+// Link links id to its account, writing extra in the same transaction.
+func (i *Identities) Link(ctx context.Context, id *Identity, extra ...types.TransactWriteItem) error {
+	item, err := attributevalue.MarshalMap(id)
+	if err != nil {
+		return err
+	}
+	identity := identityKey(id.Provider, id.Subject)
+	pointer := identityPointerKey(id.Username, id.Provider)
+	for name, value := range item {
+		identity[name] = value
+		pointer[name] = value
+	}
+
+	items := append(extra,
+		types.TransactWriteItem{
+			Put: &types.Put{
+				TableName:           i.TableName,
+				Item:                identity,
+				ConditionExpression: aws.String("attribute_not_exists(PK)"),
+			},
+		},
+		types.TransactWriteItem{
+			Put: &types.Put{
+				TableName:           i.TableName,
+				Item:                pointer,
+				ConditionExpression: aws.String("attribute_not_exists(PK)"),
+			},
+		},
+	)
+	_, err = i.DbCli.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	if isConditionFailure(err) {
+		return ErrIdentityLinked
+	}
+	return err
+}
+
+func isConditionFailure(err error) bool {
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		return false
+	}
+	for _, reason := range canceled.CancellationReasons {
+		if aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns the identities linked to username.
+func (i *Identities) List(ctx context.Context, username string) ([]Identity, error) {
+	out, err := i.DbCli.Query(ctx, &dynamodb.QueryInput{
+		TableName:              i.TableName,
+		KeyConditionExpression: aws.String("#PK = :user AND begins_with(#SK, :prefix)"),
+		ExpressionAttributeNames: map[string]string{
+			"#PK": "PK",
+			"#SK": "SK",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":user":   &types.AttributeValueMemberS{Value: "USER#" + username},
+			":prefix": &types.AttributeValueMemberS{Value: identityPrefix},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	list := []Identity{}
+	err = attributevalue.UnmarshalListOfMaps(out.Items, &list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Unlink removes the identity username has at provider.
+func (i *Identities) Unlink(ctx context.Context, username string, provider string) error {
+	out, err := i.DbCli.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      i.TableName,
+		Key:            identityPointerKey(username, provider),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+	if out.Item == nil {
+		return ErrIdentityNotFound
+	}
+	var found Identity
+	err = attributevalue.UnmarshalMap(out.Item, &found)
+	if err != nil {
+		return err
+	}
+
+	_, err = i.DbCli.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Delete: &types.Delete{TableName: i.TableName, Key: identityKey(provider, found.Subject)}},
+			{Delete: &types.Delete{TableName: i.TableName, Key: identityPointerKey(username, provider)}},
+		},
+	})
+	return err
+}
+
+// usernameFrom picks the name a new account created from claims gets.
+func usernameFrom(claims *IDClaims) string {
+	local := claims.Email
+	if at := strings.LastIndex(local, "@"); at >= 0 {
+		local = local[:at]
+	}
+
+	for _, candidate := range []string{claims.PreferredUsername, local, claims.Name} {
+		var b strings.Builder
+		for _, c := range candidate {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '-', c == '.':
+				b.WriteRune(c)
+			case c == ' ':
+				b.WriteRune('_')
+			}
+			if b.Len() == maxUsername {
+				break
+			}
+		}
+		if b.Len() >= 3 {
+			return b.String()
+		}
+	}
+	return "user"
+}
+
+// identityUser returns the account an identity logs in to, creating the
+// account on its first login.
+func (s *Server) identityUser(ctx context.Context, provider string, claims *IDClaims) (string, error) {
+	found, err := s.Identities.Find(ctx, provider, claims.Subject)
+	if err != nil {
+		return "", err
+	}
+	if found != nil {
+		return found.Username, nil
+	}
+
+	// A name that is taken gets a random suffix, and a few tries.
+	base := usernameFrom(claims)
+	username := base
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if attempt == 6 {
+				return "", fmt.Errorf("no free username for %s", base)
+			}
+			n, err := rand.Int(rand.Reader, big.NewInt(10000))
+			if err != nil {
+				return "", err
+			}
+			username = fmt.Sprintf("%s-%04d", base, n.Int64())
+		}
+
+		// Accounts created before usernames were reserved only show up
+		// here.
+		users, err := s.GetUsers(ctx, username)
+		if err != nil {
+			return "", err
+		}
+		if len(users) != 0 {
+			continue
+		}
+
+		// The empty hash never matches, so the account has no password
+		// until one is set through a password reset.
+		now := time.Now()
+		account := map[string]types.AttributeValue{
+			"PK":             &types.AttributeValueMemberS{Value: "USER#" + username},
+			"SK":             &types.AttributeValueMemberS{Value: strconv.Itoa(int(now.Unix()))},
+			"username":       &types.AttributeValueMemberS{Value: username},
+			"hashedpassword": &types.AttributeValueMemberS{Value: ""},
+		}
+		if claims.Email != "" && claims.EmailVerified && ValidateEmail(claims.Email) == nil {
+			account["email"] = &types.AttributeValueMemberS{Value: claims.Email}
+			account["email_verified"] = &types.AttributeValueMemberBOOL{Value: true}
+		}
+
+		err = s.Identities.Link(ctx, newIdentity(username, provider, claims),
+			s.reserveUsername(username),
+			types.TransactWriteItem{
+				Put: &types.Put{
+					TableName: s.TableName,
+					Item:      account,
+				},
+			},
+		)
+		if errors.Is(err, ErrIdentityLinked) {
+			// Either the same identity logged in twice at once and the
+			// other login created the account, or someone took the name
+			// in the meantime.
+			found, err = s.Identities.Find(ctx, provider, claims.Subject)
+			if err != nil {
+				return "", err
+			}
+			if found != nil {
+				return found.Username, nil
+			}
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return username, nil
+	}
+}
+
+// GetIdentities lists the identities linked to the account of the caller.
+func (s *Server) GetIdentities(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.caller(w, r)
+	if !ok {
+		return
+	}
+
+	list, err := s.Identities.List(r.Context(), c.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, http.StatusOK, list)
+}
+
+// UnlinkIdentity unlinks the identity the caller has at a provider. The
+// last identity of an account without a password stays, since it is the
+// only way in.
+func (s *Server) UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.caller(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := s.findUser(r.Context(), c.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if user == nil || user.HashedPassword == "" {
+		list, err := s.Identities.List(r.Context(), c.Id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(list) <= 1 {
+			http.Error(w, ErrLastIdentity.Error(), http.StatusConflict)
+			return
+		}
+	}
+
+	err = s.Identities.Unlink(r.Context(), c.Id, mux.Vars(r)["provider"])
+	if errors.Is(err, ErrIdentityNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,456 @@
+package auth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"log"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	keysPk  = "JWTKEY"
+	keyBits = 2048
+	// reloadAfter is how long after the keys were last read a token signed
+	// with a key they did not include has them read again.
+	reloadAfter = 10 * time.Second
+	// TokenUseAccess marks the JWTs this package issues as access tokens.
+	TokenUseAccess = "access"
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// SigningKey is one of the RSA keys access tokens are signed with.
+type SigningKey struct {
+	Kid       string
+	Private   *rsa.PrivateKey
+	CreatedAt time.Time
+}
+
+// storedKey is how a SigningKey is kept in the table. Keys are shared
+// through it by every instance, and expire on their own once no token
+// signed with them can still be valid. The private key is sealed with the
+// secret of the Signer, so reading the table is not enough to sign tokens.
+type storedKey struct {
+	Kid       string `dynamodbav:"SK"`
+	SealedKey []byte `dynamodbav:"sealed_key"`
+	CreatedAt int64  `dynamodbav:"created_at"`
+}
+
+// AccessClaims are the claims of an access token. Username matches the
+// claim the middleware reads the caller from, and Admin is copied from the
+// account when the token is issued.
+type AccessClaims struct {
+	Username string `json:"username"`
+	TokenUse string `json:"token_use"`
+	Admin    bool   `json:"admin,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Signer issues the short lived JWT access tokens of local accounts. A new
+// key is generated every RotateEvery; older keys keep verifying tokens
+// until those have expired, and are published at /.well-known/jwks.json
+// for as long.
+type Signer struct {
+	DbCli       *dynamodb.Client
+	TableName   *string
+	Issuer      string
+	AccessTTL   time.Duration
+	RotateEvery time.Duration
+
+	seal cipher.AEAD
+
+	mu   sync.RWMutex
+	keys []*SigningKey
+
+	// reloading is held while the keys are read for an unknown kid, so
+	// that a burst of such tokens reads them once.
+	reloading sync.Mutex
+	loadedAt  time.Time
+}
+
+// NewSigner returns a Signer whose keys are sealed with secret. Instances
+// sharing a table need the same secret; without one a random secret is
+// used, and the keys of other instances cannot be read.
+func NewSigner(DbCli *dynamodb.Client, tableName *string, issuer string, secret []byte) (*Signer, error) {
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		_, err := rand.Read(secret)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sealKey := sha256.Sum256(secret)
+	block, err := aes.NewCipher(sealKey[:])
+	if err != nil {
+		return nil, err
+	}
+	seal, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Signer{
+		DbCli:       DbCli,
+		TableName:   tableName,
+		Issuer:      issuer,
+		AccessTTL:   15 * time.Minute,
+		RotateEvery: 7 * 24 * time.Hour,
+		seal:        seal,
+	}, nil
+}
+
+// keyLifetime is how long a key is kept after it is created: it signs for
+// RotateEvery, then verifies for as long as its last token lives.
+func (s *Signer) keyLifetime() time.Duration {
+	return s.RotateEvery + s.AccessTTL + time.Hour
+}
+
+// Load reads the keys from the table, generating a new one when the newest
+// is due for rotation.
+func (s *Signer) Load(ctx context.Context) error {
+	out, err := s.DbCli.Query(ctx, &dynamodb.QueryInput{
+		TableName:              s.TableName,
+		KeyConditionExpression: aws.String("#PK = :keys"),
+		ExpressionAttributeNames: map[string]string{
+			"#PK": "PK",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":keys": &types.AttributeValueMemberS{Value: keysPk},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	var stored []storedKey
+	err = attributevalue.UnmarshalListOfMaps(out.Items, &stored)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var keys []*SigningKey
+	for _, k := range stored {
+		key, err := s.open(&k)
+		if err != nil {
+			log.Printf("skipping signing key %s: %s", k.Kid, err.Error())
+			continue
+		}
+		if now.Sub(key.CreatedAt) < s.keyLifetime() {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.After(keys[j].CreatedAt)
+	})
+
+	if len(keys) == 0 || now.Sub(keys[0].CreatedAt) >= s.RotateEvery {
+		key, err := s.generate(ctx, now)
+		if err != nil {
+			return err
+		}
+		keys = append([]*SigningKey{key}, keys...)
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.loadedAt = now
+	s.mu.Unlock()
+	return nil
+}
+
+// Start loads the keys and keeps reloading them every interval until ctx
+// is done, which picks up keys rotated by other instances.
+func (s *Signer) Start(ctx context.Context, interval time.Duration) error {
+	err := s.Load(ctx)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := s.Load(ctx)
+				if err != nil {
+					log.Printf("could not reload the signing keys: %s", err.Error())
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Rotate generates a new signing key right away.
+func (s *Signer) Rotate(ctx context.Context) error {
+	key, err := s.generate(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.keys = append([]*SigningKey{key}, s.keys...)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Signer) generate(ctx context.Context, now time.Time) (*SigningKey, error) {
+	private, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &SigningKey{
+		Kid:       uuid.New().String(),
+		Private:   private,
+		CreatedAt: now,
+	}
+	sealed, err := s.sealKey(key.Kid, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.DbCli.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: s.TableName,
+		Item: map[string]types.AttributeValue{
+			"PK":         &types.AttributeValueMemberS{Value: keysPk},
+			"SK":         &types.AttributeValueMemberS{Value: key.Kid},
+			"sealed_key": &types.AttributeValueMemberB{Value: sealed},
+			"created_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+			"expires_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(s.keyLifetime()).Unix(), 10)},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// sealKey encrypts the PEM of a private key, bound to its kid so that a
+// sealed key cannot be passed off under another.
+func (s *Signer) sealKey(kid string, plain []byte) ([]byte, error) {
+	nonce := make([]byte, s.seal.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return s.seal.Seal(nonce, nonce, plain, []byte(kid)), nil
+}
+
+// open decrypts a stored key. Keys sealed with another secret, and those
+// stored before keys were sealed, fail.
+func (s *Signer) open(k *storedKey) (*SigningKey, error) {
+	if len(k.SealedKey) < s.seal.NonceSize() {
+		return nil, errors.New("no sealed key")
+	}
+	nonce, sealed := k.SealedKey[:s.seal.NonceSize()], k.SealedKey[s.seal.NonceSize():]
+	plain, err := s.seal.Open(nil, nonce, sealed, []byte(k.Kid))
+	if err != nil {
+		return nil, errors.New("sealed with another secret")
+	}
+
+	block, _ := pem.Decode(plain)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return &SigningKey{
+		Kid:       k.Kid,
+		Private:   private,
+		CreatedAt: time.Unix(k.CreatedAt, 0),
+	}, nil
+}
+
+// Sign issues an access token for username, an admin when admin is set.
+func (s *Signer) Sign(username string, admin bool) (string, time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.keys) == 0 {
+		return "", time.Time{}, errors.New("no signing key loaded")
+	}
+	key := s.keys[0]
+
+	now := time.Now()
+	expires := now.Add(s.AccessTTL)
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, AccessClaims{
+		Username: username,
+		TokenUse: TokenUseAccess,
+		Admin:    admin,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.Issuer,
+			Subject:   username,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expires),
+			ID:        uuid.New().String(),
+		},
+	})
+	token.Header["kid"] = key.Kid
+
+	signed, err := token.SignedString(key.Private)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expires, nil
+}
+
+// Owns reports whether token was signed by one of the keys of s, going by
+// its kid header.
+func (s *Signer) Owns(token *jwt.Token) bool {
+	_, err := s.Keyfunc(token)
+	return err == nil
+}
+
+// Keyfunc returns the public key a token was signed with, for jwt.Parse.
+// A token of this issuer signed with a key that is not loaded has the keys
+// read again, at most once every reloadAfter, since another instance may
+// have rotated them since they were last read.
+func (s *Signer) Keyfunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+	}
+	kid, _ := token.Header["kid"].(string)
+
+	key := s.key(kid)
+	if key == nil && tokenIssuer(token) == s.Issuer {
+		s.reload()
+		key = s.key(kid)
+	}
+	if key == nil {
+		return nil, ErrUnknownKey
+	}
+	return &key.Private.PublicKey, nil
+}
+
+func (s *Signer) key(kid string) *SigningKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, key := range s.keys {
+		if key.Kid == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+// reload reads the keys again unless they were read within reloadAfter.
+func (s *Signer) reload() {
+	s.reloading.Lock()
+	defer s.reloading.Unlock()
+
+	s.mu.RLock()
+	loadedAt := s.loadedAt
+	s.mu.RUnlock()
+	if time.Since(loadedAt) < reloadAfter {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := s.Load(ctx)
+	if err != nil {
+		log.Printf("could not reload the signing keys: %s", err.Error())
+		// Failing reads are not retried for every token either.
+		s.mu.Lock()
+		s.loadedAt = time.Now()
+		s.mu.Unlock()
+	}
+}
+
+// tokenIssuer returns the iss claim of a parsed token.
+func tokenIssuer(token *jwt.Token) string {
+	switch claims := token.Claims.(type) {
+	case *AccessClaims:
+		return claims.Issuer
+	case jwt.MapClaims:
+		issuer, _ := claims["iss"].(string)
+		return issuer
+	}
+	return ""
+}
+
+// Verify parses an access token signed by s and checks its issuer and use.
+func (s *Signer) Verify(tokenString string) (*AccessClaims, error) {
+	var claims AccessClaims
+	token, err := jwt.ParseWithClaims(tokenString, &claims, s.Keyfunc)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid || claims.Issuer != s.Issuer || claims.TokenUse != TokenUseAccess {
+		return nil, errors.New("token is not valid")
+	}
+	return &claims, nil
+}
+
+// JWK is the public half of a signing key as published in the key set.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of every key that can still verify a token.
+func (s *Signer) JWKS() JWKS {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	set := JWKS{Keys: []JWK{}}
+	for _, key := range s.keys {
+		public := key.Private.PublicKey
+		set.Keys = append(set.Keys, JWK{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: "RS256",
+			Kid: key.Kid,
+			N:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		})
+	}
+	return set
+}
+
+func (s *Signer) GetJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJson(w, http.StatusOK, s.JWKS())
+}
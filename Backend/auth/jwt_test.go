@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"context"
+	"github.com/Jonathanpatta/rplace/internal/dynamotest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSigner(t *testing.T, table *dynamotest.StandIn, secret string) *Signer {
+	t.Helper()
+	s, err := NewSigner(table.Client(), aws.String("Place-Clone"), "rplace", []byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSignerSealsKeys(t *testing.T) {
+	table := dynamotest.Start()
+	defer table.Close()
+	newTestSigner(t, table, "secret")
+
+	items := table.Partition(keysPk)
+	if len(items) != 1 {
+		t.Fatalf("got %d stored keys, want 1", len(items))
+	}
+	for name, value := range items[0] {
+		if s, ok := value.(*types.AttributeValueMemberS); ok && strings.Contains(s.Value, "PRIVATE KEY") {
+			t.Fatalf("%s holds the private key in the clear", name)
+		}
+	}
+}
+
+func TestSignerVerify(t *testing.T) {
+	table := dynamotest.Start()
+	defer table.Close()
+	signer := newTestSigner(t, table, "secret")
+
+	token, _, err := signer.Sign("alice", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		verifier func() *Signer
+		ok       bool
+	}{
+		{"same instance", func() *Signer { return signer }, true},
+		{"instance sharing the secret", func() *Signer { return newTestSigner(t, table, "secret") }, true},
+		{"instance with another secret", func() *Signer { return newTestSigner(t, table, "other") }, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := test.verifier().Verify(token)
+			if test.ok && (err != nil || claims.Username != "alice" || !claims.Admin) {
+				t.Fatalf("got %+v, %v", claims, err)
+			}
+			if !test.ok && err == nil {
+				t.Fatal("token verified")
+			}
+		})
+	}
+}
+
+func TestSignerReloadsUnknownKid(t *testing.T) {
+	table := dynamotest.Start()
+	defer table.Close()
+	verifier := newTestSigner(t, table, "secret")
+	signer := newTestSigner(t, table, "secret")
+
+	// Another instance rotates after the verifier read the keys.
+	err := signer.Rotate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := signer.Sign("alice", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys read moments ago are not read again.
+	_, err = verifier.Verify(token)
+	if err == nil {
+		t.Fatal("token verified before the keys were reloaded")
+	}
+
+	verifier.mu.Lock()
+	verifier.loadedAt = time.Now().Add(-reloadAfter)
+	verifier.mu.Unlock()
+	_, err = verifier.Verify(token)
+	if err != nil {
+		t.Fatalf("token signed with the rotated key: %v", err)
+	}
+}
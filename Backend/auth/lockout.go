@@ -0,0 +1,450 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	AuditLocked   = "account.locked"
+	AuditUnlocked = "account.unlocked"
+)
+
+const (
+	failuresPk     = "LOGINFAILURES"
+	auditPk        = "AUDIT#auth"
+	auditRetention = 90 * 24 * time.Hour
+)
+
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// LockedError refuses a login attempt before the password is checked. It is
+// returned the same way for usernames that do not exist.
+type LockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockedError) Error() string {
+	return "too many failed attempts, try again later"
+}
+
+// LockoutPolicy says how failed logins slow down further attempts. After
+// FreeAttempts failures each attempt has to wait BaseDelay, doubling with
+// every failure up to MaxDelay, and after LockAfter failures the account is
+// locked for LockFor. Failures older than Window are forgotten.
+type LockoutPolicy struct {
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	LockAfter    int
+	LockFor      time.Duration
+	Window       time.Duration
+}
+
+var DefaultLockoutPolicy = LockoutPolicy{
+	FreeAttempts: 3,
+	BaseDelay:    time.Second,
+	MaxDelay:     time.Minute,
+	LockAfter:    10,
+	LockFor:      15 * time.Minute,
+	Window:       24 * time.Hour,
+}
+
+// LoginFailures is kept per username, whether or not an account exists,
+// so that how a login is refused says nothing about the username.
+type LoginFailures struct {
+	Username    string `json:"username" dynamodbav:"username"`
+	Failures    int    `json:"failures" dynamodbav:"failures"`
+	LastFailure int64  `json:"last_failure,omitempty" dynamodbav:"last_failure"`
+	LockedUntil int64  `json:"locked_until,omitempty" dynamodbav:"locked_until"`
+}
+
+// Wait is how long the next attempt has to wait under policy.
+func (f *LoginFailures) Wait(policy LockoutPolicy, now time.Time) time.Duration {
+	if wait := time.Unix(f.LockedUntil, 0).Sub(now); f.LockedUntil != 0 && wait > 0 {
+		return wait
+	}
+	last := time.Unix(f.LastFailure, 0)
+	if now.Sub(last) > policy.Window || f.Failures < policy.FreeAttempts {
+		return 0
+	}
+
+	delay := policy.MaxDelay
+	if shift := f.Failures - policy.FreeAttempts; shift < 32 {
+		delay = policy.BaseDelay << uint(shift)
+		if delay <= 0 || delay > policy.MaxDelay {
+			delay = policy.MaxDelay
+		}
+	}
+	if wait := last.Add(delay).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+type AuditEntry struct {
+	Event    string `json:"event" dynamodbav:"event"`
+	Username string `json:"username" dynamodbav:"username"`
+	By       string `json:"by,omitempty" dynamodbav:"by"`
+	Ip       string `json:"ip,omitempty" dynamodbav:"ip"`
+	Failures int    `json:"failures,omitempty" dynamodbav:"failures"`
+	Until    int64  `json:"until,omitempty" dynamodbav:"until"`
+	At       int64  `json:"at" dynamodbav:"at"`
+}
+
+// Lockout counts failed logins and locks accounts that keep failing. Locks
+// and unlocks are written to an audit trail kept for 90 days.
+type Lockout struct {
+	DbCli     *dynamodb.Client
+	TableName *string
+	Policy    LockoutPolicy
+}
+
+func NewLockout(DbCli *dynamodb.Client, tableName *string) *Lockout {
+	return &Lockout{
+		DbCli:     DbCli,
+		TableName: tableName,
+		Policy:    DefaultLockoutPolicy,
+	}
+}
+
+func (l *Lockout) Get(ctx context.Context, username string) (*LoginFailures, error) {
+	out, err := l.DbCli.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      l.TableName,
+		Key:            l.key(username),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	f := &LoginFailures{Username: username}
+	if out.Item == nil {
+		return f, nil
+	}
+	err = attributevalue.UnmarshalMap(out.Item, f)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (l *Lockout) clear(ctx context.Context, username string) error {
+	_, err := l.DbCli.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: l.TableName,
+		Key:       l.key(username),
+	})
+	return err
+}
+
+// Check returns a LockedError when username may not try to log in yet,
+// along with the failures recorded so far.
+func (l *Lockout) Check(ctx context.Context, username string, now time.Time) (*LoginFailures, error) {
+	f, err := l.Get(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if wait := f.Wait(l.Policy, now); wait > 0 {
+		return f, &LockedError{RetryAfter: wait}
+	}
+	return f, nil
+}
+
+// Fail records a failed attempt and locks the account once it has failed
+// LockAfter times. The count is added to in the table rather than written
+// from f, so concurrent failures are all counted, and the lock is decided
+// from the count the table returns.
+func (l *Lockout) Fail(ctx context.Context, f *LoginFailures, ip string, now time.Time) error {
+	failures, err := l.count(ctx, f.Username, now)
+	if err != nil {
+		return err
+	}
+	f.Failures = failures
+	f.LastFailure = now.Unix()
+	if failures < l.Policy.LockAfter {
+		return nil
+	}
+
+	// The next failure after the lock runs out starts the delays again
+	// rather than locking at once. Of concurrent failures past the limit,
+	// only the one that counted last gets to lock.
+	until := now.Add(l.Policy.LockFor).Unix()
+	_, err = l.DbCli.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           l.TableName,
+		Key:                 l.key(f.Username),
+		UpdateExpression:    aws.String("SET locked_until = :until, failures = :free"),
+		ConditionExpression: aws.String("failures = :count"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":until": &types.AttributeValueMemberN{Value: strconv.FormatInt(until, 10)},
+			":free":  &types.AttributeValueMemberN{Value: strconv.Itoa(l.Policy.FreeAttempts)},
+			":count": &types.AttributeValueMemberN{Value: strconv.Itoa(failures)},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	f.Failures = l.Policy.FreeAttempts
+	f.LockedUntil = until
+	return l.audit(ctx, &AuditEntry{
+		Event:    AuditLocked,
+		Username: f.Username,
+		Ip:       ip,
+		Failures: failures,
+		Until:    until,
+		At:       now.Unix(),
+	})
+}
+
+func (l *Lockout) key(username string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: failuresPk},
+		"SK": &types.AttributeValueMemberS{Value: username},
+	}
+}
+
+// count adds a failure of username and returns how many there are now.
+// Failures within Window are added to; older ones are started over.
+func (l *Lockout) count(ctx context.Context, username string, now time.Time) (int, error) {
+	values := map[string]types.AttributeValue{
+		":one":      &types.AttributeValueMemberN{Value: "1"},
+		":now":      &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		":since":    &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(-l.Policy.Window).Unix(), 10)},
+		":username": &types.AttributeValueMemberS{Value: username},
+	}
+	updates := []struct {
+		expression string
+		condition  string
+	}{
+		{"ADD failures :one SET last_failure = :now, username = :username", "attribute_not_exists(PK) OR last_failure >= :since"},
+		{"SET failures = :one, last_failure = :now", "last_failure < :since"},
+	}
+
+	// Each update only fails its condition when another failure changed
+	// the item in between, so a few rounds settle it.
+	var conditionFailed *types.ConditionalCheckFailedException
+	for round := 0; round < 3; round++ {
+		for _, update := range updates {
+			out, err := l.DbCli.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+				TableName:                 l.TableName,
+				Key:                       l.key(username),
+				UpdateExpression:          aws.String(update.expression),
+				ConditionExpression:       aws.String(update.condition),
+				ExpressionAttributeValues: values,
+				ReturnValues:              types.ReturnValueUpdatedNew,
+			})
+			if errors.As(err, &conditionFailed) {
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+
+			var updated LoginFailures
+			err = attributevalue.UnmarshalMap(out.Attributes, &updated)
+			if err != nil {
+				return 0, err
+			}
+			return updated.Failures, nil
+		}
+	}
+	return 0, errors.New("could not count the failed login")
+}
+
+// Succeed forgets the failures of username after a successful login.
+func (l *Lockout) Succeed(ctx context.Context, f *LoginFailures) error {
+	if f.Failures == 0 && f.LockedUntil == 0 {
+		return nil
+	}
+	return l.clear(ctx, f.Username)
+}
+
+// Unlock lifts a lock and forgets the failures of username.
+func (l *Lockout) Unlock(ctx context.Context, username string, by string) error {
+	err := l.clear(ctx, username)
+	if err != nil {
+		return err
+	}
+	return l.audit(ctx, &AuditEntry{
+		Event:    AuditUnlocked,
+		Username: username,
+		By:       by,
+		At:       time.Now().Unix(),
+	})
+}
+
+// Locked lists the usernames locked right now.
+func (l *Lockout) Locked(ctx context.Context) ([]LoginFailures, error) {
+	var items []map[string]types.AttributeValue
+	paginator := dynamodb.NewQueryPaginator(l.DbCli, &dynamodb.QueryInput{
+		TableName:              l.TableName,
+		KeyConditionExpression: aws.String("#PK = :pk"),
+		FilterExpression:       aws.String("#locked_until > :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#PK":           "PK",
+			"#locked_until": "locked_until",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk":  &types.AttributeValueMemberS{Value: failuresPk},
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, page.Items...)
+	}
+
+	locked := []LoginFailures{}
+	err := attributevalue.UnmarshalListOfMaps(items, &locked)
+	return locked, err
+}
+
+func (l *Lockout) audit(ctx context.Context, entry *AuditEntry) error {
+	item, err := attributevalue.MarshalMap(entry)
+	if err != nil {
+		return err
+	}
+	at := time.Unix(entry.At, 0)
+	item["PK"] = &types.AttributeValueMemberS{Value: auditPk}
+	item["SK"] = &types.AttributeValueMemberS{Value: fmt.Sprintf("%020d#%s", at.UnixNano(), uuid.New().String())}
+	item["expires_at"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(at.Add(auditRetention).Unix(), 10)}
+
+	_, err = l.DbCli.PutItem(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: l.TableName,
+	})
+	return err
+}
+
+// Audit returns the latest audit entries, newest first, only those about
+// username when it is given.
+func (l *Lockout) Audit(ctx context.Context, username string, limit int) ([]AuditEntry, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              l.TableName,
+		KeyConditionExpression: aws.String("#PK = :pk"),
+		ExpressionAttributeNames: map[string]string{
+			"#PK": "PK",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk": &types.AttributeValueMemberS{Value: auditPk},
+		},
+		ScanIndexForward: aws.Bool(false),
+	}
+	if username != "" {
+		input.FilterExpression = aws.String("#username = :username")
+		input.ExpressionAttributeNames["#username"] = "username"
+		input.ExpressionAttributeValues[":username"] = &types.AttributeValueMemberS{Value: username}
+	}
+
+	entries := []AuditEntry{}
+	paginator := dynamodb.NewQueryPaginator(l.DbCli, input)
+	for paginator.HasMorePages() && len(entries) < limit {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var batch []AuditEntry
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &batch)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, batch...)
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// decoyHash is compared against when a username has no account, so that a
+// failed login takes as long either way.
+func decoyHash() []byte {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("rplace decoy password"), bcrypt.DefaultCost)
+	})
+	return dummyHash
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	fmt.Fprint(w, string(out))
+}
+
+func (s *Server) GetLockouts(w http.ResponseWriter, r *http.Request) {
+	locked, err := s.Lockout.Locked(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, http.StatusOK, locked)
+}
+
+func (s *Server) UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	var admin string
+	if s.Identity != nil {
+		admin, _, _ = s.Identity(r)
+	}
+
+	err := s.Lockout.Unlock(r.Context(), mux.Vars(r)["username"], admin)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetAudit lists the latest lock and unlock events, filtered with
+// ?username= and capped with ?limit=, 100 by default.
+func (s *Server) GetAudit(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	entries, err := s.Lockout.Audit(r.Context(), r.URL.Query().Get("username"), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, http.StatusOK, entries)
+}
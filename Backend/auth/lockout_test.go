@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"github.com/Jonathanpatta/rplace/internal/dynamotest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testLockoutPolicy = LockoutPolicy{
+	FreeAttempts: 2,
+	BaseDelay:    time.Second,
+	MaxDelay:     4 * time.Second,
+	LockAfter:    5,
+	LockFor:      time.Minute,
+	Window:       time.Hour,
+}
+
+func newTestLockout(t *testing.T) *Lockout {
+	t.Helper()
+	table := dynamotest.Start()
+	t.Cleanup(table.Close)
+	l := NewLockout(table.Client(), aws.String("Place-Clone"))
+	l.Policy = testLockoutPolicy
+	return l
+}
+
+func TestLoginFailuresWait(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	at := func(d time.Duration) int64 { return now.Add(d).Unix() }
+
+	tests := []struct {
+		name     string
+		failures LoginFailures
+		wait     time.Duration
+	}{
+		{"no failures", LoginFailures{}, 0},
+		{"free attempt", LoginFailures{Failures: 1, LastFailure: at(0)}, 0},
+		{"first delay", LoginFailures{Failures: 2, LastFailure: at(0)}, time.Second},
+		{"doubled delay", LoginFailures{Failures: 3, LastFailure: at(0)}, 2 * time.Second},
+		{"delay partly waited", LoginFailures{Failures: 3, LastFailure: at(-time.Second)}, time.Second},
+		{"delay waited", LoginFailures{Failures: 3, LastFailure: at(-2 * time.Second)}, 0},
+		{"capped delay", LoginFailures{Failures: 20, LastFailure: at(0)}, 4 * time.Second},
+		{"shift past the width", LoginFailures{Failures: 40, LastFailure: at(0)}, 4 * time.Second},
+		{"failures outside the window", LoginFailures{Failures: 4, LastFailure: at(-2 * time.Hour)}, 0},
+		{"locked", LoginFailures{Failures: 2, LastFailure: at(-time.Hour), LockedUntil: at(30 * time.Second)}, 30 * time.Second},
+		{"lock ran out", LoginFailures{Failures: 2, LastFailure: at(-time.Minute), LockedUntil: at(-time.Second)}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if wait := test.failures.Wait(testLockoutPolicy, now); wait != test.wait {
+				t.Fatalf("got %s, want %s", wait, test.wait)
+			}
+		})
+	}
+}
+
+func TestLockoutFail(t *testing.T) {
+	l := newTestLockout(t)
+	ctx := context.Background()
+	// Far enough back for the unlock below to be audited after the lock.
+	now := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name     string
+		after    time.Duration
+		failures int
+		locked   bool
+	}{
+		{"first failure", 0, 1, false},
+		{"second failure", 0, 2, false},
+		{"third failure", 0, 3, false},
+		{"fourth failure", 0, 4, false},
+		{"locking failure", 0, 2, true},
+		{"after the lock ran out", 2 * time.Minute, 3, false},
+		{"after the window", 2 * time.Hour, 1, false},
+	}
+	for _, test := range tests {
+		now = now.Add(test.after)
+		f, err := l.Get(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = l.Fail(ctx, f, "203.0.113.5", now)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		stored, err := l.Get(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Failures != test.failures || f.Failures != test.failures {
+			t.Fatalf("%s: got %d failures (%d stored), want %d", test.name, f.Failures, stored.Failures, test.failures)
+		}
+		_, err = l.Check(ctx, "alice", now)
+		var locked *LockedError
+		if test.locked && (!errors.As(err, &locked) || locked.RetryAfter != time.Minute) {
+			t.Fatalf("%s: got %v, want a lock for a minute", test.name, err)
+		}
+		if !test.locked && errors.As(err, &locked) && locked.RetryAfter > testLockoutPolicy.MaxDelay {
+			t.Fatalf("%s: locked for %s", test.name, locked.RetryAfter)
+		}
+	}
+
+	err := l.Unlock(ctx, "alice", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := l.Check(ctx, "alice", now)
+	if err != nil || f.Failures != 0 {
+		t.Fatalf("got %+v, %v after the unlock", f, err)
+	}
+
+	entries, err := l.Audit(ctx, "alice", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Event != AuditUnlocked || entries[0].By != "root" ||
+		entries[1].Event != AuditLocked || entries[1].Failures != 5 || entries[1].Ip != "203.0.113.5" {
+		t.Fatalf("got %+v", entries)
+	}
+}
+
+func TestLockoutCountsConcurrentFailures(t *testing.T) {
+	l := newTestLockout(t)
+	l.Policy.LockAfter = 100
+	ctx := context.Background()
+	now := time.Now()
+
+	const attempts = 8
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Every attempt read the failures before any was counted.
+			err := l.Fail(ctx, &LoginFailures{Username: "alice"}, "", now)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	f, err := l.Get(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Failures != attempts {
+		t.Fatalf("got %d failures, want %d", f.Failures, attempts)
+	}
+}
+
+func TestLockoutSucceed(t *testing.T) {
+	l := newTestLockout(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		err := l.Fail(ctx, &LoginFailures{Username: "alice"}, "", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := l.Get(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Succeed(ctx, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = l.Check(ctx, "alice", now)
+	if err != nil || f.Failures != 0 || f.LastFailure != 0 {
+		t.Fatalf("got %+v, %v after a successful login", f, err)
+	}
+}
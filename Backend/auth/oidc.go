@@ -0,0 +1,581 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/MicahParks/keyfunc"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcSessionName  = "OIDC"
+	oidcFlowLifetime = 10 * time.Minute
+	oidcTimeout      = 10 * time.Second
+)
+
+var (
+	ErrUnknownProvider = errors.New("unknown identity provider")
+	ErrOIDCFlow        = errors.New("the login is missing, has expired or was started in another browser")
+	ErrIDToken         = errors.New("the ID token is not valid")
+
+	providerName = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+)
+
+// OIDCProvider is an OpenID Connect provider accounts can log in with.
+// Its endpoints and keys are read from the discovery document under
+// Issuer the first time it is used.
+type OIDCProvider struct {
+	// Name identifies the provider in the routes, as in
+	// /auth/oidc/{name}/login.
+	Name     string
+	Issuer   string
+	ClientID string
+	// ClientSecret authenticates the code exchange with
+	// client_secret_basic. Public clients leave it empty and rely on PKCE
+	// alone.
+	ClientSecret string
+	// RedirectURL is the callback registered with the provider. It has to
+	// reach /auth/oidc/{name}/callback.
+	RedirectURL string
+	// Scopes are asked for along with openid.
+	Scopes []string
+	Client *http.Client
+
+	mu        sync.Mutex
+	discovery *OIDCDiscovery
+	jwks      *keyfunc.JWKS
+}
+
+func NewOIDCProvider(name string, issuer string, clientID string, clientSecret string, redirectURL string) *OIDCProvider {
+	return &OIDCProvider{
+		Name:         name,
+		Issuer:       issuer,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"email", "profile"},
+		Client:       &http.Client{Timeout: oidcTimeout},
+	}
+}
+
+// OIDCDiscovery is the part of a discovery document the login uses.
+type OIDCDiscovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	CodeChallengeMethods  []string `json:"code_challenge_methods_supported"`
+}
+
+// Discover fetches the discovery document and key set of p. Once fetched
+// they are kept, and the keys refreshed in the background.
+func (p *OIDCProvider) Discover(ctx context.Context) (*OIDCDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery document of %s: %s", p.Name, resp.Status)
+	}
+
+	var d OIDCDiscovery
+	err = json.NewDecoder(resp.Body).Decode(&d)
+	if err != nil {
+		return nil, err
+	}
+	// Tokens are checked against the issuer of the document, so it has to
+	// be the one configured.
+	if d.Issuer != p.Issuer {
+		return nil, fmt.Errorf("discovery document of %s is for issuer %q", p.Name, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document of %s is missing endpoints", p.Name)
+	}
+	if len(d.CodeChallengeMethods) > 0 && !contains(d.CodeChallengeMethods, "S256") {
+		return nil, fmt.Errorf("%s does not support PKCE with S256", p.Name)
+	}
+
+	jwks, err := keyfunc.Get(d.JWKSURI, keyfunc.Options{
+		Client: p.Client,
+		RefreshErrorHandler: func(err error) {
+			log.Printf("could not refresh the keys of %s: %s", p.Name, err.Error())
+		},
+		RefreshInterval:   time.Hour,
+		RefreshRateLimit:  5 * time.Minute,
+		RefreshTimeout:    oidcTimeout,
+		RefreshUnknownKID: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p.discovery = &d
+	p.jwks = jwks
+	return p.discovery, nil
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcFlow is what a login keeps in the table while the browser is away at
+// the provider. The browser only holds the state, in a cookie, so nothing
+// it sends back decides which account an identity ends up in.
+type oidcFlow struct {
+	Provider string `dynamodbav:"provider"`
+	State    string `dynamodbav:"-"`
+	Nonce    string `dynamodbav:"nonce"`
+	Verifier string `dynamodbav:"verifier"`
+	// Redirect is the path of the frontend to come back to.
+	Redirect string `dynamodbav:"redirect"`
+	// Link is the account the identity gets linked to, when the flow was
+	// started by a logged in user.
+	Link      string `dynamodbav:"link,omitempty"`
+	ExpiresAt int64  `dynamodbav:"expires_at"`
+}
+
+// oidcFlowKey is where the flow with state is kept. Only a hash of the
+// state is stored, so reading the table does not let anyone finish a flow.
+func oidcFlowKey(state string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: "OIDCFLOW#" + hashSecret(state)},
+		"SK": &types.AttributeValueMemberS{Value: "FLOW"},
+	}
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// PKCEChallenge is the S256 code challenge of verifier.
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func newOIDCFlow(provider string, redirect string, link string) (*oidcFlow, error) {
+	f := &oidcFlow{Provider: provider, Redirect: redirect, Link: link}
+	for _, field := range []*string{&f.State, &f.Nonce, &f.Verifier} {
+		value, err := randomString()
+		if err != nil {
+			return nil, err
+		}
+		*field = value
+	}
+	return f, nil
+}
+
+// AuthCodeURL is where a browser logs in for flow f.
+func (p *OIDCProvider) authCodeURL(d *OIDCDiscovery, f *oidcFlow) (string, error) {
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", p.RedirectURL)
+	q.Set("scope", strings.Join(append([]string{"openid"}, p.Scopes...), " "))
+	q.Set("state", f.State)
+	q.Set("nonce", f.Nonce)
+	q.Set("code_challenge", PKCEChallenge(f.Verifier))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+type oidcTokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Exchange trades an authorization code for the ID token of the user who
+// logged in.
+func (p *OIDCProvider) Exchange(ctx context.Context, code string, verifier string) (string, error) {
+	d, err := p.Discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if p.ClientSecret == "" {
+		form.Set("client_id", p.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var tokens oidcTokenResponse
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens)
+	if err != nil {
+		return "", fmt.Errorf("token response of %s: %w", p.Name, err)
+	}
+	if tokens.Error != "" {
+		return "", fmt.Errorf("%s refused the code: %s %s", p.Name, tokens.Error, tokens.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return "", fmt.Errorf("%s returned no ID token: %s", p.Name, resp.Status)
+	}
+	return tokens.IDToken, nil
+}
+
+// IDClaims are the claims of an ID token accounts are found and created
+// from.
+type IDClaims struct {
+	Nonce             string `json:"nonce"`
+	AuthorizedParty   string `json:"azp,omitempty"`
+	Email             string `json:"email,omitempty"`
+	EmailVerified     bool   `json:"email_verified,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Name              string `json:"name,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// VerifyIDToken checks the signature, issuer, audience, expiry and nonce
+// of an ID token.
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, idToken string, nonce string) (*IDClaims, error) {
+	d, err := p.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims IDClaims
+	token, err := jwt.ParseWithClaims(idToken, &claims, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA, *jwt.SigningMethodRSAPSS:
+			return p.jwks.Keyfunc(token)
+		}
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrIDToken, err.Error())
+	}
+
+	switch {
+	case !token.Valid:
+		return nil, ErrIDToken
+	case claims.Issuer != d.Issuer:
+		return nil, fmt.Errorf("%w: issued by %q", ErrIDToken, claims.Issuer)
+	case !claims.VerifyAudience(p.ClientID, true):
+		return nil, fmt.Errorf("%w: not issued to this client", ErrIDToken)
+	case claims.AuthorizedParty != "" && claims.AuthorizedParty != p.ClientID:
+		return nil, fmt.Errorf("%w: issued to %q", ErrIDToken, claims.AuthorizedParty)
+	case claims.ExpiresAt == nil:
+		return nil, fmt.Errorf("%w: no expiry", ErrIDToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: no subject", ErrIDToken)
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, fmt.Errorf("%w: wrong nonce", ErrIDToken)
+	}
+	return &claims, nil
+}
+
+// safeRedirect keeps redirects on the frontend, falling back to its root.
+func safeRedirect(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/"
+	}
+	return path
+}
+
+func (s *Server) provider(w http.ResponseWriter, r *http.Request) (*OIDCProvider, bool) {
+	p, ok := s.OIDC[mux.Vars(r)["provider"]]
+	if !ok {
+		http.Error(w, ErrUnknownProvider.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	return p, true
+}
+
+// oidcCookieOptions are the options of the cookie keeping a flow. Lax
+// lets it come along on the redirect back from the provider.
+func oidcCookieOptions(maxAge int) *sessions.Options {
+	return &sessions.Options{
+		Path:     "/auth/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// startFlow stores a new flow and returns where to send the browser to
+// log in. The browser gets the state in a cookie, which ties the callback
+// to the browser that started the flow.
+func (s *Server) startFlow(w http.ResponseWriter, r *http.Request, p *OIDCProvider, link string) (string, error) {
+	d, err := p.Discover(r.Context())
+	if err != nil {
+		return "", err
+	}
+	f, err := newOIDCFlow(p.Name, safeRedirect(r.URL.Query().Get("redirect")), link)
+	if err != nil {
+		return "", err
+	}
+	f.ExpiresAt = time.Now().Add(oidcFlowLifetime).Unix()
+
+	item, err := attributevalue.MarshalMap(f)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range oidcFlowKey(f.State) {
+		item[k] = v
+	}
+	_, err = s.DbCli.PutItem(r.Context(), &dynamodb.PutItemInput{
+		TableName:           s.TableName,
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// A flow started in another tab is replaced, which only fails that
+	// other login.
+	session, _ := s.SessionsStore.Get(r, oidcSessionName)
+	session.Values = map[interface{}]interface{}{"state": f.State}
+	session.Options = oidcCookieOptions(int(oidcFlowLifetime.Seconds()))
+	err = session.Save(r, w)
+	if err != nil {
+		return "", err
+	}
+	return p.authCodeURL(d, f)
+}
+
+// takeFlow finds the flow a callback belongs to and deletes it, so that
+// each flow is completed at most once.
+func (s *Server) takeFlow(w http.ResponseWriter, r *http.Request, provider string) (*oidcFlow, error) {
+	session, err := s.SessionsStore.Get(r, oidcSessionName)
+	if err != nil || session.IsNew {
+		return nil, ErrOIDCFlow
+	}
+	cookieState, _ := session.Values["state"].(string)
+
+	// The cookie is only cleared on the path it was set on.
+	session.Options = oidcCookieOptions(-1)
+	err = session.Save(r, w)
+	if err != nil {
+		return nil, err
+	}
+
+	state := r.URL.Query().Get("state")
+	if state == "" || subtle.ConstantTimeCompare([]byte(cookieState), []byte(state)) != 1 {
+		return nil, ErrOIDCFlow
+	}
+
+	out, err := s.DbCli.DeleteItem(r.Context(), &dynamodb.DeleteItemInput{
+		TableName:           s.TableName,
+		Key:                 oidcFlowKey(state),
+		ConditionExpression: aws.String("attribute_exists(PK)"),
+		ReturnValues:        types.ReturnValueAllOld,
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return nil, ErrOIDCFlow
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var f oidcFlow
+	err = attributevalue.UnmarshalMap(out.Attributes, &f)
+	if err != nil {
+		return nil, err
+	}
+	f.State = state
+	// The table only drops expired flows eventually.
+	if f.Provider != provider || time.Now().Unix() > f.ExpiresAt {
+		return nil, ErrOIDCFlow
+	}
+	return &f, nil
+}
+
+type OIDCProviderInfo struct {
+	Name     string `json:"name"`
+	LoginURL string `json:"login_url"`
+}
+
+// GetOIDCProviders lists the providers accounts can log in with.
+func (s *Server) GetOIDCProviders(w http.ResponseWriter, r *http.Request) {
+	list := make([]OIDCProviderInfo, 0, len(s.OIDC))
+	for name := range s.OIDC {
+		list = append(list, OIDCProviderInfo{Name: name, LoginURL: "/auth/oidc/" + name + "/login"})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	writeJson(w, http.StatusOK, list)
+}
+
+// OIDCLogin sends a browser to log in at a provider.
+func (s *Server) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.provider(w, r)
+	if !ok {
+		return
+	}
+
+	location, err := s.startFlow(w, r, p, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	http.Redirect(w, r, location, http.StatusFound)
+}
+
+type OIDCLinkResponse struct {
+	// URL is where to send the browser to log in at the provider.
+	URL string `json:"url"`
+}
+
+// OIDCLink starts a login at a provider that links the identity to the
+// account of the caller instead of logging in with it.
+func (s *Server) OIDCLink(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.caller(w, r)
+	if !ok {
+		return
+	}
+	p, ok := s.provider(w, r)
+	if !ok {
+		return
+	}
+
+	location, err := s.startFlow(w, r, p, c.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJson(w, http.StatusOK, OIDCLinkResponse{URL: location})
+}
+
+// OIDCCallback finishes a login. The identity is linked to the account
+// that started a link, or else logs in to the account it is linked to,
+// which is created on its first login. Accounts are never matched by email
+// address, since that would hand them to whoever controls the address at
+// any provider.
+func (s *Server) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.provider(w, r)
+	if !ok {
+		return
+	}
+
+	f, err := s.takeFlow(w, r, p.Name)
+	if errors.Is(err, ErrOIDCFlow) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		http.Error(w, fmt.Sprintf("%s refused the login: %s %s", p.Name, e, query.Get("error_description")), http.StatusUnauthorized)
+		return
+	}
+
+	idToken, err := p.Exchange(r.Context(), query.Get("code"), f.Verifier)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	claims, err := p.VerifyIDToken(r.Context(), idToken, f.Nonce)
+	if errors.Is(err, ErrIDToken) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if f.Link != "" {
+		err = s.Identities.Link(r.Context(), newIdentity(f.Link, p.Name, claims))
+		if errors.Is(err, ErrIdentityLinked) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, strings.TrimSuffix(s.PublicURL, "/")+f.Redirect, http.StatusFound)
+		return
+	}
+
+	username, err := s.identityUser(r.Context(), p.Name, claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token, err := s.Tokens.Issue(r.Context(), username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = s.saveSession(w, r, token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, strings.TrimSuffix(s.PublicURL, "/")+f.Redirect, http.StatusFound)
+}
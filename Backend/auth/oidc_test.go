@@ -0,0 +1,448 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Jonathanpatta/rplace/internal/dynamotest"
+	"github.com/Jonathanpatta/rplace/mockidp"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const (
+	testClientId     = "rplace"
+	testClientSecret = "secret"
+	testFrontend     = "http://frontend.test"
+)
+
+type oidcTest struct {
+	t      *testing.T
+	table  *dynamotest.StandIn
+	idp    *mockidp.Provider
+	idpURL string
+	apiURL string
+	server *Server
+}
+
+// newOIDCTest runs the mock provider and the OIDC routes of a server
+// storing its state in a DynamoDB stand-in. Calls name their caller in the
+// X-User header.
+func newOIDCTest(t *testing.T) *oidcTest {
+	t.Helper()
+	o := &oidcTest{t: t, table: dynamotest.Start()}
+	t.Cleanup(o.table.Close)
+
+	// The provider has to know its own address, so it is created after
+	// its server.
+	var idpHandler http.Handler
+	idpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idpHandler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(idpServer.Close)
+	o.idpURL = idpServer.URL
+
+	s := NewServer(o.table.Client(), sessions.NewCookieStore([]byte("0123456789abcdef0123456789abcdef")))
+	s.PublicURL = testFrontend
+	s.Caller = func(r *http.Request) (Caller, bool) {
+		username := r.Header.Get("X-User")
+		return Caller{Id: username}, username != ""
+	}
+	o.server = s
+
+	router := mux.NewRouter()
+	router.HandleFunc("/auth/oidc/{provider}/login", s.OIDCLogin).Methods("GET")
+	router.HandleFunc("/auth/oidc/{provider}/callback", s.OIDCCallback).Methods("GET")
+	router.HandleFunc("/auth/identities/{provider}/link", s.OIDCLink).Methods("POST")
+	apiServer := httptest.NewServer(router)
+	t.Cleanup(apiServer.Close)
+	o.apiURL = apiServer.URL
+
+	callback := o.apiURL + "/auth/oidc/mock/callback"
+	idp, err := mockidp.New(o.idpURL, map[string]mockidp.Client{
+		testClientId: {Secret: testClientSecret, RedirectURIs: []string{callback}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idpHandler = idp.Handler()
+	o.idp = idp
+	s.OIDC["mock"] = NewOIDCProvider("mock", o.idpURL, testClientId, testClientSecret, callback)
+	return o
+}
+
+// browser returns a client keeping cookies that stops at every redirect,
+// so each step of a flow can be looked at.
+func (o *oidcTest) browser() *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Timeout: 10 * time.Second,
+	}
+}
+
+func (o *oidcTest) do(client *http.Client, method string, target string, user string) *http.Response {
+	o.t.Helper()
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	if user != "" {
+		req.Header.Set("X-User", user)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func (o *oidcTest) redirect(resp *http.Response) string {
+	o.t.Helper()
+	if resp.StatusCode != http.StatusFound {
+		o.t.Fatalf("got %s, want a redirect", resp.Status)
+	}
+	return resp.Header.Get("Location")
+}
+
+// start starts a login, or a link when user is set, and returns the
+// authorization URL it sends the browser to.
+func (o *oidcTest) start(client *http.Client, user string) string {
+	o.t.Helper()
+	if user == "" {
+		return o.redirect(o.do(client, "GET", o.apiURL+"/auth/oidc/mock/login?redirect=/canvas", ""))
+	}
+
+	req, err := http.NewRequest("POST", o.apiURL+"/auth/identities/mock/link?redirect=/settings", nil)
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	req.Header.Set("X-User", user)
+	resp, err := client.Do(req)
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		o.t.Fatalf("link: got %s", resp.Status)
+	}
+	var link OIDCLinkResponse
+	err = json.NewDecoder(resp.Body).Decode(&link)
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	return link.URL
+}
+
+// authorize logs in at the provider as hint, changing the authorization
+// URL with edit first when it is set, and returns the callback the
+// provider sends the browser back to.
+func (o *oidcTest) authorize(client *http.Client, authURL string, hint string, edit func(url.Values)) string {
+	o.t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	q := u.Query()
+	q.Set("login_hint", hint)
+	if edit != nil {
+		edit(q)
+	}
+	u.RawQuery = q.Encode()
+	return o.redirect(o.do(client, "GET", u.String(), ""))
+}
+
+// login runs a whole login, or a link when user is set, as hint and
+// returns the response to the callback.
+func (o *oidcTest) login(client *http.Client, user string, hint string) *http.Response {
+	o.t.Helper()
+	callback := o.authorize(client, o.start(client, user), hint, nil)
+	return o.do(client, "GET", callback, "")
+}
+
+// accounts counts the account items of username, leaving out its
+// identities and sessions.
+func (o *oidcTest) accounts(username string) int {
+	n := 0
+	for _, item := range o.table.Partition("USER#" + username) {
+		if _, ok := item["hashedpassword"]; ok {
+			n++
+		}
+	}
+	return n
+}
+
+func (o *oidcTest) linkedTo(subject string) string {
+	o.t.Helper()
+	found, err := o.server.Identities.Find(context.Background(), "mock", subject)
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	if found == nil {
+		return ""
+	}
+	return found.Username
+}
+
+func TestOIDCFirstLoginCreatesAccount(t *testing.T) {
+	o := newOIDCTest(t)
+
+	for i := 0; i < 2; i++ {
+		resp := o.login(o.browser(), "", "alice@example.com")
+		if location := o.redirect(resp); location != testFrontend+"/canvas" {
+			t.Fatalf("login %d went to %q", i, location)
+		}
+		if !hasCookie(resp, SessionName) {
+			t.Fatalf("login %d set no session", i)
+		}
+	}
+
+	// The second login finds the account the first one created.
+	if n := o.accounts("alice"); n != 1 {
+		t.Fatalf("got %d accounts for alice, want 1", n)
+	}
+	if username := o.linkedTo("mock|alice"); username != "alice" {
+		t.Fatalf("identity linked to %q, want alice", username)
+	}
+}
+
+func TestOIDCLinkUsesCaller(t *testing.T) {
+	o := newOIDCTest(t)
+
+	resp := o.login(o.browser(), "bob", "carol")
+	if location := o.redirect(resp); location != testFrontend+"/settings" {
+		t.Fatalf("link went to %q", location)
+	}
+	if hasCookie(resp, SessionName) {
+		t.Fatal("a link logged in")
+	}
+
+	if username := o.linkedTo("mock|carol"); username != "bob" {
+		t.Fatalf("identity linked to %q, want bob", username)
+	}
+	if n := o.accounts("carol"); n != 0 {
+		t.Fatalf("the link created %d accounts", n)
+	}
+
+	// Logging in with the identity now reaches the account it was linked
+	// to.
+	o.redirect(o.login(o.browser(), "", "carol"))
+	if n := o.accounts("carol"); n != 0 {
+		t.Fatalf("the login created %d accounts", n)
+	}
+}
+
+func TestOIDCLinkIdentityOfOtherAccount(t *testing.T) {
+	o := newOIDCTest(t)
+	o.redirect(o.login(o.browser(), "", "alice"))
+
+	resp := o.login(o.browser(), "bob", "alice")
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("got %s, want %d", resp.Status, http.StatusConflict)
+	}
+	if username := o.linkedTo("mock|alice"); username != "alice" {
+		t.Fatalf("identity linked to %q, want alice", username)
+	}
+}
+
+func TestOIDCFlowKeptInTable(t *testing.T) {
+	o := newOIDCTest(t)
+
+	authURL, err := url.Parse(o.start(o.browser(), "bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := authURL.Query().Get("state")
+	flows := o.table.Partition("OIDCFLOW#" + hashSecret(state))
+	if len(flows) != 1 || flows[0]["link"] != "bob" {
+		t.Fatalf("got flows %v", flows)
+	}
+
+	// A cookie forged with the session key still only names the state,
+	// and the account to link comes from the stored flow.
+	req := httptest.NewRequest("GET", o.apiURL, nil)
+	rec := httptest.NewRecorder()
+	session, err := o.server.SessionsStore.New(req, oidcSessionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values = map[interface{}]interface{}{"state": state, "link": "mallory", "provider": "mock"}
+	session.Options = oidcCookieOptions(600)
+	err = session.Save(req, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := o.browser()
+	callback := o.authorize(client, authURL.String(), "carol", nil)
+	forged, err := http.NewRequest("GET", callback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := rec.Result().Cookies()[0]
+	forged.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	resp, err := client.Do(forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	o.redirect(resp)
+
+	if username := o.linkedTo("mock|carol"); username != "bob" {
+		t.Fatalf("identity linked to %q, want bob", username)
+	}
+	if flows := o.table.Partition("OIDCFLOW#" + hashSecret(state)); len(flows) != 0 {
+		t.Fatalf("the flow was kept: %v", flows)
+	}
+}
+
+func TestOIDCStateMismatch(t *testing.T) {
+	o := newOIDCTest(t)
+	client := o.browser()
+
+	callback, err := url.Parse(o.authorize(client, o.start(client, ""), "alice", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := callback.Query()
+	q.Set("state", "forged")
+	callback.RawQuery = q.Encode()
+
+	resp := o.do(client, "GET", callback.String(), "")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got %s, want %d", resp.Status, http.StatusBadRequest)
+	}
+	if n := o.accounts("alice"); n != 0 {
+		t.Fatalf("got %d accounts", n)
+	}
+}
+
+func TestOIDCFlowUsedOnce(t *testing.T) {
+	o := newOIDCTest(t)
+	client := o.browser()
+
+	callback := o.authorize(client, o.start(client, ""), "alice", nil)
+	o.redirect(o.do(client, "GET", callback, ""))
+
+	resp := o.do(client, "GET", callback, "")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("replay got %s, want %d", resp.Status, http.StatusBadRequest)
+	}
+
+	// Without the cookie of the browser that started it, a flow is not
+	// found either.
+	client = o.browser()
+	callback = o.authorize(client, o.start(client, ""), "dave", nil)
+	resp = o.do(o.browser(), "GET", callback, "")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("other browser got %s, want %d", resp.Status, http.StatusBadRequest)
+	}
+}
+
+func TestOIDCWrongNonce(t *testing.T) {
+	o := newOIDCTest(t)
+	client := o.browser()
+
+	callback := o.authorize(client, o.start(client, ""), "alice", func(q url.Values) {
+		q.Set("nonce", "forged")
+	})
+	resp := o.do(client, "GET", callback, "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("got %s, want %d", resp.Status, http.StatusUnauthorized)
+	}
+	if n := o.accounts("alice"); n != 0 {
+		t.Fatalf("got %d accounts", n)
+	}
+}
+
+func TestVerifyIDTokenAudience(t *testing.T) {
+	o := newOIDCTest(t)
+	p := o.server.OIDC["mock"]
+
+	tests := []struct {
+		name     string
+		audience []string
+		azp      string
+		ok       bool
+	}{
+		{"client", []string{testClientId}, "", true},
+		{"client as azp", []string{testClientId, "other"}, testClientId, true},
+		{"other audience", []string{"other"}, "", false},
+		{"other azp", []string{testClientId, "other"}, "other", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := jwt.MapClaims{
+				"iss":   o.idpURL,
+				"sub":   "mock|alice",
+				"aud":   test.audience,
+				"exp":   time.Now().Add(time.Hour).Unix(),
+				"iat":   time.Now().Unix(),
+				"nonce": "nonce",
+			}
+			if test.azp != "" {
+				claims["azp"] = test.azp
+			}
+			idToken, err := o.idp.Sign(claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = p.VerifyIDToken(context.Background(), idToken, "nonce")
+			if test.ok && err != nil {
+				t.Fatalf("got %v", err)
+			}
+			if !test.ok && !errors.Is(err, ErrIDToken) {
+				t.Fatalf("got %v, want %v", err, ErrIDToken)
+			}
+		})
+	}
+}
+
+func TestPKCEChallenge(t *testing.T) {
+	// The example of RFC 7636, appendix B.
+	got := PKCEChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if want := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestSafeRedirect(t *testing.T) {
+	tests := map[string]string{
+		"":                     "/",
+		"/":                    "/",
+		"/canvas?x=1":          "/canvas?x=1",
+		"canvas":               "/",
+		"//evil.example":       "/",
+		"/\\evil.example":      "/",
+		"https://evil.example": "/",
+	}
+	for path, want := range tests {
+		if got := safeRedirect(path); got != want {
+			t.Errorf("safeRedirect(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func hasCookie(resp *http.Response, name string) bool {
+	for _, c := range resp.Cookies() {
+		if c.Name == name && c.MaxAge >= 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,361 @@
+package auth
+
+import (
+	"github.com/Jonathanpatta/rplace/challenge"
+	"github.com/Jonathanpatta/rplace/openapi"
+)
+
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Email is optional on registration. It is needed to reset a
+	// forgotten password once verified.
+	Email string `json:"email,omitempty"`
+}
+
+// Describe documents the routes mounted by AddSubrouter.
+func Describe(spec *openapi.Spec) {
+	credentials := spec.Schema("Credentials", Credentials{})
+	loginFailures := spec.Schema("LoginFailures", LoginFailures{})
+	auditEntry := spec.Schema("AuditEntry", AuditEntry{})
+	token := spec.Schema("Token", Token{})
+	retryAfter := map[string]*openapi.Header{
+		"Retry-After": {
+			Description: "Seconds until the next attempt is allowed",
+			Schema:      &openapi.Schema{Type: "integer"},
+		},
+	}
+
+	spec.Describe("POST", "/auth/register", &openapi.Operation{
+		OperationId: "register",
+		Summary:     "Create an account",
+		Tags:        []string{"auth"},
+		Parameters:  []*openapi.Parameter{challenge.Parameter()},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(credentials)},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The account was created"},
+			"400": {Description: "The email address is invalid"},
+			"428": {Description: "A solved register challenge is needed"},
+			"429": {Description: "Too many attempts from this address", Headers: retryAfter},
+			"500": {Description: "The user already exists or the account could not be stored"},
+		},
+	})
+	spec.Describe("POST", "/auth/generateToken", &openapi.Operation{
+		OperationId: "generateToken",
+		Summary:     "Exchange a username and password for a token",
+		Tags:        []string{"auth"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(credentials)},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "A token valid for two weeks", Content: openapi.JSON(token)},
+			"401": {Description: "The username or password is wrong"},
+			"429": {Description: "Too many attempts from this address, or too many failed logins for this username", Headers: retryAfter},
+		},
+	})
+	emailRequest := spec.Schema("EmailRequest", EmailRequest{})
+	tokenRequest := spec.Schema("TokenRequest", TokenRequest{})
+	resetPassword := spec.Schema("ResetPasswordRequest", ResetPasswordRequest{})
+	spec.Describe("POST", "/auth/email/verify/request", &openapi.Operation{
+		OperationId: "requestVerification",
+		Summary:     "Mail a new link for confirming the email address of an account",
+		Description: "The answer is the same whether or not the account exists or anything was sent.",
+		Tags:        []string{"auth"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(emailRequest)},
+		Responses: map[string]*openapi.Response{
+			"202": {Description: "A link was sent if the account has an unverified address"},
+			"429": {Description: "Too many requests from this address", Headers: retryAfter},
+		},
+	})
+	spec.Describe("POST", "/auth/email/verify", &openapi.Operation{
+		OperationId: "verifyEmail",
+		Summary:     "Confirm an email address with the token from a verification link",
+		Tags:        []string{"auth"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(tokenRequest)},
+		Responses: map[string]*openapi.Response{
+			"204": {Description: "The address is verified"},
+			"400": {Description: "The token is invalid, expired or already used"},
+			"429": {Description: "Too many attempts from this address", Headers: retryAfter},
+		},
+	})
+	spec.Describe("POST", "/auth/password/reset/request", &openapi.Operation{
+		OperationId: "requestPasswordReset",
+		Summary:     "Mail a password reset link to the verified address of an account",
+		Description: "The answer is the same whether or not the account exists or anything was sent.",
+		Tags:        []string{"auth"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(emailRequest)},
+		Responses: map[string]*openapi.Response{
+			"202": {Description: "A link was sent if the account has a verified address"},
+			"429": {Description: "Too many requests from this address", Headers: retryAfter},
+		},
+	})
+	spec.Describe("POST", "/auth/password/reset", &openapi.Operation{
+		OperationId: "resetPassword",
+		Summary:     "Set a new password with the token from a reset link",
+		Description: "Also logs the account out everywhere and lifts any lock from failed logins. Reset links sent before stop working.",
+		Tags:        []string{"auth"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(resetPassword)},
+		Responses: map[string]*openapi.Response{
+			"204": {Description: "The password was changed"},
+			"400": {Description: "The token is invalid, expired, already used or sent before the password last changed, or the password is empty"},
+			"429": {Description: "Too many attempts from this address", Headers: retryAfter},
+		},
+	})
+	changeEmail := spec.Schema("ChangeEmailRequest", ChangeEmailRequest{})
+	spec.Secure("/auth/email/change/request")
+	spec.Describe("POST", "/auth/email/change/request", &openapi.Operation{
+		OperationId: "requestEmailChange",
+		Summary:     "Mail a link for adding or changing the address of the caller's account to the new address",
+		Description: "The account keeps its current address until the link is opened.",
+		Tags:        []string{"auth"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(changeEmail)},
+		Responses: map[string]*openapi.Response{
+			"202": {Description: "A link was sent to the new address"},
+			"204": {Description: "The account already has this address verified"},
+			"400": {Description: "The email address is invalid"},
+			"403": {Description: "The request is made with an API key"},
+			"404": {Description: "The caller has no account with a password, such as one of the user pool"},
+			"429": {Description: "Too many requests from this address", Headers: retryAfter},
+		},
+	})
+	spec.Describe("POST", "/auth/email/change", &openapi.Operation{
+		OperationId: "changeEmail",
+		Summary:     "Set the address of an account with the token from an address change link",
+		Description: "The new address is verified. A verified previous address is told of the change. Change links sent before stop working.",
+		Tags:        []string{"auth"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(tokenRequest)},
+		Responses: map[string]*openapi.Response{
+			"204": {Description: "The address was changed"},
+			"400": {Description: "The token is invalid, expired, already used or sent before the address last changed"},
+			"429": {Description: "Too many attempts from this address", Headers: retryAfter},
+		},
+	})
+	tokenResponse := spec.Schema("TokenResponse", TokenResponse{})
+	refreshRequest := spec.Schema("RefreshRequest", RefreshRequest{})
+	jwks := spec.Schema("JWKS", JWKS{})
+	spec.Describe("POST", "/auth/token", &openapi.Operation{
+		OperationId: "issueTokens",
+		Summary:     "Exchange a username and password for a signed access token and a refresh token",
+		Description: "Access tokens are RS256 JWTs verifiable with the keys at /.well-known/jwks.json.",
+		Tags:        []string{"auth"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(credentials)},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The tokens", Content: openapi.JSON(tokenResponse)},
+			"401": {Description: "The username or password is wrong"},
+			"429": {Description: "Too many attempts from this address, or too many failed logins for this username", Headers: retryAfter},
+		},
+	})
+	spec.Describe("POST", "/auth/token/refresh", &openapi.Operation{
+		OperationId: "refreshTokens",
+		Summary:     "Trade a refresh token for a new access token and refresh token",
+		Description: "Each refresh token works once. Presenting one again revokes every token descended from the same login.",
+		Tags:        []string{"auth"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(refreshRequest)},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The new tokens", Content: openapi.JSON(tokenResponse)},
+			"401": {Description: "The refresh token is unknown, expired, revoked or was already used"},
+			"429": {Description: "Too many attempts from this address", Headers: retryAfter},
+		},
+	})
+	spec.Describe("POST", "/auth/token/revoke", &openapi.Operation{
+		OperationId: "revokeRefreshToken",
+		Summary:     "Revoke a refresh token and every token descended from the same login",
+		Description: "Access tokens already issued stay valid until they expire.",
+		Tags:        []string{"auth"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(refreshRequest)},
+		Responses: map[string]*openapi.Response{
+			"204": {Description: "The refresh token no longer works"},
+		},
+	})
+	spec.Describe("GET", "/.well-known/jwks.json", &openapi.Operation{
+		OperationId: "getJwks",
+		Summary:     "Public keys the access tokens are signed with",
+		Tags:        []string{"auth"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "A JSON Web Key Set", Content: openapi.JSON(jwks)},
+		},
+	})
+	apiKey := spec.Schema("APIKey", APIKey{})
+	newAPIKey := spec.Schema("NewAPIKey", NewAPIKey{})
+	createdAPIKey := spec.Schema("CreatedAPIKey", CreatedAPIKey{})
+	spec.Secure("/auth/keys")
+	spec.Describe("GET", "/auth/keys", &openapi.Operation{
+		OperationId: "getAPIKeys",
+		Summary:     "API keys of the caller",
+		Tags:        []string{"auth"},
+		Parameters: []*openapi.Parameter{
+			openapi.Query("owner", "List the keys of this user instead, for admins", &openapi.Schema{Type: "string"}, false),
+		},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The keys, newest first", Content: openapi.JSON(openapi.ArrayOf(apiKey))},
+			"403": {Description: "The request is made with an API key, or another user's keys were asked for by a non-admin"},
+		},
+	})
+	spec.Describe("POST", "/auth/keys", &openapi.Operation{
+		OperationId: "createAPIKey",
+		Summary:     "Create an API key",
+		Description: "Scopes are read, place and admin. Only admins can create admin keys. The key is only ever returned here.",
+		Tags:        []string{"auth"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(newAPIKey)},
+		Responses: map[string]*openapi.Response{
+			"201": {Description: "The key", Content: openapi.JSON(createdAPIKey)},
+			"400": {Description: "The name, scopes, rate limit or expiry are invalid"},
+			"403": {Description: "The request is made with an API key, or asks for the admin scope without being an admin"},
+		},
+	})
+	spec.Describe("DELETE", "/auth/keys/{id}", &openapi.Operation{
+		OperationId: "revokeAPIKey",
+		Summary:     "Revoke an API key",
+		Tags:        []string{"auth"},
+		Responses: map[string]*openapi.Response{
+			"204": {Description: "The key no longer works"},
+			"404": {Description: "The caller has no such key"},
+		},
+	})
+	providerInfo := spec.Schema("OIDCProviderInfo", OIDCProviderInfo{})
+	identity := spec.Schema("Identity", Identity{})
+	linkResponse := spec.Schema("OIDCLinkResponse", OIDCLinkResponse{})
+	redirect := openapi.Query("redirect", "Path of the frontend to come back to", &openapi.Schema{Type: "string"}, false)
+	spec.Describe("GET", "/auth/oidc", &openapi.Operation{
+		OperationId: "getOIDCProviders",
+		Summary:     "OpenID Connect providers accounts can log in with",
+		Tags:        []string{"auth"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The providers", Content: openapi.JSON(openapi.ArrayOf(providerInfo))},
+		},
+	})
+	spec.Describe("GET", "/auth/oidc/{provider}/login", &openapi.Operation{
+		OperationId: "oidcLogin",
+		Summary:     "Log in at a provider",
+		Description: "Sends the browser to the provider with a PKCE challenge. An identity logging in for the first time gets a new account without a password.",
+		Tags:        []string{"auth"},
+		Parameters:  []*openapi.Parameter{redirect},
+		Responses: map[string]*openapi.Response{
+			"302": {Description: "Off to the provider"},
+			"404": {Description: "No such provider"},
+			"429": {Description: "Too many attempts from this address", Headers: retryAfter},
+			"502": {Description: "The discovery document of the provider could not be read"},
+		},
+	})
+	spec.Describe("GET", "/auth/oidc/{provider}/callback", &openapi.Operation{
+		OperationId: "oidcCallback",
+		Summary:     "Where the provider sends the browser back to",
+		Description: "Logs in with a session cookie, or links the identity when the flow was started at /auth/identities/{provider}/link, then redirects to the frontend.",
+		Tags:        []string{"auth"},
+		Parameters: []*openapi.Parameter{
+			openapi.Query("code", "Authorization code", &openapi.Schema{Type: "string"}, false),
+			openapi.Query("state", "State of the flow", &openapi.Schema{Type: "string"}, true),
+		},
+		Responses: map[string]*openapi.Response{
+			"302": {Description: "Back to the frontend"},
+			"400": {Description: "The flow is missing, expired or does not match"},
+			"401": {Description: "The provider refused the login or the ID token is not valid"},
+			"409": {Description: "The identity is linked to another account, or the account has one from this provider"},
+			"502": {Description: "The code could not be exchanged"},
+		},
+	})
+	spec.Secure("/auth/identities")
+	spec.Describe("GET", "/auth/identities", &openapi.Operation{
+		OperationId: "getIdentities",
+		Summary:     "Identities linked to the caller's account",
+		Tags:        []string{"auth"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The identities", Content: openapi.JSON(openapi.ArrayOf(identity))},
+		},
+	})
+	spec.Describe("POST", "/auth/identities/{provider}/link", &openapi.Operation{
+		OperationId: "linkIdentity",
+		Summary:     "Start linking an identity at a provider to the caller's account",
+		Tags:        []string{"auth"},
+		Parameters:  []*openapi.Parameter{redirect},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "Where to send the browser", Content: openapi.JSON(linkResponse)},
+			"403": {Description: "The request is made with an API key"},
+			"404": {Description: "No such provider"},
+		},
+	})
+	spec.Describe("DELETE", "/auth/identities/{provider}", &openapi.Operation{
+		OperationId: "unlinkIdentity",
+		Summary:     "Unlink the caller's identity at a provider",
+		Tags:        []string{"auth"},
+		Responses: map[string]*openapi.Response{
+			"204": {Description: "The identity no longer logs in"},
+			"404": {Description: "The caller has no identity at the provider"},
+			"409": {Description: "It is the only way into an account without a password"},
+		},
+	})
+	session := spec.Schema("Session", Session{})
+	logout := spec.Schema("LogoutRequest", LogoutRequest{})
+	spec.Secure("/auth/logout")
+	spec.Secure("/auth/sessions")
+	spec.Describe("POST", "/auth/logout", &openapi.Operation{
+		OperationId: "logout",
+		Summary:     "Revoke the token the request is made with, or every token of its user",
+		Description: "Logging out everywhere also revokes the refresh tokens. Callers using a JWT can only log out everywhere.",
+		Tags:        []string{"auth"},
+		RequestBody: &openapi.RequestBody{Content: openapi.JSON(logout)},
+		Responses: map[string]*openapi.Response{
+			"204": {Description: "The tokens are revoked"},
+			"400": {Description: "The caller uses a JWT and did not ask to log out everywhere"},
+			"401": {Description: "The token is missing, expired or already revoked"},
+			"403": {Description: "The caller uses an API key"},
+		},
+	})
+	spec.Describe("GET", "/auth/sessions", &openapi.Operation{
+		OperationId: "getSessions",
+		Summary:     "Live tokens of the caller",
+		Tags:        []string{"auth"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The sessions, newest first", Content: openapi.JSON(openapi.ArrayOf(session))},
+			"401": {Description: "The token is missing, expired or revoked"},
+		},
+	})
+	spec.Describe("DELETE", "/auth/sessions/{id}", &openapi.Operation{
+		OperationId: "revokeSession",
+		Summary:     "Revoke one of the caller's sessions",
+		Tags:        []string{"auth"},
+		Responses: map[string]*openapi.Response{
+			"204": {Description: "The session is logged out"},
+			"401": {Description: "The token is missing, expired or revoked"},
+			"404": {Description: "The caller has no such session"},
+		},
+	})
+	spec.Describe("GET", "/auth/ping", &openapi.Operation{
+		OperationId: "authPing",
+		Tags:        []string{"auth"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The auth service is up"},
+		},
+	})
+	spec.Secure("/auth/admin")
+	spec.Describe("GET", "/auth/admin/lockouts", &openapi.Operation{
+		OperationId: "getLockouts",
+		Summary:     "Usernames locked after failed logins",
+		Description: "Usernames without an account are tracked and locked the same way, so they can show up here.",
+		Tags:        []string{"auth"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The locked usernames", Content: openapi.JSON(openapi.ArrayOf(loginFailures))},
+			"403": {Description: "The caller is not an admin"},
+		},
+	})
+	spec.Describe("DELETE", "/auth/admin/lockouts/{username}", &openapi.Operation{
+		OperationId: "unlockAccount",
+		Summary:     "Lift a lock and forget the failed logins of a username",
+		Tags:        []string{"auth"},
+		Responses: map[string]*openapi.Response{
+			"204": {Description: "The username can log in again"},
+			"403": {Description: "The caller is not an admin"},
+		},
+	})
+	spec.Describe("GET", "/auth/admin/audit", &openapi.Operation{
+		OperationId: "getAudit",
+		Summary:     "Latest account lock and unlock events",
+		Tags:        []string{"auth"},
+		Parameters: []*openapi.Parameter{
+			openapi.Query("username", "Only events about this username", &openapi.Schema{Type: "string"}, false),
+			openapi.Query("limit", "Most events to return, 100 by default", &openapi.Schema{Type: "integer"}, false),
+		},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The events, newest first", Content: openapi.JSON(openapi.ArrayOf(auditEntry))},
+			"403": {Description: "The caller is not an admin"},
+		},
+	})
+}
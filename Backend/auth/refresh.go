@@ -0,0 +1,347 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	refreshSk    = "REFRESH"
+	familyPrefix = "REFRESHFAMILY#"
+	refreshTTL   = 30 * 24 * time.Hour
+)
+
+var ErrRefreshReused = errors.New("refresh token was already used")
+
+// RefreshTokens keeps the refresh tokens handed out with access tokens.
+// Every refresh replaces the token with a new one of the same family. A
+// token presented twice means it was copied, so its whole family is
+// revoked. Families live in the USER# partition of their owner, which is
+// how a user is logged out everywhere. Only hashes of the tokens are
+// stored.
+type RefreshTokens struct {
+	DbCli     *dynamodb.Client
+	TableName *string
+	TTL       time.Duration
+}
+
+func NewRefreshTokens(DbCli *dynamodb.Client, tableName *string) *RefreshTokens {
+	return &RefreshTokens{
+		DbCli:     DbCli,
+		TableName: tableName,
+		TTL:       refreshTTL,
+	}
+}
+
+type refreshToken struct {
+	Username  string `dynamodbav:"username"`
+	Family    string `dynamodbav:"family"`
+	Used      bool   `dynamodbav:"used"`
+	ExpiresAt int64  `dynamodbav:"expires_at"`
+}
+
+func refreshPk(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "REFRESH#" + hex.EncodeToString(sum[:])
+}
+
+func familyKey(username string, family string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: "USER#" + username},
+		"SK": &types.AttributeValueMemberS{Value: familyPrefix + family},
+	}
+}
+
+// Issue starts a new family for username and returns its first token.
+func (t *RefreshTokens) Issue(ctx context.Context, username string) (string, time.Time, error) {
+	family := uuid.New().String()
+	expires := time.Now().Add(t.TTL)
+
+	item := familyKey(username, family)
+	item["expires_at"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(expires.Unix(), 10)}
+	_, err := t.DbCli.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: t.TableName,
+		Item:      item,
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return t.next(ctx, username, family, expires)
+}
+
+func (t *RefreshTokens) next(ctx context.Context, username string, family string, expires time.Time) (string, time.Time, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+
+	_, err = t.DbCli.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: t.TableName,
+		Item: map[string]types.AttributeValue{
+			"PK":         &types.AttributeValueMemberS{Value: refreshPk(token)},
+			"SK":         &types.AttributeValueMemberS{Value: refreshSk},
+			"username":   &types.AttributeValueMemberS{Value: username},
+			"family":     &types.AttributeValueMemberS{Value: family},
+			"used":       &types.AttributeValueMemberBOOL{Value: false},
+			"expires_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(expires.Unix(), 10)},
+		},
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expires, nil
+}
+
+func (t *RefreshTokens) get(ctx context.Context, token string) (*refreshToken, error) {
+	out, err := t.DbCli.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: t.TableName,
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: refreshPk(token)},
+			"SK": &types.AttributeValueMemberS{Value: refreshSk},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out.Item == nil {
+		return nil, ErrInvalidToken
+	}
+
+	var found refreshToken
+	err = attributevalue.UnmarshalMap(out.Item, &found)
+	if err != nil {
+		return nil, err
+	}
+	// Expired items linger until the table TTL gets to them.
+	if time.Now().Unix() > found.ExpiresAt {
+		return nil, ErrInvalidToken
+	}
+	return &found, nil
+}
+
+// Rotate spends token and returns the username it belongs to along with
+// its replacement.
+func (t *RefreshTokens) Rotate(ctx context.Context, token string) (string, string, time.Time, error) {
+	found, err := t.get(ctx, token)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	_, err = t.DbCli.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: t.TableName,
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: refreshPk(token)},
+			"SK": &types.AttributeValueMemberS{Value: refreshSk},
+		},
+		UpdateExpression:    aws.String("SET #used = :true"),
+		ConditionExpression: aws.String("#used = :false"),
+		ExpressionAttributeNames: map[string]string{
+			"#used": "used",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":true":  &types.AttributeValueMemberBOOL{Value: true},
+			":false": &types.AttributeValueMemberBOOL{Value: false},
+		},
+	})
+	if errors.As(err, &conditionFailed) {
+		err = t.RevokeFamily(ctx, found.Username, found.Family)
+		if err != nil {
+			log.Printf("could not revoke the refresh tokens of %s after a reuse: %s", found.Username, err.Error())
+		}
+		return "", "", time.Time{}, ErrRefreshReused
+	}
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	// The family is gone once it is revoked, which stops the rest of its
+	// tokens here.
+	expires := time.Now().Add(t.TTL)
+	_, err = t.DbCli.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           t.TableName,
+		Key:                 familyKey(found.Username, found.Family),
+		UpdateExpression:    aws.String("SET expires_at = :expires"),
+		ConditionExpression: aws.String("attribute_exists(PK)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":expires": &types.AttributeValueMemberN{Value: strconv.FormatInt(expires.Unix(), 10)},
+		},
+	})
+	if errors.As(err, &conditionFailed) {
+		return "", "", time.Time{}, ErrInvalidToken
+	}
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	next, expires, err := t.next(ctx, found.Username, found.Family, expires)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	return found.Username, next, expires, nil
+}
+
+// Revoke revokes the family of token.
+func (t *RefreshTokens) Revoke(ctx context.Context, token string) error {
+	found, err := t.get(ctx, token)
+	if err != nil {
+		return err
+	}
+	return t.RevokeFamily(ctx, found.Username, found.Family)
+}
+
+func (t *RefreshTokens) RevokeFamily(ctx context.Context, username string, family string) error {
+	_, err := t.DbCli.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: t.TableName,
+		Key:       familyKey(username, family),
+	})
+	return err
+}
+
+// RevokeAll revokes every refresh token of username.
+func (t *RefreshTokens) RevokeAll(ctx context.Context, username string) error {
+	paginator := dynamodb.NewQueryPaginator(t.DbCli, &dynamodb.QueryInput{
+		TableName:              t.TableName,
+		KeyConditionExpression: aws.String("#PK = :user AND begins_with(#SK, :prefix)"),
+		ExpressionAttributeNames: map[string]string{
+			"#PK": "PK",
+			"#SK": "SK",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":user":   &types.AttributeValueMemberS{Value: "USER#" + username},
+			":prefix": &types.AttributeValueMemberS{Value: familyPrefix},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, item := range page.Items {
+			_, err = t.DbCli.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+				TableName: t.TableName,
+				Key: map[string]types.AttributeValue{
+					"PK": item["PK"],
+					"SK": item["SK"],
+				},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// TokenResponse is an access token with the refresh token that replaces
+// it once it expires.
+type TokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int64  `json:"refresh_expires_in"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// writeTokens answers with a new access token for username next to
+// refresh. Whether it is an admin is read from the account each time, so
+// that a change reaches the next refresh.
+func (s *Server) writeTokens(w http.ResponseWriter, r *http.Request, username string, refresh string, refreshExpires time.Time) {
+	user, err := s.findUser(r.Context(), username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	access, expires, err := s.Signer.Sign(username, user != nil && user.Admin)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	w.Header().Set("Cache-Control", "no-store")
+	writeJson(w, http.StatusOK, TokenResponse{
+		AccessToken:      access,
+		TokenType:        "Bearer",
+		ExpiresIn:        int64(expires.Sub(now).Seconds()),
+		RefreshToken:     refresh,
+		RefreshExpiresIn: int64(refreshExpires.Sub(now).Seconds()),
+	})
+}
+
+// IssueTokens logs in with a username and password and returns a signed
+// access token with a refresh token.
+func (s *Server) IssueTokens(w http.ResponseWriter, r *http.Request) {
+	user, err := s.IsValidUser(r)
+	if writeLoginError(w, err) {
+		return
+	}
+
+	refresh, refreshExpires, err := s.Refresh.Issue(r.Context(), user.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.writeTokens(w, r, user.Username, refresh, refreshExpires)
+}
+
+// RefreshAccessToken trades a refresh token for a new pair.
+func (s *Server) RefreshAccessToken(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	username, refresh, refreshExpires, err := s.Refresh.Rotate(r.Context(), req.RefreshToken)
+	if errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrRefreshReused) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.writeTokens(w, r, username, refresh, refreshExpires)
+}
+
+// RevokeRefreshToken logs out the session a refresh token belongs to.
+// Access tokens already handed out stay valid until they expire.
+func (s *Server) RevokeRefreshToken(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.Refresh.Revoke(r.Context(), req.RefreshToken)
+	if err != nil && !errors.Is(err, ErrInvalidToken) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
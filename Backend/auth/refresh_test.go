@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"github.com/Jonathanpatta/rplace/internal/dynamotest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"testing"
+	"time"
+)
+
+func newTestRefreshTokens(t *testing.T) *RefreshTokens {
+	t.Helper()
+	table := dynamotest.Start()
+	t.Cleanup(table.Close)
+	return NewRefreshTokens(table.Client(), aws.String("Place-Clone"))
+}
+
+func TestRefreshRotate(t *testing.T) {
+	tokens := newTestRefreshTokens(t)
+	ctx := context.Background()
+
+	first, _, err := tokens.Issue(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := tokens.Issue(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each step presents the token of an earlier one, by name.
+	issued := map[string]string{"first": first, "other": other, "unknown": "not-a-token"}
+	tests := []struct {
+		name    string
+		present string
+		err     error
+	}{
+		{"second", "first", nil},
+		{"third", "second", nil},
+		{"unknown token", "unknown", ErrInvalidToken},
+		// Presenting a spent token revokes its family.
+		{"reused", "first", ErrRefreshReused},
+		{"after the reuse", "third", ErrInvalidToken},
+		{"reused again", "second", ErrRefreshReused},
+		{"other family", "other", nil},
+	}
+	for _, test := range tests {
+		username, next, _, err := tokens.Rotate(ctx, issued[test.present])
+		if !errors.Is(err, test.err) {
+			t.Fatalf("%s: got %v, want %v", test.name, err, test.err)
+		}
+		if err == nil {
+			if username != "alice" || next == "" || next == issued[test.present] {
+				t.Fatalf("%s: got %q, %q", test.name, username, next)
+			}
+			issued[test.name] = next
+		}
+	}
+}
+
+func TestRefreshRevoke(t *testing.T) {
+	tokens := newTestRefreshTokens(t)
+	ctx := context.Background()
+	issue := func(username string) string {
+		token, _, err := tokens.Issue(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	revoked := issue("alice")
+	kept := issue("alice")
+	err := tokens.Revoke(ctx, revoked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = tokens.Rotate(ctx, revoked); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("revoked token: got %v", err)
+	}
+	_, kept, _, err = tokens.Rotate(ctx, kept)
+	if err != nil {
+		t.Fatalf("token of another family: %v", err)
+	}
+
+	bob := issue("bob")
+	err = tokens.RevokeAll(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = tokens.Rotate(ctx, kept); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("token after logging out everywhere: got %v", err)
+	}
+	if _, _, _, err = tokens.Rotate(ctx, bob); err != nil {
+		t.Fatalf("token of another user: %v", err)
+	}
+}
+
+func TestRefreshExpired(t *testing.T) {
+	tokens := newTestRefreshTokens(t)
+	tokens.TTL = -time.Minute
+
+	token, _, err := tokens.Issue(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = tokens.Rotate(context.Background(), token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidToken)
+	}
+}
@@ -0,0 +1,493 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/Jonathanpatta/rplace/broker"
+	"github.com/Jonathanpatta/rplace/cache"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// touchInterval is how often the last use of a token is written back.
+// Without a broker, it also bounds how long another instance keeps
+// accepting a revoked token from its cache.
+const touchInterval = time.Minute
+
+// revocationTopic carries the tokens revoked on one instance to the
+// others, for them to evict.
+const revocationTopic = "rplace:revocations"
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// Tokens keeps the opaque tokens handed out on login. Each token has its
+// own TOKEN# item, which the middleware looks it up by, and a pointer in
+// the USER# partition of its owner, which its sessions are listed from.
+// Looked up tokens are kept in the leveldb cache, and revoking one evicts
+// it there right away, and from the caches of the instances sharing Broker
+// once they hear of it.
+type Tokens struct {
+	DbCli     *dynamodb.Client
+	TableName *string
+	Cache     *cache.Client
+	Broker    broker.Broker
+}
+
+func NewTokens(DbCli *dynamodb.Client, tableName *string, c *cache.Client) *Tokens {
+	return &Tokens{
+		DbCli:     DbCli,
+		TableName: tableName,
+		Cache:     c,
+	}
+}
+
+// Session describes a token to its owner without giving the token away.
+type Session struct {
+	Id        string `json:"id"`
+	CreatedAt int64  `json:"created_at"`
+	ValidTill int64  `json:"valid_till"`
+	LastUsed  int64  `json:"last_used,omitempty"`
+	Current   bool   `json:"current,omitempty"`
+}
+
+// SessionId is the public name of a token.
+func SessionId(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (t *Tokens) cacheKey(token string) string {
+	return "TOKEN#" + token
+}
+
+func (t *Tokens) evict(token string) {
+	if t.Cache != nil {
+		t.Cache.Delete(t.cacheKey(token))
+	}
+}
+
+// evictAll empties the cache of tokens, which are read from the table
+// again as they are used.
+func (t *Tokens) evictAll() {
+	if t.Cache == nil {
+		return
+	}
+	keys, err := t.Cache.Keys(t.cacheKey(""))
+	if err != nil {
+		log.Println("could not list the cached tokens:", err.Error())
+		return
+	}
+	for key := range keys {
+		t.Cache.Delete(key)
+	}
+}
+
+// announce tells the other instances that token was revoked. The token is
+// worthless by then, so it is sent as it is.
+func (t *Tokens) announce(token string) {
+	if t.Broker == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := t.Broker.Publish(ctx, revocationTopic, []byte(token))
+	if err != nil {
+		log.Println("could not publish a token revocation to the broker:", err.Error())
+	}
+}
+
+// RunRevocations evicts the tokens other instances revoke until ctx is
+// done. When the broker lost some, every cached token is evicted.
+func (t *Tokens) RunRevocations(ctx context.Context) error {
+	if t.Broker == nil {
+		return nil
+	}
+
+	revocations, err := t.Broker.Subscribe(ctx, revocationTopic)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for message := range revocations {
+			t.applyRevocation(message)
+		}
+	}()
+	return nil
+}
+
+func (t *Tokens) applyRevocation(message broker.Message) {
+	if message.Lost {
+		t.evictAll()
+		return
+	}
+	t.evict(string(message.Payload))
+}
+
+// Issue hands out a new token to username.
+func (t *Tokens) Issue(ctx context.Context, username string) (*Token, error) {
+	token := GenerateNewToken()
+	token.Username = username
+	token.CreatedAt = time.Now().Unix()
+	token.CreatePk()
+
+	validTill := strconv.FormatInt(token.ValidTill, 10)
+	_, err := t.DbCli.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Put: &types.Put{
+				TableName: t.TableName,
+				Item: map[string]types.AttributeValue{
+					"PK":         &types.AttributeValueMemberS{Value: token.PK},
+					"SK":         &types.AttributeValueMemberS{Value: validTill},
+					"token":      &types.AttributeValueMemberS{Value: token.Token},
+					"username":   &types.AttributeValueMemberS{Value: username},
+					"created_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(token.CreatedAt, 10)},
+					"valid_till": &types.AttributeValueMemberN{Value: validTill},
+					"last_used":  &types.AttributeValueMemberN{Value: "0"},
+					"expires_at": &types.AttributeValueMemberN{Value: validTill},
+				},
+			}},
+			{Put: &types.Put{
+				TableName: t.TableName,
+				Item: map[string]types.AttributeValue{
+					"PK":         &types.AttributeValueMemberS{Value: "USER#" + username},
+					"SK":         &types.AttributeValueMemberS{Value: token.PK},
+					"token":      &types.AttributeValueMemberS{Value: token.Token},
+					"expires_at": &types.AttributeValueMemberN{Value: validTill},
+				},
+			}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (t *Tokens) get(ctx context.Context, token string) (*Token, error) {
+	out, err := t.DbCli.Query(ctx, &dynamodb.QueryInput{
+		TableName:              t.TableName,
+		KeyConditionExpression: aws.String("#PK = :token"),
+		ExpressionAttributeNames: map[string]string{
+			"#PK": "PK",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":token": &types.AttributeValueMemberS{Value: "TOKEN#" + token},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Items) != 1 {
+		return nil, ErrInvalidToken
+	}
+
+	var found Token
+	err = attributevalue.UnmarshalMap(out.Items[0], &found)
+	if err != nil {
+		return nil, err
+	}
+	found.CreatePk()
+	return &found, nil
+}
+
+// Lookup returns a valid token, from the cache when it is there. Tokens
+// that are unknown, expired or revoked give ErrInvalidToken.
+func (t *Tokens) Lookup(ctx context.Context, token string) (*Token, error) {
+	if !(&Token{Token: token, ValidTill: time.Now().Unix()}).IsValid() {
+		return nil, ErrInvalidToken
+	}
+
+	var found Token
+	err := ErrInvalidToken
+	if t.Cache != nil {
+		err = t.Cache.Get(t.cacheKey(token), &found)
+	}
+	if err != nil {
+		stored, err := t.get(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		found = *stored
+		if t.Cache != nil {
+			t.Cache.Put(t.cacheKey(token), found)
+		}
+	}
+
+	if !found.IsValid() {
+		t.evict(token)
+		return nil, ErrInvalidToken
+	}
+	return &found, nil
+}
+
+// Touch records a use of token, writing it back at most once every
+// touchInterval. A token that has since been revoked elsewhere is found out
+// here and evicted.
+func (t *Tokens) Touch(ctx context.Context, token *Token) error {
+	now := time.Now()
+	if now.Unix()-token.LastUsed < int64(touchInterval/time.Second) {
+		return nil
+	}
+
+	token.CreatePk()
+	_, err := t.DbCli.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: t.TableName,
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: token.PK},
+			"SK": &types.AttributeValueMemberS{Value: strconv.FormatInt(token.ValidTill, 10)},
+		},
+		UpdateExpression:    aws.String("SET last_used = :now"),
+		ConditionExpression: aws.String("attribute_exists(PK)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		t.evict(token.Token)
+		return ErrInvalidToken
+	}
+	if err != nil {
+		return err
+	}
+
+	token.LastUsed = now.Unix()
+	if t.Cache != nil {
+		t.Cache.Put(t.cacheKey(token.Token), *token)
+	}
+	return nil
+}
+
+// Revoke deletes token and evicts it from the cache, announcing it to the
+// other instances.
+func (t *Tokens) Revoke(ctx context.Context, token *Token) error {
+	token.CreatePk()
+	t.evict(token.Token)
+
+	items := []types.TransactWriteItem{
+		{Delete: &types.Delete{
+			TableName: t.TableName,
+			Key: map[string]types.AttributeValue{
+				"PK": &types.AttributeValueMemberS{Value: token.PK},
+				"SK": &types.AttributeValueMemberS{Value: strconv.FormatInt(token.ValidTill, 10)},
+			},
+		}},
+	}
+	if token.Username != "" {
+		items = append(items, types.TransactWriteItem{Delete: &types.Delete{
+			TableName: t.TableName,
+			Key: map[string]types.AttributeValue{
+				"PK": &types.AttributeValueMemberS{Value: "USER#" + token.Username},
+				"SK": &types.AttributeValueMemberS{Value: token.PK},
+			},
+		}})
+	}
+
+	_, err := t.DbCli.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		return err
+	}
+	// Announced only once it is gone from the table, so that no instance
+	// reads it back into its cache afterwards.
+	t.announce(token.Token)
+	return nil
+}
+
+// List returns the live tokens of username.
+func (t *Tokens) List(ctx context.Context, username string) ([]Token, error) {
+	var tokens []Token
+	paginator := dynamodb.NewQueryPaginator(t.DbCli, &dynamodb.QueryInput{
+		TableName:              t.TableName,
+		KeyConditionExpression: aws.String("#PK = :user AND begins_with(#SK, :prefix)"),
+		ExpressionAttributeNames: map[string]string{
+			"#PK": "PK",
+			"#SK": "SK",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":user":   &types.AttributeValueMemberS{Value: "USER#" + username},
+			":prefix": &types.AttributeValueMemberS{Value: "TOKEN#"},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			value, ok := item["token"].(*types.AttributeValueMemberS)
+			if !ok {
+				continue
+			}
+			token, err := t.get(ctx, value.Value)
+			if errors.Is(err, ErrInvalidToken) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if token.IsValid() {
+				tokens = append(tokens, *token)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// RevokeAll revokes every token of username, logging it out everywhere.
+func (t *Tokens) RevokeAll(ctx context.Context, username string) error {
+	tokens, err := t.List(ctx, username)
+	if err != nil {
+		return err
+	}
+	for i := range tokens {
+		err = t.Revoke(ctx, &tokens[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SessionName is the cookie session a browser's token is kept in.
+const SessionName = "Token"
+
+// forgetSession clears the cookie session of a browser logging out.
+func (s *Server) forgetSession(w http.ResponseWriter, r *http.Request) {
+	if s.SessionsStore == nil {
+		return
+	}
+	session, err := s.SessionsStore.Get(r, SessionName)
+	if err != nil || session.IsNew {
+		return
+	}
+	session.Options.MaxAge = -1
+	session.Save(r, w)
+}
+
+type LogoutRequest struct {
+	// Everywhere revokes every token of the user instead of only the one
+	// the request is made with.
+	Everywhere bool `json:"everywhere,omitempty"`
+}
+
+// logoutEverywhere revokes every opaque token and refresh token family of
+// username. Its sessions, cookie ones included, are opaque tokens.
+func (s *Server) logoutEverywhere(ctx context.Context, username string) error {
+	err := s.Tokens.RevokeAll(ctx, username)
+	if err != nil {
+		return err
+	}
+	return s.Refresh.RevokeAll(ctx, username)
+}
+
+// Logout revokes the opaque token the request is made with. A JWT expires
+// on its own, so a caller using one can only log out everywhere.
+func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.caller(w, r)
+	if !ok {
+		return
+	}
+
+	var req LogoutRequest
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.Everywhere {
+		err := s.logoutEverywhere(r.Context(), c.Id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.forgetSession(w, r)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if c.Token == "" {
+		http.Error(w, "only opaque tokens can be logged out alone; revoke the refresh token or log out everywhere", http.StatusBadRequest)
+		return
+	}
+	token, err := s.Tokens.Lookup(r.Context(), c.Token)
+	if errors.Is(err, ErrInvalidToken) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err == nil {
+		err = s.Tokens.Revoke(r.Context(), token)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.forgetSession(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) GetSessions(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.caller(w, r)
+	if !ok {
+		return
+	}
+
+	tokens, err := s.Tokens.List(r.Context(), c.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sessions := make([]Session, 0, len(tokens))
+	for _, t := range tokens {
+		sessions = append(sessions, t.Session(c.Token))
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt > sessions[j].CreatedAt
+	})
+	writeJson(w, http.StatusOK, sessions)
+}
+
+// RevokeSession logs out one of the caller's other sessions by its id.
+func (s *Server) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	c, ok := s.caller(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	tokens, err := s.Tokens.List(r.Context(), c.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range tokens {
+		if SessionId(tokens[i].Token) != id {
+			continue
+		}
+		err = s.Tokens.Revoke(r.Context(), &tokens[i])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	http.Error(w, "session not found", http.StatusNotFound)
+}
@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"github.com/Jonathanpatta/rplace/broker"
+	"github.com/Jonathanpatta/rplace/cache"
+	"github.com/Jonathanpatta/rplace/internal/dynamotest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"testing"
+	"time"
+)
+
+// newInstanceTokens returns the tokens of one instance, with a cache of its
+// own, subscribed to revocations on b.
+func newInstanceTokens(t *testing.T, table *dynamotest.StandIn, b broker.Broker) *Tokens {
+	t.Helper()
+	c, err := cache.NewClient(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.DbCli.Close() })
+
+	tokens := NewTokens(table.Client(), aws.String("Place-Clone"), c)
+	tokens.Broker = b
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	err = tokens.RunRevocations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+func TestRevokeReachesOtherInstances(t *testing.T) {
+	table := dynamotest.Start()
+	defer table.Close()
+	b := broker.NewMemoryBroker()
+	defer b.Close()
+	revoking := newInstanceTokens(t, table, b)
+	other := newInstanceTokens(t, table, b)
+	ctx := context.Background()
+
+	token, err := revoking.Issue(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := revoking.Issue(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The other instance caches both and would not check the table again
+	// for a minute.
+	for _, tok := range []*Token{token, kept} {
+		found, err := other.Lookup(ctx, tok.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = other.Touch(ctx, found)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = revoking.Revoke(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err = other.Lookup(ctx, token.Token)
+		if errors.Is(err, ErrInvalidToken) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("revoked token still accepted: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err = other.Lookup(ctx, kept.Token); err != nil {
+		t.Fatalf("token that was not revoked: %v", err)
+	}
+}
+
+func TestLostRevocationsEvictEveryToken(t *testing.T) {
+	table := dynamotest.Start()
+	defer table.Close()
+	tokens := newInstanceTokens(t, table, nil)
+	ctx := context.Background()
+
+	token, err := tokens.Issue(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tokens.Lookup(ctx, token.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens.applyRevocation(broker.Message{Lost: true})
+	var cached Token
+	if err = tokens.Cache.Get(tokens.cacheKey(token.Token), &cached); err == nil {
+		t.Fatal("token still cached after revocations were lost")
+	}
+	if _, err = tokens.Lookup(ctx, token.Token); err != nil {
+		t.Fatalf("token read back from the table: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package broker
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Broker carries messages between server instances. Every subscriber of a
+// topic receives the messages published to it after it subscribed,
+// including the ones its own instance published, or learns that it lost
+// some.
+type Broker interface {
+	Publish(ctx context.Context, topic string, payload []byte) error
+	// Subscribe delivers the messages of topic on the returned channel until
+	// ctx is done, after which the channel is closed.
+	Subscribe(ctx context.Context, topic string) (<-chan Message, error)
+	Close() error
+}
+
+// Message is what a subscription delivers. A message with Lost set carries
+// no payload: it takes the place of messages the subscriber missed, because
+// it fell behind or its connection to the broker dropped, and tells it to
+// catch up some other way.
+type Message struct {
+	Payload []byte
+	Lost    bool
+}
+
+// bufferSize is how many messages a subscriber may fall behind by before
+// it loses some.
+const bufferSize = 256
+
+// MemoryBroker is a Broker for a single process. Slow subscribers lose
+// messages instead of blocking publishers.
+type MemoryBroker struct {
+	mu     sync.RWMutex
+	topics map[string]map[*memorySubscriber]struct{}
+}
+
+type memorySubscriber struct {
+	ch chan Message
+	// lost is 1 when messages were dropped since the last one delivered.
+	lost int32
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		topics: make(map[string]map[*memorySubscriber]struct{}),
+	}
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, topic string, payload []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for sub := range b.topics[topic] {
+		// A subscriber that lost messages hears about it before it gets
+		// the next one.
+		if atomic.LoadInt32(&sub.lost) == 1 {
+			select {
+			case sub.ch <- Message{Lost: true}:
+				atomic.StoreInt32(&sub.lost, 0)
+			default:
+				continue
+			}
+		}
+
+		select {
+		case sub.ch <- Message{Payload: payload}:
+		default:
+			atomic.StoreInt32(&sub.lost, 1)
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(ctx context.Context, topic string) (<-chan Message, error) {
+	sub := &memorySubscriber{ch: make(chan Message, bufferSize)}
+
+	b.mu.Lock()
+	if b.topics[topic] == nil {
+		b.topics[topic] = make(map[*memorySubscriber]struct{})
+	}
+	b.topics[topic][sub] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(b.topics[topic], sub)
+		b.mu.Unlock()
+		close(sub.ch)
+	}()
+
+	return sub.ch, nil
+}
+
+func (b *MemoryBroker) Close() error {
+	return nil
+}
@@ -0,0 +1,165 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"github.com/Jonathanpatta/rplace/internal/brokertest"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, messages <-chan Message) Message {
+	t.Helper()
+	select {
+	case msg, ok := <-messages:
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message arrived")
+	}
+	return Message{}
+}
+
+func expectPayload(t *testing.T, messages <-chan Message, want string) {
+	t.Helper()
+	msg := receive(t, messages)
+	if msg.Lost || string(msg.Payload) != want {
+		t.Fatalf("got %+v, want payload %q", msg, want)
+	}
+}
+
+func newStandIn(t *testing.T) *brokertest.StandIn {
+	t.Helper()
+	standIn, err := brokertest.ListenStandIn("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { standIn.Close() })
+	return standIn
+}
+
+func testDelivery(t *testing.T, b Broker) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first, err := b.Subscribe(ctx, "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := b.Subscribe(ctx, "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := b.Subscribe(ctx, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = b.Publish(ctx, "topic", []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		expectPayload(t, first, fmt.Sprint(i))
+		expectPayload(t, second, fmt.Sprint(i))
+	}
+	select {
+	case msg := <-other:
+		t.Fatalf("other topic got %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	for range first {
+	}
+}
+
+func TestMemoryBrokerDelivers(t *testing.T) {
+	testDelivery(t, NewMemoryBroker())
+}
+
+func TestRedisBrokerDelivers(t *testing.T) {
+	b := NewRedisBroker(newStandIn(t).Addr(), "")
+	defer b.Close()
+	testDelivery(t, b)
+}
+
+func TestMemoryBrokerReportsLostMessages(t *testing.T) {
+	b := NewMemoryBroker()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages, err := b.Subscribe(ctx, "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The subscriber does not read, so everything past its buffer is lost.
+	for i := 0; i < bufferSize+10; i++ {
+		b.Publish(ctx, "topic", []byte(fmt.Sprint(i)))
+	}
+	for i := 0; i < bufferSize; i++ {
+		expectPayload(t, messages, fmt.Sprint(i))
+	}
+
+	b.Publish(ctx, "topic", []byte("after"))
+	if msg := receive(t, messages); !msg.Lost {
+		t.Fatalf("got %+v, want the loss reported", msg)
+	}
+	expectPayload(t, messages, "after")
+}
+
+func TestRedisBrokerReportsReconnects(t *testing.T) {
+	standIn := newStandIn(t)
+	b := NewRedisBroker(standIn.Addr(), "")
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages, err := b.Subscribe(ctx, "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Publish(ctx, "topic", []byte("before"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPayload(t, messages, "before")
+
+	standIn.DropConnections()
+	if msg := receive(t, messages); !msg.Lost {
+		t.Fatalf("got %+v, want the reconnect reported", msg)
+	}
+
+	// The publishing connection was dropped as well and is dialed again.
+	err = b.Publish(ctx, "topic", []byte("after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPayload(t, messages, "after")
+}
+
+func TestRedisBrokerClosesSubscriptionWithContext(t *testing.T) {
+	b := NewRedisBroker(newStandIn(t).Addr(), "")
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	messages, err := b.Subscribe(ctx, "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	select {
+	case _, ok := <-messages:
+		if ok {
+			t.Fatal("got a message after the context was done")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription was not closed")
+	}
+}
@@ -0,0 +1,226 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/Jonathanpatta/rplace/internal/resp"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// RedisBroker is a Broker backed by Redis pub/sub, or anything else that
+// speaks its protocol. Publishing shares one connection; every Subscribe
+// holds its own and reconnects when it drops. Redis keeps nothing for a
+// subscriber that is away, so a reconnect is reported as lost messages.
+type RedisBroker struct {
+	Addr     string
+	Password string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func NewRedisBroker(addr string, password string) *RedisBroker {
+	return &RedisBroker{
+		Addr:     addr,
+		Password: password,
+	}
+}
+
+func (b *RedisBroker) dial(ctx context.Context) (net.Conn, *bufio.Reader, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", b.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+
+	if b.Password != "" {
+		err = resp.WriteCommand(conn, []byte("AUTH"), []byte(b.Password))
+		if err == nil {
+			_, err = resp.ReadReply(reader)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	return conn, reader, nil
+}
+
+func (b *RedisBroker) Publish(ctx context.Context, topic string, payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var err error
+	// A pooled connection may have been closed by the server since it was
+	// last used, so a failure on it is retried once on a fresh one.
+	for attempt := 0; attempt < 2; attempt++ {
+		if b.conn == nil {
+			b.conn, b.reader, err = b.dial(ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+		if deadline, ok := ctx.Deadline(); ok {
+			b.conn.SetDeadline(deadline)
+		} else {
+			b.conn.SetDeadline(time.Time{})
+		}
+
+		err = resp.WriteCommand(b.conn, []byte("PUBLISH"), []byte(topic), payload)
+		if err == nil {
+			_, err = resp.ReadReply(b.reader)
+		}
+		if err == nil {
+			return nil
+		}
+		var replyErr resp.Error
+		if errors.As(err, &replyErr) {
+			return err
+		}
+
+		b.conn.Close()
+		b.conn = nil
+		b.reader = nil
+	}
+	return err
+}
+
+func (b *RedisBroker) subscribe(ctx context.Context, topic string) (net.Conn, *bufio.Reader, error) {
+	conn, reader, err := b.dial(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = resp.WriteCommand(conn, []byte("SUBSCRIBE"), []byte(topic))
+	if err == nil {
+		_, err = resp.ReadReply(reader)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, reader, nil
+}
+
+func (b *RedisBroker) Subscribe(ctx context.Context, topic string) (<-chan Message, error) {
+	conn, reader, err := b.subscribe(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan Message, bufferSize)
+	go func() {
+		defer close(ch)
+
+		var mu sync.Mutex
+		current := conn
+		go func() {
+			<-ctx.Done()
+			mu.Lock()
+			current.Close()
+			mu.Unlock()
+		}()
+
+		backoff := time.Second
+		lost := false
+		for {
+			err := b.receive(ctx, reader, ch, &lost)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Println("broker: lost subscription to", topic+":", err)
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+
+				conn, reader, err = b.subscribe(ctx, topic)
+				if err == nil {
+					break
+				}
+				if backoff < 30*time.Second {
+					backoff *= 2
+				}
+			}
+			backoff = time.Second
+
+			mu.Lock()
+			current = conn
+			mu.Unlock()
+			if ctx.Err() != nil {
+				conn.Close()
+				return
+			}
+
+			select {
+			case ch <- Message{Lost: true}:
+				lost = false
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// receive forwards messages until the connection fails. Messages are dropped
+// when the subscriber falls behind, like the in-process broker does, and
+// lost is set until the subscriber has been told so.
+func (b *RedisBroker) receive(ctx context.Context, reader *bufio.Reader, ch chan<- Message, lost *bool) error {
+	for {
+		reply, err := resp.ReadReply(reader)
+		if err != nil {
+			return err
+		}
+
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 3 || resp.ReplyString(items[0]) != "message" {
+			continue
+		}
+		payload, ok := items[2].([]byte)
+		if !ok {
+			continue
+		}
+
+		if *lost {
+			select {
+			case ch <- Message{Lost: true}:
+				*lost = false
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		select {
+		case ch <- Message{Payload: payload}:
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			*lost = true
+		}
+	}
+}
+
+func (b *RedisBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn == nil {
+		return nil
+	}
+	err := b.conn.Close()
+	b.conn = nil
+	b.reader = nil
+	return err
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/gob"
 	"fmt"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 type Client struct {
@@ -79,3 +80,20 @@ func NewClient(path string) (*Client, error) {
 		Path:  path,
 	}, nil
 }
+
+// Keys lists the keys starting with prefix along with the size of their
+// encoded values.
+func (c *Client) Keys(prefix string) (map[string]int, error) {
+	keys := make(map[string]int)
+	iter := c.DbCli.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	for iter.Next() {
+		keys[string(iter.Key())] = len(iter.Value())
+	}
+	iter.Release()
+	return keys, iter.Error()
+}
+
+// GetRaw returns the gob encoding stored under key.
+func (c *Client) GetRaw(key string) ([]byte, error) {
+	return c.DbCli.Get([]byte(key), nil)
+}
@@ -0,0 +1,368 @@
+// Package challenge hands out hashcash style proof of work challenges. A
+// challenge is signed by the server, so it can be checked without keeping
+// state beyond the challenges already spent. Solving one means finding a
+// solution such that the SHA-256 of "challenge:solution" starts with
+// Difficulty zero bits.
+package challenge
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header carries a solved challenge as "challenge:solution".
+const Header = "X-Proof-Of-Work"
+
+const (
+	ScopePlace    = "place"
+	ScopeRegister = "register"
+)
+
+const (
+	// ModeOff never asks for a proof of work.
+	ModeOff = "off"
+	// ModeRisk asks risky callers, and everyone while load is high.
+	ModeRisk = "risk"
+	// ModeAlways asks every caller.
+	ModeAlways = "always"
+)
+
+const maxDifficulty = 32
+
+var (
+	ErrRequired  = errors.New("a solved challenge is required")
+	ErrMalformed = errors.New("malformed challenge")
+	ErrSignature = errors.New("challenge was not issued by this server")
+	ErrExpired   = errors.New("challenge has expired")
+	ErrScope     = errors.New("challenge was issued for something else")
+	ErrSpent     = errors.New("challenge has already been used")
+	ErrUnsolved  = errors.New("solution does not meet the difficulty")
+)
+
+type Challenge struct {
+	Challenge  string `json:"challenge"`
+	Scope      string `json:"scope"`
+	Difficulty int    `json:"difficulty"`
+	ExpiresAt  int64  `json:"expires_at"`
+}
+
+// Config holds the settings that can be changed at runtime. HighLoad is the
+// number of attempts per minute on a scope above which ModeRisk asks
+// everyone; zero turns that off.
+type Config struct {
+	Mode       string `json:"mode"`
+	Difficulty int    `json:"difficulty"`
+	HighLoad   int    `json:"high_load"`
+	TTLSeconds int64  `json:"ttl_seconds"`
+}
+
+func (c *Config) Validate() error {
+	if c.Mode != ModeOff && c.Mode != ModeRisk && c.Mode != ModeAlways {
+		return errors.New("mode must be off, risk or always")
+	}
+	if c.Difficulty < 1 || c.Difficulty > maxDifficulty {
+		return fmt.Errorf("difficulty must be between 1 and %d", maxDifficulty)
+	}
+	if c.HighLoad < 0 {
+		return errors.New("high_load must not be negative")
+	}
+	if c.TTLSeconds <= 0 {
+		return errors.New("ttl_seconds must be positive")
+	}
+	return nil
+}
+
+type load struct {
+	minute   int64
+	current  int
+	previous int
+}
+
+// Issuer issues and verifies challenges. Instances that share a secret
+// accept each other's challenges, so the challenges spent are recorded in
+// the table when DbCli is set, until they expire. Without it each instance
+// only remembers the ones spent on it.
+type Issuer struct {
+	DbCli     *dynamodb.Client
+	TableName *string
+
+	secret []byte
+
+	mu     sync.Mutex
+	config Config
+	spent  map[string]time.Time
+	loads  map[string]*load
+}
+
+// NewIssuer returns an issuer signing with secret, or with a random secret
+// when it is empty.
+func NewIssuer(secret []byte) (*Issuer, error) {
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		_, err := rand.Read(secret)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Issuer{
+		secret: secret,
+		config: Config{
+			Mode:       ModeRisk,
+			Difficulty: 18,
+			HighLoad:   0,
+			TTLSeconds: 300,
+		},
+		spent: make(map[string]time.Time),
+		loads: make(map[string]*load),
+	}, nil
+}
+
+func (i *Issuer) Config() Config {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.config
+}
+
+// Configure changes the settings. Challenges already issued keep the
+// difficulty they were issued with.
+func (i *Issuer) Configure(c Config) error {
+	err := c.Validate()
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	i.config = c
+	i.mu.Unlock()
+	return nil
+}
+
+func (i *Issuer) sign(payload string) string {
+	mac := hmac.New(sha256.New, i.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue returns a new challenge for scope at the current difficulty.
+func (i *Issuer) Issue(scope string) (*Challenge, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	config := i.Config()
+	expiresAt := time.Now().Add(time.Duration(config.TTLSeconds) * time.Second).Unix()
+	payload := strings.Join([]string{
+		scope,
+		strconv.Itoa(config.Difficulty),
+		strconv.FormatInt(expiresAt, 10),
+		base64.RawURLEncoding.EncodeToString(nonce),
+	}, ".")
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+
+	return &Challenge{
+		Challenge:  encoded + "." + i.sign(encoded),
+		Scope:      scope,
+		Difficulty: config.Difficulty,
+		ExpiresAt:  expiresAt,
+	}, nil
+}
+
+// Verify checks a proof sent as "challenge:solution" and spends the
+// challenge, so it cannot be used again.
+func (i *Issuer) Verify(ctx context.Context, proof string, scope string) error {
+	if proof == "" {
+		return ErrRequired
+	}
+	separator := strings.LastIndex(proof, ":")
+	if separator < 0 {
+		return ErrMalformed
+	}
+	challenge, solution := proof[:separator], proof[separator+1:]
+
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 2 {
+		return ErrMalformed
+	}
+	if !hmac.Equal([]byte(i.sign(parts[0])), []byte(parts[1])) {
+		return ErrSignature
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrMalformed
+	}
+	fields := strings.Split(string(payload), ".")
+	if len(fields) != 4 {
+		return ErrMalformed
+	}
+	difficulty, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return ErrMalformed
+	}
+	expiresAt, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return ErrMalformed
+	}
+
+	now := time.Now()
+	if fields[0] != scope {
+		return ErrScope
+	}
+	if now.Unix() > expiresAt {
+		return ErrExpired
+	}
+	if !Solved(challenge, solution, difficulty) {
+		return ErrUnsolved
+	}
+
+	i.mu.Lock()
+	for spent, expiry := range i.spent {
+		if now.After(expiry) {
+			delete(i.spent, spent)
+		}
+	}
+	_, spent := i.spent[challenge]
+	if !spent && i.DbCli == nil {
+		i.spent[challenge] = time.Unix(expiresAt, 0)
+	}
+	i.mu.Unlock()
+	if spent {
+		return ErrSpent
+	}
+	if i.DbCli == nil {
+		return nil
+	}
+
+	// The table decides between instances, and between requests racing on
+	// this one. A challenge is only remembered here once it was spent
+	// there, so that a failed write leaves it for another try.
+	err = i.spend(ctx, challenge, expiresAt)
+	if err != nil {
+		return err
+	}
+	i.mu.Lock()
+	i.spent[challenge] = time.Unix(expiresAt, 0)
+	i.mu.Unlock()
+	return nil
+}
+
+// spend records challenge as spent in the table, failing with ErrSpent when
+// another instance already did. The record goes once the challenge has
+// expired, when it would be refused anyway.
+func (i *Issuer) spend(ctx context.Context, challenge string, expiresAt int64) error {
+	sum := sha256.Sum256([]byte(challenge))
+	_, err := i.DbCli.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: i.TableName,
+		Item: map[string]types.AttributeValue{
+			"PK":         &types.AttributeValueMemberS{Value: "CHALLENGE#" + hex.EncodeToString(sum[:])},
+			"SK":         &types.AttributeValueMemberS{Value: "SPENT"},
+			"expires_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt, 10)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrSpent
+	}
+	return err
+}
+
+// Required counts an attempt on scope and reports whether it has to come
+// with a solved challenge.
+func (i *Issuer) Required(scope string, risky bool) bool {
+	minute := time.Now().Unix() / 60
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	l, ok := i.loads[scope]
+	if !ok {
+		l = &load{minute: minute}
+		i.loads[scope] = l
+	}
+	switch {
+	case minute == l.minute+1:
+		l.previous, l.current = l.current, 0
+	case minute > l.minute+1:
+		l.previous, l.current = 0, 0
+	}
+	l.minute = minute
+	l.current++
+
+	switch i.config.Mode {
+	case ModeAlways:
+		return true
+	case ModeRisk:
+		rate := l.current
+		if l.previous > rate {
+			rate = l.previous
+		}
+		return risky || (i.config.HighLoad > 0 && rate > i.config.HighLoad)
+	}
+	return false
+}
+
+// Check verifies the proof when the attempt needs one.
+func (i *Issuer) Check(ctx context.Context, proof string, scope string, risky bool) error {
+	if !i.Required(scope, risky) {
+		return nil
+	}
+	return i.Verify(ctx, proof, scope)
+}
+
+// Solved reports whether solution solves challenge at difficulty.
+func Solved(challenge string, solution string, difficulty int) bool {
+	sum := sha256.Sum256([]byte(challenge + ":" + solution))
+	zeros := 0
+	for _, b := range sum {
+		if b != 0 {
+			zeros += bits.LeadingZeros8(b)
+			break
+		}
+		zeros += 8
+	}
+	return zeros >= difficulty
+}
+
+// Solve finds a solution by counting up, and returns the proof to send in
+// Header.
+func Solve(ctx context.Context, c *Challenge) (string, error) {
+	for n := 0; ; n++ {
+		if n%4096 == 0 && ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		solution := strconv.Itoa(n)
+		if Solved(c.Challenge, solution, c.Difficulty) {
+			return c.Challenge + ":" + solution, nil
+		}
+	}
+}
+
+type proofKey struct{}
+
+// WithProof returns a context carrying the proof sent with a request, for
+// checks made further down such as placement rules.
+func WithProof(ctx context.Context, proof string) context.Context {
+	return context.WithValue(ctx, proofKey{}, proof)
+}
+
+func ProofFrom(ctx context.Context) string {
+	proof, _ := ctx.Value(proofKey{}).(string)
+	return proof
+}
@@ -0,0 +1,98 @@
+package challenge
+
+import (
+	"context"
+	"errors"
+	"github.com/Jonathanpatta/rplace/internal/dynamotest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func newTestIssuer(t *testing.T, secret string, table *dynamotest.StandIn) *Issuer {
+	t.Helper()
+	i, err := NewIssuer([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = i.Configure(Config{Mode: ModeAlways, Difficulty: 4, TTLSeconds: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table != nil {
+		i.DbCli = table.Client()
+		i.TableName = aws.String("Place-Clone")
+	}
+	return i
+}
+
+func solve(t *testing.T, i *Issuer, scope string) string {
+	t.Helper()
+	c, err := i.Issue(scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := Solve(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proof
+}
+
+func TestVerify(t *testing.T) {
+	i := newTestIssuer(t, "secret", nil)
+	proof := solve(t, i, ScopePlace)
+	separator := strings.LastIndex(proof, ":")
+
+	expired := newTestIssuer(t, "secret", nil)
+	expired.config.TTLSeconds = -60
+
+	// The first count that does not solve it.
+	challenge := proof[:separator]
+	n := 0
+	for Solved(challenge, strconv.Itoa(n), 4) {
+		n++
+	}
+
+	tests := []struct {
+		name  string
+		proof func() string
+		scope string
+		err   error
+	}{
+		{"missing", func() string { return "" }, ScopePlace, ErrRequired},
+		{"no solution", func() string { return proof[:separator] }, ScopePlace, ErrMalformed},
+		{"other scope", func() string { return proof }, ScopeRegister, ErrScope},
+		{"other secret", func() string { return solve(t, newTestIssuer(t, "other", nil), ScopePlace) }, ScopePlace, ErrSignature},
+		{"expired", func() string { return solve(t, expired, ScopePlace) }, ScopePlace, ErrExpired},
+		{"unsolved", func() string { return challenge + ":" + strconv.Itoa(n) }, ScopePlace, ErrUnsolved},
+		{"solved", func() string { return proof }, ScopePlace, nil},
+		{"spent", func() string { return proof }, ScopePlace, ErrSpent},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := i.Verify(context.Background(), test.proof(), test.scope)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestVerifySpentAcrossInstances(t *testing.T) {
+	table := dynamotest.Start()
+	defer table.Close()
+	first := newTestIssuer(t, "secret", table)
+	second := newTestIssuer(t, "secret", table)
+
+	proof := solve(t, first, ScopeRegister)
+	err := first.Verify(context.Background(), proof, ScopeRegister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = second.Verify(context.Background(), proof, ScopeRegister)
+	if !errors.Is(err, ErrSpent) {
+		t.Fatalf("got %v from the other instance, want %v", err, ErrSpent)
+	}
+}
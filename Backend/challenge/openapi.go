@@ -0,0 +1,35 @@
+package challenge
+
+import (
+	"github.com/Jonathanpatta/rplace/openapi"
+)
+
+// Parameter documents the header a solved challenge is sent in, for the
+// operations that may ask for one.
+func Parameter() *openapi.Parameter {
+	return &openapi.Parameter{
+		Name:        Header,
+		In:          "header",
+		Description: "A solved challenge as challenge:solution, needed when the server answers 428",
+		Schema:      &openapi.Schema{Type: "string"},
+	}
+}
+
+// Describe documents the routes mounted by AddSubrouter.
+func Describe(spec *openapi.Spec) {
+	challenge := spec.Schema("Challenge", Challenge{})
+
+	spec.Describe("GET", "/challenge", &openapi.Operation{
+		OperationId: "getChallenge",
+		Summary:     "Issue a proof of work challenge",
+		Description: "Solve it by finding a solution such that the SHA-256 of challenge:solution starts with difficulty zero bits, then send challenge:solution in the " + Header + " header before expires_at. Each challenge can be used once.",
+		Tags:        []string{"auth"},
+		Parameters: []*openapi.Parameter{
+			openapi.Query("scope", "What the challenge is for", &openapi.Schema{Type: "string", Enum: []string{ScopePlace, ScopeRegister}}, true),
+		},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "A new challenge", Content: openapi.JSON(challenge)},
+			"400": {Description: "The scope is unknown"},
+		},
+	})
+}
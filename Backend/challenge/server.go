@@ -0,0 +1,70 @@
+package challenge
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+// Code is the rejection code sent when a request needs a solved challenge.
+const Code = "challenge_required"
+
+type Server struct {
+	Issuer *Issuer
+}
+
+func NewServer(issuer *Issuer) *Server {
+	return &Server{Issuer: issuer}
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	fmt.Fprint(w, string(out))
+}
+
+// WriteError answers a request whose proof was missing or wrong, in the
+// same shape as a refused placement.
+func WriteError(w http.ResponseWriter, err error) {
+	writeJson(w, http.StatusPreconditionRequired, map[string]string{
+		"code":   Code,
+		"reason": err.Error(),
+	})
+}
+
+// GetChallenge issues a challenge for the scope given in ?scope=.
+func (s *Server) GetChallenge(w http.ResponseWriter, r *http.Request) {
+	scope := r.URL.Query().Get("scope")
+	if scope != ScopePlace && scope != ScopeRegister {
+		http.Error(w, "scope must be place or register", http.StatusBadRequest)
+		return
+	}
+
+	c, err := s.Issuer.Issue(scope)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJson(w, http.StatusOK, c)
+}
+
+type Options struct {
+	Issuer *Issuer
+}
+
+// AddSubrouter serves challenges at /challenge. It is open to anyone since
+// registering may need one. The settings are changed through the canvas
+// admin API.
+func AddSubrouter(o *Options, r *mux.Router) {
+	server := NewServer(o.Issuer)
+
+	r.HandleFunc("/challenge", server.GetChallenge).Methods("GET", "OPTIONS")
+}
@@ -0,0 +1,318 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type Canvas struct {
+	Name      string   `json:"name"`
+	Rows      int      `json:"rows"`
+	Cols      int      `json:"cols"`
+	Palette   []string `json:"palette,omitempty"`
+	CreatedAt int64    `json:"created_at,omitempty"`
+	UpdatedAt int64    `json:"updated_at,omitempty"`
+}
+
+type Ban struct {
+	Username  string `json:"username"`
+	Reason    string `json:"reason,omitempty"`
+	By        string `json:"by,omitempty"`
+	CreatedAt int64  `json:"created_at,omitempty"`
+	Until     int64  `json:"until,omitempty"`
+}
+
+type Lock struct {
+	Id        string `json:"id"`
+	Row       int    `json:"row"`
+	Col       int    `json:"col"`
+	Rows      int    `json:"rows"`
+	Cols      int    `json:"cols"`
+	Reason    string `json:"reason,omitempty"`
+	By        string `json:"by,omitempty"`
+	CreatedAt int64  `json:"created_at,omitempty"`
+}
+
+type Suspicion struct {
+	Username    string  `json:"username"`
+	Score       float64 `json:"score"`
+	Regularity  float64 `json:"regularity"`
+	AtExpiry    float64 `json:"at_expiry"`
+	Coordinated float64 `json:"coordinated"`
+	Placements  int     `json:"placements"`
+	Flagged     bool    `json:"flagged"`
+	UpdatedAt   int64   `json:"updated_at"`
+}
+
+type CacheEntry struct {
+	Key   string          `json:"key"`
+	Size  int             `json:"size"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Raw   string          `json:"raw,omitempty"`
+}
+
+// call sends a JSON request and decodes the response into out, if given.
+func (c *Client) call(ctx context.Context, method string, path string, body interface{}, out interface{}) error {
+	req, err := c.newRequest(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(req, out)
+	return err
+}
+
+func (c *Client) Canvas(ctx context.Context) (*Canvas, error) {
+	var canvas Canvas
+	err := c.call(ctx, "GET", "/api/canvas", nil, &canvas)
+	if err != nil {
+		return nil, err
+	}
+	return &canvas, nil
+}
+
+func (c *Client) ResizeCanvas(ctx context.Context, rows int, cols int) (*Canvas, error) {
+	body := map[string]int{"rows": rows, "cols": cols}
+
+	var canvas Canvas
+	err := c.call(ctx, "PUT", "/api/admin/canvas", body, &canvas)
+	if err != nil {
+		return nil, err
+	}
+	return &canvas, nil
+}
+
+func (c *Client) Bans(ctx context.Context) ([]Ban, error) {
+	var bans []Ban
+	err := c.call(ctx, "GET", "/api/admin/bans", nil, &bans)
+	return bans, err
+}
+
+// Ban bans a user from the canvas, for good when duration is zero.
+func (c *Client) Ban(ctx context.Context, username string, reason string, duration time.Duration) (*Ban, error) {
+	body := struct {
+		Username        string `json:"username"`
+		Reason          string `json:"reason,omitempty"`
+		DurationSeconds int64  `json:"duration_seconds,omitempty"`
+	}{username, reason, int64(duration / time.Second)}
+
+	var ban Ban
+	err := c.call(ctx, "POST", "/api/admin/bans", body, &ban)
+	if err != nil {
+		return nil, err
+	}
+	return &ban, nil
+}
+
+func (c *Client) Unban(ctx context.Context, username string) error {
+	return c.call(ctx, "DELETE", "/api/admin/bans/"+url.PathEscape(username), nil, nil)
+}
+
+// Suspicions lists the accounts flagged as likely automated, or every
+// scored account when all is set.
+func (c *Client) Suspicions(ctx context.Context, all bool) ([]Suspicion, error) {
+	var list []Suspicion
+	err := c.call(ctx, "GET", "/api/admin/suspicions?all="+strconv.FormatBool(all), nil, &list)
+	return list, err
+}
+
+func (c *Client) ClearSuspicion(ctx context.Context, username string) error {
+	return c.call(ctx, "DELETE", "/api/admin/suspicions/"+url.PathEscape(username), nil, nil)
+}
+
+func (c *Client) Locks(ctx context.Context) ([]Lock, error) {
+	var locks []Lock
+	err := c.call(ctx, "GET", "/api/locks", nil, &locks)
+	return locks, err
+}
+
+func (c *Client) Lock(ctx context.Context, row int, col int, rows int, cols int, reason string) (*Lock, error) {
+	body := Lock{Row: row, Col: col, Rows: rows, Cols: cols, Reason: reason}
+
+	var lock Lock
+	err := c.call(ctx, "POST", "/api/admin/locks", body, &lock)
+	if err != nil {
+		return nil, err
+	}
+	return &lock, nil
+}
+
+func (c *Client) Unlock(ctx context.Context, id string) error {
+	return c.call(ctx, "DELETE", "/api/admin/locks/"+url.PathEscape(id), nil, nil)
+}
+
+func (c *Client) CacheKeys(ctx context.Context, prefix string) ([]CacheEntry, error) {
+	var entries []CacheEntry
+	err := c.call(ctx, "GET", "/api/admin/cache?prefix="+url.QueryEscape(prefix), nil, &entries)
+	return entries, err
+}
+
+func (c *Client) CacheEntry(ctx context.Context, key string) (*CacheEntry, error) {
+	var entry CacheEntry
+	err := c.call(ctx, "GET", "/api/admin/cache/"+url.PathEscape(key), nil, &entry)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+type ImportResult struct {
+	Row     int `json:"row"`
+	Col     int `json:"col"`
+	Width   int `json:"width"`
+	Height  int `json:"height"`
+	Placed  int `json:"placed"`
+	Skipped int `json:"skipped"`
+}
+
+// ImportJob is an import running on the server. Status is running, done or
+// failed.
+type ImportJob struct {
+	Id     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Total  int    `json:"total"`
+	ImportResult
+	StartedAt  int64 `json:"started_at"`
+	UpdatedAt  int64 `json:"updated_at"`
+	FinishedAt int64 `json:"finished_at,omitempty"`
+}
+
+// Import starts painting an image (PNG, JPEG or GIF) onto the canvas with
+// its top left corner at row, col. dither is "none" or "floyd-steinberg".
+// The import goes on in the background; GetImport tells how far it got.
+func (c *Client) Import(ctx context.Context, image io.Reader, row int, col int, dither string) (*ImportJob, error) {
+	req, err := c.importRequest(ctx, image, row, col, dither, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var job ImportJob
+	_, err = c.do(req, &job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (c *Client) GetImport(ctx context.Context, id string) (*ImportJob, error) {
+	var job ImportJob
+	err := c.call(ctx, "GET", "/api/admin/import/"+url.PathEscape(id), nil, &job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// PreviewImport returns the image as Import would paint it, as a PNG,
+// without painting anything.
+func (c *Client) PreviewImport(ctx context.Context, image io.Reader, row int, col int, dither string) ([]byte, error) {
+	req, err := c.importRequest(ctx, image, row, col, dither, true)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, responseError(resp, data)
+	}
+	return data, nil
+}
+
+func (c *Client) importRequest(ctx context.Context, image io.Reader, row int, col int, dither string, preview bool) (*http.Request, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	fields := map[string]string{
+		"row":     strconv.Itoa(row),
+		"col":     strconv.Itoa(col),
+		"dither":  dither,
+		"preview": strconv.FormatBool(preview),
+	}
+	for name, value := range fields {
+		err := form.WriteField(name, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	part, err := form.CreateFormFile("image", "image")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(part, image)
+	if err != nil {
+		return nil, err
+	}
+	err = form.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := c.newRequest(ctx, "POST", "/api/admin/import", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(&body)
+	req.ContentLength = int64(body.Len())
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req, nil
+}
+
+type LoginFailures struct {
+	Username    string `json:"username"`
+	Failures    int    `json:"failures"`
+	LastFailure int64  `json:"last_failure,omitempty"`
+	LockedUntil int64  `json:"locked_until,omitempty"`
+}
+
+type AuditEntry struct {
+	Event    string `json:"event"`
+	Username string `json:"username"`
+	By       string `json:"by,omitempty"`
+	Ip       string `json:"ip,omitempty"`
+	Failures int    `json:"failures,omitempty"`
+	Until    int64  `json:"until,omitempty"`
+	At       int64  `json:"at"`
+}
+
+// Lockouts lists the usernames locked after failed logins.
+func (c *Client) Lockouts(ctx context.Context) ([]LoginFailures, error) {
+	var locked []LoginFailures
+	err := c.call(ctx, "GET", "/auth/admin/lockouts", nil, &locked)
+	return locked, err
+}
+
+func (c *Client) UnlockAccount(ctx context.Context, username string) error {
+	return c.call(ctx, "DELETE", "/auth/admin/lockouts/"+url.PathEscape(username), nil, nil)
+}
+
+// Audit returns the latest account lock and unlock events, only those about
+// username when it is given.
+func (c *Client) Audit(ctx context.Context, username string, limit int) ([]AuditEntry, error) {
+	query := url.Values{}
+	if username != "" {
+		query.Set("username", username)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+
+	var entries []AuditEntry
+	err := c.call(ctx, "GET", "/auth/admin/audit?"+query.Encode(), nil, &entries)
+	return entries, err
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/Jonathanpatta/rplace/challenge"
+	"net/url"
+)
+
+type Challenge struct {
+	Challenge  string `json:"challenge"`
+	Scope      string `json:"scope"`
+	Difficulty int    `json:"difficulty"`
+	ExpiresAt  int64  `json:"expires_at"`
+}
+
+type ChallengeConfig struct {
+	Mode       string `json:"mode"`
+	Difficulty int    `json:"difficulty"`
+	HighLoad   int    `json:"high_load"`
+	TTLSeconds int64  `json:"ttl_seconds"`
+}
+
+// IsChallengeRequired reports whether err is the server asking for a solved
+// challenge. Solve one with SolveChallenge and retry.
+func IsChallengeRequired(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == challenge.Code
+}
+
+func (c *Client) Challenge(ctx context.Context, scope string) (*Challenge, error) {
+	var ch Challenge
+	err := c.call(ctx, "GET", "/challenge?scope="+url.QueryEscape(scope), nil, &ch)
+	if err != nil {
+		return nil, err
+	}
+	return &ch, nil
+}
+
+// SolveChallenge fetches a challenge for scope, "place" or "register", and
+// solves it. The proof is sent with the next request.
+func (c *Client) SolveChallenge(ctx context.Context, scope string) error {
+	ch, err := c.Challenge(ctx, scope)
+	if err != nil {
+		return err
+	}
+
+	proof, err := challenge.Solve(ctx, &challenge.Challenge{
+		Challenge:  ch.Challenge,
+		Scope:      ch.Scope,
+		Difficulty: ch.Difficulty,
+		ExpiresAt:  ch.ExpiresAt,
+	})
+	if err != nil {
+		return err
+	}
+	c.Proof = proof
+	return nil
+}
+
+func (c *Client) ChallengeConfig(ctx context.Context) (*ChallengeConfig, error) {
+	var config ChallengeConfig
+	err := c.call(ctx, "GET", "/api/admin/challenge", nil, &config)
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// ConfigureChallenges replaces the proof of work settings.
+func (c *Client) ConfigureChallenges(ctx context.Context, config ChallengeConfig) (*ChallengeConfig, error) {
+	var updated ChallengeConfig
+	err := c.call(ctx, "PUT", "/api/admin/challenge", config, &updated)
+	if err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
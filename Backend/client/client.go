@@ -0,0 +1,524 @@
+// Package client talks to the rplace HTTP API. It mirrors the JSON types of
+// the server instead of importing them, so bots do not pull in the server's
+// dependencies. The contract it follows is served at /openapi.json.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Jonathanpatta/rplace/challenge"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Pixel struct {
+	Row          int    `json:"row"`
+	Col          int    `json:"col"`
+	Color        string `json:"color,omitempty"`
+	Author       string `json:"author,omitempty"`
+	AuthorName   string `json:"author_name,omitempty"`
+	Faction      string `json:"faction,omitempty"`
+	LastModified int64  `json:"last_modified,omitempty"`
+	Version      int64  `json:"version,omitempty"`
+	Seq          int64  `json:"seq,omitempty"`
+}
+
+type PixelInfo struct {
+	Row        int    `json:"row"`
+	Col        int    `json:"col"`
+	Color      string `json:"color,omitempty"`
+	Author     string `json:"author,omitempty"`
+	AuthorName string `json:"author_name,omitempty"`
+	Faction    string `json:"faction,omitempty"`
+	PlacedAt   string `json:"placed_at,omitempty"`
+}
+
+type Token struct {
+	Token     string `json:"token,omitempty"`
+	Username  string `json:"username,omitempty"`
+	CreatedAt int64  `json:"created_at,omitempty"`
+	ValidTill int64  `json:"valid_till,omitempty"`
+	LastUsed  int64  `json:"last_used,omitempty"`
+}
+
+// Session is a live token of the caller, named by an id instead of the
+// token itself.
+type Session struct {
+	Id        string `json:"id"`
+	CreatedAt int64  `json:"created_at"`
+	ValidTill int64  `json:"valid_till"`
+	LastUsed  int64  `json:"last_used,omitempty"`
+	Current   bool   `json:"current,omitempty"`
+}
+
+// Snapshot is every placed pixel along with the sequence number to ask for
+// changes from.
+type Snapshot struct {
+	Seq    int64
+	Pixels []Pixel
+}
+
+type Changes struct {
+	Seq    int64   `json:"seq"`
+	Reload bool    `json:"reload,omitempty"`
+	Pixels []Pixel `json:"pixels"`
+}
+
+type PhaseChange struct {
+	Phase            string   `json:"phase"`
+	Previous         string   `json:"previous,omitempty"`
+	RestrictedColors []string `json:"restricted_colors,omitempty"`
+	ChangedAt        int64    `json:"changed_at"`
+}
+
+type Event struct {
+	Type  string       `json:"type"`
+	Pixel *Pixel       `json:"pixel,omitempty"`
+	Phase *PhaseChange `json:"phase,omitempty"`
+}
+
+// Error is a response the server refused. Code and RetryAfter are set for
+// refused placements; Current holds the pixel as it is now when a placement
+// lost to a concurrent one.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RetryAfter time.Duration
+	Current    *Pixel
+}
+
+func (e *Error) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("rplace: %d %s: %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("rplace: %d: %s", e.StatusCode, e.Message)
+}
+
+// ErrReload is returned by Changes when the server no longer holds the
+// changes asked for and the snapshot has to be fetched again.
+var ErrReload = errors.New("rplace: changes are gone, reload the snapshot")
+
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	// Token is sent as a bearer token with every request when set.
+	Token string
+	// Proof is a solved challenge sent with the next request, see
+	// SolveChallenge.
+	Proof string
+}
+
+// New returns a client for the server at baseURL, such as
+// http://localhost:8000.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+func (c *Client) newRequest(ctx context.Context, method string, path string, body interface{}) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if c.Proof != "" {
+		req.Header.Set(challenge.Header, c.Proof)
+		c.Proof = ""
+	}
+	return req, nil
+}
+
+// do sends a request and decodes a successful response into out, if given.
+func (c *Client) do(req *http.Request, out interface{}) (*http.Response, error) {
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, err
+	}
+	if resp.StatusCode >= 300 {
+		return resp, responseError(resp, data)
+	}
+
+	if out != nil && len(bytes.TrimSpace(data)) > 0 {
+		err = json.Unmarshal(data, out)
+	}
+	return resp, err
+}
+
+func responseError(resp *http.Response, data []byte) *Error {
+	e := &Error{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(data)),
+	}
+
+	var rejection struct {
+		Code   string `json:"code"`
+		Reason string `json:"reason"`
+	}
+	if json.Unmarshal(data, &rejection) == nil && rejection.Code != "" {
+		e.Code = rejection.Code
+		e.Message = rejection.Reason
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	if resp.StatusCode == http.StatusConflict {
+		var current Pixel
+		if json.Unmarshal(data, &current) == nil {
+			e.Current = &current
+		}
+	}
+	return e
+}
+
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (c *Client) Register(ctx context.Context, username string, password string) error {
+	req, err := c.newRequest(ctx, "POST", "/auth/register", credentials{username, password})
+	if err != nil {
+		return err
+	}
+	_, err = c.do(req, nil)
+	return err
+}
+
+// RegisterWithEmail creates an account with an email address, which is
+// sent a verification link.
+func (c *Client) RegisterWithEmail(ctx context.Context, username string, password string, email string) error {
+	body := struct {
+		credentials
+		Email string `json:"email"`
+	}{credentials{username, password}, email}
+
+	req, err := c.newRequest(ctx, "POST", "/auth/register", body)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(req, nil)
+	return err
+}
+
+// RequestVerification mails a new verification link if username has an
+// unverified address.
+func (c *Client) RequestVerification(ctx context.Context, username string) error {
+	return c.call(ctx, "POST", "/auth/email/verify/request", map[string]string{"username": username}, nil)
+}
+
+// VerifyEmail confirms an address with the token from a verification link.
+func (c *Client) VerifyEmail(ctx context.Context, token string) error {
+	return c.call(ctx, "POST", "/auth/email/verify", map[string]string{"token": token}, nil)
+}
+
+// RequestEmailChange mails a link for setting the address of the client's
+// account to email. The account keeps its address until the link is
+// opened.
+func (c *Client) RequestEmailChange(ctx context.Context, email string) error {
+	return c.call(ctx, "POST", "/auth/email/change/request", map[string]string{"email": email}, nil)
+}
+
+// ChangeEmail sets the address of an account with the token from an
+// address change link.
+func (c *Client) ChangeEmail(ctx context.Context, token string) error {
+	return c.call(ctx, "POST", "/auth/email/change", map[string]string{"token": token}, nil)
+}
+
+// RequestPasswordReset mails a reset link if username has a verified
+// address.
+func (c *Client) RequestPasswordReset(ctx context.Context, username string) error {
+	return c.call(ctx, "POST", "/auth/password/reset/request", map[string]string{"username": username}, nil)
+}
+
+// ResetPassword sets a new password with the token from a reset link.
+func (c *Client) ResetPassword(ctx context.Context, token string, password string) error {
+	return c.call(ctx, "POST", "/auth/password/reset", map[string]string{"token": token, "password": password}, nil)
+}
+
+// GenerateToken logs in and returns the user's token. It does not set
+// Token on the client.
+func (c *Client) GenerateToken(ctx context.Context, username string, password string) (*Token, error) {
+	req, err := c.newRequest(ctx, "POST", "/auth/generateToken", credentials{username, password})
+	if err != nil {
+		return nil, err
+	}
+
+	var token Token
+	_, err = c.do(req, &token)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// Tokens are a signed access token and the refresh token that replaces it.
+type Tokens struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int64  `json:"refresh_expires_in"`
+}
+
+// Login returns an access token and a refresh token. It does not set Token
+// on the client.
+func (c *Client) Login(ctx context.Context, username string, password string) (*Tokens, error) {
+	return c.tokens(ctx, "/auth/token", credentials{username, password})
+}
+
+// Refresh trades a refresh token for new tokens. The old refresh token no
+// longer works afterwards.
+func (c *Client) Refresh(ctx context.Context, refreshToken string) (*Tokens, error) {
+	return c.tokens(ctx, "/auth/token/refresh", map[string]string{"refresh_token": refreshToken})
+}
+
+// RevokeRefreshToken logs out the login a refresh token came from.
+func (c *Client) RevokeRefreshToken(ctx context.Context, refreshToken string) error {
+	return c.call(ctx, "POST", "/auth/token/revoke", map[string]string{"refresh_token": refreshToken}, nil)
+}
+
+func (c *Client) tokens(ctx context.Context, path string, body interface{}) (*Tokens, error) {
+	var tokens Tokens
+	err := c.call(ctx, "POST", path, body, &tokens)
+	if err != nil {
+		return nil, err
+	}
+	return &tokens, nil
+}
+
+// Logout revokes Token. With everywhere set every token of the user is
+// revoked.
+func (c *Client) Logout(ctx context.Context, everywhere bool) error {
+	return c.call(ctx, "POST", "/auth/logout", map[string]bool{"everywhere": everywhere}, nil)
+}
+
+// Sessions lists the live tokens of the user Token belongs to.
+func (c *Client) Sessions(ctx context.Context) ([]Session, error) {
+	var sessions []Session
+	err := c.call(ctx, "GET", "/auth/sessions", nil, &sessions)
+	return sessions, err
+}
+
+func (c *Client) RevokeSession(ctx context.Context, id string) error {
+	return c.call(ctx, "DELETE", "/auth/sessions/"+url.PathEscape(id), nil, nil)
+}
+
+// APIKey is a named, scoped credential for bots and integrations. It is
+// used by setting Token to the key.
+type APIKey struct {
+	Id        string   `json:"id"`
+	Name      string   `json:"name"`
+	Owner     string   `json:"owner"`
+	Scopes    []string `json:"scopes"`
+	RateLimit int      `json:"rate_limit"`
+	CreatedAt int64    `json:"created_at"`
+	ExpiresAt int64    `json:"expires_at,omitempty"`
+	LastUsed  int64    `json:"last_used,omitempty"`
+}
+
+type NewAPIKey struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// RateLimit is in requests a minute.
+	RateLimit int `json:"rate_limit,omitempty"`
+	// ExpiresIn is in seconds.
+	ExpiresIn int64 `json:"expires_in,omitempty"`
+}
+
+type CreatedAPIKey struct {
+	Key    string `json:"key"`
+	APIKey APIKey `json:"api_key"`
+}
+
+// CreateAPIKey mints a key. The key is only returned here.
+func (c *Client) CreateAPIKey(ctx context.Context, key NewAPIKey) (*CreatedAPIKey, error) {
+	var created CreatedAPIKey
+	err := c.call(ctx, "POST", "/auth/keys", key, &created)
+	if err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// APIKeys lists the caller's keys, or those of owner for admins.
+func (c *Client) APIKeys(ctx context.Context, owner string) ([]APIKey, error) {
+	path := "/auth/keys"
+	if owner != "" {
+		path += "?owner=" + url.QueryEscape(owner)
+	}
+
+	var keys []APIKey
+	err := c.call(ctx, "GET", path, nil, &keys)
+	return keys, err
+}
+
+func (c *Client) RevokeAPIKey(ctx context.Context, id string) error {
+	return c.call(ctx, "DELETE", "/auth/keys/"+url.PathEscape(id), nil, nil)
+}
+
+type OIDCProvider struct {
+	Name     string `json:"name"`
+	LoginURL string `json:"login_url"`
+}
+
+// OIDCProviders lists the providers accounts can log in with. Logging in
+// at one takes a browser, sent to the LoginURL.
+func (c *Client) OIDCProviders(ctx context.Context) ([]OIDCProvider, error) {
+	var providers []OIDCProvider
+	err := c.call(ctx, "GET", "/auth/oidc", nil, &providers)
+	return providers, err
+}
+
+// Identity is an account's identity at an OpenID Connect provider.
+type Identity struct {
+	Username  string `json:"username"`
+	Provider  string `json:"provider"`
+	Subject   string `json:"subject"`
+	Email     string `json:"email,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+func (c *Client) Identities(ctx context.Context) ([]Identity, error) {
+	var identities []Identity
+	err := c.call(ctx, "GET", "/auth/identities", nil, &identities)
+	return identities, err
+}
+
+func (c *Client) UnlinkIdentity(ctx context.Context, provider string) error {
+	return c.call(ctx, "DELETE", "/auth/identities/"+url.PathEscape(provider), nil, nil)
+}
+
+func (c *Client) Pixels(ctx context.Context) (*Snapshot, error) {
+	req, err := c.newRequest(ctx, "GET", "/api/pixels", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot Snapshot
+	resp, err := c.do(req, &snapshot.Pixels)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Seq, _ = strconv.ParseInt(resp.Header.Get("X-Canvas-Seq"), 10, 64)
+	return &snapshot, nil
+}
+
+// Changes returns the pixels placed after since, or ErrReload when they are
+// no longer held.
+func (c *Client) Changes(ctx context.Context, since int64) (*Changes, error) {
+	req, err := c.newRequest(ctx, "GET", "/api/pixels/changes?since="+strconv.FormatInt(since, 10), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes Changes
+	_, err = c.do(req, &changes)
+	var e *Error
+	if errors.As(err, &e) && e.StatusCode == http.StatusGone {
+		return nil, ErrReload
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &changes, nil
+}
+
+func (c *Client) Pixel(ctx context.Context, row int, col int) (*PixelInfo, error) {
+	req, err := c.newRequest(ctx, "GET", fmt.Sprintf("/api/pixels/%d/%d", row, col), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var info PixelInfo
+	_, err = c.do(req, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+type updatePixelRequest struct {
+	Row             int    `json:"row"`
+	Col             int    `json:"col"`
+	Color           string `json:"color"`
+	ExpectedVersion *int64 `json:"expected_version,omitempty"`
+}
+
+// PlacePixel places a pixel. A refused placement comes back as an *Error.
+func (c *Client) PlacePixel(ctx context.Context, row int, col int, color string) (*Pixel, error) {
+	return c.placePixel(ctx, updatePixelRequest{Row: row, Col: col, Color: color})
+}
+
+// ReplacePixel places a pixel only if it is still at expectedVersion. When
+// it is not, the returned *Error has status 409 and holds the current pixel.
+func (c *Client) ReplacePixel(ctx context.Context, row int, col int, color string, expectedVersion int64) (*Pixel, error) {
+	return c.placePixel(ctx, updatePixelRequest{Row: row, Col: col, Color: color, ExpectedVersion: &expectedVersion})
+}
+
+func (c *Client) placePixel(ctx context.Context, body updatePixelRequest) (*Pixel, error) {
+	req, err := c.newRequest(ctx, "POST", "/api/updatePixel", body)
+	if err != nil {
+		return nil, err
+	}
+
+	var pixel Pixel
+	_, err = c.do(req, &pixel)
+	if err != nil {
+		return nil, err
+	}
+	return &pixel, nil
+}
+
+// Tile fetches a rendered tile, format being "png" or "bin".
+func (c *Client) Tile(ctx context.Context, z int, x int, y int, format string) ([]byte, error) {
+	req, err := c.newRequest(ctx, "GET", fmt.Sprintf("/api/tiles/%d/%d/%d.%s", z, x, y, url.PathEscape(format)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, responseError(resp, data)
+	}
+	return data, nil
+}
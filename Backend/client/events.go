@@ -0,0 +1,75 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// EventStream reads the server-sent events of /api/events.
+type EventStream struct {
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+}
+
+// Events opens the event stream. It stays open until ctx is done or Close
+// is called.
+func (c *Client) Events(ctx context.Context) (*EventStream, error) {
+	req, err := c.newRequest(ctx, "GET", "/api/events", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return nil, responseError(resp, data)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return &EventStream{body: resp.Body, scanner: scanner}, nil
+}
+
+// Next blocks until the next event arrives. It returns io.EOF once the
+// server ends the stream.
+func (s *EventStream) Next() (*Event, error) {
+	var data []string
+	for s.scanner.Scan() {
+		line := s.scanner.Text()
+		switch {
+		case line == "":
+			if len(data) == 0 {
+				continue
+			}
+			var event Event
+			err := json.Unmarshal([]byte(strings.Join(data, "\n")), &event)
+			if err != nil {
+				return nil, err
+			}
+			return &event, nil
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+		// Comments such as the heartbeat and the event name, which the
+		// data repeats as its type, are skipped.
+	}
+
+	err := s.scanner.Err()
+	if err == nil {
+		err = io.EOF
+	}
+	return nil, err
+}
+
+func (s *EventStream) Close() error {
+	return s.body.Close()
+}
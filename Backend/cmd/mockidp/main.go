@@ -0,0 +1,39 @@
+// Command mockidp runs an OpenID Connect provider for logging in to a local
+// rplace without a real one. Point the server at it with
+//
+//	OIDC_PROVIDERS=mock
+//	OIDC_MOCK_ISSUER=http://localhost:9100
+//	OIDC_MOCK_CLIENT_ID=rplace
+//	OIDC_MOCK_CLIENT_SECRET=secret
+//
+// and open /auth/oidc/mock/login.
+package main
+
+import (
+	"flag"
+	"github.com/Jonathanpatta/rplace/mockidp"
+	"log"
+	"net/http"
+	"strings"
+)
+
+func main() {
+	addr := flag.String("addr", ":9100", "address to listen on")
+	issuer := flag.String("issuer", "http://localhost:9100", "issuer URL the provider is reached at")
+	clientId := flag.String("client-id", "rplace", "id of the registered client")
+	secret := flag.String("client-secret", "secret", "secret of the client, empty for a public client")
+	redirects := flag.String("redirect-uris", "", "comma separated callbacks the client may use, any when empty")
+	flag.Parse()
+
+	client := mockidp.Client{Secret: *secret}
+	if *redirects != "" {
+		client.RedirectURIs = strings.Split(*redirects, ",")
+	}
+	provider, err := mockidp.New(*issuer, map[string]mockidp.Client{*clientId: client})
+	if err != nil {
+		log.Fatalf("unable to create the provider, %v", err)
+	}
+
+	log.Printf("mock identity provider %s listening on %s", provider.Issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, provider.Handler()))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"strconv"
+)
+
+func accountsLocked(ctx context.Context, a *app, args []string) error {
+	list, err := a.api().Lockouts(ctx)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(list))
+	for _, f := range list {
+		rows = append(rows, []string{f.Username, strconv.Itoa(f.Failures), formatTime(f.LastFailure), formatTime(f.LockedUntil)})
+	}
+	return a.out.print(list, []string{"USERNAME", "FAILURES", "LAST FAILURE", "LOCKED UNTIL"}, rows)
+}
+
+func accountsUnlock(ctx context.Context, a *app, args []string) error {
+	if len(args) != 1 {
+		return errors.New("accounts unlock takes one username")
+	}
+
+	err := a.api().UnlockAccount(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return a.out.message(map[string]string{"username": args[0]}, "unlocked %s", args[0])
+}
+
+func accountsAudit(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("accounts audit", flag.ContinueOnError)
+	username := fs.String("user", "", "only events about this username")
+	limit := fs.Int("limit", 100, "most events to show")
+	_, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	entries, err := a.api().Audit(ctx, *username, *limit)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(entries))
+	for _, e := range entries {
+		rows = append(rows, []string{formatTime(e.At), e.Event, e.Username, e.By, e.Ip, formatTime(e.Until)})
+	}
+	return a.out.print(entries, []string{"AT", "EVENT", "USERNAME", "BY", "IP", "UNTIL"}, rows)
+}
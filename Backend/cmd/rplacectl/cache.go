@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"strconv"
+)
+
+// The cache is a leveldb database the server keeps open, so it is
+// inspected through the admin API.
+
+func cacheKeys(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("cache keys", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "only list keys starting with this")
+	_, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	entries, err := a.api().CacheKeys(ctx, *prefix)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(entries))
+	for _, e := range entries {
+		rows = append(rows, []string{e.Key, strconv.Itoa(e.Size)})
+	}
+	return a.out.print(entries, []string{"KEY", "SIZE"}, rows)
+}
+
+func cacheGet(ctx context.Context, a *app, args []string) error {
+	if len(args) != 1 {
+		return errors.New("cache get takes one key")
+	}
+
+	e, err := a.api().CacheEntry(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	value := string(e.Value)
+	if value == "" {
+		value = "(not decoded) " + e.Raw
+	}
+	return a.out.print(e, []string{"KEY", "SIZE", "VALUE"}, [][]string{{e.Key, strconv.Itoa(e.Size), value}})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"github.com/Jonathanpatta/rplace/client"
+	"github.com/Jonathanpatta/rplace/placeclone"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func printCanvas(a *app, c *client.Canvas) error {
+	return a.out.print(c, []string{"NAME", "ROWS", "COLS", "PALETTE"}, [][]string{{
+		c.Name, strconv.Itoa(c.Rows), strconv.Itoa(c.Cols), strings.Join(c.Palette, ","),
+	}})
+}
+
+// canvasCreate stores the configuration of a new canvas. A server started
+// with that canvas name picks it up.
+func canvasCreate(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("canvas create", flag.ContinueOnError)
+	rows := fs.Int("rows", placeclone.DefaultRows, "number of rows")
+	cols := fs.Int("cols", placeclone.DefaultCols, "number of columns")
+	palette := fs.String("palette", "", "comma separated hex colors, the default palette when empty")
+	_, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	c := &placeclone.Canvas{
+		Name:      a.canvas,
+		Rows:      *rows,
+		Cols:      *cols,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if *palette != "" {
+		c.Palette = strings.Split(*palette, ",")
+	}
+	err = c.Validate()
+	if err != nil {
+		return err
+	}
+
+	db, err := a.store(ctx)
+	if err != nil {
+		return err
+	}
+	err = placeclone.PutCanvas(ctx, db, a.tableName(), c, true)
+	if err != nil {
+		return err
+	}
+
+	return printCanvas(a, &client.Canvas{Name: c.Name, Rows: c.Rows, Cols: c.Cols, Palette: c.Palette})
+}
+
+func canvasResize(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("canvas resize", flag.ContinueOnError)
+	rows := fs.Int("rows", 0, "number of rows")
+	cols := fs.Int("cols", 0, "number of columns")
+	_, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if *rows <= 0 || *cols <= 0 {
+		return errors.New("-rows and -cols are required")
+	}
+
+	c, err := a.api().ResizeCanvas(ctx, *rows, *cols)
+	if err != nil {
+		return err
+	}
+	return printCanvas(a, c)
+}
+
+func canvasShow(ctx context.Context, a *app, args []string) error {
+	c, err := a.api().Canvas(ctx)
+	if err != nil {
+		return err
+	}
+	return printCanvas(a, c)
+}
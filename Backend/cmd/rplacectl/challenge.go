@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/Jonathanpatta/rplace/client"
+	"strconv"
+)
+
+func challengeShow(ctx context.Context, a *app, args []string) error {
+	c, err := a.api().ChallengeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	return printChallengeConfig(a, c)
+}
+
+// challengeSet changes the settings given as flags and keeps the others.
+func challengeSet(ctx context.Context, a *app, args []string) error {
+	api := a.api()
+	c, err := api.ChallengeConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("challenge set", flag.ContinueOnError)
+	fs.StringVar(&c.Mode, "mode", c.Mode, "off, risk or always")
+	fs.IntVar(&c.Difficulty, "difficulty", c.Difficulty, "leading zero bits a solution needs")
+	fs.IntVar(&c.HighLoad, "high-load", c.HighLoad, "attempts a minute above which everyone is challenged, 0 for never")
+	fs.Int64Var(&c.TTLSeconds, "ttl", c.TTLSeconds, "seconds a challenge stays valid")
+	_, err = parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	c, err = api.ConfigureChallenges(ctx, *c)
+	if err != nil {
+		return err
+	}
+	return printChallengeConfig(a, c)
+}
+
+func printChallengeConfig(a *app, c *client.ChallengeConfig) error {
+	row := []string{c.Mode, strconv.Itoa(c.Difficulty), strconv.Itoa(c.HighLoad), strconv.FormatInt(c.TTLSeconds, 10)}
+	return a.out.print(c, []string{"MODE", "DIFFICULTY", "HIGH LOAD", "TTL"}, [][]string{row})
+}
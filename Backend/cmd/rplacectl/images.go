@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/Jonathanpatta/rplace/broker"
+	"github.com/Jonathanpatta/rplace/client"
+	"github.com/Jonathanpatta/rplace/placeclone"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+)
+
+// importImage paints an image onto the canvas. By default it goes through
+// the admin API, so the pixels are attributed to the caller. With -direct it
+// works on the table instead, skipping the placement rules; running servers
+// then see the pixels right away when they share a Redis broker, given as
+// REDIS_ADDR, and on their next start otherwise.
+func importImage(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	row := fs.Int("row", 0, "canvas row of the top left corner")
+	col := fs.Int("col", 0, "canvas column of the top left corner")
+	dither := fs.String("dither", placeclone.DitherNone, "none or floyd-steinberg")
+	preview := fs.String("preview", "", "write the quantized image to this file instead of painting it")
+	direct := fs.Bool("direct", false, "write to the table instead of going through the API")
+	as := fs.String("as", "admin", "user the pixels are attributed to, with -direct")
+	args, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("import takes one image file")
+	}
+
+	if *direct {
+		return importDirect(ctx, a, args[0], *row, *col, *dither, *preview, *as)
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if *preview != "" {
+		data, err := a.api().PreviewImport(ctx, f, *row, *col, *dither)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(*preview, data, 0644)
+		if err != nil {
+			return err
+		}
+		return a.out.message(map[string]string{"file": *preview}, "wrote preview to %s", *preview)
+	}
+
+	api := a.api()
+	job, err := api.Import(ctx, f, *row, *col, *dither)
+	if err != nil {
+		return err
+	}
+	// The import runs on the server; waiting for it only reports the end.
+	for job.Status == "running" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+		job, err = api.GetImport(ctx, job.Id)
+		if err != nil {
+			return err
+		}
+	}
+	if job.Status == "failed" {
+		return fmt.Errorf("import %s failed after placing %d pixels: %s", job.Id, job.Placed, job.Error)
+	}
+	return a.out.message(job, "placed %d pixels, skipped %d", job.Placed, job.Skipped)
+}
+
+func importDirect(ctx context.Context, a *app, file string, row int, col int, dither string, preview string, as string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	img, err := placeclone.DecodeImport(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	db, err := a.store(ctx)
+	if err != nil {
+		return err
+	}
+	server := placeclone.NewCanvasServer(db, nil, nil, a.canvas)
+	err = server.LoadCanvas(ctx)
+	if err != nil {
+		return err
+	}
+
+	quantized, err := placeclone.QuantizeImage(img, server.Image.Palette, dither)
+	if err != nil {
+		return err
+	}
+	if preview != "" {
+		out, err := os.Create(preview)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		err = png.Encode(out, quantized)
+		if err != nil {
+			return err
+		}
+		return a.out.message(map[string]string{"file": preview}, "wrote preview to %s", preview)
+	}
+
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		server.Broker = broker.NewRedisBroker(addr, os.Getenv("REDIS_PASSWORD"))
+	}
+	result, err := server.Import(ctx, quantized, row, col, as, as, nil)
+	server.Wait()
+	if err != nil {
+		return err
+	}
+	return a.out.message(result, "placed %d pixels, skipped %d", result.Placed, result.Skipped)
+}
+
+// export writes the canvas as served by the API, either as a PNG with one
+// image pixel per canvas pixel or as the JSON list of placed pixels.
+func export(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "png", "png or json")
+	out := fs.String("o", "", "file to write")
+	_, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		return errors.New("-o is required")
+	}
+	if *format != "png" && *format != "json" {
+		return errors.New("-format must be png or json")
+	}
+
+	api := a.api()
+	canvas, err := api.Canvas(ctx)
+	if err != nil {
+		return err
+	}
+	snapshot, err := api.Pixels(ctx)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if *format == "json" {
+		err = newPrinter(f, true).print(snapshot, nil, nil)
+	} else {
+		err = png.Encode(f, render(canvas, snapshot.Pixels))
+	}
+	if err != nil {
+		return err
+	}
+
+	summary := map[string]interface{}{"file": *out, "pixels": len(snapshot.Pixels), "seq": snapshot.Seq}
+	return a.out.message(summary, "wrote %d pixels at seq %s to %s", len(snapshot.Pixels), strconv.FormatInt(snapshot.Seq, 10), *out)
+}
+
+func render(canvas *client.Canvas, pixels []client.Pixel) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, canvas.Cols, canvas.Rows))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+
+	for _, p := range pixels {
+		c, err := placeclone.ParseColor(p.Color)
+		if err != nil {
+			continue
+		}
+		img.Set(p.Col, p.Row, c)
+	}
+	return img
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"github.com/Jonathanpatta/rplace/client"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func keysList(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("keys", flag.ContinueOnError)
+	owner := fs.String("owner", "", "list the keys of this user instead")
+	_, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	keys, err := a.api().APIKeys(ctx, *owner)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(keys))
+	for _, k := range keys {
+		rows = append(rows, []string{k.Id, k.Name, k.Owner, strings.Join(k.Scopes, ","), strconv.Itoa(k.RateLimit), formatTime(k.ExpiresAt), formatTime(k.LastUsed)})
+	}
+	return a.out.print(keys, []string{"ID", "NAME", "OWNER", "SCOPES", "PER MINUTE", "EXPIRES", "LAST USED"}, rows)
+}
+
+func keysCreate(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("keys create", flag.ContinueOnError)
+	name := fs.String("name", "", "what the key is for")
+	scopes := fs.String("scopes", "read", "comma separated scopes: read, place, admin")
+	rate := fs.Int("rate", 0, "requests a minute, the server default when 0")
+	expires := fs.Duration("expires", 0, "how long the key lasts, forever when 0")
+	_, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if *name == "" {
+		return errors.New("keys create needs -name")
+	}
+
+	created, err := a.api().CreateAPIKey(ctx, client.NewAPIKey{
+		Name:      *name,
+		Scopes:    strings.Split(*scopes, ","),
+		RateLimit: *rate,
+		ExpiresIn: int64(*expires / time.Second),
+	})
+	if err != nil {
+		return err
+	}
+	return a.out.message(created, "%s\n\nThis is the only time the key is shown.", created.Key)
+}
+
+func keysRevoke(ctx context.Context, a *app, args []string) error {
+	if len(args) != 1 {
+		return errors.New("keys revoke takes one key id")
+	}
+
+	err := a.api().RevokeAPIKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return a.out.message(map[string]string{"id": args[0]}, "revoked %s", args[0])
+}
@@ -0,0 +1,166 @@
+// Command rplacectl administers an rplace deployment. Commands that change
+// what a running server holds in memory, such as bans and locks, go through
+// its admin API; the others work on the table directly.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/Jonathanpatta/rplace/client"
+	"github.com/Jonathanpatta/rplace/placeclone"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"os"
+	"sort"
+	"strings"
+)
+
+type app struct {
+	server string
+	token  string
+	region string
+	canvas string
+	out    *printer
+
+	db *dynamodb.Client
+}
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, a *app, args []string) error
+}
+
+var commands = map[string]command{
+	"canvas create":   {"canvas create -rows N -cols N [-palette c1,c2,...]", canvasCreate},
+	"canvas resize":   {"canvas resize -rows N -cols N", canvasResize},
+	"canvas show":     {"canvas show", canvasShow},
+	"ban":             {"ban [-reason text] [-duration 24h] <username>", ban},
+	"unban":           {"unban <username>", unban},
+	"bans":            {"bans", bans},
+	"suspects":        {"suspects [-all]", suspects},
+	"challenge show":  {"challenge show", challengeShow},
+	"challenge set":   {"challenge set [-mode off|risk|always] [-difficulty N] [-high-load N] [-ttl seconds]", challengeSet},
+	"suspects clear":  {"suspects clear <username>", clearSuspect},
+	"lock":            {"lock -row N -col N -rows N -cols N [-reason text]", lock},
+	"unlock":          {"unlock <id>", unlock},
+	"locks":           {"locks", locks},
+	"import":          {"import [-row N] [-col N] [-dither none|floyd-steinberg] [-preview file] [-direct [-as user]] <image>", importImage},
+	"export":          {"export [-format png|json] -o <file>", export},
+	"tokens":          {"tokens -user username", tokens},
+	"keys":            {"keys [-owner username]", keysList},
+	"keys create":     {"keys create -name text [-scopes read,place,admin] [-rate N] [-expires 720h]", keysCreate},
+	"keys revoke":     {"keys revoke <id>", keysRevoke},
+	"accounts locked": {"accounts locked", accountsLocked},
+	"accounts unlock": {"accounts unlock <username>", accountsUnlock},
+	"accounts audit":  {"accounts audit [-user username] [-limit N]", accountsAudit},
+	"cache keys":      {"cache keys [-prefix TOKEN#]", cacheKeys},
+	"cache get":       {"cache get <key>", cacheGet},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: rplacectl [flags] <command> [args]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	var lines []string
+	for _, cmd := range commands {
+		lines = append(lines, "  "+cmd.usage)
+	}
+	sort.Strings(lines)
+	fmt.Fprintln(os.Stderr, strings.Join(lines, "\n"))
+	fmt.Fprintln(os.Stderr, "\nflags:")
+	flag.PrintDefaults()
+}
+
+func main() {
+	a := &app{}
+	var output string
+	flag.StringVar(&a.server, "server", getenv("RPLACE_SERVER", "http://localhost:8000"), "base URL of the server, for admin API commands")
+	flag.StringVar(&a.token, "token", os.Getenv("RPLACE_TOKEN"), "admin bearer token, for admin API commands")
+	flag.StringVar(&a.region, "region", getenv("AWS_REGION", "ap-south-1"), "AWS region of the table")
+	flag.StringVar(&a.canvas, "canvas", placeclone.DefaultCanvas, "canvas to work on")
+	flag.StringVar(&output, "output", "table", "output format: table or json")
+	flag.Usage = usage
+	flag.Parse()
+
+	if output != "table" && output != "json" {
+		fmt.Fprintln(os.Stderr, "output must be table or json")
+		os.Exit(2)
+	}
+	a.out = newPrinter(os.Stdout, output == "json")
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[args[0]]
+	rest := args[1:]
+	if len(args) > 1 {
+		if sub, found := commands[args[0]+" "+args[1]]; found {
+			cmd, ok = sub, true
+			rest = args[2:]
+		}
+	}
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	err := cmd.run(context.Background(), a, rest)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "rplacectl:", err)
+		os.Exit(1)
+	}
+}
+
+func getenv(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// api returns a client for the admin API.
+func (a *app) api() *client.Client {
+	c := client.New(a.server)
+	c.Token = a.token
+	return c
+}
+
+// store returns a client for the table.
+func (a *app) store(ctx context.Context) (*dynamodb.Client, error) {
+	if a.db != nil {
+		return a.db, nil
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(a.region))
+	if err != nil {
+		return nil, err
+	}
+	a.db = dynamodb.NewFromConfig(cfg)
+	return a.db, nil
+}
+
+func (a *app) tableName() *string {
+	return aws.String("Place-Clone")
+}
+
+// parse parses the flags of a command, which may come before or after its
+// positional arguments.
+func parse(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		err := fs.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
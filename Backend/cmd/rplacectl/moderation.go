@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"github.com/Jonathanpatta/rplace/client"
+	"strconv"
+)
+
+func ban(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("ban", flag.ContinueOnError)
+	reason := fs.String("reason", "", "reason shown to moderators")
+	duration := fs.Duration("duration", 0, "length of the ban, forever when zero")
+	args, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("ban takes one username")
+	}
+
+	b, err := a.api().Ban(ctx, args[0], *reason, *duration)
+	if err != nil {
+		return err
+	}
+	return printBans(a, []client.Ban{*b})
+}
+
+func unban(ctx context.Context, a *app, args []string) error {
+	if len(args) != 1 {
+		return errors.New("unban takes one username")
+	}
+
+	err := a.api().Unban(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return a.out.message(map[string]string{"username": args[0]}, "unbanned %s", args[0])
+}
+
+func bans(ctx context.Context, a *app, args []string) error {
+	list, err := a.api().Bans(ctx)
+	if err != nil {
+		return err
+	}
+	return printBans(a, list)
+}
+
+func printBans(a *app, list []client.Ban) error {
+	rows := make([][]string, 0, len(list))
+	for _, b := range list {
+		rows = append(rows, []string{b.Username, b.Reason, b.By, formatTime(b.CreatedAt), formatTime(b.Until)})
+	}
+	return a.out.print(list, []string{"USERNAME", "REASON", "BY", "CREATED", "UNTIL"}, rows)
+}
+
+func suspects(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("suspects", flag.ContinueOnError)
+	all := fs.Bool("all", false, "list every scored account, not only flagged ones")
+	_, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	list, err := a.api().Suspicions(ctx, *all)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(list))
+	for _, s := range list {
+		rows = append(rows, []string{
+			s.Username,
+			strconv.FormatFloat(s.Score, 'f', 2, 64),
+			strconv.FormatFloat(s.Regularity, 'f', 2, 64),
+			strconv.FormatFloat(s.AtExpiry, 'f', 2, 64),
+			strconv.FormatFloat(s.Coordinated, 'f', 2, 64),
+			strconv.Itoa(s.Placements),
+			strconv.FormatBool(s.Flagged),
+		})
+	}
+	return a.out.print(list, []string{"USERNAME", "SCORE", "REGULARITY", "AT EXPIRY", "COORDINATED", "PLACEMENTS", "FLAGGED"}, rows)
+}
+
+func clearSuspect(ctx context.Context, a *app, args []string) error {
+	if len(args) != 1 {
+		return errors.New("suspects clear takes one username")
+	}
+
+	err := a.api().ClearSuspicion(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return a.out.message(map[string]string{"username": args[0]}, "cleared the score of %s", args[0])
+}
+
+func lock(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("lock", flag.ContinueOnError)
+	row := fs.Int("row", 0, "top row of the region")
+	col := fs.Int("col", 0, "left column of the region")
+	rows := fs.Int("rows", 0, "height of the region")
+	cols := fs.Int("cols", 0, "width of the region")
+	reason := fs.String("reason", "", "reason shown to moderators")
+	_, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	l, err := a.api().Lock(ctx, *row, *col, *rows, *cols, *reason)
+	if err != nil {
+		return err
+	}
+	return printLocks(a, []client.Lock{*l})
+}
+
+func unlock(ctx context.Context, a *app, args []string) error {
+	if len(args) != 1 {
+		return errors.New("unlock takes one lock id")
+	}
+
+	err := a.api().Unlock(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return a.out.message(map[string]string{"id": args[0]}, "unlocked %s", args[0])
+}
+
+func locks(ctx context.Context, a *app, args []string) error {
+	list, err := a.api().Locks(ctx)
+	if err != nil {
+		return err
+	}
+	return printLocks(a, list)
+}
+
+func printLocks(a *app, list []client.Lock) error {
+	rows := make([][]string, 0, len(list))
+	for _, l := range list {
+		rows = append(rows, []string{
+			l.Id, strconv.Itoa(l.Row), strconv.Itoa(l.Col), strconv.Itoa(l.Rows), strconv.Itoa(l.Cols), l.Reason, l.By,
+		})
+	}
+	return a.out.print(list, []string{"ID", "ROW", "COL", "ROWS", "COLS", "REASON", "BY"}, rows)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"github.com/Jonathanpatta/rplace/auth"
+)
+
+// tokens lists the live sessions of a user, the tokens handed out to them
+// on login. Tokens are shown by their session id, never in full.
+func tokens(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("tokens", flag.ContinueOnError)
+	username := fs.String("user", "", "username whose tokens to list")
+	_, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if *username == "" {
+		return errors.New("tokens needs -user")
+	}
+
+	db, err := a.store(ctx)
+	if err != nil {
+		return err
+	}
+
+	list, err := auth.NewTokens(db, a.tableName(), nil).List(ctx, *username)
+	if err != nil {
+		return err
+	}
+
+	sessions := make([]auth.Session, 0, len(list))
+	rows := make([][]string, 0, len(list))
+	for _, t := range list {
+		session := t.Session("")
+		sessions = append(sessions, session)
+		rows = append(rows, []string{session.Id, formatTime(session.CreatedAt), formatTime(session.ValidTill), formatTime(session.LastUsed)})
+	}
+	return a.out.print(sessions, []string{"SESSION", "CREATED", "VALID TILL", "LAST USED"}, rows)
+}
@@ -0,0 +1,208 @@
+// Package brokertest provides a stand-in for Redis, for testing the Redis
+// broker and the instances sharing one without a real server.
+package brokertest
+
+import (
+	"bufio"
+	"github.com/Jonathanpatta/rplace/internal/resp"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// StandIn is a tiny server speaking the Redis pub/sub commands (PING, AUTH,
+// PUBLISH, SUBSCRIBE, UNSUBSCRIBE, QUIT), so several instances can share a
+// RedisBroker in tests without a real Redis.
+type StandIn struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	channels map[string]map[*standInConn]struct{}
+	conns    map[*standInConn]struct{}
+}
+
+type standInConn struct {
+	conn net.Conn
+
+	mu       sync.Mutex
+	channels map[string]struct{}
+}
+
+func (c *standInConn) write(args ...[]byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return resp.WriteCommand(c.conn, args...)
+}
+
+func (c *standInConn) writeRaw(reply string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.conn.Write([]byte(reply))
+	return err
+}
+
+// ListenStandIn starts a stand-in on addr. Use "127.0.0.1:0" for a free
+// port and Addr to find out which one was picked.
+func ListenStandIn(addr string) (*StandIn, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &StandIn{
+		listener: listener,
+		channels: make(map[string]map[*standInConn]struct{}),
+		conns:    make(map[*standInConn]struct{}),
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *StandIn) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *StandIn) Close() error {
+	err := s.listener.Close()
+	s.DropConnections()
+	return err
+}
+
+// DropConnections closes every client connection, as a restarting Redis
+// would. Clients may connect again right away.
+func (s *StandIn) DropConnections() {
+	s.mu.Lock()
+	conns := make([]*standInConn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.conn.Close()
+	}
+}
+
+// Subscribers is how many connections are subscribed to channel.
+func (s *StandIn) Subscribers(channel string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.channels[channel])
+}
+
+func (s *StandIn) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &standInConn{conn: conn, channels: make(map[string]struct{})}
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+		go s.handle(c)
+	}
+}
+
+func (s *StandIn) handle(c *standInConn) {
+	defer func() {
+		s.mu.Lock()
+		for channel := range c.channels {
+			delete(s.channels[channel], c)
+		}
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.conn.Close()
+	}()
+
+	reader := bufio.NewReader(c.conn)
+	for {
+		reply, err := resp.ReadReply(reader)
+		if err != nil {
+			return
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) == 0 {
+			c.writeRaw("-ERR expected a command\r\n")
+			continue
+		}
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i] = resp.ReplyString(item)
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			err = c.writeRaw("+PONG\r\n")
+		case "AUTH":
+			err = c.writeRaw("+OK\r\n")
+		case "QUIT":
+			c.writeRaw("+OK\r\n")
+			return
+		case "PUBLISH":
+			if len(args) != 3 {
+				err = c.writeRaw("-ERR wrong number of arguments for 'publish'\r\n")
+				break
+			}
+			n := s.publish(args[1], []byte(args[2]))
+			err = c.writeRaw(":" + strconv.Itoa(n) + "\r\n")
+		case "SUBSCRIBE":
+			for _, channel := range args[1:] {
+				s.mu.Lock()
+				if s.channels[channel] == nil {
+					s.channels[channel] = make(map[*standInConn]struct{})
+				}
+				s.channels[channel][c] = struct{}{}
+				c.channels[channel] = struct{}{}
+				count := len(c.channels)
+				s.mu.Unlock()
+				err = c.writeRaw(confirmation("subscribe", channel, count))
+			}
+		case "UNSUBSCRIBE":
+			channels := args[1:]
+			if len(channels) == 0 {
+				s.mu.Lock()
+				for channel := range c.channels {
+					channels = append(channels, channel)
+				}
+				s.mu.Unlock()
+			}
+			for _, channel := range channels {
+				s.mu.Lock()
+				delete(s.channels[channel], c)
+				delete(c.channels, channel)
+				count := len(c.channels)
+				s.mu.Unlock()
+				err = c.writeRaw(confirmation("unsubscribe", channel, count))
+			}
+		default:
+			err = c.writeRaw("-ERR unknown command '" + args[0] + "'\r\n")
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *StandIn) publish(channel string, payload []byte) int {
+	s.mu.Lock()
+	subscribers := make([]*standInConn, 0, len(s.channels[channel]))
+	for c := range s.channels[channel] {
+		subscribers = append(subscribers, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range subscribers {
+		c.write([]byte("message"), []byte(channel), payload)
+	}
+	return len(subscribers)
+}
+
+// confirmation is the reply to (UN)SUBSCRIBE: the command, the channel and
+// how many channels the connection is subscribed to afterwards.
+func confirmation(kind string, channel string, count int) string {
+	return "*3\r\n$" + strconv.Itoa(len(kind)) + "\r\n" + kind + "\r\n" +
+		"$" + strconv.Itoa(len(channel)) + "\r\n" + channel + "\r\n" +
+		":" + strconv.Itoa(count) + "\r\n"
+}
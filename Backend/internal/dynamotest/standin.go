@@ -0,0 +1,755 @@
+// Package dynamotest provides a stand-in for DynamoDB, for testing code that
+// keeps its state in the table without a real one.
+package dynamotest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// StandIn is a tiny server speaking the DynamoDB JSON protocol for
+// GetItem, PutItem, UpdateItem, DeleteItem, Query, BatchGetItem,
+// TransactGetItems and TransactWriteItems, with Put, Update, Delete and
+// ConditionCheck. Every table name shares one table keyed by PK and SK.
+// Conditions are limited to comparisons, of booleans only for equality,
+// begins_with, attribute_exists and attribute_not_exists joined by AND or
+// OR, without parentheses, and updates to SET with plain values, ADD of
+// numbers and REMOVE; anything else is refused, so that a test fails
+// instead of passing by accident.
+type StandIn struct {
+	server *httptest.Server
+
+	mu         sync.Mutex
+	partitions map[string]map[string]item
+}
+
+type value map[string]interface{}
+
+type item map[string]value
+
+// Start starts a stand-in on a free local port.
+func Start() *StandIn {
+	s := &StandIn{partitions: make(map[string]map[string]item)}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *StandIn) URL() string {
+	return s.server.URL
+}
+
+func (s *StandIn) Close() {
+	s.server.Close()
+}
+
+// Client returns a client of the stand-in. The endpoint is built on every
+// call, as the resolver from EndpointResolverFromURL writes to the endpoint
+// it shares between requests.
+func (s *StandIn) Client() *dynamodb.Client {
+	url := s.server.URL
+	return dynamodb.New(dynamodb.Options{
+		Region:      "local",
+		Credentials: aws.AnonymousCredentials{},
+		EndpointResolver: dynamodb.EndpointResolverFunc(func(region string, options dynamodb.EndpointResolverOptions) (aws.Endpoint, error) {
+			return aws.Endpoint{URL: url, SigningRegion: region, Source: aws.EndpointSourceCustom}, nil
+		}),
+	})
+}
+
+// Partition returns the items under pk as plain values, for tests to look
+// at what was written.
+func (s *StandIn) Partition(pk string) []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []map[string]interface{}
+	for _, sk := range sortedKeys(s.partitions[pk]) {
+		plain := make(map[string]interface{})
+		for name, v := range s.partitions[pk][sk] {
+			for _, inner := range v {
+				plain[name] = inner
+			}
+		}
+		list = append(list, plain)
+	}
+	return list
+}
+
+func sortedKeys(partition map[string]item) []string {
+	keys := make([]string, 0, len(partition))
+	for sk := range partition {
+		keys = append(keys, sk)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type apiError struct {
+	kind    string
+	message string
+	reasons []string
+}
+
+func (e *apiError) Error() string {
+	return e.kind + ": " + e.message
+}
+
+func validation(format string, args ...interface{}) *apiError {
+	return &apiError{kind: "ValidationException", message: fmt.Sprintf(format, args...)}
+}
+
+var conditionFailed = &apiError{kind: "ConditionalCheckFailedException", message: "The conditional request failed"}
+
+func (s *StandIn) serve(w http.ResponseWriter, r *http.Request) {
+	operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.")
+
+	var body map[string]json.RawMessage
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeError(w, validation("malformed request: %s", err.Error()))
+		return
+	}
+
+	s.mu.Lock()
+	var out interface{}
+	var failure *apiError
+	switch operation {
+	case "GetItem":
+		out, failure = s.getItem(body)
+	case "PutItem":
+		out, failure = s.putItem(body)
+	case "UpdateItem":
+		out, failure = s.updateItem(body)
+	case "DeleteItem":
+		out, failure = s.deleteItem(body)
+	case "Query":
+		out, failure = s.query(body)
+	case "BatchGetItem":
+		out, failure = s.batchGetItem(body)
+	case "TransactGetItems":
+		out, failure = s.transactGetItems(body)
+	case "TransactWriteItems":
+		out, failure = s.transactWriteItems(body)
+	default:
+		failure = &apiError{kind: "UnknownOperationException", message: "the stand-in does not support " + operation}
+	}
+	s.mu.Unlock()
+
+	if failure != nil {
+		writeError(w, failure)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	json.NewEncoder(w).Encode(out)
+}
+
+func writeError(w http.ResponseWriter, e *apiError) {
+	body := map[string]interface{}{
+		"__type":  "com.amazonaws.dynamodb.v20120810#" + e.kind,
+		"message": e.message,
+	}
+	if e.reasons != nil {
+		reasons := make([]map[string]string, len(e.reasons))
+		for i, code := range e.reasons {
+			reasons[i] = map[string]string{"Code": code}
+		}
+		body["CancellationReasons"] = reasons
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	w.Header().Set("X-Amzn-ErrorType", e.kind)
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(body)
+}
+
+// request is what the operations read from their input.
+type request struct {
+	Key                       item
+	Item                      item
+	ConditionExpression       string
+	UpdateExpression          string
+	KeyConditionExpression    string
+	FilterExpression          string
+	ExpressionAttributeNames  map[string]string
+	ExpressionAttributeValues item
+	ScanIndexForward          *bool
+	ReturnValues              string
+}
+
+func decode(body map[string]json.RawMessage) (*request, *apiError) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, validation("%s", err.Error())
+	}
+	var req request
+	err = json.Unmarshal(raw, &req)
+	if err != nil {
+		return nil, validation("%s", err.Error())
+	}
+	return &req, nil
+}
+
+// scalar returns the string or number in v as a string.
+func scalar(v value) (string, bool) {
+	if s, ok := v["S"].(string); ok {
+		return s, true
+	}
+	if n, ok := v["N"].(string); ok {
+		return n, true
+	}
+	return "", false
+}
+
+func key(it item) (string, string, *apiError) {
+	pk, ok := scalar(it["PK"])
+	if !ok {
+		return "", "", validation("the key has no PK")
+	}
+	sk, ok := scalar(it["SK"])
+	if !ok {
+		return "", "", validation("the key has no SK")
+	}
+	return pk, sk, nil
+}
+
+func (s *StandIn) find(k item) (item, *apiError) {
+	pk, sk, err := key(k)
+	if err != nil {
+		return nil, err
+	}
+	return s.partitions[pk][sk], nil
+}
+
+func (s *StandIn) put(it item) *apiError {
+	pk, sk, err := key(it)
+	if err != nil {
+		return err
+	}
+	if s.partitions[pk] == nil {
+		s.partitions[pk] = make(map[string]item)
+	}
+	s.partitions[pk][sk] = it
+	return nil
+}
+
+func (s *StandIn) delete(k item) *apiError {
+	pk, sk, err := key(k)
+	if err != nil {
+		return err
+	}
+	delete(s.partitions[pk], sk)
+	return nil
+}
+
+func (s *StandIn) getItem(body map[string]json.RawMessage) (interface{}, *apiError) {
+	req, err := decode(body)
+	if err != nil {
+		return nil, err
+	}
+	found, err := s.find(req.Key)
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return map[string]interface{}{}, nil
+	}
+	return map[string]interface{}{"Item": found}, nil
+}
+
+// check evaluates the condition of req against the item under k.
+func (s *StandIn) check(req *request, k item) *apiError {
+	if req.ConditionExpression == "" {
+		return nil
+	}
+	current, err := s.find(k)
+	if err != nil {
+		return err
+	}
+	ok, err := evaluate(req.ConditionExpression, current, req)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return conditionFailed
+	}
+	return nil
+}
+
+func (s *StandIn) putItem(body map[string]json.RawMessage) (interface{}, *apiError) {
+	req, err := decode(body)
+	if err != nil {
+		return nil, err
+	}
+	err = s.check(req, req.Item)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{}, s.put(req.Item)
+}
+
+func (s *StandIn) updateItem(body map[string]json.RawMessage) (interface{}, *apiError) {
+	req, err := decode(body)
+	if err != nil {
+		return nil, err
+	}
+	err = s.check(req, req.Key)
+	if err != nil {
+		return nil, err
+	}
+	old, err := s.find(req.Key)
+	if err != nil {
+		return nil, err
+	}
+	updated, changed, err := applyUpdate(old, req)
+	if err != nil {
+		return nil, err
+	}
+	err = s.put(updated)
+	if err != nil {
+		return nil, err
+	}
+
+	var attributes item
+	switch req.ReturnValues {
+	case "", "NONE":
+	case "ALL_OLD":
+		attributes = old
+	case "ALL_NEW":
+		attributes = updated
+	case "UPDATED_NEW":
+		attributes = item{}
+		for _, name := range changed {
+			attributes[name] = updated[name]
+		}
+	default:
+		return nil, validation("the stand-in does not support ReturnValues %s", req.ReturnValues)
+	}
+	if attributes == nil {
+		return map[string]interface{}{}, nil
+	}
+	return map[string]interface{}{"Attributes": attributes}, nil
+}
+
+// applyUpdate returns a copy of old, or a new item under the key of req,
+// with the update expression of req applied, along with the attributes it
+// set or added to.
+func applyUpdate(old item, req *request) (item, []string, *apiError) {
+	updated := item{}
+	for name, v := range old {
+		updated[name] = v
+	}
+	for name, v := range req.Key {
+		updated[name] = v
+	}
+
+	// The expression is a series of SET, ADD and REMOVE clauses, each with
+	// a comma separated list of actions.
+	var clauses [][2]string
+	for _, token := range strings.Fields(req.UpdateExpression) {
+		switch token {
+		case "SET", "ADD", "REMOVE":
+			clauses = append(clauses, [2]string{token, ""})
+			continue
+		case "DELETE":
+			return nil, nil, validation("the stand-in does not support DELETE in %q", req.UpdateExpression)
+		}
+		if len(clauses) == 0 {
+			return nil, nil, validation("malformed update %q", req.UpdateExpression)
+		}
+		clauses[len(clauses)-1][1] += " " + token
+	}
+
+	var changed []string
+	for _, clause := range clauses {
+		keyword := clause[0]
+		for _, action := range strings.Split(clause[1], ",") {
+			parts := strings.Fields(action)
+			switch {
+			case keyword == "SET" && len(parts) == 3 && parts[1] == "=":
+				v, ok := req.ExpressionAttributeValues[parts[2]]
+				if !ok {
+					return nil, nil, validation("no value for %s", parts[2])
+				}
+				name := resolveName(parts[0], req)
+				updated[name] = v
+				changed = append(changed, name)
+			case keyword == "ADD" && len(parts) == 2:
+				v, ok := req.ExpressionAttributeValues[parts[1]]
+				if !ok {
+					return nil, nil, validation("no value for %s", parts[1])
+				}
+				name := resolveName(parts[0], req)
+				sum, err := add(updated[name], v)
+				if err != nil {
+					return nil, nil, err
+				}
+				updated[name] = sum
+				changed = append(changed, name)
+			case keyword == "REMOVE" && len(parts) == 1:
+				delete(updated, resolveName(parts[0], req))
+			default:
+				return nil, nil, validation("the stand-in does not support %s %q", keyword, strings.TrimSpace(action))
+			}
+		}
+	}
+	return updated, changed, nil
+}
+
+// add adds the number in delta to have, which is nil when the attribute
+// does not exist yet.
+func add(have value, delta value) (value, *apiError) {
+	d, ok := delta["N"].(string)
+	if !ok {
+		return nil, validation("the stand-in only supports ADD of numbers")
+	}
+	if have == nil {
+		return value{"N": d}, nil
+	}
+	h, ok := have["N"].(string)
+	if !ok {
+		return nil, validation("ADD to an attribute that is not a number")
+	}
+
+	hi, err1 := strconv.ParseInt(h, 10, 64)
+	di, err2 := strconv.ParseInt(d, 10, 64)
+	if err1 == nil && err2 == nil {
+		return value{"N": strconv.FormatInt(hi+di, 10)}, nil
+	}
+	hf, err1 := strconv.ParseFloat(h, 64)
+	df, err2 := strconv.ParseFloat(d, 64)
+	if err1 != nil || err2 != nil {
+		return nil, validation("malformed number in ADD")
+	}
+	return value{"N": strconv.FormatFloat(hf+df, 'f', -1, 64)}, nil
+}
+
+func (s *StandIn) deleteItem(body map[string]json.RawMessage) (interface{}, *apiError) {
+	req, err := decode(body)
+	if err != nil {
+		return nil, err
+	}
+	err = s.check(req, req.Key)
+	if err != nil {
+		return nil, err
+	}
+	old, err := s.find(req.Key)
+	if err != nil {
+		return nil, err
+	}
+	err = s.delete(req.Key)
+	if err != nil {
+		return nil, err
+	}
+	if req.ReturnValues == "ALL_OLD" && old != nil {
+		return map[string]interface{}{"Attributes": old}, nil
+	}
+	return map[string]interface{}{}, nil
+}
+
+func (s *StandIn) query(body map[string]json.RawMessage) (interface{}, *apiError) {
+	req, err := decode(body)
+	if err != nil {
+		return nil, err
+	}
+
+	// The partition is named by the first clause, PK = :value.
+	first := strings.SplitN(req.KeyConditionExpression, " AND ", 2)[0]
+	parts := strings.Fields(first)
+	if len(parts) != 3 || parts[1] != "=" || resolveName(parts[0], req) != "PK" {
+		return nil, validation("unsupported key condition %q", req.KeyConditionExpression)
+	}
+	pk, ok := scalar(req.ExpressionAttributeValues[parts[2]])
+	if !ok {
+		return nil, validation("no value for %s", parts[2])
+	}
+
+	keys := sortedKeys(s.partitions[pk])
+	if req.ScanIndexForward != nil && !*req.ScanIndexForward {
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+
+	items := []item{}
+	for _, sk := range keys {
+		it := s.partitions[pk][sk]
+		for _, expression := range []string{req.KeyConditionExpression, req.FilterExpression} {
+			if expression == "" {
+				continue
+			}
+			ok, err = evaluate(expression, it, req)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				break
+			}
+		}
+		if ok {
+			items = append(items, it)
+		}
+	}
+	return map[string]interface{}{"Items": items, "Count": len(items), "ScannedCount": len(keys)}, nil
+}
+
+func (s *StandIn) batchGetItem(body map[string]json.RawMessage) (interface{}, *apiError) {
+	var tables map[string]struct {
+		Keys []item
+	}
+	err := json.Unmarshal(body["RequestItems"], &tables)
+	if err != nil {
+		return nil, validation("%s", err.Error())
+	}
+
+	responses := map[string][]item{}
+	for table, request := range tables {
+		if len(request.Keys) > 100 {
+			return nil, validation("too many keys in BatchGetItem")
+		}
+		responses[table] = []item{}
+		for _, k := range request.Keys {
+			found, failure := s.find(k)
+			if failure != nil {
+				return nil, failure
+			}
+			if found != nil {
+				responses[table] = append(responses[table], found)
+			}
+		}
+	}
+	return map[string]interface{}{"Responses": responses, "UnprocessedKeys": map[string]interface{}{}}, nil
+}
+
+func (s *StandIn) transactGetItems(body map[string]json.RawMessage) (interface{}, *apiError) {
+	var items []struct {
+		Get *request
+	}
+	err := json.Unmarshal(body["TransactItems"], &items)
+	if err != nil {
+		return nil, validation("%s", err.Error())
+	}
+
+	responses := make([]map[string]interface{}, len(items))
+	for i, t := range items {
+		if t.Get == nil {
+			return nil, validation("a transaction of reads only holds Get")
+		}
+		found, failure := s.find(t.Get.Key)
+		if failure != nil {
+			return nil, failure
+		}
+		responses[i] = map[string]interface{}{}
+		if found != nil {
+			responses[i]["Item"] = found
+		}
+	}
+	return map[string]interface{}{"Responses": responses}, nil
+}
+
+type transactItem struct {
+	Put            *request
+	Delete         *request
+	ConditionCheck *request
+	Update         *request
+}
+
+func (s *StandIn) transactWriteItems(body map[string]json.RawMessage) (interface{}, *apiError) {
+	var items []transactItem
+	err := json.Unmarshal(body["TransactItems"], &items)
+	if err != nil {
+		return nil, validation("%s", err.Error())
+	}
+
+	// Every condition is checked before anything is written, and a failed
+	// one cancels the whole transaction.
+	reasons := make([]string, len(items))
+	canceled := false
+	for i, t := range items {
+		var failure *apiError
+		switch {
+		case t.Put != nil:
+			failure = s.check(t.Put, t.Put.Item)
+		case t.Update != nil:
+			failure = s.check(t.Update, t.Update.Key)
+		case t.Delete != nil:
+			failure = s.check(t.Delete, t.Delete.Key)
+		case t.ConditionCheck != nil:
+			failure = s.check(t.ConditionCheck, t.ConditionCheck.Key)
+		default:
+			return nil, validation("a transaction item holds none of Put, Update, Delete and ConditionCheck")
+		}
+		reasons[i] = "None"
+		if failure == conditionFailed {
+			reasons[i] = "ConditionalCheckFailed"
+			canceled = true
+		} else if failure != nil {
+			return nil, failure
+		}
+	}
+	if canceled {
+		return nil, &apiError{
+			kind:    "TransactionCanceledException",
+			message: "Transaction cancelled, please refer cancellation reasons for specific reasons [" + strings.Join(reasons, ", ") + "]",
+			reasons: reasons,
+		}
+	}
+
+	for _, t := range items {
+		var failure *apiError
+		switch {
+		case t.Put != nil:
+			failure = s.put(t.Put.Item)
+		case t.Update != nil:
+			var old, updated item
+			old, failure = s.find(t.Update.Key)
+			if failure == nil {
+				updated, _, failure = applyUpdate(old, t.Update)
+			}
+			if failure == nil {
+				failure = s.put(updated)
+			}
+		case t.Delete != nil:
+			failure = s.delete(t.Delete.Key)
+		}
+		if failure != nil {
+			return nil, failure
+		}
+	}
+	return map[string]interface{}{}, nil
+}
+
+func resolveName(name string, req *request) string {
+	if strings.HasPrefix(name, "#") {
+		return req.ExpressionAttributeNames[name]
+	}
+	return name
+}
+
+// evaluate evaluates expression against it, which is nil when there is no
+// item. AND binds tighter than OR.
+func evaluate(expression string, it item, req *request) (bool, *apiError) {
+	if strings.ContainsAny(expression, "()") && strings.Count(expression, "(") != strings.Count(expression, "_exists(")+strings.Count(expression, "begins_with(") {
+		return false, validation("the stand-in does not support parentheses in %q", expression)
+	}
+
+	for _, alternative := range strings.Split(expression, " OR ") {
+		all := true
+		for _, clause := range strings.Split(alternative, " AND ") {
+			ok, err := clauseHolds(strings.TrimSpace(clause), it, req)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				all = false
+				break
+			}
+		}
+		if all {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func clauseHolds(clause string, it item, req *request) (bool, *apiError) {
+	function := func(name string) (string, bool) {
+		if !strings.HasPrefix(clause, name+"(") || !strings.HasSuffix(clause, ")") {
+			return "", false
+		}
+		return strings.TrimSuffix(strings.TrimPrefix(clause, name+"("), ")"), true
+	}
+
+	if arg, ok := function("attribute_exists"); ok {
+		_, exists := it[resolveName(strings.TrimSpace(arg), req)]
+		return exists, nil
+	}
+	if arg, ok := function("attribute_not_exists"); ok {
+		_, exists := it[resolveName(strings.TrimSpace(arg), req)]
+		return !exists, nil
+	}
+	if args, ok := function("begins_with"); ok {
+		parts := strings.Split(args, ",")
+		if len(parts) != 2 {
+			return false, validation("malformed %q", clause)
+		}
+		have, _ := scalar(it[resolveName(strings.TrimSpace(parts[0]), req)])
+		prefix, ok := scalar(req.ExpressionAttributeValues[strings.TrimSpace(parts[1])])
+		if !ok {
+			return false, validation("no value for %s", parts[1])
+		}
+		return strings.HasPrefix(have, prefix), nil
+	}
+
+	parts := strings.Fields(clause)
+	if len(parts) != 3 {
+		return false, validation("the stand-in does not support %q", clause)
+	}
+	v, exists := it[resolveName(parts[0], req)]
+	if !exists {
+		return false, nil
+	}
+	want, ok := req.ExpressionAttributeValues[parts[2]]
+	if !ok {
+		return false, validation("no value for %s", parts[2])
+	}
+	return compare(parts[1], v, want)
+}
+
+func compare(operator string, have value, want value) (bool, *apiError) {
+	if h, ok := have["BOOL"].(bool); ok {
+		w, isBool := want["BOOL"].(bool)
+		switch operator {
+		case "=":
+			return isBool && h == w, nil
+		case "<>":
+			return !isBool || h != w, nil
+		}
+		return false, validation("the stand-in does not order booleans with %s", operator)
+	}
+
+	var order int
+	if h, ok := have["N"].(string); ok {
+		w, _ := want["N"].(string)
+		hn, err1 := strconv.ParseFloat(h, 64)
+		wn, err2 := strconv.ParseFloat(w, 64)
+		if err1 != nil || err2 != nil {
+			return false, nil
+		}
+		switch {
+		case hn < wn:
+			order = -1
+		case hn > wn:
+			order = 1
+		}
+	} else {
+		h, ok1 := have["S"].(string)
+		w, ok2 := want["S"].(string)
+		if !ok1 || !ok2 {
+			return false, nil
+		}
+		order = strings.Compare(h, w)
+	}
+
+	switch operator {
+	case "=":
+		return order == 0, nil
+	case "<>":
+		return order != 0, nil
+	case "<":
+		return order < 0, nil
+	case "<=":
+		return order <= 0, nil
+	case ">":
+		return order > 0, nil
+	case ">=":
+		return order >= 0, nil
+	}
+	return false, validation("the stand-in does not support the operator %s", operator)
+}
@@ -0,0 +1,120 @@
+// Package mailer sends the emails of the auth flows. SMTPMailer delivers
+// them; FileMailer and MemoryMailer keep them for local testing.
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+type Mailer interface {
+	Send(ctx context.Context, m *Message) error
+}
+
+// format renders a plain text message with the headers mail servers expect.
+func format(from string, m *Message, now time.Time) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// SMTPMailer sends through an SMTP server, authenticating with PLAIN auth
+// when a username is given.
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+func NewSMTPMailer(addr string, from string, username string, password string) *SMTPMailer {
+	m := &SMTPMailer{Addr: addr, From: from}
+	if username != "" {
+		host := addr
+		if i := strings.LastIndex(addr, ":"); i >= 0 {
+			host = addr[:i]
+		}
+		m.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+// Send ignores ctx beyond checking it up front, since net/smtp has no way
+// to cancel a send.
+func (s *SMTPMailer) Send(ctx context.Context, m *Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return smtp.SendMail(s.Addr, s.Auth, s.From, []string{m.To}, format(s.From, m, time.Now()))
+}
+
+// FileMailer writes every message to its own .eml file in Dir.
+type FileMailer struct {
+	Dir  string
+	From string
+
+	mu sync.Mutex
+	n  int
+}
+
+func NewFileMailer(dir string, from string) (*FileMailer, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileMailer{Dir: dir, From: from}, nil
+}
+
+func (f *FileMailer) Send(ctx context.Context, m *Message) error {
+	now := time.Now()
+
+	f.mu.Lock()
+	f.n++
+	name := fmt.Sprintf("%d-%04d.eml", now.UnixNano(), f.n)
+	f.mu.Unlock()
+
+	return ioutil.WriteFile(filepath.Join(f.Dir, name), format(f.From, m, now), 0644)
+}
+
+// MemoryMailer keeps the messages it is given.
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []Message
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(ctx context.Context, msg *Message) error {
+	m.mu.Lock()
+	m.sent = append(m.sent, *msg)
+	m.mu.Unlock()
+	return nil
+}
+
+// Sent returns the messages sent so far, oldest first.
+func (m *MemoryMailer) Sent() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.sent...)
+}
@@ -2,17 +2,29 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"fmt"
 	"github.com/Jonathanpatta/rplace/auth"
+	"github.com/Jonathanpatta/rplace/broker"
 	"github.com/Jonathanpatta/rplace/cache"
+	"github.com/Jonathanpatta/rplace/challenge"
+	"github.com/Jonathanpatta/rplace/mailer"
 	"github.com/Jonathanpatta/rplace/middleware"
+	"github.com/Jonathanpatta/rplace/openapi"
 	"github.com/Jonathanpatta/rplace/placeclone"
+	"github.com/Jonathanpatta/rplace/ratelimit"
+	"github.com/Jonathanpatta/rplace/webhook"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 )
 
 func main() {
@@ -32,31 +44,210 @@ func main() {
 	}
 
 	DbCli := dynamodb.NewFromConfig(cfg)
-	sessionStore := sessions.NewCookieStore([]byte("aksjdfjjlasdfjlkjlasdf"))
+	// The session key signs the login cookies, so a key anyone can read
+	// would let anyone log in as anyone.
+	requireSecret("SESSION_SECRET", "logins end when the instance restarts and cookies of other instances are refused")
+	sessionKey := []byte(os.Getenv("SESSION_SECRET"))
+	if len(sessionKey) == 0 {
+		sessionKey = make([]byte, 32)
+		_, err = rand.Read(sessionKey)
+		if err != nil {
+			log.Fatalf("unable to create a session key, %v", err)
+		}
+	}
+	sessionStore := sessions.NewCookieStore(sessionKey)
 	userpoolId := "ap-south-1_DTkRR7wmN"
+	if id, ok := os.LookupEnv("COGNITO_USER_POOL_ID"); ok {
+		userpoolId = id
+	}
 	middlewareServer := middleware.NewAuthMiddlewareServer(sessionStore, client, DbCli, userpoolId)
 
+	// Access tokens of local accounts are signed with keys kept in the
+	// table, so every instance verifies them without going to Cognito. The
+	// keys are sealed with JWT_KEY_SECRET there.
+	issuer := os.Getenv("JWT_ISSUER")
+	if issuer == "" {
+		issuer = "rplace"
+	}
+	requireSecret("JWT_KEY_SECRET", "access tokens signed by other instances are refused, and by this one once it restarts")
+	signer, err := auth.NewSigner(DbCli, aws.String("Place-Clone"), issuer, []byte(os.Getenv("JWT_KEY_SECRET")))
+	if err != nil {
+		log.Fatalf("unable to create the token signer, %v", err)
+	}
+	err = signer.Start(context.Background(), 10*time.Minute)
+	if err != nil {
+		fmt.Println("signing keys could not be loaded:", err.Error())
+		signer = nil
+	}
+	middlewareServer.Signer = signer
+
 	mainRouter := mux.NewRouter()
 
 	mainRouter.Use(middleware.CorsMiddleware)
 
+	webhooks := webhook.NewDispatcher(DbCli)
+	// Local setups point webhooks at services on the same machine.
+	webhooks.AllowPrivateTargets = os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true"
+	err = webhooks.Start(context.Background(), 4)
+	if err != nil {
+		fmt.Println("webhook subscriptions could not be loaded:", err.Error())
+	}
+
+	webhookServerOptions := &webhook.Options{
+		Dispatcher:     webhooks,
+		AuthMiddleware: middlewareServer,
+	}
+
+	// Instances serving the same canvas share placements and token
+	// revocations through Redis when it is configured; a single instance
+	// gets by with the in-process broker.
+	var pixelBroker broker.Broker = broker.NewMemoryBroker()
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		pixelBroker = broker.NewRedisBroker(addr, os.Getenv("REDIS_PASSWORD"))
+	}
+
+	// Instances behind the same load balancer need the same secret to accept
+	// each other's challenges.
+	requireSecret("CHALLENGE_SECRET", "challenges solved on one instance are refused by the others")
+	challenges, err := challenge.NewIssuer([]byte(os.Getenv("CHALLENGE_SECRET")))
+	if err != nil {
+		log.Fatalf("unable to create the challenge issuer, %v", err)
+	}
+	challenges.DbCli = DbCli
+	challenges.TableName = aws.String("Place-Clone")
+
 	placecloneServerOptions := &placeclone.Options{
 		DbCli:          DbCli,
 		Store:          sessionStore,
 		CacheCli:       client,
 		AuthMiddleware: middlewareServer,
+		Webhooks:       webhooks,
+		Broker:         pixelBroker,
+		Challenges:     challenges,
+	}
+
+	// Behind a load balancer, TRUSTED_PROXIES lists its addresses so the
+	// client is read from X-Forwarded-For.
+	limiter, err := ratelimit.New(ratelimit.NewCacheStore(client), strings.Split(os.Getenv("TRUSTED_PROXIES"), ","))
+	if err != nil {
+		log.Fatalf("unable to create the rate limiter, %v", err)
 	}
 
+	// Mail goes out through SMTP_ADDR when it is set. Otherwise messages are
+	// written to MAIL_DIR, for reading the links during local development.
+	var mail mailer.Mailer
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = "rplace <no-reply@localhost>"
+	}
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		mail = mailer.NewSMTPMailer(addr, from, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+	} else {
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "/tmp/rplace-mail"
+		}
+		mail, err = mailer.NewFileMailer(dir, from)
+		if err != nil {
+			log.Fatalf("unable to create the mail directory, %v", err)
+		}
+	}
+
+	publicURL := os.Getenv("PUBLIC_URL")
+	if publicURL == "" {
+		publicURL = "http://localhost:3000"
+	}
+	middleware.AllowedOrigin = publicURL
+
+	// OIDC_PROVIDERS names the OpenID Connect providers accounts can log in
+	// with, each set up by OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET and
+	// optionally _SCOPES. Their callbacks are registered under API_URL.
+	apiURL := os.Getenv("API_URL")
+	if apiURL == "" {
+		apiURL = "http://localhost:8000"
+	}
+	var providers []*auth.OIDCProvider
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		provider := auth.NewOIDCProvider(name, os.Getenv(prefix+"ISSUER"), os.Getenv(prefix+"CLIENT_ID"), os.Getenv(prefix+"CLIENT_SECRET"),
+			strings.TrimSuffix(apiURL, "/")+"/auth/oidc/"+name+"/callback")
+		if scopes := os.Getenv(prefix + "SCOPES"); scopes != "" {
+			provider.Scopes = strings.Fields(scopes)
+		}
+		providers = append(providers, provider)
+	}
+
+	// API keys are checked by the middleware and managed under /auth/keys.
+	// Each key gets its own rate limit in the same buckets as the IP limits.
+	apiKeys := auth.NewAPIKeys(DbCli, aws.String("Place-Clone"), client)
+	apiKeys.Limiter = limiter
+	middlewareServer.APIKeys = middleware.LookupAPIKeys(apiKeys)
+	middlewareServer.APIKeyPrefix = auth.APIKeyPrefix
+
+	requireSecret("EMAIL_TOKEN_SECRET", "links mailed by one instance are refused by the others and by this one once it restarts")
 	authServerOptions := &auth.Options{
-		DbCli: DbCli,
-		Store: sessionStore,
+		DbCli:         DbCli,
+		Store:         sessionStore,
+		Cache:         client,
+		Broker:        pixelBroker,
+		Challenges:    challenges,
+		Limiter:       limiter,
+		Admin:         []mux.MiddlewareFunc{middlewareServer.Authenticate, middleware.AdminOnly},
+		Identity:      middleware.Identity,
+		Mailer:        mail,
+		TokenSecret:   []byte(os.Getenv("EMAIL_TOKEN_SECRET")),
+		PublicURL:     publicURL,
+		Signer:        signer,
+		Authenticated: []mux.MiddlewareFunc{middlewareServer.Authenticate},
+		Caller:        middleware.Caller,
+		OIDC:          providers,
 	}
 
-	placeclone.AddSubrouter(placecloneServerOptions, mainRouter)
-	auth.AddSubrouter(authServerOptions, mainRouter)
+	challengeServerOptions := &challenge.Options{
+		Issuer: challenges,
+	}
+
+	webhook.AddSubrouter(webhookServerOptions, mainRouter)
+	challenge.AddSubrouter(challengeServerOptions, mainRouter)
+	placecloneServer := placeclone.AddSubrouter(placecloneServerOptions, mainRouter)
+	err = auth.AddSubrouter(authServerOptions, mainRouter)
+	if err != nil {
+		log.Fatalf("unable to mount the auth routes, %v", err)
+	}
+
+	spec := openapi.NewSpec("rplace", "1.0.0")
+	auth.Describe(spec)
+	challenge.Describe(spec)
+	placeclone.Describe(spec)
+	mainRouter.HandleFunc("/openapi.json", spec.Handler(mainRouter)).Methods("GET")
+
+	grpcListener, err := net.Listen("tcp", ":9000")
+	if err != nil {
+		log.Fatalf("unable to listen for grpc, %v", err)
+	}
+	grpcServer := placeclone.NewGrpcServer(placecloneServer, middlewareServer)
+	go grpcServer.Serve(grpcListener)
 
 	http.Handle("/", mainRouter)
 
 	http.ListenAndServe(":8000", nil)
 
 }
+
+// requireSecret checks that the secret in the environment variable name is
+// set. Instances sharing a broker cannot do without it, so they refuse to
+// start; a single one falls back to a random secret, and warns about what
+// that breaks.
+func requireSecret(name string, breaks string) {
+	if os.Getenv(name) != "" {
+		return
+	}
+	if os.Getenv("REDIS_ADDR") != "" {
+		log.Fatalf("%s is not set, and instances sharing a broker need the same one", name)
+	}
+	log.Printf("WARNING: %s is not set, using a random one: %s", name, breaks)
+}
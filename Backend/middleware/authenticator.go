@@ -0,0 +1,424 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"github.com/Jonathanpatta/rplace/auth"
+	"github.com/Jonathanpatta/rplace/ratelimit"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"github.com/gorilla/sessions"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Ways a principal can be authenticated.
+const (
+	MethodJWT     = "jwt"
+	MethodToken   = "token"
+	MethodAPIKey  = "api_key"
+	MethodSession = "session"
+)
+
+// CredentialParam is the cookie and query parameter a credential is read
+// from when there is no Authorization header.
+const CredentialParam = "access_token"
+
+// APIKeyHeader carries an API key instead of the Authorization header.
+const APIKeyHeader = "X-API-Key"
+
+// AllowedOrigin is where the frontend is served. It is the only origin
+// allowed to make cross-origin requests with credentials.
+var AllowedOrigin = "http://localhost:3000"
+
+// cookieAllowed reports whether a credential kept in a cookie may be used
+// for r. Browsers send cookies along with requests other sites make, so
+// requests that change anything, and WebSocket handshakes, have to come
+// from AllowedOrigin.
+func cookieAllowed(r *http.Request) bool {
+	safe := r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+	if safe && !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	return origin != "" && origin == strings.TrimSuffix(AllowedOrigin, "/")
+}
+
+var (
+	// ErrNoCredentials is returned by an Authenticator that found nothing
+	// it handles, so that the next one is tried.
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials is wrapped by the errors of an Authenticator
+	// that found credentials it handles and refused them.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	// Id is stable across logins and is what placements are attributed to.
+	// Those of the user pool start with UserPoolPrefix.
+	Id string `json:"id"`
+	// Name is fit for display.
+	Name   string `json:"name"`
+	Method string `json:"method"`
+	Admin  bool   `json:"admin,omitempty"`
+	// Scopes limit what the principal may do. They are only set for API
+	// keys; everyone else may do anything their account allows.
+	Scopes []string `json:"scopes,omitempty"`
+	// Claims are the verified claims of a JWT.
+	Claims jwt.MapClaims `json:"-"`
+	// Token is the opaque token of a principal authenticated with one, so
+	// that it can be logged out.
+	Token string `json:"-"`
+}
+
+// Authenticator recognizes one kind of credential.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// AuthenticatorFunc lets a function be used as an Authenticator.
+type AuthenticatorFunc func(r *http.Request) (*Principal, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (*Principal, error) {
+	return f(r)
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the caller authenticated for ctx.
+func PrincipalFrom(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// Credential returns the credential a request is made with: the bearer
+// token of the Authorization header, or else the access_token cookie when
+// cookieAllowed. The access_token query parameter is only read for
+// WebSocket handshakes and event streams, which browsers open without a
+// way to set headers.
+func Credential(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	if header != "" {
+		return ""
+	}
+
+	if cookie, err := r.Cookie(CredentialParam); err == nil && cookie.Value != "" && cookieAllowed(r) {
+		return cookie.Value
+	}
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return r.URL.Query().Get(CredentialParam)
+	}
+	return ""
+}
+
+// UserPoolPrefix starts the Id of every principal of the user pool. Its
+// usernames are chosen apart from those of local accounts, so without it
+// a user pool account could act as the local account of the same name.
+const UserPoolPrefix = "cognito:"
+
+// principalFromClaims names the caller of a verified JWT. Tokens of the
+// user pool make admins of its admin group; tokens issued by the auth
+// package, which local is set for, carry an admin claim instead.
+func principalFromClaims(claims jwt.MapClaims, local bool) *Principal {
+	p := &Principal{Method: MethodJWT, Claims: claims}
+	for _, claim := range []string{"username", "cognito:username", "sub"} {
+		if value, _ := claims[claim].(string); value != "" {
+			p.Id = value
+			break
+		}
+	}
+
+	p.Name = p.Id
+	for _, claim := range []string{"preferred_username", "name"} {
+		if value, _ := claims[claim].(string); value != "" {
+			p.Name = value
+			break
+		}
+	}
+
+	if local {
+		p.Admin, _ = claims["admin"].(bool)
+		return p
+	}
+	if p.Id != "" {
+		p.Id = UserPoolPrefix + p.Id
+	}
+	groups, _ := claims["cognito:groups"].([]interface{})
+	for _, group := range groups {
+		if group == "admin" {
+			p.Admin = true
+		}
+	}
+	return p
+}
+
+// BearerJWT accepts JWTs signed by the auth package or the user pool.
+func (s *AuthMiddlewareServer) BearerJWT() Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (*Principal, error) {
+		credential := Credential(r)
+		if strings.Count(credential, ".") != 2 {
+			return nil, ErrNoCredentials
+		}
+
+		claims, err := s.ParseToken(credential)
+		if err != nil {
+			return nil, Invalid(err)
+		}
+		p := principalFromClaims(claims, s.Signer != nil && claims["iss"] == s.Signer.Issuer)
+		if p.Id == "" {
+			return nil, Invalid(errors.New("token names no user"))
+		}
+		return p, nil
+	})
+}
+
+// OpaqueToken accepts the tokens handed out by /auth/generateToken.
+func (s *AuthMiddlewareServer) OpaqueToken() Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (*Principal, error) {
+		credential := Credential(r)
+		if _, err := uuid.Parse(credential); err != nil {
+			return nil, ErrNoCredentials
+		}
+		return s.tokenPrincipal(r.Context(), credential, MethodToken)
+	})
+}
+
+func (s *AuthMiddlewareServer) tokenPrincipal(ctx context.Context, credential string, method string) (*Principal, error) {
+	token, err := s.Tokens.Lookup(ctx, credential)
+	if errors.Is(err, auth.ErrInvalidToken) {
+		return nil, Invalid(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.Tokens.Touch(ctx, token)
+	if errors.Is(err, auth.ErrInvalidToken) {
+		return nil, Invalid(err)
+	}
+	if err != nil {
+		log.Printf("could not record the use of a token: %s", err.Error())
+	}
+	if token.Username == "" {
+		return nil, Invalid(errors.New("token names no user"))
+	}
+	return &Principal{Id: token.Username, Name: token.Username, Method: method, Token: token.Token}, nil
+}
+
+// APIKeyLookup resolves an API key to the principal it was issued to.
+type APIKeyLookup func(ctx context.Context, key string) (*Principal, error)
+
+// APIKey accepts keys from the X-API-Key header, or bearer credentials
+// starting with prefix.
+func APIKey(prefix string, lookup APIKeyLookup) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (*Principal, error) {
+		key := r.Header.Get(APIKeyHeader)
+		if key == "" {
+			key = Credential(r)
+			if prefix == "" || !strings.HasPrefix(key, prefix) {
+				return nil, ErrNoCredentials
+			}
+		}
+
+		p, err := lookup(r.Context(), key)
+		if err != nil {
+			return nil, err
+		}
+		p.Method = MethodAPIKey
+		return p, nil
+	})
+}
+
+// LookupAPIKeys resolves API keys from keys. A key with the admin scope
+// makes its holder an admin; only admins can create those, and keys keeps
+// the scope from keys whose owner has stopped being one.
+func LookupAPIKeys(keys *auth.APIKeys) APIKeyLookup {
+	return func(ctx context.Context, presented string) (*Principal, error) {
+		key, err := keys.Authenticate(ctx, presented)
+		if errors.Is(err, auth.ErrInvalidAPIKey) {
+			return nil, Invalid(err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &Principal{
+			Id:     key.Owner,
+			Name:   key.Owner,
+			Admin:  key.HasScope(auth.ScopeAdmin),
+			Scopes: key.Scopes,
+		}, nil
+	}
+}
+
+// Caller tells the auth package who is calling its API key and session
+// routes.
+func Caller(r *http.Request) (auth.Caller, bool) {
+	p, ok := PrincipalFrom(r.Context())
+	if !ok {
+		return auth.Caller{}, false
+	}
+	return auth.Caller{Id: p.Id, Admin: p.Admin, APIKey: p.Method == MethodAPIKey, Token: p.Token}, true
+}
+
+// HasScope reports whether p may act within scope. Only API keys are
+// limited to scopes; an admin key may do anything.
+func (p *Principal) HasScope(scope string) bool {
+	if p.Method != MethodAPIKey {
+		return true
+	}
+	for _, s := range p.Scopes {
+		if s == scope || s == auth.ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// RequiredScope is the scope an API key needs for r: admin for admin
+// routes, read for reads and place for every other change.
+func RequiredScope(r *http.Request) string {
+	if strings.Contains(r.URL.Path, "/admin/") || strings.HasSuffix(r.URL.Path, "/admin") {
+		return auth.ScopeAdmin
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return auth.ScopeRead
+	}
+	return auth.ScopePlace
+}
+
+// Scoped refuses requests made with an API key that lacks the scope they
+// need. It goes after one of the authenticating middlewares.
+func Scoped(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := PrincipalFrom(r.Context())
+		if r.Method != http.MethodOptions && ok && !p.HasScope(RequiredScope(r)) {
+			http.Error(w, "the API key lacks the "+RequiredScope(r)+" scope", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SessionCookie accepts the token kept in the cookie session of a browser
+// that logged in through /auth/generateToken.
+func (s *AuthMiddlewareServer) SessionCookie(store *sessions.CookieStore) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (*Principal, error) {
+		if store == nil {
+			return nil, ErrNoCredentials
+		}
+		if !cookieAllowed(r) {
+			return nil, ErrNoCredentials
+		}
+		session, err := store.Get(r, auth.SessionName)
+		if err != nil {
+			return nil, ErrNoCredentials
+		}
+		credential, _ := session.Values["token"].(string)
+		if credential == "" {
+			return nil, ErrNoCredentials
+		}
+		return s.tokenPrincipal(r.Context(), credential, MethodSession)
+	})
+}
+
+// Invalid marks err as a refusal of the credentials, answered with a 401
+// rather than a 500.
+func Invalid(err error) error {
+	return &invalidError{err}
+}
+
+type invalidError struct {
+	err error
+}
+
+func (e *invalidError) Error() string {
+	return e.err.Error()
+}
+
+func (e *invalidError) Unwrap() error {
+	return e.err
+}
+
+func (e *invalidError) Is(target error) bool {
+	return target == ErrInvalidCredentials
+}
+
+// Resolve authenticates r with the first of authenticators that
+// recognizes its credentials, giving ErrNoCredentials when none does.
+func Resolve(r *http.Request, authenticators ...Authenticator) (*Principal, error) {
+	for _, a := range authenticators {
+		p, err := a.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	return nil, ErrNoCredentials
+}
+
+// Chain authenticates requests with the first authenticator that
+// recognizes their credentials. Requests without any, or with credentials
+// that are refused, get a 401. Preflight requests pass through.
+func Chain(authenticators ...Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			p, err := Resolve(r, authenticators...)
+			if errors.Is(err, ErrNoCredentials) {
+				unauthorized(w, "Bearer", "missing credentials")
+				return
+			}
+			if errors.Is(err, ErrInvalidCredentials) {
+				unauthorized(w, `Bearer error="invalid_token"`, "invalid credentials: "+err.Error())
+				return
+			}
+			var limited *ratelimit.LimitedError
+			if errors.As(err, &limited) {
+				ratelimit.WriteLimited(w, limited.RetryAfter)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+		})
+	}
+}
+
+func unauthorized(w http.ResponseWriter, challenge string, message string) {
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, message, http.StatusUnauthorized)
+}
+
+// Authenticate accepts every kind of credential: JWTs, API keys, opaque
+// tokens and session cookies, in that order.
+func (s *AuthMiddlewareServer) Authenticate(next http.Handler) http.Handler {
+	return Chain(s.Authenticators()...)(next)
+}
+
+// Authenticators are the authenticators Authenticate tries.
+func (s *AuthMiddlewareServer) Authenticators() []Authenticator {
+	authenticators := []Authenticator{s.BearerJWT()}
+	if s.APIKeys != nil {
+		authenticators = append(authenticators, APIKey(s.APIKeyPrefix, s.APIKeys))
+	}
+	return append(authenticators, s.OpaqueToken(), s.SessionCookie(s.SessionStore))
+}
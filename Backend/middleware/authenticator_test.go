@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"github.com/Jonathanpatta/rplace/auth"
+	"github.com/Jonathanpatta/rplace/ratelimit"
+	"github.com/golang-jwt/jwt/v4"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPrincipalFromClaims(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		local  bool
+		id     string
+		admin  bool
+	}{
+		{"local", jwt.MapClaims{"username": "alice", "admin": true}, true, "alice", true},
+		{"user pool", jwt.MapClaims{"cognito:username": "alice"}, false, UserPoolPrefix + "alice", false},
+		{"user pool claiming admin", jwt.MapClaims{"username": "alice", "admin": true}, false, UserPoolPrefix + "alice", false},
+		{"user pool admin group", jwt.MapClaims{"sub": "1234", "cognito:groups": []interface{}{"admin"}}, false, UserPoolPrefix + "1234", true},
+		{"no user", jwt.MapClaims{}, false, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := principalFromClaims(test.claims, test.local)
+			if p.Id != test.id || p.Admin != test.admin {
+				t.Fatalf("got id %q admin %v, want %q %v", p.Id, p.Admin, test.id, test.admin)
+			}
+		})
+	}
+}
+
+func TestCredential(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		header     map[string]string
+		cookie     string
+		credential string
+	}{
+		{"bearer header", "POST", "/", map[string]string{"Authorization": "Bearer abc"}, "", "abc"},
+		{"other scheme", "GET", "/", map[string]string{"Authorization": "Basic abc"}, "cookie", ""},
+		{"cookie on a read", "GET", "/", nil, "cookie", "cookie"},
+		{"cookie on a change from another site", "POST", "/", map[string]string{"Origin": "http://evil.example"}, "cookie", ""},
+		{"cookie on a change without an origin", "POST", "/", nil, "cookie", ""},
+		{"cookie on a change from the frontend", "POST", "/", map[string]string{"Origin": AllowedOrigin}, "cookie", "cookie"},
+		{"cookie on a handshake from another site", "GET", "/ws", map[string]string{"Upgrade": "websocket", "Origin": "http://evil.example"}, "cookie", ""},
+		{"query on a handshake", "GET", "/ws?access_token=abc", map[string]string{"Upgrade": "websocket"}, "", "abc"},
+		{"query on an event stream", "GET", "/events?access_token=abc", map[string]string{"Accept": "text/event-stream"}, "", "abc"},
+		{"query on a plain request", "GET", "/?access_token=abc", nil, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, test.target, nil)
+			for name, value := range test.header {
+				r.Header.Set(name, value)
+			}
+			if test.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: CredentialParam, Value: test.cookie})
+			}
+			if credential := Credential(r); credential != test.credential {
+				t.Fatalf("got %q, want %q", credential, test.credential)
+			}
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	refuse := func(err error) Authenticator {
+		return AuthenticatorFunc(func(r *http.Request) (*Principal, error) { return nil, err })
+	}
+	accept := AuthenticatorFunc(func(r *http.Request) (*Principal, error) {
+		return &Principal{Id: "alice", Method: MethodToken}, nil
+	})
+
+	tests := []struct {
+		name           string
+		method         string
+		authenticators []Authenticator
+		code           int
+		challenge      string
+	}{
+		{"no authenticators", "GET", nil, http.StatusUnauthorized, "Bearer"},
+		{"no credentials", "GET", []Authenticator{refuse(ErrNoCredentials)}, http.StatusUnauthorized, "Bearer"},
+		{"refused", "GET", []Authenticator{refuse(Invalid(errors.New("expired"))), accept}, http.StatusUnauthorized, `Bearer error="invalid_token"`},
+		{"accepted by a later one", "GET", []Authenticator{refuse(ErrNoCredentials), accept}, http.StatusOK, ""},
+		{"rate limited", "GET", []Authenticator{refuse(&ratelimit.LimitedError{RetryAfter: time.Second})}, http.StatusTooManyRequests, ""},
+		{"failed", "GET", []Authenticator{refuse(errors.New("table unavailable")), accept}, http.StatusInternalServerError, ""},
+		{"preflight", "OPTIONS", []Authenticator{refuse(ErrNoCredentials)}, http.StatusNoContent, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := Chain(test.authenticators...)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodOptions {
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				if p, ok := PrincipalFrom(r.Context()); !ok || p.Id != "alice" {
+					t.Errorf("got principal %+v", p)
+				}
+			}))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(test.method, "/", nil))
+			if w.Code != test.code || w.Header().Get("WWW-Authenticate") != test.challenge {
+				t.Fatalf("got %d %q, want %d %q", w.Code, w.Header().Get("WWW-Authenticate"), test.code, test.challenge)
+			}
+		})
+	}
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	lookup := func(ctx context.Context, key string) (*Principal, error) {
+		if key != "rp_good" {
+			return nil, Invalid(errors.New("unknown key"))
+		}
+		return &Principal{Id: "alice", Scopes: []string{auth.ScopeRead}}, nil
+	}
+	a := APIKey("rp_", lookup)
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		err    error
+	}{
+		{"key header", map[string]string{APIKeyHeader: "rp_good"}, nil},
+		{"bearer key", map[string]string{"Authorization": "Bearer rp_good"}, nil},
+		{"unknown key", map[string]string{APIKeyHeader: "rp_bad"}, ErrInvalidCredentials},
+		{"other bearer credential", map[string]string{"Authorization": "Bearer abc"}, ErrNoCredentials},
+		{"nothing", nil, ErrNoCredentials},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			for name, value := range test.header {
+				r.Header.Set(name, value)
+			}
+			p, err := a.Authenticate(r)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got %v, want %v", err, test.err)
+			}
+			if err == nil && (p.Method != MethodAPIKey || !p.HasScope(auth.ScopeRead) || p.HasScope(auth.ScopePlace)) {
+				t.Fatalf("got %+v", p)
+			}
+		})
+	}
+}
@@ -2,16 +2,14 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/Jonathanpatta/rplace/auth"
 	"github.com/Jonathanpatta/rplace/cache"
 	"github.com/MicahParks/keyfunc"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/golang-jwt/jwt/v4"
-	"github.com/google/uuid"
 	"github.com/gorilla/sessions"
 	"log"
 	"net/http"
@@ -20,10 +18,11 @@ import (
 
 func CorsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+		w.Header().Set("Access-Control-Allow-Origin", AllowedOrigin)
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type,AccessToken,X-CSRF-Token, Authorization, Token")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Canvas-Seq, ETag")
 		w.Header().Set("content-type", "application/json;charset=UTF-8")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusNoContent)
@@ -39,9 +38,28 @@ type AuthMiddlewareServer struct {
 	Jwks         *keyfunc.JWKS
 	CacheCli     *cache.Client
 	DbCli        *dynamodb.Client
+	Tokens       *auth.Tokens
+	// Signer verifies the access tokens issued by the auth package, which
+	// are accepted next to the user pool's.
+	Signer *auth.Signer
+	// APIKeys resolves API keys, which Authenticate accepts when it is set.
+	APIKeys APIKeyLookup
+	// APIKeyPrefix tells API keys sent as bearer tokens apart.
+	APIKeyPrefix string
 }
 
 func NewAuthMiddlewareServer(store *sessions.CookieStore, cache *cache.Client, DbCli *dynamodb.Client, userpoolId string) *AuthMiddlewareServer {
+	server := &AuthMiddlewareServer{
+		SessionStore: store,
+		CacheCli:     cache,
+		DbCli:        DbCli,
+		UserPoolId:   userpoolId,
+		Tokens:       auth.NewTokens(DbCli, aws.String("Place-Clone"), cache),
+	}
+	if userpoolId == "" {
+		return server
+	}
+
 	publicKeysUrl := fmt.Sprintf("https://cognito-idp.ap-south-1.amazonaws.com/%s/.well-known/jwks.json", userpoolId)
 	options := keyfunc.Options{
 		RefreshErrorHandler: func(err error) {
@@ -56,104 +74,94 @@ func NewAuthMiddlewareServer(store *sessions.CookieStore, cache *cache.Client, D
 	if err != nil {
 		log.Fatalf("Failed to create JWKS from resource at the given URL.\nError: %s", err.Error())
 	}
-	return &AuthMiddlewareServer{
-		SessionStore: store,
-		CacheCli:     cache,
-		DbCli:        DbCli,
-		UserPoolId:   userpoolId,
-		Jwks:         jwks,
-	}
+	server.Jwks = jwks
+	return server
 }
 
+// JwtAuthorization only accepts JWTs. Authenticate accepts them along with
+// every other kind of credential.
 func (s *AuthMiddlewareServer) JwtAuthorization(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		tokenString := authHeader[7:]
-		token, err := jwt.Parse(tokenString, s.Jwks.Keyfunc)
-		if err != nil {
-			http.Error(w, "invalid token: "+err.Error(), http.StatusInternalServerError)
-			return
+	return Chain(s.BearerJWT())(next)
+}
+
+// ParseToken verifies a JWT against our own signing keys or the user pool
+// keys and returns its claims.
+func (s *AuthMiddlewareServer) ParseToken(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, s.keyfunc)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if the token is valid.
+	if !token.Valid {
+		return nil, errors.New("token is not valid")
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if s.Signer != nil && s.Signer.Owns(token) {
+		if claims["iss"] != s.Signer.Issuer || claims["token_use"] != auth.TokenUseAccess {
+			return nil, errors.New("token is not valid")
 		}
+	}
+	return claims, nil
+}
 
-		// Check if the token is valid.
-		if !token.Valid {
-			http.Error(w, "invalid token: "+err.Error(), http.StatusInternalServerError)
-			return
+func (s *AuthMiddlewareServer) keyfunc(token *jwt.Token) (interface{}, error) {
+	if s.Signer != nil {
+		key, err := s.Signer.Keyfunc(token)
+		if err == nil {
+			return key, nil
 		}
-		user := token.Claims.(jwt.MapClaims)
-		ctx := context.WithValue(r.Context(), "user", user)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+	}
+	if s.Jwks == nil {
+		return nil, auth.ErrUnknownKey
+	}
+	return s.Jwks.Keyfunc(token)
 }
 
-func (s *AuthMiddlewareServer) Authorization(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
+// WithClaims sets the caller of ctx from verified token claims.
+func WithClaims(ctx context.Context, claims jwt.MapClaims) context.Context {
+	return WithPrincipal(ctx, principalFromClaims(claims, false))
+}
 
-		tokenString := authHeader[7:]
+// Identity returns the authenticated caller as a stable id and a name fit
+// for display.
+func Identity(r *http.Request) (id string, name string, ok bool) {
+	return ContextIdentity(r.Context())
+}
 
-		_, err := uuid.Parse(tokenString)
+func ContextIdentity(ctx context.Context) (id string, name string, ok bool) {
+	p, ok := PrincipalFrom(ctx)
+	if !ok || p.Id == "" {
+		return "", "", false
+	}
+	return p.Id, p.Name, true
+}
 
-		if err != nil {
-			http.Error(w, "invalid token: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
+// IsAdmin reports whether the caller belongs to the admin group.
+func IsAdmin(r *http.Request) bool {
+	return ContextIsAdmin(r.Context())
+}
 
-		var token auth.Token
-
-		err = s.CacheCli.Get("TOKEN#"+tokenString, &token)
-
-		if err != nil {
-
-			out, err := s.DbCli.Query(context.TODO(), &dynamodb.QueryInput{
-				TableName:              aws.String("Place-Clone"),
-				KeyConditionExpression: aws.String("#PK = :name"),
-				ExpressionAttributeValues: map[string]types.AttributeValue{
-					":name": &types.AttributeValueMemberS{Value: "TOKEN#" + tokenString},
-				},
-				ExpressionAttributeNames: map[string]string{
-					"#PK": "PK",
-				},
-			})
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			var tokens []auth.Token
-
-			err = attributevalue.UnmarshalListOfMaps(out.Items, &tokens)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			if len(tokens) > 1 {
-				if err != nil {
-					http.Error(w, "unique token not found", http.StatusInternalServerError)
-					return
-				}
-			}
-
-			if len(tokens) == 1 {
-				token = tokens[0]
-				if !token.IsValid() {
-					if err != nil {
-						http.Error(w, "token expired", http.StatusInternalServerError)
-						return
-					}
-				}
-				err := s.CacheCli.Put("TOKEN#"+token.Token, token)
-				if err != nil {
-					http.Error(w, "failed to put in cache", http.StatusInternalServerError)
-					return
-				}
-			}
-		}
+func ContextIsAdmin(ctx context.Context) bool {
+	p, ok := PrincipalFrom(ctx)
+	return ok && p.Admin
+}
 
-		if !token.IsValid() {
-			http.Error(w, "invalid token", http.StatusInternalServerError)
+// AdminOnly refuses callers outside the admin group. It goes after one of
+// the authenticating middlewares, which set the caller.
+func AdminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions && !IsAdmin(r) {
+			http.Error(w, "admin only", http.StatusForbidden)
 			return
 		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// Authorization only accepts the opaque tokens handed out by
+// /auth/generateToken. Revoked tokens are refused as soon as they are
+// evicted from the cache.
+func (s *AuthMiddlewareServer) Authorization(next http.Handler) http.Handler {
+	return Chain(s.OpaqueToken())(next)
+}
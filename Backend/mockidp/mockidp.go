@@ -0,0 +1,324 @@
+// Package mockidp is an OpenID Connect provider for trying the login flow
+// locally. It serves discovery, an authorization endpoint that logs in
+// whoever is named in its form, a token endpoint that checks PKCE and a
+// key set. It keeps everything in memory and trusts everyone, so it is
+// only fit for development.
+package mockidp
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	codeLifetime  = time.Minute
+	tokenLifetime = time.Hour
+)
+
+// Client is a client registered with the provider. An empty Secret makes
+// it a public client.
+type Client struct {
+	Secret string
+	// RedirectURIs are the callbacks codes may be sent to. Any is accepted
+	// when there are none.
+	RedirectURIs []string
+}
+
+// User is who logs in. Subject defaults to the username.
+type User struct {
+	Subject       string
+	Username      string
+	Email         string
+	EmailVerified bool
+}
+
+type grant struct {
+	ClientId    string
+	RedirectURI string
+	Challenge   string
+	Nonce       string
+	User        User
+	ExpiresAt   time.Time
+}
+
+type Provider struct {
+	Issuer  string
+	Clients map[string]Client
+
+	key   *rsa.PrivateKey
+	kid   string
+	mu    sync.Mutex
+	codes map[string]*grant
+}
+
+func New(issuer string, clients map[string]Client) (*Provider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &Provider{
+		Issuer:  strings.TrimSuffix(issuer, "/"),
+		Clients: clients,
+		key:     key,
+		kid:     uuid.New().String(),
+		codes:   make(map[string]*grant),
+	}, nil
+}
+
+func (p *Provider) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/jwks", p.jwks)
+	return mux
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.Issuer,
+		"authorization_endpoint":                p.Issuer + "/authorize",
+		"token_endpoint":                        p.Issuer + "/token",
+		"jwks_uri":                              p.Issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+	})
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<title>Mock identity provider</title>
+<h1>Log in to {{.Client}}</h1>
+<form method="post">
+<p><label>Username <input name="username" required autofocus></label></p>
+<p><label>Email <input name="email" type="email"></label></p>
+<p><label><input name="email_verified" type="checkbox" checked> Email verified</label></p>
+<p><button>Log in</button></p>
+</form>
+`))
+
+// authorize shows a form naming the user to log in as. Passing login_hint
+// skips the form, which lets scripts run the flow without a browser.
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	clientId := r.Form.Get("client_id")
+	client, ok := p.Clients[clientId]
+	if !ok {
+		http.Error(w, "unknown client", http.StatusBadRequest)
+		return
+	}
+	redirectURI := r.Form.Get("redirect_uri")
+	if len(client.RedirectURIs) > 0 && !contains(client.RedirectURIs, redirectURI) {
+		http.Error(w, "redirect_uri is not registered", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(redirectURI)
+	if err != nil || !redirect.IsAbs() {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	// From here on errors go back to the client.
+	fail := func(code string, description string) {
+		q := redirect.Query()
+		q.Set("error", code)
+		q.Set("error_description", description)
+		q.Set("state", r.Form.Get("state"))
+		redirect.RawQuery = q.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+	}
+	if r.Form.Get("response_type") != "code" {
+		fail("unsupported_response_type", "only the code flow is supported")
+		return
+	}
+	if !contains(strings.Fields(r.Form.Get("scope")), "openid") {
+		fail("invalid_scope", "openid is required")
+		return
+	}
+	if r.Form.Get("code_challenge") == "" || r.Form.Get("code_challenge_method") != "S256" {
+		fail("invalid_request", "a S256 code challenge is required")
+		return
+	}
+
+	username := r.PostForm.Get("username")
+	email := r.PostForm.Get("email")
+	verified := r.PostForm.Get("email_verified") != ""
+	if hint := r.URL.Query().Get("login_hint"); hint != "" && r.Method == "GET" {
+		username, verified = hint, true
+		if strings.Contains(hint, "@") {
+			username, email = hint[:strings.Index(hint, "@")], hint
+		}
+	}
+	if username == "" {
+		// The form posts back to this address, query and all.
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		loginPage.Execute(w, map[string]string{"Client": clientId})
+		return
+	}
+
+	code := uuid.New().String()
+	p.mu.Lock()
+	p.codes[code] = &grant{
+		ClientId:    clientId,
+		RedirectURI: redirectURI,
+		Challenge:   r.Form.Get("code_challenge"),
+		Nonce:       r.Form.Get("nonce"),
+		User:        User{Subject: "mock|" + username, Username: username, Email: email, EmailVerified: verified && email != ""},
+		ExpiresAt:   time.Now().Add(codeLifetime),
+	}
+	p.mu.Unlock()
+
+	q := redirect.Query()
+	q.Set("code", code)
+	q.Set("state", r.Form.Get("state"))
+	redirect.RawQuery = q.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func tokenError(w http.ResponseWriter, status int, code string, description string) {
+	writeJson(w, status, map[string]string{"error": code, "error_description": description})
+}
+
+// clientCredentials reads the client from basic auth or the form.
+func clientCredentials(r *http.Request) (string, string) {
+	if id, secret, ok := r.BasicAuth(); ok {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+		return id, secret
+	}
+	return r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+}
+
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		tokenError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	clientId, secret := clientCredentials(r)
+	client, ok := p.Clients[clientId]
+	if !ok || subtle.ConstantTimeCompare([]byte(client.Secret), []byte(secret)) != 1 {
+		tokenError(w, http.StatusUnauthorized, "invalid_client", "unknown client or wrong secret")
+		return
+	}
+
+	// Codes are spent whether or not the exchange succeeds.
+	code := r.PostForm.Get("code")
+	p.mu.Lock()
+	g, ok := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case !ok || time.Now().After(g.ExpiresAt):
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "unknown or expired code")
+	case g.ClientId != clientId || g.RedirectURI != r.PostForm.Get("redirect_uri"):
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "the code was issued to another client or redirect_uri")
+	case base64.RawURLEncoding.EncodeToString(sum[:]) != g.Challenge:
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "the code verifier does not match the challenge")
+	default:
+		idToken, err := p.IDToken(clientId, g.Nonce, g.User)
+		if err != nil {
+			tokenError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJson(w, http.StatusOK, map[string]interface{}{
+			"access_token": uuid.New().String(),
+			"token_type":   "Bearer",
+			"expires_in":   int(tokenLifetime.Seconds()),
+			"id_token":     idToken,
+		})
+	}
+}
+
+// IDToken signs an ID token for user, as the token endpoint hands out.
+func (p *Provider) IDToken(clientId string, nonce string, user User) (string, error) {
+	if user.Subject == "" {
+		user.Subject = user.Username
+	}
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":                p.Issuer,
+		"sub":                user.Subject,
+		"aud":                clientId,
+		"iat":                now.Unix(),
+		"exp":                now.Add(tokenLifetime).Unix(),
+		"preferred_username": user.Username,
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	if user.Email != "" {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.EmailVerified
+	}
+
+	return p.Sign(claims)
+}
+
+// Sign signs claims with the key of the provider, which lets tests hand
+// clients ID tokens the token endpoint never would.
+func (p *Provider) Sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = p.kid
+	return token.SignedString(p.key)
+}
+
+func (p *Provider) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": p.kid,
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.PublicKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.PublicKey.E)).Bytes()),
+		}},
+	})
+}
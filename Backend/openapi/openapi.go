@@ -0,0 +1,354 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type Document struct {
+	OpenAPI    string                `json:"openapi"`
+	Info       Info                  `json:"info"`
+	Paths      map[string]PathItem   `json:"paths"`
+	Components Components            `json:"components"`
+	Security   []map[string][]string `json:"security,omitempty"`
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// PathItem maps lower case HTTP methods to their operations.
+type PathItem map[string]*Operation
+
+type Operation struct {
+	OperationId string                `json:"operationId,omitempty"`
+	Summary     string                `json:"summary,omitempty"`
+	Description string                `json:"description,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Parameters  []*Parameter          `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema,omitempty"`
+}
+
+type RequestBody struct {
+	Description string                `json:"description,omitempty"`
+	Required    bool                  `json:"required,omitempty"`
+	Content     map[string]*MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string                `json:"description"`
+	Headers     map[string]*Header    `json:"headers,omitempty"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+type Header struct {
+	Description string  `json:"description,omitempty"`
+	Schema      *Schema `json:"schema,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema,omitempty"`
+}
+
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas,omitempty"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	Name         string `json:"name,omitempty"`
+	In           string `json:"in,omitempty"`
+}
+
+// BearerAuth is the security scheme of the routes behind the authenticating
+// middlewares. They also take an API key, in APIKeyAuth or as the bearer
+// token.
+const (
+	BearerAuth = "bearerAuth"
+	APIKeyAuth = "apiKeyAuth"
+)
+
+// Spec collects the descriptions of the routes. The document itself is
+// built from the router, so every registered route shows up in it whether
+// it has been described or not.
+type Spec struct {
+	Info Info
+
+	mu         sync.RWMutex
+	operations map[string]*Operation
+	schemas    map[string]*Schema
+	secured    []string
+}
+
+func NewSpec(title string, version string) *Spec {
+	return &Spec{
+		Info:       Info{Title: title, Version: version},
+		operations: make(map[string]*Operation),
+		schemas:    make(map[string]*Schema),
+	}
+}
+
+// Describe documents the route registered for method at path. Path is the
+// full route template as given to the router, including any patterns.
+func (s *Spec) Describe(method string, path string, op *Operation) {
+	s.mu.Lock()
+	s.operations[strings.ToUpper(method)+" "+cleanPath(path)] = op
+	s.mu.Unlock()
+}
+
+// Schema registers the schema of v under name and returns a reference to
+// it.
+func (s *Spec) Schema(name string, v interface{}) *Schema {
+	s.mu.Lock()
+	s.schemas[name] = SchemaOf(v)
+	s.mu.Unlock()
+	return Ref(name)
+}
+
+// Secure marks every route under prefix as needing a bearer token.
+func (s *Spec) Secure(prefix string) {
+	s.mu.Lock()
+	s.secured = append(s.secured, prefix)
+	s.mu.Unlock()
+}
+
+func Ref(name string) *Schema {
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+var (
+	pathVar     = regexp.MustCompile(`\{([^{}:]+)(?::([^{}]+))?\}`)
+	enumPattern = regexp.MustCompile(`^[a-z|]+$`)
+)
+
+// cleanPath turns a mux template such as /pixels/{row:[0-9]+} into the
+// OpenAPI form /pixels/{row}.
+func cleanPath(path string) string {
+	return pathVar.ReplaceAllString(path, "{$1}")
+}
+
+func pathParameters(path string) []*Parameter {
+	var params []*Parameter
+	for _, match := range pathVar.FindAllStringSubmatch(path, -1) {
+		schema := &Schema{Type: "string"}
+		switch pattern := match[2]; {
+		case pattern == "[0-9]+":
+			schema = &Schema{Type: "integer"}
+		case pattern != "" && enumPattern.MatchString(pattern):
+			schema.Enum = strings.Split(pattern, "|")
+		}
+		params = append(params, &Parameter{Name: match[1], In: "path", Required: true, Schema: schema})
+	}
+	return params
+}
+
+// Build walks the router and documents every route on it.
+func (s *Spec) Build(router *mux.Router) (*Document, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	schemas := make(map[string]*Schema, len(s.schemas))
+	for name, schema := range s.schemas {
+		schemas[name] = schema
+	}
+
+	doc := &Document{
+		OpenAPI: "3.0.3",
+		Info:    s.Info,
+		Paths:   make(map[string]PathItem),
+		Components: Components{
+			Schemas: schemas,
+			SecuritySchemes: map[string]*SecurityScheme{
+				BearerAuth: {Type: "http", Scheme: "bearer", BearerFormat: "JWT"},
+				APIKeyAuth: {Type: "apiKey", Name: "X-API-Key", In: "header"},
+			},
+		},
+	}
+
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		path := cleanPath(template)
+		for _, method := range methods {
+			if method == http.MethodOptions {
+				continue
+			}
+
+			op, ok := s.operations[method+" "+path]
+			if !ok {
+				op = &Operation{
+					Summary: method + " " + path,
+					Responses: map[string]*Response{
+						"200": {Description: "OK"},
+					},
+				}
+			}
+			described := *op
+			described.Parameters = append(pathParameters(template), op.Parameters...)
+			if described.Security == nil && s.isSecured(path) {
+				described.Security = []map[string][]string{{BearerAuth: {}}, {APIKeyAuth: {}}}
+			}
+
+			if doc.Paths[path] == nil {
+				doc.Paths[path] = make(PathItem)
+			}
+			doc.Paths[path][strings.ToLower(method)] = &described
+		}
+		return nil
+	})
+	return doc, err
+}
+
+func (s *Spec) isSecured(path string) bool {
+	for _, prefix := range s.secured {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler serves the document for router. It is built on every request so
+// routes added after start up are included.
+func (s *Spec) Handler(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		doc, err := s.Build(router)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		out, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprint(w, string(out))
+	}
+}
+
+// SchemaOf describes the JSON encoding of v, following its json tags.
+func SchemaOf(v interface{}) *Schema {
+	return schemaOf(reflect.TypeOf(v))
+}
+
+func schemaOf(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: schemaOf(t.Elem())}
+	case reflect.Struct:
+		schema := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+		addFields(schema, t)
+		return schema
+	}
+	return &Schema{}
+}
+
+func addFields(schema *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		omitempty := strings.Contains(tag, ",omitempty")
+
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			for embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				addFields(schema, embedded)
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema.Properties[name] = schemaOf(field.Type)
+		if !omitempty {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	sort.Strings(schema.Required)
+}
+
+// JSON is the content of a JSON request or response body.
+func JSON(schema *Schema) map[string]*MediaType {
+	return map[string]*MediaType{"application/json": {Schema: schema}}
+}
+
+func ArrayOf(schema *Schema) *Schema {
+	return &Schema{Type: "array", Items: schema}
+}
+
+func Query(name string, description string, schema *Schema, required bool) *Parameter {
+	return &Parameter{Name: name, In: "query", Description: description, Required: required, Schema: schema}
+}
@@ -0,0 +1,145 @@
+package placeclone
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"github.com/Jonathanpatta/rplace/auth"
+	"github.com/Jonathanpatta/rplace/middleware"
+	"github.com/Jonathanpatta/rplace/ratelimit"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// CacheEntry describes a key of the local cache. Value is decoded for the
+// key prefixes the server knows about and left out otherwise; Raw holds the
+// gob encoding, base64 encoded. Entries holding credentials are redacted:
+// the key of a token names its session id instead of the token, and
+// neither tokens nor API keys come with Raw.
+type CacheEntry struct {
+	Key   string      `json:"key"`
+	Size  int         `json:"size"`
+	Value interface{} `json:"value,omitempty"`
+	Raw   string      `json:"raw,omitempty"`
+}
+
+// decodeCacheValue decodes the value of the cache keys written by this
+// repo: tokens and API keys by the auth middleware, faction memberships
+// and rate limit buckets.
+func decodeCacheValue(key string, raw []byte) interface{} {
+	var value interface{}
+	switch {
+	case strings.HasPrefix(key, "TOKEN#"):
+		value = &auth.Token{}
+	case strings.HasPrefix(key, "USERFACTION#"):
+		value = &cachedFaction{}
+	case strings.HasPrefix(key, "RATELIMIT#"):
+		value = &ratelimit.Bucket{}
+	case strings.HasPrefix(key, "APIKEY#"):
+		value = &auth.APIKey{}
+	default:
+		return nil
+	}
+
+	err := gob.NewDecoder(bytes.NewReader(raw)).Decode(value)
+	if err != nil {
+		return nil
+	}
+	if token, ok := value.(*auth.Token); ok {
+		token.Token = ""
+	}
+	return value
+}
+
+// secretCacheKey reports whether the value of key holds a credential.
+func secretCacheKey(key string) bool {
+	return strings.HasPrefix(key, "TOKEN#") || strings.HasPrefix(key, "APIKEY#")
+}
+
+// redactCacheKey returns key as admins get to see it. Tokens are named by
+// their session id, so the cache cannot be used to borrow one.
+func redactCacheKey(key string) string {
+	if strings.HasPrefix(key, "TOKEN#") {
+		return "TOKEN#" + auth.SessionId(strings.TrimPrefix(key, "TOKEN#"))
+	}
+	return key
+}
+
+// resolveCacheKey finds the key of the cache that redactCacheKey shows as
+// redacted.
+func (s *Server) resolveCacheKey(redacted string) (string, bool) {
+	if !strings.HasPrefix(redacted, "TOKEN#") {
+		return redacted, true
+	}
+	keys, err := s.cacheCli.Keys("TOKEN#")
+	if err != nil {
+		return "", false
+	}
+	for key := range keys {
+		if redactCacheKey(key) == redacted {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+func (s *Server) GetCacheKeys(w http.ResponseWriter, r *http.Request) {
+	if !middleware.IsAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return
+	}
+	if s.cacheCli == nil {
+		http.Error(w, "no cache configured", http.StatusNotFound)
+		return
+	}
+
+	keys, err := s.cacheCli.Keys(r.URL.Query().Get("prefix"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	entries := make([]CacheEntry, 0, len(keys))
+	for key, size := range keys {
+		entries = append(entries, CacheEntry{Key: redactCacheKey(key), Size: size})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	writeJson(w, http.StatusOK, entries)
+}
+
+func (s *Server) GetCacheEntry(w http.ResponseWriter, r *http.Request) {
+	if !middleware.IsAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return
+	}
+	if s.cacheCli == nil {
+		http.Error(w, "no cache configured", http.StatusNotFound)
+		return
+	}
+
+	key, ok := s.resolveCacheKey(mux.Vars(r)["key"])
+	if !ok {
+		http.Error(w, "key not found", http.StatusNotFound)
+		return
+	}
+	raw, err := s.cacheCli.GetRaw(key)
+	if err != nil {
+		http.Error(w, "key not found", http.StatusNotFound)
+		return
+	}
+
+	entry := CacheEntry{
+		Key:   redactCacheKey(key),
+		Size:  len(raw),
+		Value: decodeCacheValue(key, raw),
+	}
+	if !secretCacheKey(key) {
+		entry.Raw = base64.StdEncoding.EncodeToString(raw)
+	}
+	writeJson(w, http.StatusOK, entry)
+}
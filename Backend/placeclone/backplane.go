@@ -0,0 +1,275 @@
+package placeclone
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+const (
+	// relayQueueSize is how many placements may wait to be relayed before
+	// further ones are dropped. The other instances notice the missing
+	// sequence numbers and reload.
+	relayQueueSize = 4096
+	// configReload is how often the configuration kept in the table is
+	// read again, in case an announcement of a change got lost.
+	configReload = time.Minute
+)
+
+// backplaneMessage is a placement relayed between instances sharing a
+// broker. Origin lets an instance skip the placements it made itself, which
+// it has already applied.
+type backplaneMessage struct {
+	Origin string `json:"origin"`
+	Pixel  *Pixel `json:"pixel"`
+}
+
+func (s *Server) pixelTopic() string {
+	return "rplace:pixels:" + s.Image.Name
+}
+
+// relayPixel queues a placement made on this instance for the other ones.
+// A single goroutine publishes the queue, so the relays go out in the order
+// they were queued.
+func (s *Server) relayPixel(p *Pixel) {
+	if s.Broker == nil {
+		return
+	}
+	s.relayOnce.Do(func() {
+		go s.runRelays()
+	})
+
+	s.pending.Add(1)
+	select {
+	case s.relays <- p:
+	default:
+		s.pending.Done()
+		log.Printf("dropping relay of pixel %d on %s, the queue is full", p.Seq, s.Image.Name)
+	}
+}
+
+func (s *Server) runRelays() {
+	for p := range s.relays {
+		s.publishPixel(p)
+		s.pending.Done()
+	}
+}
+
+func (s *Server) publishPixel(p *Pixel) {
+	payload, err := json.Marshal(backplaneMessage{Origin: s.instanceId, Pixel: p})
+	if err != nil {
+		log.Println("could not encode pixel for the broker:", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = s.Broker.Publish(ctx, s.pixelTopic(), payload)
+	if err != nil {
+		log.Println("could not publish pixel to the broker:", err.Error())
+	}
+}
+
+// Kinds of control messages.
+const (
+	// controlFaction evicts the cached faction membership of the user in
+	// Key.
+	controlFaction = "faction"
+	// controlReload reads the part of the configuration named in Key from
+	// the table again.
+	controlReload = "reload"
+	// controlSuspicion forgets what the detector holds against the user in
+	// Key.
+	controlSuspicion = "suspicion"
+)
+
+// Parts of the configuration a controlReload names.
+const (
+	reloadCanvas     = "canvas"
+	reloadModeration = "moderation"
+	reloadTemplates  = "templates"
+	reloadSchedule   = "schedule"
+	reloadDetection  = "detection"
+	reloadChallenge  = "challenge"
+)
+
+// controlMessage tells the other instances that state they keep in memory
+// or in their cache changed in the table.
+type controlMessage struct {
+	Origin string `json:"origin"`
+	Kind   string `json:"kind"`
+	Key    string `json:"key,omitempty"`
+}
+
+func (s *Server) controlTopic() string {
+	return "rplace:control:" + s.Image.Name
+}
+
+// announce tells the other instances that state of kind changed.
+func (s *Server) announce(kind string, key string) {
+	if s.Broker == nil {
+		return
+	}
+
+	payload, err := json.Marshal(controlMessage{Origin: s.instanceId, Kind: kind, Key: key})
+	if err != nil {
+		log.Println("could not encode control message for the broker:", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = s.Broker.Publish(ctx, s.controlTopic(), payload)
+	if err != nil {
+		log.Println("could not publish control message to the broker:", err.Error())
+	}
+}
+
+// applyControl acts on a control message from another instance.
+func (s *Server) applyControl(ctx context.Context, msg controlMessage) {
+	switch msg.Kind {
+	case controlFaction:
+		if s.cacheCli != nil {
+			s.cacheCli.Delete(factionCacheKey(msg.Key))
+		}
+	case controlSuspicion:
+		s.Detector.Clear(msg.Key)
+	case controlReload:
+		err := s.reload(ctx, msg.Key)
+		if err != nil {
+			log.Printf("could not reload the %s of %s: %s", msg.Key, s.Image.Name, err.Error())
+		}
+	default:
+		log.Println("dropping control message of unknown kind", msg.Kind)
+	}
+}
+
+// reload reads a part of the configuration from the table again.
+func (s *Server) reload(ctx context.Context, part string) error {
+	switch part {
+	case reloadCanvas:
+		rows, cols := s.Image.Size()
+		err := s.LoadCanvas(ctx)
+		if err != nil {
+			return err
+		}
+		// A canvas that grew gets back the pixels an earlier shrink cut
+		// off.
+		if r, c := s.Image.Size(); r != rows || c != cols {
+			return s.LoadImage(ctx)
+		}
+		return nil
+	case reloadModeration:
+		return s.Moderation.Load(ctx)
+	case reloadTemplates:
+		return s.LoadTemplates(ctx)
+	case reloadSchedule:
+		return s.LoadSchedule(ctx)
+	case reloadDetection:
+		return s.LoadDetection(ctx)
+	case reloadChallenge:
+		return s.LoadChallengeConfig(ctx)
+	}
+	log.Println("ignoring reload of unknown configuration", part)
+	return nil
+}
+
+// reloadAll reloads the given parts of the configuration, logging the
+// ones that fail.
+func (s *Server) reloadAll(ctx context.Context, parts ...string) {
+	for _, part := range parts {
+		err := s.reload(ctx, part)
+		if err != nil {
+			log.Printf("could not reload the %s of %s: %s", part, s.Image.Name, err.Error())
+		}
+	}
+}
+
+// requestReload asks watchConfig to reload the whole configuration.
+// Requests made while one is pending are folded into it.
+func (s *Server) requestReload() {
+	select {
+	case s.reloads <- struct{}{}:
+	default:
+	}
+}
+
+// watchConfig reloads the configuration every configReload, and whenever
+// a reload is requested, until ctx is done. The schedule is left to
+// RunSchedule between requests, since it reloads it more often.
+func (s *Server) watchConfig(ctx context.Context) {
+	ticker := time.NewTicker(configReload)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.reloads:
+			s.reloadAll(ctx, reloadCanvas, reloadModeration, reloadTemplates, reloadSchedule, reloadDetection, reloadChallenge)
+		case <-ticker.C:
+			s.reloadAll(ctx, reloadCanvas, reloadModeration, reloadTemplates, reloadDetection, reloadChallenge)
+		}
+	}
+}
+
+// RunBackplane applies the placements and control messages of other
+// instances until ctx is done. Placements run their listeners as local ones
+// do, so the pixels reach this instance's tiles, streams and cooldowns.
+// When the broker lost messages, the canvas and the configuration are read
+// from the table again; cached faction memberships expire on their own.
+func (s *Server) RunBackplane(ctx context.Context) error {
+	if s.Broker == nil {
+		return nil
+	}
+
+	messages, err := s.Broker.Subscribe(ctx, s.pixelTopic())
+	if err != nil {
+		return err
+	}
+	controls, err := s.Broker.Subscribe(ctx, s.controlTopic())
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for message := range messages {
+			if message.Lost {
+				s.requestResync("placements relayed through the broker were lost")
+				continue
+			}
+
+			var msg backplaneMessage
+			err := json.Unmarshal(message.Payload, &msg)
+			if err != nil || msg.Pixel == nil {
+				log.Println("dropping malformed broker message")
+				continue
+			}
+			if msg.Origin == s.instanceId {
+				continue
+			}
+			s.ApplyPixel(msg.Pixel)
+		}
+	}()
+
+	go func() {
+		for message := range controls {
+			if message.Lost {
+				s.requestReload()
+				continue
+			}
+
+			var msg controlMessage
+			err := json.Unmarshal(message.Payload, &msg)
+			if err != nil {
+				log.Println("dropping malformed control message")
+				continue
+			}
+			if msg.Origin == s.instanceId {
+				continue
+			}
+			s.applyControl(ctx, msg)
+		}
+	}()
+	return nil
+}
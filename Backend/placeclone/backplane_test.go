@@ -0,0 +1,119 @@
+package placeclone
+
+import (
+	"context"
+	"github.com/Jonathanpatta/rplace/broker"
+	"github.com/Jonathanpatta/rplace/internal/brokertest"
+	"testing"
+	"time"
+)
+
+// newBackplane starts n instances of the same canvas, sharing a Redis
+// broker served by a stand-in. Nothing is loaded from the table.
+func newBackplane(t *testing.T, n int) (*brokertest.StandIn, []*Server) {
+	t.Helper()
+	standIn, err := brokertest.ListenStandIn("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		standIn.Close()
+	})
+
+	servers := make([]*Server, n)
+	for i := range servers {
+		b := broker.NewRedisBroker(standIn.Addr(), "")
+		t.Cleanup(func() { b.Close() })
+
+		servers[i] = NewCanvasServer(nil, nil, nil, "test")
+		servers[i].Broker = b
+		err = servers[i].RunBackplane(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return standIn, servers
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBackplaneRelaysPlacementsInOrder(t *testing.T) {
+	_, servers := newBackplane(t, 2)
+	origin, other := servers[0], servers[1]
+
+	const placements = 200
+	for seq := int64(1); seq <= placements; seq++ {
+		p := origin.Image.NewPixel(int(seq%10), 0, "#FF4500", "alice")
+		p.Seq = seq
+		p.Version = seq
+		origin.ApplyPixel(p)
+		origin.relayPixel(p)
+	}
+	origin.Wait()
+
+	waitFor(t, "the relayed placements", func() bool {
+		return other.ChangeLog.Latest() == placements
+	})
+	pixels, _, ok := other.ChangeLog.Since(0)
+	if !ok || len(pixels) != placements {
+		t.Fatalf("got %d changes, want %d", len(pixels), placements)
+	}
+	for i, p := range pixels {
+		if p.Seq != int64(i+1) {
+			t.Fatalf("change %d has sequence number %d", i, p.Seq)
+		}
+	}
+	if p := other.Image.GetPixel(0, 0); p == nil || p.Seq != placements {
+		t.Fatalf("pixel 0,0 is %+v, want the last placement on it", p)
+	}
+	if origin.ChangeLog.Latest() != placements {
+		t.Fatalf("the origin logged up to %d", origin.ChangeLog.Latest())
+	}
+}
+
+func TestBackplaneResyncsAfterReconnect(t *testing.T) {
+	standIn, servers := newBackplane(t, 1)
+
+	standIn.DropConnections()
+	select {
+	case <-servers[0].resyncs:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no reload of the canvas was requested after the broker connection dropped")
+	}
+	select {
+	case <-servers[0].reloads:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no reload of the configuration was requested after the broker connection dropped")
+	}
+}
+
+func TestBackplaneRelaysControlMessages(t *testing.T) {
+	_, servers := newBackplane(t, 2)
+	origin, other := servers[0], servers[1]
+
+	for _, s := range servers {
+		p := s.Image.NewPixel(1, 1, "#FF4500", "alice")
+		s.Detector.Record(p)
+		if _, ok := s.Detector.Suspicion("alice"); !ok {
+			t.Fatal("alice was not scored")
+		}
+	}
+
+	origin.Detector.Clear("alice")
+	origin.announce(controlSuspicion, "alice")
+	waitFor(t, "the suspicion to be cleared", func() bool {
+		_, ok := other.Detector.Suspicion("alice")
+		return !ok
+	})
+}
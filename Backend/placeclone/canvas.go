@@ -0,0 +1,219 @@
+package placeclone
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Jonathanpatta/rplace/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"net/http"
+	"time"
+)
+
+// MaxCanvasSize bounds both sides of a canvas.
+const MaxCanvasSize = 4096
+
+var ErrCanvasExists = errors.New("canvas already exists")
+
+// Canvas is the stored configuration of a canvas. An empty palette means
+// DefaultPalette.
+type Canvas struct {
+	Name      string   `json:"name"`
+	Rows      int      `json:"rows"`
+	Cols      int      `json:"cols"`
+	Palette   []string `json:"palette,omitempty"`
+	CreatedAt int64    `json:"created_at,omitempty" dynamodbav:"created_at"`
+	UpdatedAt int64    `json:"updated_at,omitempty" dynamodbav:"updated_at"`
+}
+
+func (c *Canvas) Validate() error {
+	if c.Name == "" {
+		return errors.New("a canvas needs a name")
+	}
+	if c.Rows <= 0 || c.Cols <= 0 || c.Rows > MaxCanvasSize || c.Cols > MaxCanvasSize {
+		return errors.New("canvas size out of range")
+	}
+	for _, color := range c.Palette {
+		_, err := NormalizeColor(color)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func canvasKey(name string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: "CANVAS#" + name},
+		"SK": &types.AttributeValueMemberS{Value: "META"},
+	}
+}
+
+// GetCanvas reads the configuration of a canvas. It returns nil when the
+// canvas has never been configured.
+func GetCanvas(ctx context.Context, DbCli *dynamodb.Client, tableName *string, name string) (*Canvas, error) {
+	out, err := DbCli.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: tableName,
+		Key:       canvasKey(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	var c Canvas
+	err = attributevalue.UnmarshalMap(out.Item, &c)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// PutCanvas stores the configuration of a canvas. With create set it fails
+// with ErrCanvasExists instead of replacing one.
+func PutCanvas(ctx context.Context, DbCli *dynamodb.Client, tableName *string, c *Canvas, create bool) error {
+	item, err := attributevalue.MarshalMap(c)
+	if err != nil {
+		return err
+	}
+	for k, v := range canvasKey(c.Name) {
+		item[k] = v
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName: tableName,
+		Item:      item,
+	}
+	if create {
+		input.ConditionExpression = aws.String("attribute_not_exists(PK)")
+	}
+
+	_, err = DbCli.PutItem(ctx, input)
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrCanvasExists
+	}
+	return err
+}
+
+// putSetting stores v under the canvas as the setting named sk.
+func (s *Server) putSetting(ctx context.Context, sk string, v interface{}) error {
+	item, err := attributevalue.MarshalMap(v)
+	if err != nil {
+		return err
+	}
+	item["PK"] = &types.AttributeValueMemberS{Value: "CANVAS#" + s.Image.Name}
+	item["SK"] = &types.AttributeValueMemberS{Value: sk}
+
+	_, err = s.DbCli.PutItem(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: s.TableName,
+	})
+	return err
+}
+
+// getSetting reads the setting named sk into v. found is false when it has
+// never been stored.
+func (s *Server) getSetting(ctx context.Context, sk string, v interface{}) (bool, error) {
+	out, err := s.DbCli.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: s.TableName,
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: "CANVAS#" + s.Image.Name},
+			"SK": &types.AttributeValueMemberS{Value: sk},
+		},
+	})
+	if err != nil || out.Item == nil {
+		return false, err
+	}
+	return true, attributevalue.UnmarshalMap(out.Item, v)
+}
+
+// LoadCanvas applies the stored configuration to the in-memory canvas.
+func (s *Server) LoadCanvas(ctx context.Context) error {
+	c, err := GetCanvas(ctx, s.DbCli, s.TableName, s.Image.Name)
+	if err != nil || c == nil {
+		return err
+	}
+
+	s.Image.Resize(c.Rows, c.Cols)
+	if len(c.Palette) > 0 {
+		s.Image.Palette = c.Palette
+	}
+	return nil
+}
+
+// Canvas returns the configuration of the canvas being served.
+func (s *Server) Canvas() *Canvas {
+	rows, cols := s.Image.Size()
+	return &Canvas{
+		Name:    s.Image.Name,
+		Rows:    rows,
+		Cols:    cols,
+		Palette: s.Image.Palette,
+	}
+}
+
+type ResizeCanvasRequest struct {
+	Rows int `json:"rows"`
+	Cols int `json:"cols"`
+}
+
+func (s *Server) GetCanvasHandler(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, s.Canvas())
+}
+
+// ResizeCanvas stores a new size and reloads the canvas in it, so pixels
+// cut off by an earlier shrink come back when it grows.
+func (s *Server) ResizeCanvas(w http.ResponseWriter, r *http.Request) {
+	if !middleware.IsAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return
+	}
+
+	var req ResizeCanvasRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c, err := GetCanvas(r.Context(), s.DbCli, s.TableName, s.Image.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().Unix()
+	if c == nil {
+		c = s.Canvas()
+		c.CreatedAt = now
+	}
+	c.Rows = req.Rows
+	c.Cols = req.Cols
+	c.UpdatedAt = now
+	err = c.Validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = PutCanvas(r.Context(), s.DbCli, s.TableName, c, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.Image.Resize(c.Rows, c.Cols)
+	err = s.LoadImage(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.announce(controlReload, reloadCanvas)
+
+	writeJson(w, http.StatusOK, s.Canvas())
+}
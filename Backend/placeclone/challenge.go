@@ -0,0 +1,93 @@
+package placeclone
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Jonathanpatta/rplace/challenge"
+	"github.com/Jonathanpatta/rplace/middleware"
+	"net/http"
+)
+
+const RejectChallenge RejectionCode = challenge.Code
+
+// checkChallenge asks for a solved challenge, sent along with the placement
+// and carried in ctx, when the issuer calls for one: because the canvas is
+// under heavy load or because the detector wants this user challenged.
+// Without an issuer, users the detector wants challenged are refused.
+func (s *Server) checkChallenge(ctx context.Context, p *Placement) *Rejection {
+	risky := s.Detector.Challenged(p.User)
+	if s.Challenges == nil {
+		if risky {
+			return &Rejection{Code: RejectChallenge, Reason: "this account cannot place pixels right now"}
+		}
+		return nil
+	}
+
+	err := s.Challenges.Check(ctx, challenge.ProofFrom(ctx), challenge.ScopePlace, risky)
+	if err != nil {
+		return &Rejection{Code: RejectChallenge, Reason: err.Error()}
+	}
+	return nil
+}
+
+func (s *Server) GetChallengeConfig(w http.ResponseWriter, r *http.Request) {
+	if !middleware.IsAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return
+	}
+	if s.Challenges == nil {
+		http.Error(w, "challenges are not enabled", http.StatusNotFound)
+		return
+	}
+
+	writeJson(w, http.StatusOK, s.Challenges.Config())
+}
+
+// PutChallengeConfig changes the challenge mode, difficulty and load
+// threshold. Fields left out keep their value.
+func (s *Server) PutChallengeConfig(w http.ResponseWriter, r *http.Request) {
+	if !middleware.IsAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return
+	}
+	if s.Challenges == nil {
+		http.Error(w, "challenges are not enabled", http.StatusNotFound)
+		return
+	}
+
+	config := s.Challenges.Config()
+	err := json.NewDecoder(r.Body).Decode(&config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = config.Validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = s.putSetting(r.Context(), "CHALLENGE", config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.Challenges.Configure(config)
+	s.announce(controlReload, reloadChallenge)
+
+	writeJson(w, http.StatusOK, config)
+}
+
+// LoadChallengeConfig applies the stored challenge settings, if there are
+// any and challenges are enabled.
+func (s *Server) LoadChallengeConfig(ctx context.Context) error {
+	if s.Challenges == nil {
+		return nil
+	}
+
+	var c challenge.Config
+	found, err := s.getSetting(ctx, "CHALLENGE", &c)
+	if err != nil || !found {
+		return err
+	}
+	return s.Challenges.Configure(c)
+}
@@ -0,0 +1,180 @@
+package placeclone
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxChangeGap is how long a missing sequence number may hold back the
+// changes after it before the canvas is reloaded from the table.
+const MaxChangeGap = 10 * time.Second
+
+// ChangeLog keeps the most recent accepted placements of a canvas ordered by
+// sequence number so that clients can catch up after a short disconnect.
+// Floor is the highest sequence number whose changes are no longer held;
+// anything at or below it has to be fetched from the full snapshot.
+//
+// Placements reach an instance out of order, its own and the relayed ones
+// racing each other. Only the changes up to the first missing sequence
+// number are handed out, so a client that has synced up to some number has
+// seen every change before it.
+type ChangeLog struct {
+	mu       sync.RWMutex
+	pixels   []*Pixel
+	capacity int
+	floor    int64
+	latest   int64
+	// gapSince is when the changes after latest started waiting on a
+	// missing one, zero when nothing is waiting.
+	gapSince time.Time
+}
+
+func NewChangeLog(capacity int) *ChangeLog {
+	return &ChangeLog{
+		capacity: capacity,
+	}
+}
+
+func (c *ChangeLog) Add(p *Pixel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if p.Seq <= c.latest {
+		return
+	}
+
+	idx := sort.Search(len(c.pixels), func(i int) bool {
+		return c.pixels[i].Seq >= p.Seq
+	})
+	if idx < len(c.pixels) && c.pixels[idx].Seq == p.Seq {
+		return
+	}
+	c.pixels = append(c.pixels, nil)
+	copy(c.pixels[idx+1:], c.pixels[idx:])
+	c.pixels[idx] = p
+	c.advance()
+}
+
+// advance moves latest past the changes that follow it without a gap and
+// drops the oldest changes over capacity. It must be called with c.mu held.
+func (c *ChangeLog) advance() {
+	next := sort.Search(len(c.pixels), func(i int) bool {
+		return c.pixels[i].Seq > c.latest
+	})
+	advanced := false
+	for next < len(c.pixels) && c.pixels[next].Seq == c.latest+1 {
+		c.latest++
+		next++
+		advanced = true
+	}
+	switch {
+	case next == len(c.pixels):
+		c.gapSince = time.Time{}
+	case advanced || c.gapSince.IsZero():
+		c.gapSince = time.Now()
+	}
+
+	for len(c.pixels) > c.capacity && c.pixels[0].Seq <= c.latest {
+		c.floor = c.pixels[0].Seq
+		c.pixels = c.pixels[1:]
+	}
+}
+
+// Reset marks seq as the point from which the log is complete. Changes up
+// to seq are discarded and the ones after it kept, since they may have
+// arrived before the log was reset.
+func (c *ChangeLog) Reset(seq int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	idx := sort.Search(len(c.pixels), func(i int) bool {
+		return c.pixels[i].Seq > seq
+	})
+	c.pixels = append([]*Pixel(nil), c.pixels[idx:]...)
+	c.floor = seq
+	c.latest = seq
+	c.gapSince = time.Time{}
+	c.advance()
+}
+
+// Latest is the sequence number up to which the log is complete.
+func (c *ChangeLog) Latest() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.latest
+}
+
+// Stalled reports whether changes have been waiting on a missing one for
+// longer than max.
+func (c *ChangeLog) Stalled(max time.Duration) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !c.gapSince.IsZero() && time.Since(c.gapSince) > max
+}
+
+// Since returns the changes after seq. ok is false when seq is older than
+// the retained history and the client has to reload the full snapshot.
+func (c *ChangeLog) Since(seq int64) (pixels []*Pixel, latest int64, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if seq < c.floor {
+		return nil, c.latest, false
+	}
+
+	from := sort.Search(len(c.pixels), func(i int) bool {
+		return c.pixels[i].Seq > seq
+	})
+	to := sort.Search(len(c.pixels), func(i int) bool {
+		return c.pixels[i].Seq > c.latest
+	})
+	if from > to {
+		from = to
+	}
+	pixels = make([]*Pixel, to-from)
+	copy(pixels, c.pixels[from:to])
+	return pixels, c.latest, true
+}
+
+// resync reloads the canvas from the table, for when this instance may
+// have missed placements.
+func (s *Server) resync(ctx context.Context, reason string) {
+	log.Printf("reloading canvas %s: %s", s.Image.Name, reason)
+	err := s.LoadImage(ctx)
+	if err != nil {
+		log.Printf("could not reload canvas %s: %s", s.Image.Name, err.Error())
+	}
+}
+
+// requestResync asks watchChangeLog to reload the canvas. Requests made
+// while one is pending are folded into it.
+func (s *Server) requestResync(reason string) {
+	select {
+	case s.resyncs <- reason:
+	default:
+	}
+}
+
+// watchChangeLog reloads the canvas whenever a missing placement holds the
+// change log back for too long, or a reload was requested, until ctx is
+// done. A placement only goes missing when its relay was lost, and the
+// table has it.
+func (s *Server) watchChangeLog(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case reason := <-s.resyncs:
+			s.resync(ctx, reason)
+		case <-ticker.C:
+			if s.ChangeLog.Stalled(MaxChangeGap) {
+				s.resync(ctx, "a placement is missing from the change log")
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package placeclone
+
+import (
+	"testing"
+	"time"
+)
+
+func logSeqs(pixels []*Pixel) []int64 {
+	seqs := make([]int64, len(pixels))
+	for i, p := range pixels {
+		seqs[i] = p.Seq
+	}
+	return seqs
+}
+
+func equalSeqs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestChangeLogAdd(t *testing.T) {
+	tests := []struct {
+		name   string
+		added  []int64
+		latest int64
+		since  []int64
+	}{
+		{"in order", []int64{1, 2, 3}, 3, []int64{1, 2, 3}},
+		{"out of order", []int64{2, 3, 1}, 3, []int64{1, 2, 3}},
+		{"held back by a gap", []int64{1, 3, 4}, 1, []int64{1}},
+		{"gap filled", []int64{1, 3, 4, 2}, 4, []int64{1, 2, 3, 4}},
+		{"duplicates", []int64{1, 1, 2, 2}, 2, []int64{1, 2}},
+		{"nothing from the start", []int64{2, 3}, 0, []int64{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := NewChangeLog(10)
+			for _, seq := range test.added {
+				c.Add(&Pixel{Seq: seq})
+			}
+			if c.Latest() != test.latest {
+				t.Fatalf("got latest %d, want %d", c.Latest(), test.latest)
+			}
+			pixels, latest, ok := c.Since(0)
+			if !ok || latest != test.latest || !equalSeqs(logSeqs(pixels), test.since) {
+				t.Fatalf("got %v up to %d (%v), want %v", logSeqs(pixels), latest, ok, test.since)
+			}
+		})
+	}
+}
+
+func TestChangeLogSince(t *testing.T) {
+	c := NewChangeLog(3)
+	for seq := int64(1); seq <= 5; seq++ {
+		c.Add(&Pixel{Seq: seq})
+	}
+	// Two of the five changes were dropped over capacity.
+	tests := []struct {
+		seq    int64
+		pixels []int64
+		ok     bool
+	}{
+		{0, nil, false},
+		{1, nil, false},
+		{2, []int64{3, 4, 5}, true},
+		{4, []int64{5}, true},
+		{5, []int64{}, true},
+		{9, []int64{}, true},
+	}
+	for _, test := range tests {
+		pixels, latest, ok := c.Since(test.seq)
+		if ok != test.ok || latest != 5 || (ok && !equalSeqs(logSeqs(pixels), test.pixels)) {
+			t.Fatalf("since %d: got %v up to %d (%v), want %v (%v)", test.seq, logSeqs(pixels), latest, ok, test.pixels, test.ok)
+		}
+	}
+}
+
+func TestChangeLogReset(t *testing.T) {
+	c := NewChangeLog(10)
+	for _, seq := range []int64{1, 2, 6, 8} {
+		c.Add(&Pixel{Seq: seq})
+	}
+
+	// The snapshot reaches 5; the 6 that arrived before it is kept and the 8
+	// still waits on 7.
+	c.Reset(5)
+	if c.Latest() != 6 {
+		t.Fatalf("got latest %d, want 6", c.Latest())
+	}
+	if _, _, ok := c.Since(4); ok {
+		t.Fatal("changes before the snapshot handed out")
+	}
+	pixels, _, ok := c.Since(5)
+	if !ok || !equalSeqs(logSeqs(pixels), []int64{6}) {
+		t.Fatalf("got %v (%v)", logSeqs(pixels), ok)
+	}
+
+	c.Add(&Pixel{Seq: 7})
+	if c.Latest() != 8 {
+		t.Fatalf("got latest %d, want 8", c.Latest())
+	}
+}
+
+func TestChangeLogStalled(t *testing.T) {
+	c := NewChangeLog(10)
+	c.Add(&Pixel{Seq: 1})
+	if c.Stalled(0) {
+		t.Fatal("stalled without a gap")
+	}
+
+	c.Add(&Pixel{Seq: 3})
+	time.Sleep(time.Millisecond)
+	if !c.Stalled(0) {
+		t.Fatal("not stalled on the missing 2")
+	}
+	if c.Stalled(time.Hour) {
+		t.Fatal("stalled before the gap got old")
+	}
+
+	c.Add(&Pixel{Seq: 2})
+	if c.Stalled(0) {
+		t.Fatal("still stalled after the gap was filled")
+	}
+}
@@ -0,0 +1,87 @@
+package placeclone
+
+import (
+	"fmt"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+var emptyColor = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+
+// DefaultPalette is the palette a new canvas is painted with.
+var DefaultPalette = []string{
+	"#ffffff", "#e4e4e4", "#888888", "#222222",
+	"#ffa7d1", "#e50000", "#e59500", "#a06a42",
+	"#e5d900", "#94e044", "#02be01", "#00d3dd",
+	"#0083c7", "#0000ea", "#cf6ee4", "#820080",
+}
+
+// ParseColor reads a pixel color written as #rrggbb or #rgb, with or
+// without the leading hash.
+func ParseColor(c string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(c, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("invalid color %q", c)
+	}
+
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid color %q", c)
+	}
+
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 255}, nil
+}
+
+func FormatColor(c color.Color) string {
+	r, g, b, _ := c.RGBA()
+	return fmt.Sprintf("#%02x%02x%02x", r>>8, g>>8, b>>8)
+}
+
+// pixelColor is the color a pixel is drawn with. Unset and unreadable
+// pixels are drawn as the blank canvas.
+func pixelColor(p *Pixel) color.RGBA {
+	if p == nil {
+		return emptyColor
+	}
+	c, err := ParseColor(p.Color)
+	if err != nil {
+		return emptyColor
+	}
+	return c
+}
+
+// NormalizeColor rewrites a color in the lowercase #rrggbb form used for
+// comparisons.
+func NormalizeColor(c string) (string, error) {
+	rgba, err := ParseColor(c)
+	if err != nil {
+		return "", err
+	}
+	return FormatColor(rgba), nil
+}
+
+// Quantize returns the palette entry closest to c.
+func Quantize(palette []string, c color.Color) string {
+	r, g, b, _ := c.RGBA()
+	best := ""
+	bestDistance := -1
+	for _, entry := range palette {
+		p, err := ParseColor(entry)
+		if err != nil {
+			continue
+		}
+		dr := int(r>>8) - int(p.R)
+		dg := int(g>>8) - int(p.G)
+		db := int(b>>8) - int(p.B)
+		distance := dr*dr + dg*dg + db*db
+		if bestDistance < 0 || distance < bestDistance {
+			best = FormatColor(p)
+			bestDistance = distance
+		}
+	}
+	return best
+}
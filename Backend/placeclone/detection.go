@@ -0,0 +1,449 @@
+package placeclone
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Jonathanpatta/rplace/middleware"
+	"github.com/Jonathanpatta/rplace/webhook"
+	"github.com/gorilla/mux"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	ActionNone      = "none"
+	ActionSlowdown  = "slowdown"
+	ActionChallenge = "challenge"
+)
+
+const RejectSlowdown RejectionCode = "slowed_down"
+
+const (
+	// historySize is how many placement times are kept per user.
+	historySize = 30
+	// minSamples is how many placements a user needs before being scored.
+	minSamples = 10
+	// expirySlack is how soon after the cooldown ends a placement counts
+	// as made at expiry.
+	expirySlack = 2 * time.Second
+	// expiryPeriod is how long a user has to keep painting at expiry for
+	// that signal to count in full.
+	expiryPeriod = 2 * time.Hour
+	// coordinationWindow is how close in time two users have to paint
+	// neighbouring template pixels to count as coordinated.
+	coordinationWindow = 10 * time.Second
+)
+
+var ErrInvalidAction = errors.New("action must be none, slowdown or challenge")
+
+// Suspicion is how likely a user is to be scripted. Each signal is between
+// 0 and 1; Score combines them so that any one strong signal is enough.
+type Suspicion struct {
+	Username    string  `json:"username"`
+	Score       float64 `json:"score"`
+	Regularity  float64 `json:"regularity"`
+	AtExpiry    float64 `json:"at_expiry"`
+	Coordinated float64 `json:"coordinated"`
+	Placements  int     `json:"placements"`
+	Flagged     bool    `json:"flagged"`
+	UpdatedAt   int64   `json:"updated_at"`
+}
+
+type activity struct {
+	times       []time.Time
+	placements  int
+	coordinated int
+	suspicion   Suspicion
+}
+
+type templatePlacement struct {
+	user     string
+	template string
+	row      int
+	col      int
+	time     time.Time
+	counted  *bool
+}
+
+// Detector watches the placements of a canvas for signs of automation:
+// intervals between placements that are too regular, placements made right
+// as the cooldown runs out, and users painting neighbouring template pixels
+// in lockstep. It learns from the pixels applied to the canvas, so
+// placements relayed from other instances are scored as well, and keeps its
+// scores in memory only.
+//
+// Depending on the configured action a flagged user is left alone, has to
+// wait the slowdown factor times the cooldown between placements, or has to
+// solve a proof of work challenge with every placement.
+type Detector struct {
+	Cooldown  *Cooldown
+	Templates *Templates
+	// OnFlag is called when a user is first flagged.
+	OnFlag func(Suspicion)
+
+	mu             sync.RWMutex
+	threshold      float64
+	action         string
+	slowdownFactor float64
+	users          map[string]*activity
+	recent         []templatePlacement
+}
+
+// DetectionConfig holds the settings of a detector that can be changed at
+// runtime.
+type DetectionConfig struct {
+	Threshold      float64 `json:"threshold"`
+	Action         string  `json:"action"`
+	SlowdownFactor float64 `json:"slowdown_factor"`
+}
+
+func (c *DetectionConfig) Validate() error {
+	if c.Threshold <= 0 || c.Threshold > 1 {
+		return errors.New("threshold must be above 0 and at most 1")
+	}
+	if c.Action != ActionNone && c.Action != ActionSlowdown && c.Action != ActionChallenge {
+		return ErrInvalidAction
+	}
+	if c.SlowdownFactor < 1 {
+		return errors.New("slowdown_factor must be at least 1")
+	}
+	return nil
+}
+
+func NewDetector(cooldown *Cooldown, templates *Templates) *Detector {
+	return &Detector{
+		Cooldown:       cooldown,
+		Templates:      templates,
+		threshold:      0.8,
+		action:         ActionNone,
+		slowdownFactor: 4,
+		users:          make(map[string]*activity),
+	}
+}
+
+func (d *Detector) Config() DetectionConfig {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return DetectionConfig{Threshold: d.threshold, Action: d.action, SlowdownFactor: d.slowdownFactor}
+}
+
+// Configure changes the settings and rescores every user against the new
+// threshold.
+func (d *Detector) Configure(c DetectionConfig) error {
+	err := c.Validate()
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.threshold = c.Threshold
+	d.action = c.Action
+	d.slowdownFactor = c.SlowdownFactor
+	for _, a := range d.users {
+		a.suspicion.Flagged = a.suspicion.Placements >= minSamples && a.suspicion.Score >= d.threshold
+	}
+	return nil
+}
+
+// Record scores a placement. It is registered as a pixel listener.
+func (d *Detector) Record(p *Pixel) {
+	if p.Author == "" {
+		return
+	}
+	placed := time.Unix(p.LastModified, 0)
+	template, follows := d.Templates.Follows(p)
+
+	d.mu.Lock()
+	a, ok := d.users[p.Author]
+	if !ok {
+		a = &activity{suspicion: Suspicion{Username: p.Author}}
+		d.users[p.Author] = a
+	}
+	a.placements++
+	a.times = append(a.times, placed)
+	if len(a.times) > historySize {
+		a.times = a.times[len(a.times)-historySize:]
+	}
+	if follows {
+		d.coordinate(p, template, placed)
+	}
+
+	wasFlagged := a.suspicion.Flagged
+	d.score(a, placed)
+	suspicion := a.suspicion
+	onFlag := d.OnFlag
+	d.mu.Unlock()
+
+	if suspicion.Flagged && !wasFlagged && onFlag != nil {
+		onFlag(suspicion)
+	}
+}
+
+// coordinate looks for other users who painted a neighbouring pixel of the
+// same template just before, and counts both placements as coordinated.
+func (d *Detector) coordinate(p *Pixel, template string, placed time.Time) {
+	cutoff := placed.Add(-coordinationWindow)
+	kept := d.recent[:0]
+	for _, r := range d.recent {
+		if r.time.After(cutoff) {
+			kept = append(kept, r)
+		}
+	}
+	d.recent = kept
+
+	counted := false
+	for _, r := range d.recent {
+		if r.user == p.Author || r.template != template {
+			continue
+		}
+		if abs(r.row-p.Row) > 1 || abs(r.col-p.Col) > 1 {
+			continue
+		}
+		if !*r.counted {
+			*r.counted = true
+			if other, ok := d.users[r.user]; ok {
+				other.coordinated++
+			}
+		}
+		if !counted {
+			counted = true
+			d.users[p.Author].coordinated++
+		}
+	}
+
+	d.recent = append(d.recent, templatePlacement{
+		user:     p.Author,
+		template: template,
+		row:      p.Row,
+		col:      p.Col,
+		time:     placed,
+		counted:  &counted,
+	})
+}
+
+func (d *Detector) score(a *activity, now time.Time) {
+	s := &a.suspicion
+	s.Placements = a.placements
+	s.UpdatedAt = now.Unix()
+	s.Regularity, s.AtExpiry = 0, 0
+	s.Coordinated = math.Min(1, float64(a.coordinated)/float64(a.placements))
+
+	if len(a.times) > minSamples {
+		intervals := make([]float64, 0, len(a.times)-1)
+		atExpiry := 0
+		cooldown := d.Cooldown.Duration
+		for i := 1; i < len(a.times); i++ {
+			interval := a.times[i].Sub(a.times[i-1])
+			intervals = append(intervals, interval.Seconds())
+			if interval >= cooldown && interval-cooldown <= expirySlack {
+				atExpiry++
+			}
+		}
+
+		// A coefficient of variation of 0.2 or more is well within what
+		// people manage; below that regularity rises to 1 at none at all.
+		mean, deviation := meanDeviation(intervals)
+		if mean > 0 {
+			s.Regularity = math.Max(0, 1-deviation/mean/0.2)
+		}
+
+		span := a.times[len(a.times)-1].Sub(a.times[0])
+		s.AtExpiry = float64(atExpiry) / float64(len(intervals)) * math.Min(1, float64(span)/float64(expiryPeriod))
+	}
+
+	s.Score = 1 - (1-s.Regularity)*(1-s.AtExpiry)*(1-s.Coordinated)
+	s.Flagged = a.placements >= minSamples && s.Score >= d.threshold
+}
+
+func meanDeviation(values []float64) (float64, float64) {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+
+	var squares float64
+	for _, v := range values {
+		squares += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(squares / float64(len(values)))
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// Suspicion returns the current score of a user.
+func (d *Detector) Suspicion(user string) (Suspicion, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	a, ok := d.users[user]
+	if !ok {
+		return Suspicion{}, false
+	}
+	return a.suspicion, true
+}
+
+// Suspicions lists the scored users, most suspicious first. Only flagged
+// users are listed unless all is set.
+func (d *Detector) Suspicions(all bool) []Suspicion {
+	d.mu.RLock()
+	list := make([]Suspicion, 0, len(d.users))
+	for _, a := range d.users {
+		if all || a.suspicion.Flagged {
+			list = append(list, a.suspicion)
+		}
+	}
+	d.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Score != list[j].Score {
+			return list[i].Score > list[j].Score
+		}
+		return list[i].Username < list[j].Username
+	})
+	return list
+}
+
+// Clear forgets everything recorded about a user, for when a moderator has
+// looked into a flag and found nothing wrong.
+func (d *Detector) Clear(user string) {
+	d.mu.Lock()
+	delete(d.users, user)
+	d.mu.Unlock()
+}
+
+// Challenged reports whether user has to solve a challenge to place.
+func (d *Detector) Challenged(user string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	a, ok := d.users[user]
+	return ok && a.suspicion.Flagged && d.action == ActionChallenge
+}
+
+// Check slows down flagged users when the action is ActionSlowdown. The
+// challenge asked for by ActionChallenge is checked by ChallengeRule.
+func (d *Detector) Check(ctx context.Context, p *Placement) *Rejection {
+	d.mu.RLock()
+	a, ok := d.users[p.User]
+	slowed := ok && a.suspicion.Flagged && d.action == ActionSlowdown
+	factor := d.slowdownFactor
+	d.mu.RUnlock()
+
+	if !slowed {
+		return nil
+	}
+
+	wait := d.Cooldown.Last(p.User).Add(time.Duration(float64(d.Cooldown.Duration) * factor)).Sub(p.Time)
+	if wait > 0 {
+		return &Rejection{
+			Code:       RejectSlowdown,
+			Reason:     fmt.Sprintf("next placement allowed in %s", wait.Round(time.Second)),
+			RetryAfter: wait,
+		}
+	}
+	return nil
+}
+
+// GetSuspicions lists flagged users, or every scored user with ?all=true.
+func (s *Server) GetSuspicions(w http.ResponseWriter, r *http.Request) {
+	if !middleware.IsAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return
+	}
+
+	all, _ := strconv.ParseBool(r.URL.Query().Get("all"))
+	writeJson(w, http.StatusOK, s.Detector.Suspicions(all))
+}
+
+func (s *Server) GetSuspicion(w http.ResponseWriter, r *http.Request) {
+	if !middleware.IsAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return
+	}
+
+	suspicion, ok := s.Detector.Suspicion(mux.Vars(r)["username"])
+	if !ok {
+		http.Error(w, "user has not been scored", http.StatusNotFound)
+		return
+	}
+	writeJson(w, http.StatusOK, suspicion)
+}
+
+func (s *Server) ClearSuspicion(w http.ResponseWriter, r *http.Request) {
+	if !middleware.IsAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return
+	}
+
+	s.Detector.Clear(mux.Vars(r)["username"])
+	s.announce(controlSuspicion, mux.Vars(r)["username"])
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) GetDetection(w http.ResponseWriter, r *http.Request) {
+	if !middleware.IsAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return
+	}
+
+	writeJson(w, http.StatusOK, s.Detector.Config())
+}
+
+func (s *Server) PutDetection(w http.ResponseWriter, r *http.Request) {
+	if !middleware.IsAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return
+	}
+
+	config := s.Detector.Config()
+	err := json.NewDecoder(r.Body).Decode(&config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = config.Validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = s.SaveDetection(r.Context(), config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.Detector.Configure(config)
+	s.announce(controlReload, reloadDetection)
+
+	writeJson(w, http.StatusOK, config)
+}
+
+// SaveDetection stores the detection settings, which every instance of the
+// canvas loads.
+func (s *Server) SaveDetection(ctx context.Context, c DetectionConfig) error {
+	return s.putSetting(ctx, "DETECTION", c)
+}
+
+// LoadDetection applies the stored detection settings, if there are any.
+func (s *Server) LoadDetection(ctx context.Context) error {
+	var c DetectionConfig
+	found, err := s.getSetting(ctx, "DETECTION", &c)
+	if err != nil || !found {
+		return err
+	}
+	return s.Detector.Configure(c)
+}
+
+func (s *Server) publishFlag(suspicion Suspicion) {
+	s.Webhooks.Publish(webhook.EventUserFlagged, suspicion)
+}
@@ -0,0 +1,101 @@
+package placeclone
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	EventPixel = "pixel"
+	EventPhase = "phase"
+)
+
+type Event struct {
+	Type  string       `json:"type"`
+	Pixel *Pixel       `json:"pixel,omitempty"`
+	Phase *PhaseChange `json:"phase,omitempty"`
+}
+
+// Events fans canvas events out to every connected client. Subscribers that
+// fall behind lose events rather than holding up the publisher; they can
+// catch up through the changes endpoint.
+type Events struct {
+	mu          sync.RWMutex
+	subscribers map[chan Event]struct{}
+}
+
+func NewEvents() *Events {
+	return &Events{
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+func (e *Events) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 256)
+
+	e.mu.Lock()
+	e.subscribers[ch] = struct{}{}
+	e.mu.Unlock()
+
+	return ch, func() {
+		e.mu.Lock()
+		delete(e.subscribers, ch)
+		e.mu.Unlock()
+	}
+}
+
+func (e *Events) Publish(event Event) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	for ch := range e.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func (e *Events) PublishPixel(p *Pixel) {
+	e.Publish(Event{Type: EventPixel, Pixel: p})
+}
+
+// StreamEvents sends canvas events to the client as server-sent events.
+func (s *Server) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events, unsubscribe := s.Events.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,691 @@
+package placeclone
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Jonathanpatta/rplace/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/gorilla/mux"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var factionNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{3,32}$`)
+
+var (
+	ErrFactionExists    = errors.New("faction already exists")
+	ErrFactionNotFound  = errors.New("faction not found")
+	ErrAlreadyInFaction = errors.New("user is already in a faction")
+	ErrNotInFaction     = errors.New("user is not in this faction")
+	ErrInvalidFaction   = errors.New("invalid faction")
+	ErrOwnerLeaving     = errors.New("the owner has to transfer or disband the faction first")
+	ErrNotFactionOwner  = errors.New("only the owner can do this")
+)
+
+// factionCacheTTL bounds how long an instance goes on crediting a faction
+// with the placements of a user who left it elsewhere, should the
+// eviction relayed through the broker get lost.
+const factionCacheTTL = time.Minute
+
+// cachedFaction is a faction membership kept in the local cache.
+type cachedFaction struct {
+	Faction   string
+	ExpiresAt int64
+}
+
+type Faction struct {
+	Name      string   `json:"name"`
+	Tag       string   `json:"tag"`
+	Owner     string   `json:"owner"`
+	CreatedAt int64    `json:"created_at,omitempty" dynamodbav:"created_at"`
+	Members   []string `json:"members,omitempty" dynamodbav:"-"`
+}
+
+type FactionMember struct {
+	Username string `json:"username"`
+	JoinedAt int64  `json:"joined_at,omitempty" dynamodbav:"joined_at"`
+}
+
+type FactionStats struct {
+	Name    string `json:"name"`
+	Members int    `json:"members"`
+	Pixels  int    `json:"pixels"`
+}
+
+func factionPk(name string) string {
+	return "FACTION#" + name
+}
+
+func userPk(username string) string {
+	return "USER#" + username
+}
+
+func factionCacheKey(username string) string {
+	return "USERFACTION#" + username
+}
+
+// GetFaction reads a faction with its member list.
+func (s *Server) GetFaction(ctx context.Context, name string) (*Faction, error) {
+	paginator := dynamodb.NewQueryPaginator(s.DbCli, &dynamodb.QueryInput{
+		TableName:              s.TableName,
+		KeyConditionExpression: aws.String("#PK = :name"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":name": &types.AttributeValueMemberS{Value: factionPk(name)},
+		},
+		ExpressionAttributeNames: map[string]string{
+			"#PK": "PK",
+		},
+	})
+
+	var faction *Faction
+	var members []string
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range page.Items {
+			sk, _ := item["SK"].(*types.AttributeValueMemberS)
+			if sk == nil {
+				continue
+			}
+			if sk.Value == "META" {
+				faction = &Faction{}
+				err = attributevalue.UnmarshalMap(item, faction)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			var member FactionMember
+			err = attributevalue.UnmarshalMap(item, &member)
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, member.Username)
+		}
+	}
+	if faction == nil {
+		return nil, ErrFactionNotFound
+	}
+	faction.Members = members
+
+	return faction, nil
+}
+
+// UserFaction returns the faction username belongs to, or an empty string.
+// Lookups are cached since every placement needs one.
+func (s *Server) UserFaction(ctx context.Context, username string) (string, error) {
+	var cached cachedFaction
+	if s.cacheCli != nil && s.cacheCli.Get(factionCacheKey(username), &cached) == nil && time.Now().Unix() < cached.ExpiresAt {
+		return cached.Faction, nil
+	}
+
+	out, err := s.DbCli.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: s.TableName,
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: userPk(username)},
+			"SK": &types.AttributeValueMemberS{Value: "FACTION"},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var membership struct {
+		Faction string
+	}
+	err = attributevalue.UnmarshalMap(out.Item, &membership)
+	if err != nil {
+		return "", err
+	}
+
+	s.cacheFaction(username, membership.Faction)
+	return membership.Faction, nil
+}
+
+func (s *Server) CreateFaction(ctx context.Context, name string, tag string, owner string) (*Faction, error) {
+	if !factionNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("%w: names are 3 to 32 letters, digits, dashes or underscores", ErrInvalidFaction)
+	}
+	tag, err := NormalizeColor(tag)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidFaction, err.Error())
+	}
+
+	faction := &Faction{
+		Name:      name,
+		Tag:       tag,
+		Owner:     owner,
+		CreatedAt: time.Now().Unix(),
+		Members:   []string{owner},
+	}
+
+	_, err = s.DbCli.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Put: &types.Put{
+					TableName: s.TableName,
+					Item: map[string]types.AttributeValue{
+						"PK":         &types.AttributeValueMemberS{Value: factionPk(name)},
+						"SK":         &types.AttributeValueMemberS{Value: "META"},
+						"name":       &types.AttributeValueMemberS{Value: faction.Name},
+						"tag":        &types.AttributeValueMemberS{Value: faction.Tag},
+						"owner":      &types.AttributeValueMemberS{Value: faction.Owner},
+						"created_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(faction.CreatedAt, 10)},
+					},
+					ConditionExpression: aws.String("attribute_not_exists(PK)"),
+				},
+			},
+			s.membershipPut(name, owner, faction.CreatedAt),
+			s.memberPut(name, owner, faction.CreatedAt),
+		},
+	})
+	if isTransactionConditionFailure(err) {
+		if current, _ := s.UserFaction(ctx, owner); current != "" {
+			return nil, ErrAlreadyInFaction
+		}
+		return nil, ErrFactionExists
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.cacheFaction(owner, name)
+	return faction, nil
+}
+
+func (s *Server) JoinFaction(ctx context.Context, name string, username string) error {
+	_, err := s.DbCli.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				ConditionCheck: &types.ConditionCheck{
+					TableName: s.TableName,
+					Key: map[string]types.AttributeValue{
+						"PK": &types.AttributeValueMemberS{Value: factionPk(name)},
+						"SK": &types.AttributeValueMemberS{Value: "META"},
+					},
+					ConditionExpression: aws.String("attribute_exists(PK)"),
+				},
+			},
+			s.membershipPut(name, username, time.Now().Unix()),
+			s.memberPut(name, username, time.Now().Unix()),
+		},
+	})
+	if isTransactionConditionFailure(err) {
+		if current, _ := s.UserFaction(ctx, username); current != "" {
+			return ErrAlreadyInFaction
+		}
+		return ErrFactionNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	s.cacheFaction(username, name)
+	return nil
+}
+
+// LeaveFaction takes username out of a faction. The owner cannot leave,
+// so that a faction always has one.
+func (s *Server) LeaveFaction(ctx context.Context, name string, username string) error {
+	_, err := s.DbCli.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				ConditionCheck: &types.ConditionCheck{
+					TableName: s.TableName,
+					Key: map[string]types.AttributeValue{
+						"PK": &types.AttributeValueMemberS{Value: factionPk(name)},
+						"SK": &types.AttributeValueMemberS{Value: "META"},
+					},
+					ConditionExpression: aws.String("#owner <> :username"),
+					ExpressionAttributeNames: map[string]string{
+						"#owner": "owner",
+					},
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":username": &types.AttributeValueMemberS{Value: username},
+					},
+				},
+			},
+			{
+				Delete: &types.Delete{
+					TableName: s.TableName,
+					Key: map[string]types.AttributeValue{
+						"PK": &types.AttributeValueMemberS{Value: userPk(username)},
+						"SK": &types.AttributeValueMemberS{Value: "FACTION"},
+					},
+					ConditionExpression: aws.String("#faction = :faction"),
+					ExpressionAttributeNames: map[string]string{
+						"#faction": "faction",
+					},
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":faction": &types.AttributeValueMemberS{Value: name},
+					},
+				},
+			},
+			{
+				Delete: &types.Delete{
+					TableName: s.TableName,
+					Key: map[string]types.AttributeValue{
+						"PK": &types.AttributeValueMemberS{Value: factionPk(name)},
+						"SK": &types.AttributeValueMemberS{Value: "MEMBER#" + username},
+					},
+				},
+			},
+		},
+	})
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) && len(canceled.CancellationReasons) > 0 && aws.ToString(canceled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+		return ErrOwnerLeaving
+	}
+	if isTransactionConditionFailure(err) {
+		return ErrNotInFaction
+	}
+	if err != nil {
+		return err
+	}
+
+	s.forgetFaction(username)
+	return nil
+}
+
+// TransferFaction hands a faction over to one of its members.
+func (s *Server) TransferFaction(ctx context.Context, name string, owner string, newOwner string) error {
+	_, err := s.DbCli.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Update: &types.Update{
+					TableName: s.TableName,
+					Key: map[string]types.AttributeValue{
+						"PK": &types.AttributeValueMemberS{Value: factionPk(name)},
+						"SK": &types.AttributeValueMemberS{Value: "META"},
+					},
+					UpdateExpression:    aws.String("SET #owner = :new_owner"),
+					ConditionExpression: aws.String("#owner = :owner"),
+					ExpressionAttributeNames: map[string]string{
+						"#owner": "owner",
+					},
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":owner":     &types.AttributeValueMemberS{Value: owner},
+						":new_owner": &types.AttributeValueMemberS{Value: newOwner},
+					},
+				},
+			},
+			{
+				ConditionCheck: &types.ConditionCheck{
+					TableName: s.TableName,
+					Key: map[string]types.AttributeValue{
+						"PK": &types.AttributeValueMemberS{Value: factionPk(name)},
+						"SK": &types.AttributeValueMemberS{Value: "MEMBER#" + newOwner},
+					},
+					ConditionExpression: aws.String("attribute_exists(PK)"),
+				},
+			},
+		},
+	})
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) && len(canceled.CancellationReasons) == 2 {
+		if aws.ToString(canceled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+			return ErrNotFactionOwner
+		}
+		if aws.ToString(canceled.CancellationReasons[1].Code) == "ConditionalCheckFailed" {
+			return ErrNotInFaction
+		}
+	}
+	return err
+}
+
+// DisbandFaction deletes a faction and every membership in it. The faction
+// goes first, which stops anyone joining while the members are removed.
+func (s *Server) DisbandFaction(ctx context.Context, name string, owner string) error {
+	var conditionFailed *types.ConditionalCheckFailedException
+	_, err := s.DbCli.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: s.TableName,
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: factionPk(name)},
+			"SK": &types.AttributeValueMemberS{Value: "META"},
+		},
+		ConditionExpression: aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]string{
+			"#owner": "owner",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: owner},
+		},
+	})
+	if errors.As(err, &conditionFailed) {
+		return ErrNotFactionOwner
+	}
+	if err != nil {
+		return err
+	}
+
+	paginator := dynamodb.NewQueryPaginator(s.DbCli, &dynamodb.QueryInput{
+		TableName:              s.TableName,
+		KeyConditionExpression: aws.String("#PK = :name AND begins_with(#SK, :member)"),
+		ExpressionAttributeNames: map[string]string{
+			"#PK": "PK",
+			"#SK": "SK",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":name":   &types.AttributeValueMemberS{Value: factionPk(name)},
+			":member": &types.AttributeValueMemberS{Value: "MEMBER#"},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		var members []FactionMember
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &members)
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			err = s.removeMembership(ctx, name, member.Username)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeMembership deletes both sides of a membership without checking
+// the faction, which is gone while it is disbanded.
+func (s *Server) removeMembership(ctx context.Context, name string, username string) error {
+	_, err := s.DbCli.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Delete: &types.Delete{
+					TableName: s.TableName,
+					Key: map[string]types.AttributeValue{
+						"PK": &types.AttributeValueMemberS{Value: userPk(username)},
+						"SK": &types.AttributeValueMemberS{Value: "FACTION"},
+					},
+					ConditionExpression: aws.String("attribute_not_exists(PK) OR #faction = :faction"),
+					ExpressionAttributeNames: map[string]string{
+						"#faction": "faction",
+					},
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":faction": &types.AttributeValueMemberS{Value: name},
+					},
+				},
+			},
+			{
+				Delete: &types.Delete{
+					TableName: s.TableName,
+					Key: map[string]types.AttributeValue{
+						"PK": &types.AttributeValueMemberS{Value: factionPk(name)},
+						"SK": &types.AttributeValueMemberS{Value: "MEMBER#" + username},
+					},
+				},
+			},
+		},
+	})
+	if err != nil && !isTransactionConditionFailure(err) {
+		return err
+	}
+
+	s.forgetFaction(username)
+	return nil
+}
+
+// FactionStats counts the members of a faction and the pixels placed by
+// them that are still on the canvas.
+func (s *Server) FactionStats(faction *Faction) FactionStats {
+	stats := FactionStats{
+		Name:    faction.Name,
+		Members: len(faction.Members),
+	}
+
+	s.Image.mu.RLock()
+	defer s.Image.mu.RUnlock()
+	for _, p := range s.Image.Pixels {
+		if p != nil && p.Faction == faction.Name {
+			stats.Pixels++
+		}
+	}
+
+	return stats
+}
+
+func (s *Server) membershipPut(name string, username string, joinedAt int64) types.TransactWriteItem {
+	return types.TransactWriteItem{
+		Put: &types.Put{
+			TableName: s.TableName,
+			Item: map[string]types.AttributeValue{
+				"PK":        &types.AttributeValueMemberS{Value: userPk(username)},
+				"SK":        &types.AttributeValueMemberS{Value: "FACTION"},
+				"faction":   &types.AttributeValueMemberS{Value: name},
+				"joined_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(joinedAt, 10)},
+			},
+			ConditionExpression: aws.String("attribute_not_exists(PK)"),
+		},
+	}
+}
+
+func (s *Server) memberPut(name string, username string, joinedAt int64) types.TransactWriteItem {
+	return types.TransactWriteItem{
+		Put: &types.Put{
+			TableName: s.TableName,
+			Item: map[string]types.AttributeValue{
+				"PK":        &types.AttributeValueMemberS{Value: factionPk(name)},
+				"SK":        &types.AttributeValueMemberS{Value: "MEMBER#" + username},
+				"username":  &types.AttributeValueMemberS{Value: username},
+				"joined_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(joinedAt, 10)},
+			},
+		},
+	}
+}
+
+func (s *Server) cacheFaction(username string, faction string) {
+	if s.cacheCli != nil {
+		s.cacheCli.Put(factionCacheKey(username), cachedFaction{
+			Faction:   faction,
+			ExpiresAt: time.Now().Add(factionCacheTTL).Unix(),
+		})
+	}
+}
+
+// forgetFaction drops the cached membership of username here and on the
+// other instances.
+func (s *Server) forgetFaction(username string) {
+	if s.cacheCli != nil {
+		s.cacheCli.Delete(factionCacheKey(username))
+	}
+	s.announce(controlFaction, username)
+}
+
+func isTransactionConditionFailure(err error) bool {
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		return false
+	}
+	for _, reason := range canceled.CancellationReasons {
+		if aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+			return true
+		}
+	}
+	return false
+}
+
+func factionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrFactionNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrFactionExists), errors.Is(err, ErrAlreadyInFaction):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrOwnerLeaving):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrNotFactionOwner):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, ErrNotInFaction), errors.Is(err, ErrInvalidFaction):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) CreateFactionHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, ok := middleware.Identity(r)
+	if !ok {
+		http.Error(w, "unknown user", http.StatusUnauthorized)
+		return
+	}
+
+	var f Faction
+	err := json.NewDecoder(r.Body).Decode(&f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	faction, err := s.CreateFaction(r.Context(), f.Name, f.Tag, username)
+	if err != nil {
+		factionError(w, err)
+		return
+	}
+
+	writeJson(w, http.StatusCreated, faction)
+}
+
+func (s *Server) GetFactionHandler(w http.ResponseWriter, r *http.Request) {
+	faction, err := s.GetFaction(r.Context(), mux.Vars(r)["name"])
+	if err != nil {
+		factionError(w, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, faction)
+}
+
+func (s *Server) GetFactionStats(w http.ResponseWriter, r *http.Request) {
+	faction, err := s.GetFaction(r.Context(), mux.Vars(r)["name"])
+	if err != nil {
+		factionError(w, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, s.FactionStats(faction))
+}
+
+func (s *Server) JoinFactionHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, ok := middleware.Identity(r)
+	if !ok {
+		http.Error(w, "unknown user", http.StatusUnauthorized)
+		return
+	}
+
+	err := s.JoinFaction(r.Context(), mux.Vars(r)["name"], username)
+	if err != nil {
+		factionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) LeaveFactionHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, ok := middleware.Identity(r)
+	if !ok {
+		http.Error(w, "unknown user", http.StatusUnauthorized)
+		return
+	}
+
+	err := s.LeaveFaction(r.Context(), mux.Vars(r)["name"], username)
+	if err != nil {
+		factionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RemoveFactionMember lets the owner of a faction remove one of its members.
+func (s *Server) RemoveFactionMember(w http.ResponseWriter, r *http.Request) {
+	username, _, ok := middleware.Identity(r)
+	if !ok {
+		http.Error(w, "unknown user", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	faction, err := s.GetFaction(r.Context(), vars["name"])
+	if err != nil {
+		factionError(w, err)
+		return
+	}
+	if faction.Owner != username {
+		http.Error(w, "only the owner can remove members", http.StatusForbidden)
+		return
+	}
+	if vars["username"] == faction.Owner {
+		http.Error(w, "the owner cannot be removed", http.StatusBadRequest)
+		return
+	}
+
+	err = s.LeaveFaction(r.Context(), faction.Name, vars["username"])
+	if err != nil {
+		factionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type TransferFactionRequest struct {
+	Owner string `json:"owner"`
+}
+
+// TransferFactionHandler lets the owner of a faction hand it to a member.
+func (s *Server) TransferFactionHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, ok := middleware.Identity(r)
+	if !ok {
+		http.Error(w, "unknown user", http.StatusUnauthorized)
+		return
+	}
+
+	var req TransferFactionRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Owner == "" {
+		http.Error(w, "owner is required", http.StatusBadRequest)
+		return
+	}
+
+	err = s.TransferFaction(r.Context(), mux.Vars(r)["name"], username, req.Owner)
+	if err != nil {
+		factionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DisbandFactionHandler lets the owner of a faction delete it.
+func (s *Server) DisbandFactionHandler(w http.ResponseWriter, r *http.Request) {
+	username, _, ok := middleware.Identity(r)
+	if !ok {
+		http.Error(w, "unknown user", http.StatusUnauthorized)
+		return
+	}
+
+	err := s.DisbandFaction(r.Context(), mux.Vars(r)["name"], username)
+	if err != nil {
+		factionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
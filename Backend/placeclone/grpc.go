@@ -0,0 +1,290 @@
+package placeclone
+
+import (
+	"context"
+	"errors"
+	"github.com/Jonathanpatta/rplace/auth"
+	"github.com/Jonathanpatta/rplace/challenge"
+	"github.com/Jonathanpatta/rplace/middleware"
+	"github.com/Jonathanpatta/rplace/placepb"
+	"github.com/Jonathanpatta/rplace/ratelimit"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"net/http"
+	"strings"
+)
+
+// GrpcServer serves the canvas of a Server over gRPC. It goes through the
+// same placement path and rules as the HTTP handlers.
+type GrpcServer struct {
+	placepb.UnimplementedPlaceServer
+
+	Server *Server
+	Auth   *middleware.AuthMiddlewareServer
+}
+
+// NewGrpcServer returns a gRPC server with the Place service registered and
+// every call authenticated like the /api routes.
+func NewGrpcServer(s *Server, auth *middleware.AuthMiddlewareServer) *grpc.Server {
+	g := &GrpcServer{Server: s, Auth: auth}
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(g.authorizeUnary),
+		grpc.StreamInterceptor(g.authorizeStream),
+	)
+	placepb.RegisterPlaceServer(server, g)
+	return server
+}
+
+// authenticate runs the credentials of a call through the same
+// authenticators as the /api routes, with its metadata standing in for
+// request headers.
+func (g *GrpcServer) authenticate(ctx context.Context, method string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/", nil)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	for _, header := range []string{"Authorization", middleware.APIKeyHeader} {
+		if values := md.Get(header); len(values) > 0 {
+			r.Header.Set(header, values[0])
+		}
+	}
+
+	p, err := middleware.Resolve(r, g.Auth.Authenticators()...)
+	if errors.Is(err, middleware.ErrNoCredentials) {
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+	if errors.Is(err, middleware.ErrInvalidCredentials) {
+		return nil, status.Error(codes.Unauthenticated, "invalid token: "+err.Error())
+	}
+	var limited *ratelimit.LimitedError
+	if errors.As(err, &limited) {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	scope := auth.ScopeRead
+	if strings.HasSuffix(method, "/PlacePixel") {
+		scope = auth.ScopePlace
+	}
+	if !p.HasScope(scope) {
+		return nil, status.Error(codes.PermissionDenied, "the API key lacks the "+scope+" scope")
+	}
+	return middleware.WithPrincipal(ctx, p), nil
+}
+
+func (g *GrpcServer) authorizeUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := g.authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authorizedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (g *GrpcServer) authorizeStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := g.authenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authorizedStream{ServerStream: ss, ctx: ctx})
+}
+
+func toProtoPixel(p *Pixel) *placepb.Pixel {
+	return &placepb.Pixel{
+		Row:          int32(p.Row),
+		Col:          int32(p.Col),
+		Color:        p.Color,
+		Author:       p.Author,
+		AuthorName:   p.AuthorName,
+		Faction:      p.Faction,
+		LastModified: p.LastModified,
+		Version:      p.Version,
+		Seq:          p.Seq,
+	}
+}
+
+// rejectionStatus maps a rejection to a gRPC status the way RejectionStatus
+// maps it to an HTTP one.
+func rejectionStatus(rejection *Rejection) error {
+	code := codes.PermissionDenied
+	switch RejectionStatus(rejection.Code) {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusPreconditionRequired:
+		code = codes.FailedPrecondition
+	}
+
+	st := status.New(code, rejection.Reason)
+	info := &errdetails.ErrorInfo{Reason: string(rejection.Code), Domain: "rplace"}
+	if rejection.RetryAfter > 0 {
+		withDetails, err := st.WithDetails(info, &errdetails.RetryInfo{RetryDelay: durationpb.New(rejection.RetryAfter)})
+		if err == nil {
+			return withDetails.Err()
+		}
+		return st.Err()
+	}
+	withDetails, err := st.WithDetails(info)
+	if err == nil {
+		return withDetails.Err()
+	}
+	return st.Err()
+}
+
+func (g *GrpcServer) PlacePixel(ctx context.Context, req *placepb.PlacePixelRequest) (*placepb.PlacePixelResponse, error) {
+	author, authorName, ok := middleware.ContextIdentity(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "unknown user")
+	}
+
+	// A solved challenge comes in the same metadata key as the HTTP header.
+	md, _ := metadata.FromIncomingContext(ctx)
+	if proofs := md.Get(strings.ToLower(challenge.Header)); len(proofs) > 0 {
+		ctx = challenge.WithProof(ctx, proofs[0])
+	}
+
+	pixel, rejection, err := g.Server.PlaceAs(ctx, author, authorName, int(req.Row), int(req.Col), req.Color, req.ExpectedVersion)
+	if rejection != nil {
+		return nil, rejectionStatus(rejection)
+	}
+	if errors.Is(err, ErrStalePixel) {
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &placepb.PlacePixelResponse{Pixel: toProtoPixel(pixel)}, nil
+}
+
+// maxRegionPixels is the most pixels GetRegion returns at once. It keeps
+// its answers well below the 4 MB a gRPC message may take by default.
+const maxRegionPixels = 128 * 128
+
+// region returns the pixels of a rectangle clipped to the canvas, filling
+// the ones never placed with the empty color.
+func (s *Server) region(row int, col int, rows int, cols int) []*placepb.Pixel {
+	pixels := make([]*placepb.Pixel, 0, rows*cols)
+	for r := row; r < row+rows; r++ {
+		for c := col; c < col+cols; c++ {
+			pixel := s.Image.GetPixel(r, c)
+			if pixel == nil {
+				pixels = append(pixels, &placepb.Pixel{Row: int32(r), Col: int32(c), Color: FormatColor(emptyColor)})
+				continue
+			}
+			pixels = append(pixels, toProtoPixel(pixel))
+		}
+	}
+	return pixels
+}
+
+// GetCanvas describes the canvas. Its pixels are read with GetRegion, a
+// message at most maxRegionPixels large at a time.
+func (g *GrpcServer) GetCanvas(ctx context.Context, req *placepb.GetCanvasRequest) (*placepb.Canvas, error) {
+	s := g.Server
+	seq := s.ChangeLog.Latest()
+	rows, cols := s.Image.Size()
+
+	return &placepb.Canvas{
+		Name:    s.Image.Name,
+		Rows:    int32(rows),
+		Cols:    int32(cols),
+		Palette: s.Image.Palette,
+		Seq:     seq,
+	}, nil
+}
+
+// clip fits a requested region into the canvas. ok is false when nothing of
+// it is left.
+func (s *Server) clip(req *placepb.GetRegionRequest) (row int, col int, rows int, cols int, ok bool) {
+	row, col = int(req.Row), int(req.Col)
+	rows, cols = int(req.Rows), int(req.Cols)
+	if row < 0 {
+		rows += row
+		row = 0
+	}
+	if col < 0 {
+		cols += col
+		col = 0
+	}
+	maxRows, maxCols := s.Image.Size()
+	if row+rows > maxRows {
+		rows = maxRows - row
+	}
+	if col+cols > maxCols {
+		cols = maxCols - col
+	}
+	return row, col, rows, cols, rows > 0 && cols > 0
+}
+
+func (g *GrpcServer) GetRegion(ctx context.Context, req *placepb.GetRegionRequest) (*placepb.Region, error) {
+	s := g.Server
+	seq := s.ChangeLog.Latest()
+
+	row, col, rows, cols, ok := s.clip(req)
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "region does not overlap the canvas")
+	}
+	if rows*cols > maxRegionPixels {
+		return nil, status.Errorf(codes.InvalidArgument, "region of %d pixels is larger than %d", rows*cols, maxRegionPixels)
+	}
+
+	return &placepb.Region{
+		Row:    int32(row),
+		Col:    int32(col),
+		Rows:   int32(rows),
+		Cols:   int32(cols),
+		Seq:    seq,
+		Pixels: s.region(row, col, rows, cols),
+	}, nil
+}
+
+func (g *GrpcServer) Subscribe(req *placepb.SubscribeRequest, stream placepb.Place_SubscribeServer) error {
+	s := g.Server
+	rows, cols := s.Image.Size()
+	row, col := 0, 0
+	if req.Region != nil && (req.Region.Rows != 0 || req.Region.Cols != 0) {
+		var ok bool
+		row, col, rows, cols, ok = s.clip(req.Region)
+		if !ok {
+			return status.Error(codes.InvalidArgument, "region does not overlap the canvas")
+		}
+	}
+	within := func(p *Pixel) bool {
+		return p.Row >= row && p.Row < row+rows && p.Col >= col && p.Col < col+cols
+	}
+
+	events, unsubscribe := s.Events.Subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event := <-events:
+			if event.Type != EventPixel || !within(event.Pixel) {
+				continue
+			}
+			err := stream.Send(&placepb.PixelEvent{Pixel: toProtoPixel(event.Pixel)})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
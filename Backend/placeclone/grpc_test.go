@@ -0,0 +1,45 @@
+package placeclone
+
+import (
+	"context"
+	"github.com/Jonathanpatta/rplace/placepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestGetRegionSize(t *testing.T) {
+	s := NewCanvasServer(nil, nil, nil, "test")
+	g := &GrpcServer{Server: s}
+	s.Image.Resize(300, 200)
+	rows, cols := s.Image.Size()
+
+	tests := []struct {
+		name   string
+		req    *placepb.GetRegionRequest
+		code   codes.Code
+		pixels int
+	}{
+		{"within the limit", &placepb.GetRegionRequest{Rows: 128, Cols: 128}, codes.OK, 128 * 128},
+		{"clipped to the limit", &placepb.GetRegionRequest{Row: -10, Rows: 138, Cols: 128}, codes.OK, 128 * 128},
+		{"over the limit", &placepb.GetRegionRequest{Rows: 129, Cols: 128}, codes.InvalidArgument, 0},
+		{"whole canvas", &placepb.GetRegionRequest{Rows: int32(rows), Cols: int32(cols)}, codes.InvalidArgument, 0},
+		{"outside the canvas", &placepb.GetRegionRequest{Row: int32(rows), Rows: 1, Cols: 1}, codes.InvalidArgument, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			region, err := g.GetRegion(context.Background(), test.req)
+			if status.Code(err) != test.code {
+				t.Fatalf("got %v, want %v", err, test.code)
+			}
+			if err == nil && len(region.Pixels) != test.pixels {
+				t.Fatalf("got %d pixels, want %d", len(region.Pixels), test.pixels)
+			}
+		})
+	}
+
+	canvas, err := g.GetCanvas(context.Background(), &placepb.GetCanvasRequest{})
+	if err != nil || len(canvas.Pixels) != 0 || canvas.Rows != int32(rows) {
+		t.Fatalf("got %v, %v", canvas, err)
+	}
+}
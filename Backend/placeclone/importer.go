@@ -0,0 +1,394 @@
+package placeclone
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/Jonathanpatta/rplace/middleware"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const maxImportSize = 8 << 20
+
+const (
+	DitherNone           = "none"
+	DitherFloydSteinberg = "floyd-steinberg"
+)
+
+var (
+	ErrInvalidDither = errors.New("dither must be none or floyd-steinberg")
+	ErrImageTooLarge = errors.New("image is larger than any canvas")
+)
+
+// QuantizeImage maps every opaque pixel of img to the nearest palette
+// color, optionally spreading the error to its neighbours with
+// Floyd–Steinberg dithering. Pixels less than half opaque stay transparent
+// and are never painted.
+func QuantizeImage(img image.Image, palette []string, dither string) (*image.NRGBA, error) {
+	if dither == "" {
+		dither = DitherNone
+	}
+	if dither != DitherNone && dither != DitherFloydSteinberg {
+		return nil, ErrInvalidDither
+	}
+
+	var colors []color.RGBA
+	for _, entry := range palette {
+		c, err := ParseColor(entry)
+		if err == nil {
+			colors = append(colors, c)
+		}
+	}
+	if len(colors) == 0 {
+		return nil, errors.New("the palette is empty")
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	out := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	// The working copy holds the colors with the error diffused so far.
+	work := make([][3]float64, width*height)
+	opaque := make([]bool, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+			work[y*width+x] = [3]float64{float64(c.R), float64(c.G), float64(c.B)}
+			opaque[y*width+x] = c.A >= 128
+		}
+	}
+
+	spread := func(x int, y int, err [3]float64, weight float64) {
+		if x < 0 || x >= width || y >= height || !opaque[y*width+x] {
+			return
+		}
+		for i := range err {
+			work[y*width+x][i] += err[i] * weight
+		}
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if !opaque[y*width+x] {
+				continue
+			}
+
+			want := work[y*width+x]
+			got := nearest(colors, want)
+			out.SetNRGBA(x, y, color.NRGBA{R: got.R, G: got.G, B: got.B, A: 255})
+
+			if dither == DitherFloydSteinberg {
+				err := [3]float64{want[0] - float64(got.R), want[1] - float64(got.G), want[2] - float64(got.B)}
+				spread(x+1, y, err, 7.0/16)
+				spread(x-1, y+1, err, 3.0/16)
+				spread(x, y+1, err, 5.0/16)
+				spread(x+1, y+1, err, 1.0/16)
+			}
+		}
+	}
+	return out, nil
+}
+
+func nearest(colors []color.RGBA, c [3]float64) color.RGBA {
+	best := colors[0]
+	bestDistance := -1.0
+	for _, p := range colors {
+		dr := c[0] - float64(p.R)
+		dg := c[1] - float64(p.G)
+		db := c[2] - float64(p.B)
+		distance := dr*dr + dg*dg + db*db
+		if bestDistance < 0 || distance < bestDistance {
+			best = p
+			bestDistance = distance
+		}
+	}
+	return best
+}
+
+// DecodeImport decodes an image to import. Its size is read from the
+// header first, so an image claiming to be larger than any canvas is
+// refused before anything is allocated for it.
+func DecodeImport(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxImportSize))
+	if err != nil {
+		return nil, err
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width > MaxCanvasSize || config.Height > MaxCanvasSize {
+		return nil, ErrImageTooLarge
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	return decoded, err
+}
+
+type ImportResult struct {
+	Row     int `json:"row"`
+	Col     int `json:"col"`
+	Width   int `json:"width"`
+	Height  int `json:"height"`
+	Placed  int `json:"placed"`
+	Skipped int `json:"skipped"`
+}
+
+const (
+	ImportRunning = "running"
+	ImportDone    = "done"
+	ImportFailed  = "failed"
+
+	importRetention = 7 * 24 * time.Hour
+)
+
+// ImportJob is an import running in the background, kept in the table so
+// any instance can report its progress. Placed and Skipped grow as batches
+// are written. A job whose instance stopped stays running; importing the
+// same image again finishes it, since pixels that already have the right
+// color are skipped.
+type ImportJob struct {
+	Id     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Total is how many opaque pixels the image has.
+	Total int `json:"total"`
+	ImportResult
+	StartedAt  int64 `json:"started_at" dynamodbav:"started_at"`
+	UpdatedAt  int64 `json:"updated_at" dynamodbav:"updated_at"`
+	FinishedAt int64 `json:"finished_at,omitempty" dynamodbav:"finished_at,omitempty"`
+	ExpiresAt  int64 `json:"-" dynamodbav:"expires_at"`
+}
+
+func importKey(id string) string {
+	return "IMPORT#" + id
+}
+
+func (s *Server) putImportJob(ctx context.Context, job *ImportJob) error {
+	job.UpdatedAt = time.Now().Unix()
+	job.ExpiresAt = time.Now().Add(importRetention).Unix()
+	return s.putSetting(ctx, importKey(job.Id), job)
+}
+
+// GetImportJob reads an import job, which is nil when there is no such job.
+func (s *Server) GetImportJob(ctx context.Context, id string) (*ImportJob, error) {
+	var job ImportJob
+	found, err := s.getSetting(ctx, importKey(id), &job)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// StartImport records a job for painting quantized and runs it in the
+// background, independent of the request that started it.
+func (s *Server) StartImport(ctx context.Context, quantized *image.NRGBA, row int, col int, author string, authorName string) (*ImportJob, error) {
+	bounds := quantized.Bounds()
+	now := time.Now().Unix()
+	job := &ImportJob{
+		Id:           uuid.New().String(),
+		Status:       ImportRunning,
+		ImportResult: ImportResult{Row: row, Col: col, Width: bounds.Dx(), Height: bounds.Dy()},
+		StartedAt:    now,
+	}
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			if quantized.NRGBAAt(x, y).A != 0 {
+				job.Total++
+			}
+		}
+	}
+	err := s.putImportJob(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	started := *job
+	s.pending.Add(1)
+	go func() {
+		defer s.pending.Done()
+		ctx := context.Background()
+		result, err := s.Import(ctx, quantized, row, col, author, authorName, func(progress *ImportResult) {
+			job.ImportResult = *progress
+			err := s.putImportJob(ctx, job)
+			if err != nil {
+				log.Printf("could not record the progress of import %s: %s", job.Id, err.Error())
+			}
+		})
+		job.ImportResult = *result
+		job.Status = ImportDone
+		if err != nil {
+			job.Status = ImportFailed
+			job.Error = err.Error()
+			log.Printf("import %s failed: %s", job.Id, err.Error())
+		}
+		job.FinishedAt = time.Now().Unix()
+		err = s.putImportJob(ctx, job)
+		if err != nil {
+			log.Printf("could not record the end of import %s: %s", job.Id, err.Error())
+		}
+	}()
+	return &started, nil
+}
+
+// Import paints a quantized image onto the canvas with its top left corner
+// at row, col, in batches of up to maxPutBatch pixels written together.
+// Every pixel is placed, so it is versioned, logged and broadcast like any
+// placement, but the placement rules are not checked. Pixels that already
+// have the right color, fall outside the canvas or are transparent are
+// skipped. progress, when set, is called after each batch.
+func (s *Server) Import(ctx context.Context, quantized *image.NRGBA, row int, col int, author string, authorName string, progress func(*ImportResult)) (*ImportResult, error) {
+	bounds := quantized.Bounds()
+	result := &ImportResult{Row: row, Col: col, Width: bounds.Dx(), Height: bounds.Dy()}
+
+	var batch []*Pixel
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		s.waitForRelays(ctx)
+		placed, err := s.PlaceBatch(ctx, batch)
+		if err != nil {
+			return err
+		}
+		result.Placed += len(placed)
+		result.Skipped += len(batch) - len(placed)
+		batch = batch[:0]
+		if progress != nil {
+			progress(result)
+		}
+		return nil
+	}
+
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			c := quantized.NRGBAAt(x, y)
+			if c.A == 0 {
+				continue
+			}
+
+			pixel := s.Image.NewPixel(row+y, col+x, FormatColor(c), author)
+			if !s.Image.WithinBounds(pixel) {
+				result.Skipped++
+				continue
+			}
+			if current := s.Image.GetPixel(pixel.Row, pixel.Col); current != nil && current.Color == pixel.Color {
+				result.Skipped++
+				continue
+			}
+			pixel.AuthorName = authorName
+
+			batch = append(batch, pixel)
+			if len(batch) == maxPutBatch {
+				err := flush()
+				if err != nil {
+					return result, err
+				}
+			}
+		}
+	}
+	return result, flush()
+}
+
+// waitForRelays holds an import back while the relay queue is more than
+// half full, so that it does not crowd out the placements of players.
+func (s *Server) waitForRelays(ctx context.Context) {
+	for len(s.relays) > relayQueueSize/2 && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// ImportImage takes a multipart form with an image (PNG, JPEG or GIF), the
+// anchor row and col and a dither mode. With preview set it answers with
+// the quantized PNG and writes nothing.
+func (s *Server) ImportImage(w http.ResponseWriter, r *http.Request) {
+	admin, adminName, _ := middleware.Identity(r)
+	if !middleware.IsAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return
+	}
+
+	err := r.ParseMultipartForm(maxImportSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	row, errRow := strconv.Atoi(r.FormValue("row"))
+	col, errCol := strconv.Atoi(r.FormValue("col"))
+	if errRow != nil || errCol != nil {
+		http.Error(w, "row and col must be numbers", http.StatusBadRequest)
+		return
+	}
+	preview, _ := strconv.ParseBool(r.FormValue("preview"))
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	decoded, err := DecodeImport(file)
+	if errors.Is(err, ErrImageTooLarge) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "could not decode image: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	quantized, err := QuantizeImage(decoded, s.Image.Palette, r.FormValue("dither"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if preview {
+		var buf bytes.Buffer
+		err = png.Encode(&buf, quantized)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(buf.Bytes())
+		return
+	}
+
+	job, err := s.StartImport(r.Context(), quantized, row, col, admin, adminName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/api/admin/import/"+job.Id)
+	writeJson(w, http.StatusAccepted, job)
+}
+
+// GetImport reports the progress of an import.
+func (s *Server) GetImport(w http.ResponseWriter, r *http.Request) {
+	if !middleware.IsAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return
+	}
+
+	job, err := s.GetImportJob(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if job == nil {
+		http.Error(w, "import not found", http.StatusNotFound)
+		return
+	}
+	writeJson(w, http.StatusOK, job)
+}
@@ -0,0 +1,621 @@
+package placeclone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WindowHour = "hour"
+	WindowDay  = "day"
+	WindowAll  = "all"
+
+	KindUser    = "user"
+	KindFaction = "faction"
+
+	// MaxLeaderboard is the most entries a leaderboard is read with.
+	MaxLeaderboard = 100
+	// leaderboardRefresh is how long a leaderboard is served before it is
+	// read again.
+	leaderboardRefresh = 30 * time.Second
+)
+
+// Leaderboard keeps placement counters per user and per faction. Every
+// placement increments the counters of the current hour, the current day
+// and all time. Surviving pixels are only tracked all time since they
+// describe the canvas as it is now.
+//
+// The windows are calendar buckets in UTC rather than sliding ones: hour
+// counts the placements since the start of the current hour and day those
+// since midnight, so both start over from nothing when a new one begins.
+//
+// Each counter is an item in its own partition, so placements by different
+// subjects never write the same partition. Next to them every window keeps
+// a bounded top of each kind in a single item, rewritten when a placement
+// earns a subject a place in it or moves it up. The cooldown keeps that to
+// a few writes a second even for the busiest canvas. A leaderboard is read
+// from the top item and the counters it names, and kept for
+// leaderboardRefresh so the requests in between are served from memory.
+type Leaderboard struct {
+	DbCli     *dynamodb.Client
+	TableName *string
+	Canvas    string
+
+	mu        sync.Mutex
+	snapshots map[string]*leaderboardSnapshot
+	// tops are the top items as last read or written, by key. The lowest
+	// entry of a top only ever goes up, so a cached one tells which
+	// placements cannot earn a place without reading it again.
+	tops map[string]*leaderboardTop
+}
+
+// leaderboardSnapshot is the top of a partition as it was read at some
+// point.
+type leaderboardSnapshot struct {
+	entries []*LeaderboardEntry
+	readAt  time.Time
+}
+
+type LeaderboardEntry struct {
+	Name       string `json:"name"`
+	Kind       string `json:"kind"`
+	Placements int64  `json:"placements"`
+	Surviving  int64  `json:"surviving"`
+	TopColor   string `json:"top_color,omitempty"`
+}
+
+// leaderboardTop is the bounded top of one kind in one window: the
+// placements of at most MaxLeaderboard subjects, by name.
+type leaderboardTop struct {
+	Placements map[string]int64 `dynamodbav:"placements"`
+	Version    int64            `dynamodbav:"version"`
+	ExpiresAt  int64            `dynamodbav:"expires_at,omitempty"`
+
+	readAt time.Time
+}
+
+// lowest returns the entry of t that ranks last.
+func (t *leaderboardTop) lowest() *LeaderboardEntry {
+	var low *LeaderboardEntry
+	for name, placements := range t.Placements {
+		entry := &LeaderboardEntry{Name: name, Placements: placements}
+		if low == nil || ranksAbove(low, entry) {
+			low = entry
+		}
+	}
+	return low
+}
+
+// admits reports whether name with placements belongs in t where it does
+// not already stand.
+func (t *leaderboardTop) admits(name string, placements int64) bool {
+	if current, ok := t.Placements[name]; ok {
+		return placements > current
+	}
+	if len(t.Placements) < MaxLeaderboard {
+		return true
+	}
+	return ranksAbove(&LeaderboardEntry{Name: name, Placements: placements}, t.lowest())
+}
+
+// with returns t with name at placements, dropping the lowest entry when
+// that makes it too long.
+func (t *leaderboardTop) with(name string, placements int64) *leaderboardTop {
+	next := &leaderboardTop{
+		Placements: make(map[string]int64, len(t.Placements)+1),
+		Version:    t.Version + 1,
+		ExpiresAt:  t.ExpiresAt,
+	}
+	for n, p := range t.Placements {
+		next.Placements[n] = p
+	}
+	next.Placements[name] = placements
+	if len(next.Placements) > MaxLeaderboard {
+		delete(next.Placements, next.lowest().Name)
+	}
+	return next
+}
+
+func NewLeaderboard(DbCli *dynamodb.Client, tableName *string, canvas string) *Leaderboard {
+	return &Leaderboard{
+		DbCli:     DbCli,
+		TableName: tableName,
+		Canvas:    canvas,
+		snapshots: make(map[string]*leaderboardSnapshot),
+		tops:      make(map[string]*leaderboardTop),
+	}
+}
+
+func (l *Leaderboard) partition(window string, t time.Time) string {
+	pk := "LEADERBOARD#" + l.Canvas + "#" + window
+	switch window {
+	case WindowHour:
+		pk += "#" + t.UTC().Format("2006-01-02T15")
+	case WindowDay:
+		pk += "#" + t.UTC().Format("2006-01-02")
+	}
+	return pk
+}
+
+// counterKey is where the counters of subject in the window partition pk
+// are kept.
+func counterKey(pk string, subject string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: pk + "#" + subject},
+		"SK": &types.AttributeValueMemberS{Value: "COUNT"},
+	}
+}
+
+// topKey is where the top of the subjects with prefix in the window
+// partition pk is kept.
+func topKey(pk string, prefix string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: pk},
+		"SK": &types.AttributeValueMemberS{Value: "TOP#" + prefix},
+	}
+}
+
+func windowExpiry(window string, t time.Time) int64 {
+	switch window {
+	case WindowHour:
+		return t.Add(48 * time.Hour).Unix()
+	case WindowDay:
+		return t.Add(90 * 24 * time.Hour).Unix()
+	}
+	return 0
+}
+
+func leaderboardSubjects(p *Pixel) []string {
+	subjects := []string{"USER#" + p.Author}
+	if p.Faction != "" {
+		subjects = append(subjects, "FACTION#"+p.Faction)
+	}
+	return subjects
+}
+
+// splitSubject splits a subject such as USER#alice into its prefix and
+// name.
+func splitSubject(subject string) (string, string) {
+	parts := strings.SplitN(subject, "#", 2)
+	if len(parts) != 2 {
+		return subject, ""
+	}
+	return parts[0] + "#", parts[1]
+}
+
+// Record counts a placement. previous is the pixel it replaced, whose
+// author and faction lose a surviving pixel.
+func (l *Leaderboard) Record(p *Pixel, previous *Pixel) {
+	ctx := context.Background()
+	now := time.Unix(p.LastModified, 0)
+
+	surviving := make(map[string]int)
+	for _, subject := range leaderboardSubjects(p) {
+		surviving[subject]++
+	}
+	if previous != nil && previous.Author != "" {
+		for _, subject := range leaderboardSubjects(previous) {
+			surviving[subject]--
+		}
+	}
+
+	for _, subject := range leaderboardSubjects(p) {
+		for _, window := range []string{WindowHour, WindowDay, WindowAll} {
+			delta := 0
+			if window == WindowAll {
+				delta = surviving[subject]
+			}
+			pk := l.partition(window, now)
+			placements, err := l.add(ctx, pk, subject, p.Color, delta, windowExpiry(window, now))
+			if err == nil {
+				err = l.offer(ctx, pk, subject, placements, windowExpiry(window, now))
+			}
+			if err != nil {
+				log.Printf("could not record placement of %s: %s", subject, err.Error())
+			}
+		}
+		delete(surviving, subject)
+	}
+
+	for subject, delta := range surviving {
+		if delta == 0 {
+			continue
+		}
+		_, err := l.add(ctx, l.partition(WindowAll, now), subject, "", delta, 0)
+		if err != nil {
+			log.Printf("could not update surviving pixels of %s: %s", subject, err.Error())
+		}
+	}
+}
+
+// add increments the counters of one subject and returns its placements.
+// An empty color only applies the surviving delta.
+func (l *Leaderboard) add(ctx context.Context, pk string, subject string, color string, surviving int, expiresAt int64) (int64, error) {
+	var add, set []string
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{}
+
+	if color != "" {
+		add = append(add, "#placements :one", "#color :one")
+		names["#placements"] = "placements"
+		names["#color"] = "color_" + strings.TrimPrefix(color, "#")
+		values[":one"] = &types.AttributeValueMemberN{Value: "1"}
+	}
+	if surviving != 0 {
+		add = append(add, "#surviving :surviving")
+		names["#surviving"] = "surviving"
+		values[":surviving"] = &types.AttributeValueMemberN{Value: strconv.Itoa(surviving)}
+	}
+	if expiresAt != 0 {
+		set = append(set, "#expires_at = :expires_at")
+		names["#expires_at"] = "expires_at"
+		values[":expires_at"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt, 10)}
+	}
+
+	expression := "ADD " + strings.Join(add, ", ")
+	if len(set) > 0 {
+		expression = "SET " + strings.Join(set, ", ") + " " + expression
+	}
+
+	out, err := l.DbCli.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 l.TableName,
+		Key:                       counterKey(pk, subject),
+		UpdateExpression:          aws.String(expression),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ReturnValues:              types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		return 0, err
+	}
+	var counters struct {
+		Placements int64 `dynamodbav:"placements"`
+	}
+	err = attributevalue.UnmarshalMap(out.Attributes, &counters)
+	return counters.Placements, err
+}
+
+// topAttempts is how often offer reads a top again after losing a race to
+// rewrite it.
+const topAttempts = 5
+
+// offer puts subject in the top of its kind in the window partition pk
+// when placements earns it a place there, or moves it up.
+func (l *Leaderboard) offer(ctx context.Context, pk string, subject string, placements int64, expiresAt int64) error {
+	prefix, name := splitSubject(subject)
+	for attempt := 0; attempt < topAttempts; attempt++ {
+		top, err := l.top(ctx, pk, prefix, attempt > 0)
+		if err != nil {
+			return err
+		}
+		if !top.admits(name, placements) {
+			return nil
+		}
+
+		next := top.with(name, placements)
+		if expiresAt != 0 {
+			next.ExpiresAt = expiresAt
+		}
+		err = l.putTop(ctx, pk, prefix, top.Version, next)
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("the top of %s kept changing", pk)
+}
+
+// top returns the top of the subjects with prefix in pk, from memory unless
+// fresh is set or it is older than leaderboardRefresh.
+func (l *Leaderboard) top(ctx context.Context, pk string, prefix string, fresh bool) (*leaderboardTop, error) {
+	key := pk + "#TOP#" + prefix
+	l.mu.Lock()
+	top, ok := l.tops[key]
+	l.mu.Unlock()
+	if ok && !fresh && time.Since(top.readAt) < leaderboardRefresh {
+		return top, nil
+	}
+
+	out, err := l.DbCli.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      l.TableName,
+		Key:            topKey(pk, prefix),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	top = &leaderboardTop{}
+	err = attributevalue.UnmarshalMap(out.Item, top)
+	if err != nil {
+		return nil, err
+	}
+	if top.Placements == nil {
+		top.Placements = make(map[string]int64)
+	}
+	l.remember(key, top)
+	return top, nil
+}
+
+// putTop writes next over the top at version.
+func (l *Leaderboard) putTop(ctx context.Context, pk string, prefix string, version int64, next *leaderboardTop) error {
+	item, err := attributevalue.MarshalMap(next)
+	if err != nil {
+		return err
+	}
+	for k, v := range topKey(pk, prefix) {
+		item[k] = v
+	}
+
+	condition := "#version = :version"
+	values := map[string]types.AttributeValue{
+		":version": &types.AttributeValueMemberN{Value: strconv.FormatInt(version, 10)},
+	}
+	if version == 0 {
+		condition = "attribute_not_exists(#version)"
+		values = nil
+	}
+	_, err = l.DbCli.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                 l.TableName,
+		Item:                      item,
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeNames:  map[string]string{"#version": "version"},
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		return err
+	}
+	l.remember(pk+"#TOP#"+prefix, next)
+	return nil
+}
+
+// remember keeps top in memory, dropping the tops of windows gone by.
+func (l *Leaderboard) remember(key string, top *leaderboardTop) {
+	top.readAt = time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, old := range l.tops {
+		if time.Since(old.readAt) > leaderboardRefresh {
+			delete(l.tops, k)
+		}
+	}
+	l.tops[key] = top
+}
+
+// Top returns the subjects of a kind with the most placements in the
+// current window, at most MaxLeaderboard of them.
+func (l *Leaderboard) Top(ctx context.Context, window string, kind string, limit int) ([]*LeaderboardEntry, error) {
+	prefix := "USER#"
+	if kind == KindFaction {
+		prefix = "FACTION#"
+	}
+	pk := l.partition(window, time.Now())
+
+	l.mu.Lock()
+	snapshot, ok := l.snapshots[pk+"#"+prefix]
+	l.mu.Unlock()
+	if !ok || time.Since(snapshot.readAt) > leaderboardRefresh {
+		entries, err := l.read(ctx, pk, window, prefix)
+		if err != nil {
+			return nil, err
+		}
+		snapshot = &leaderboardSnapshot{entries: entries, readAt: time.Now()}
+
+		l.mu.Lock()
+		for key, old := range l.snapshots {
+			if time.Since(old.readAt) > leaderboardRefresh {
+				delete(l.snapshots, key)
+			}
+		}
+		l.snapshots[pk+"#"+prefix] = snapshot
+		l.mu.Unlock()
+	}
+
+	entries := snapshot.entries
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+// read reads the top subjects with prefix from a window partition: the top
+// item names them, and their counters tell the rest.
+func (l *Leaderboard) read(ctx context.Context, pk string, window string, prefix string) ([]*LeaderboardEntry, error) {
+	top, err := l.top(ctx, pk, prefix, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(top.Placements) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]map[string]types.AttributeValue, 0, len(top.Placements))
+	for name := range top.Placements {
+		keys = append(keys, counterKey(pk, prefix+name))
+	}
+	items, err := l.batchGet(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*LeaderboardEntry, 0, len(items))
+	for _, item := range items {
+		entries = append(entries, leaderboardEntry(strings.TrimPrefix(itemPk(item), pk+"#"), item))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return ranksAbove(entries[i], entries[j])
+	})
+
+	if window != WindowAll {
+		err := l.fillSurviving(ctx, prefix, entries)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+// ranksAbove reports whether a comes before b on a leaderboard.
+func ranksAbove(a *LeaderboardEntry, b *LeaderboardEntry) bool {
+	if a.Placements == b.Placements {
+		return a.Name < b.Name
+	}
+	return a.Placements > b.Placements
+}
+
+// batchGetAttempts is how often batchGet asks again for keys DynamoDB left
+// unprocessed.
+const batchGetAttempts = 5
+
+// batchGet reads the items under keys, at most 100 of them, asking again
+// for any DynamoDB leaves unprocessed. Keys without an item are left out.
+func (l *Leaderboard) batchGet(ctx context.Context, keys []map[string]types.AttributeValue) ([]map[string]types.AttributeValue, error) {
+	var items []map[string]types.AttributeValue
+	request := map[string]types.KeysAndAttributes{
+		*l.TableName: {Keys: keys},
+	}
+	for attempt := 1; len(request) > 0; attempt++ {
+		if attempt > batchGetAttempts {
+			return nil, errors.New("the leaderboard could not be read in full, try again")
+		}
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt*attempt) * 10 * time.Millisecond)
+		}
+
+		out, err := l.DbCli.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+			RequestItems: request,
+		})
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, out.Responses[*l.TableName]...)
+		request = out.UnprocessedKeys
+	}
+	return items, nil
+}
+
+// fillSurviving copies the all time surviving counts onto windowed entries.
+func (l *Leaderboard) fillSurviving(ctx context.Context, prefix string, entries []*LeaderboardEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	pk := l.partition(WindowAll, time.Now())
+	keys := make([]map[string]types.AttributeValue, 0, len(entries))
+	for _, entry := range entries {
+		keys = append(keys, counterKey(pk, prefix+entry.Name))
+	}
+
+	items, err := l.batchGet(ctx, keys)
+	if err != nil {
+		return err
+	}
+
+	surviving := make(map[string]int64)
+	for _, item := range items {
+		entry := leaderboardEntry(strings.TrimPrefix(itemPk(item), pk+"#"), item)
+		surviving[entry.Name] = entry.Surviving
+	}
+	for _, entry := range entries {
+		entry.Surviving = surviving[entry.Name]
+	}
+	return nil
+}
+
+func itemPk(item map[string]types.AttributeValue) string {
+	if pk, ok := item["PK"].(*types.AttributeValueMemberS); ok {
+		return pk.Value
+	}
+	return ""
+}
+
+// leaderboardEntry reads the counters of subject.
+func leaderboardEntry(subject string, item map[string]types.AttributeValue) *LeaderboardEntry {
+	prefix, name := splitSubject(subject)
+	entry := &LeaderboardEntry{
+		Kind: strings.ToLower(strings.TrimSuffix(prefix, "#")),
+		Name: name,
+	}
+
+	var topCount int64
+	for attribute, value := range item {
+		n, ok := value.(*types.AttributeValueMemberN)
+		if !ok {
+			continue
+		}
+		count, err := strconv.ParseInt(n.Value, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case attribute == "placements":
+			entry.Placements = count
+		case attribute == "surviving":
+			entry.Surviving = count
+		case strings.HasPrefix(attribute, "color_"):
+			color := "#" + strings.TrimPrefix(attribute, "color_")
+			if count > topCount || (count == topCount && color < entry.TopColor) {
+				entry.TopColor = color
+				topCount = count
+			}
+		}
+	}
+
+	return entry
+}
+
+func (s *Server) GetLeaderboard(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	window := query.Get("window")
+	if window == "" {
+		window = WindowAll
+	}
+	if window != WindowHour && window != WindowDay && window != WindowAll {
+		http.Error(w, "window must be hour, day or all", http.StatusBadRequest)
+		return
+	}
+
+	kind := query.Get("kind")
+	if kind == "" {
+		kind = KindUser
+	}
+	if kind != KindUser && kind != KindFaction {
+		http.Error(w, "kind must be user or faction", http.StatusBadRequest)
+		return
+	}
+
+	limit := 10
+	if query.Get("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > MaxLeaderboard {
+			http.Error(w, "limit must be between 1 and 100", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := s.Leaderboard.Top(r.Context(), window, kind, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []*LeaderboardEntry{}
+	}
+
+	writeJson(w, http.StatusOK, entries)
+}
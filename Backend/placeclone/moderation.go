@@ -0,0 +1,376 @@
+package placeclone
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Jonathanpatta/rplace/middleware"
+	"github.com/Jonathanpatta/rplace/webhook"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Ban keeps a user from placing pixels on a canvas. A zero Until bans for
+// good.
+type Ban struct {
+	Username  string `json:"username"`
+	Reason    string `json:"reason,omitempty"`
+	By        string `json:"by,omitempty"`
+	CreatedAt int64  `json:"created_at,omitempty" dynamodbav:"created_at"`
+	Until     int64  `json:"until,omitempty"`
+}
+
+func (b *Ban) Active(now time.Time) bool {
+	return b.Until == 0 || now.Unix() < b.Until
+}
+
+// Lock freezes a rectangle of the canvas, Rows by Cols pixels with its top
+// left corner at Row, Col.
+type Lock struct {
+	Id        string `json:"id"`
+	Row       int    `json:"row"`
+	Col       int    `json:"col"`
+	Rows      int    `json:"rows"`
+	Cols      int    `json:"cols"`
+	Reason    string `json:"reason,omitempty"`
+	By        string `json:"by,omitempty"`
+	CreatedAt int64  `json:"created_at,omitempty" dynamodbav:"created_at"`
+}
+
+func (l *Lock) Contains(row int, col int) bool {
+	return row >= l.Row && row < l.Row+l.Rows && col >= l.Col && col < l.Col+l.Cols
+}
+
+// Moderation holds the bans and region locks of a canvas. They are kept in
+// memory for the placement rules and written through to the table.
+type Moderation struct {
+	DbCli     *dynamodb.Client
+	TableName *string
+	Canvas    string
+
+	mu    sync.RWMutex
+	bans  map[string]*Ban
+	locks map[string]*Lock
+}
+
+func NewModeration(DbCli *dynamodb.Client, tableName *string, canvas string) *Moderation {
+	return &Moderation{
+		DbCli:     DbCli,
+		TableName: tableName,
+		Canvas:    canvas,
+		bans:      make(map[string]*Ban),
+		locks:     make(map[string]*Lock),
+	}
+}
+
+func (m *Moderation) banPk() string {
+	return "BAN#" + m.Canvas
+}
+
+func (m *Moderation) lockPk() string {
+	return "LOCK#" + m.Canvas
+}
+
+func (m *Moderation) Load(ctx context.Context) error {
+	var bans []*Ban
+	err := m.query(ctx, m.banPk(), &bans)
+	if err != nil {
+		return err
+	}
+	var locks []*Lock
+	err = m.query(ctx, m.lockPk(), &locks)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bans = make(map[string]*Ban)
+	for _, ban := range bans {
+		m.bans[ban.Username] = ban
+	}
+	m.locks = make(map[string]*Lock)
+	for _, lock := range locks {
+		m.locks[lock.Id] = lock
+	}
+	return nil
+}
+
+func (m *Moderation) query(ctx context.Context, pk string, out interface{}) error {
+	var items []map[string]types.AttributeValue
+	paginator := dynamodb.NewQueryPaginator(m.DbCli, &dynamodb.QueryInput{
+		TableName:              m.TableName,
+		KeyConditionExpression: aws.String("#PK = :pk"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk": &types.AttributeValueMemberS{Value: pk},
+		},
+		ExpressionAttributeNames: map[string]string{
+			"#PK": "PK",
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		items = append(items, page.Items...)
+	}
+
+	return attributevalue.UnmarshalListOfMaps(items, out)
+}
+
+func (m *Moderation) put(ctx context.Context, pk string, sk string, v interface{}) error {
+	item, err := attributevalue.MarshalMap(v)
+	if err != nil {
+		return err
+	}
+	item["PK"] = &types.AttributeValueMemberS{Value: pk}
+	item["SK"] = &types.AttributeValueMemberS{Value: sk}
+
+	_, err = m.DbCli.PutItem(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: m.TableName,
+	})
+	return err
+}
+
+func (m *Moderation) delete(ctx context.Context, pk string, sk string) error {
+	_, err := m.DbCli.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: m.TableName,
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: pk},
+			"SK": &types.AttributeValueMemberS{Value: sk},
+		},
+	})
+	return err
+}
+
+func (m *Moderation) Ban(ctx context.Context, ban *Ban) error {
+	err := m.put(ctx, m.banPk(), ban.Username, ban)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.bans[ban.Username] = ban
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Moderation) Unban(ctx context.Context, username string) error {
+	err := m.delete(ctx, m.banPk(), username)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	delete(m.bans, username)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Moderation) Lock(ctx context.Context, lock *Lock) error {
+	err := m.put(ctx, m.lockPk(), lock.Id, lock)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.locks[lock.Id] = lock
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Moderation) Unlock(ctx context.Context, id string) error {
+	err := m.delete(ctx, m.lockPk(), id)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	delete(m.locks, id)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *Moderation) Bans() []*Ban {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	bans := make([]*Ban, 0, len(m.bans))
+	for _, ban := range m.bans {
+		bans = append(bans, ban)
+	}
+	return bans
+}
+
+func (m *Moderation) Locks() []*Lock {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	locks := make([]*Lock, 0, len(m.locks))
+	for _, lock := range m.locks {
+		locks = append(locks, lock)
+	}
+	return locks
+}
+
+func (m *Moderation) BanRule() PlacementRule {
+	return PlacementRuleFunc(func(ctx context.Context, p *Placement) *Rejection {
+		m.mu.RLock()
+		ban, ok := m.bans[p.User]
+		m.mu.RUnlock()
+
+		if ok && ban.Active(p.Time) {
+			return &Rejection{Code: RejectBanned, Reason: "user is banned from this canvas"}
+		}
+		return nil
+	})
+}
+
+func (m *Moderation) LockRule() PlacementRule {
+	return PlacementRuleFunc(func(ctx context.Context, p *Placement) *Rejection {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		for _, lock := range m.locks {
+			if lock.Contains(p.Pixel.Row, p.Pixel.Col) {
+				return &Rejection{Code: RejectLocked, Reason: "this region of the canvas is locked"}
+			}
+		}
+		return nil
+	})
+}
+
+type BanRequest struct {
+	Username        string `json:"username"`
+	Reason          string `json:"reason,omitempty"`
+	DurationSeconds int64  `json:"duration_seconds,omitempty"`
+}
+
+func (s *Server) BanUser(w http.ResponseWriter, r *http.Request) {
+	admin, _, _ := middleware.Identity(r)
+	if !middleware.IsAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return
+	}
+
+	var req BanRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Username == "" {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	ban := &Ban{
+		Username:  req.Username,
+		Reason:    req.Reason,
+		By:        admin,
+		CreatedAt: now.Unix(),
+	}
+	if req.DurationSeconds > 0 {
+		ban.Until = now.Add(time.Duration(req.DurationSeconds) * time.Second).Unix()
+	}
+
+	err = s.Moderation.Ban(r.Context(), ban)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.announce(controlReload, reloadModeration)
+	s.Webhooks.Publish(webhook.EventUserBanned, ban)
+
+	writeJson(w, http.StatusCreated, ban)
+}
+
+func (s *Server) UnbanUser(w http.ResponseWriter, r *http.Request) {
+	if !middleware.IsAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return
+	}
+
+	username := mux.Vars(r)["username"]
+	err := s.Moderation.Unban(r.Context(), username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.announce(controlReload, reloadModeration)
+	s.Webhooks.Publish(webhook.EventUserUnbanned, map[string]string{"username": username})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) GetBans(w http.ResponseWriter, r *http.Request) {
+	if !middleware.IsAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return
+	}
+
+	writeJson(w, http.StatusOK, s.Moderation.Bans())
+}
+
+func (s *Server) LockRegion(w http.ResponseWriter, r *http.Request) {
+	admin, _, _ := middleware.Identity(r)
+	if !middleware.IsAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return
+	}
+
+	var lock Lock
+	err := json.NewDecoder(r.Body).Decode(&lock)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if lock.Rows <= 0 || lock.Cols <= 0 {
+		http.Error(w, "a lock needs a positive size", http.StatusBadRequest)
+		return
+	}
+	lock.Id = uuid.New().String()
+	lock.By = admin
+	lock.CreatedAt = time.Now().Unix()
+
+	err = s.Moderation.Lock(r.Context(), &lock)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.announce(controlReload, reloadModeration)
+	s.Webhooks.Publish(webhook.EventRegionLocked, lock)
+
+	writeJson(w, http.StatusCreated, lock)
+}
+
+func (s *Server) UnlockRegion(w http.ResponseWriter, r *http.Request) {
+	if !middleware.IsAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	err := s.Moderation.Unlock(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.announce(controlReload, reloadModeration)
+	s.Webhooks.Publish(webhook.EventRegionUnlocked, map[string]string{"id": id})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) GetLocks(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, s.Moderation.Locks())
+}
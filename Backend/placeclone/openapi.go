@@ -0,0 +1,394 @@
+package placeclone
+
+import (
+	"github.com/Jonathanpatta/rplace/challenge"
+	"github.com/Jonathanpatta/rplace/openapi"
+)
+
+// Describe documents the routes mounted by AddSubrouter. Routes without a
+// description still appear in the document with their path parameters.
+func Describe(spec *openapi.Spec) {
+	spec.Secure("/api")
+
+	pixel := spec.Schema("Pixel", Pixel{})
+	pixelInfo := spec.Schema("PixelInfo", PixelInfo{})
+	changes := spec.Schema("ChangesResponse", ChangesResponse{})
+	updatePixel := spec.Schema("UpdatePixelRequest", UpdatePixelRequest{})
+	rejection := spec.Schema("Rejection", Rejection{})
+	event := spec.Schema("Event", Event{})
+	template := spec.Schema("Template", Template{})
+	templateDiff := spec.Schema("TemplateDiff", TemplateDiff{})
+	faction := spec.Schema("Faction", Faction{})
+	factionStats := spec.Schema("FactionStats", FactionStats{})
+	leaderboardEntry := spec.Schema("LeaderboardEntry", LeaderboardEntry{})
+	schedule := spec.Schema("ScheduleResponse", ScheduleResponse{})
+	lock := spec.Schema("Lock", Lock{})
+	canvas := spec.Schema("Canvas", Canvas{})
+	resize := spec.Schema("ResizeCanvasRequest", ResizeCanvasRequest{})
+	ban := spec.Schema("Ban", Ban{})
+	banRequest := spec.Schema("BanRequest", BanRequest{})
+	cacheEntry := spec.Schema("CacheEntry", CacheEntry{})
+	importJob := spec.Schema("ImportJob", ImportJob{})
+	suspicion := spec.Schema("Suspicion", Suspicion{})
+	detection := spec.Schema("DetectionConfig", DetectionConfig{})
+	challengeConfig := spec.Schema("ChallengeConfig", challenge.Config{})
+
+	seqHeader := map[string]*openapi.Header{
+		"X-Canvas-Seq": {
+			Description: "The latest change included, to pass as since to /api/pixels/changes",
+			Schema:      &openapi.Schema{Type: "integer", Format: "int64"},
+		},
+	}
+	retryAfter := map[string]*openapi.Header{
+		"Retry-After": {
+			Description: "Seconds until the placement may succeed",
+			Schema:      &openapi.Schema{Type: "integer"},
+		},
+	}
+	integer := &openapi.Schema{Type: "integer"}
+	str := &openapi.Schema{Type: "string"}
+
+	spec.Describe("GET", "/api/pixels", &openapi.Operation{
+		OperationId: "getPixels",
+		Summary:     "Snapshot of every placed pixel",
+		Tags:        []string{"canvas"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The placed pixels", Headers: seqHeader, Content: openapi.JSON(openapi.ArrayOf(pixel))},
+		},
+	})
+	spec.Describe("GET", "/api/pixels/changes", &openapi.Operation{
+		OperationId: "getChanges",
+		Summary:     "Pixels placed after a sequence number",
+		Tags:        []string{"canvas"},
+		Parameters: []*openapi.Parameter{
+			openapi.Query("since", "The last sequence number seen", &openapi.Schema{Type: "integer", Format: "int64"}, true),
+		},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The changes since the given sequence number", Content: openapi.JSON(changes)},
+			"400": {Description: "since is missing or not a number"},
+			"410": {Description: "The changes are no longer held; reload the snapshot", Content: openapi.JSON(changes)},
+		},
+	})
+	spec.Describe("GET", "/api/pixels/{row}/{col}", &openapi.Operation{
+		OperationId: "getPixel",
+		Summary:     "Who placed a pixel and when",
+		Tags:        []string{"canvas"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The pixel", Content: openapi.JSON(pixelInfo)},
+			"404": {Description: "Nothing has been placed there"},
+		},
+	})
+	spec.Describe("POST", "/api/updatePixel", &openapi.Operation{
+		OperationId: "updatePixel",
+		Summary:     "Place a pixel",
+		Description: "Checked against the placement rules. With expected_version the placement only succeeds if the pixel has not changed since.",
+		Tags:        []string{"canvas"},
+		Parameters:  []*openapi.Parameter{challenge.Parameter()},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(updatePixel)},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The placed pixel", Content: openapi.JSON(pixel)},
+			"400": {Description: "Out of bounds or not in the palette", Content: openapi.JSON(rejection)},
+			"401": {Description: "The token does not name a user"},
+			"403": {Description: "Refused by a placement rule", Content: openapi.JSON(rejection)},
+			"409": {Description: "The pixel changed since expected_version; the current pixel is returned", Content: openapi.JSON(pixel)},
+			"428": {Description: "A solved place challenge is needed", Content: openapi.JSON(rejection)},
+			"429": {Description: "The user is cooling down", Headers: retryAfter, Content: openapi.JSON(rejection)},
+		},
+	})
+	spec.Describe("GET", "/api/tiles/{z}/{x}/{y}.{format}", &openapi.Operation{
+		OperationId: "getTile",
+		Summary:     "A rendered tile of the canvas",
+		Description: "png is an image, bin holds one RGBA quadruple per pixel. Tiles carry an ETag and honour If-None-Match. Shared caches may keep them as long as they revalidate.",
+		Tags:        []string{"canvas"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The tile"},
+			"304": {Description: "The tile has not changed"},
+			"404": {Description: "There is no such tile"},
+		},
+	})
+	spec.Describe("GET", "/api/events", &openapi.Operation{
+		OperationId: "streamEvents",
+		Summary:     "Canvas events as server-sent events",
+		Description: "Each event is named after its type and carries an Event as JSON data.",
+		Tags:        []string{"canvas"},
+		Parameters: []*openapi.Parameter{
+			openapi.Query("access_token", "Credential for clients that cannot set the Authorization header, such as EventSource", &openapi.Schema{Type: "string"}, false),
+		},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The event stream", Content: map[string]*openapi.MediaType{"text/event-stream": {Schema: event}}},
+		},
+	})
+	spec.Describe("GET", "/api/templates", &openapi.Operation{
+		OperationId: "getTemplates",
+		Tags:        []string{"templates"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The templates of the canvas", Content: openapi.JSON(openapi.ArrayOf(template))},
+		},
+	})
+	spec.Describe("POST", "/api/templates", &openapi.Operation{
+		OperationId: "createTemplate",
+		Summary:     "Upload a template image",
+		Description: "The image is a PNG of at most 350 KB and no larger than the canvas.",
+		Tags:        []string{"templates"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: map[string]*openapi.MediaType{
+			"multipart/form-data": {Schema: &openapi.Schema{Type: "object", Properties: map[string]*openapi.Schema{
+				"image": {Type: "string", Format: "binary"},
+				"name":  str,
+				"row":   integer,
+				"col":   integer,
+			}, Required: []string{"image"}}},
+		}},
+		Responses: map[string]*openapi.Response{
+			"201": {Description: "The template", Content: openapi.JSON(template)},
+			"400": {Description: "The image is not a PNG or is larger than the canvas"},
+			"413": {Description: "The image is over 350 KB"},
+		},
+	})
+	spec.Describe("GET", "/api/templates/{id}/diff", &openapi.Operation{
+		OperationId: "getTemplateDiff",
+		Tags:        []string{"templates"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "How much of the template is on the canvas", Content: openapi.JSON(templateDiff)},
+		},
+	})
+	spec.Describe("POST", "/api/factions", &openapi.Operation{
+		OperationId: "createFaction",
+		Tags:        []string{"factions"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(faction)},
+		Responses: map[string]*openapi.Response{
+			"201": {Description: "The faction", Content: openapi.JSON(faction)},
+			"409": {Description: "The faction exists or the user is in one already"},
+		},
+	})
+	spec.Describe("GET", "/api/factions/{name}", &openapi.Operation{
+		OperationId: "getFaction",
+		Tags:        []string{"factions"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The faction and its members", Content: openapi.JSON(faction)},
+			"404": {Description: "There is no such faction"},
+		},
+	})
+	spec.Describe("GET", "/api/factions/{name}/stats", &openapi.Operation{
+		OperationId: "getFactionStats",
+		Tags:        []string{"factions"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The faction's presence on the canvas", Content: openapi.JSON(factionStats)},
+		},
+	})
+	spec.Describe("PUT", "/api/factions/{name}/owner", &openapi.Operation{
+		OperationId: "transferFaction",
+		Tags:        []string{"factions"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(&openapi.Schema{
+			Type:       "object",
+			Properties: map[string]*openapi.Schema{"owner": {Type: "string"}},
+			Required:   []string{"owner"},
+		})},
+		Responses: map[string]*openapi.Response{
+			"204": {Description: "The member owns the faction now"},
+			"400": {Description: "The new owner is not a member"},
+			"403": {Description: "The caller does not own the faction"},
+		},
+	})
+	spec.Describe("DELETE", "/api/factions/{name}", &openapi.Operation{
+		OperationId: "disbandFaction",
+		Tags:        []string{"factions"},
+		Responses: map[string]*openapi.Response{
+			"204": {Description: "The faction and its memberships are gone"},
+			"403": {Description: "The caller does not own the faction"},
+		},
+	})
+	spec.Describe("GET", "/api/leaderboard", &openapi.Operation{
+		OperationId: "getLeaderboard",
+		Tags:        []string{"leaderboard"},
+		Parameters: []*openapi.Parameter{
+			openapi.Query("window", "hour counts since the start of the current UTC hour and day since midnight UTC", &openapi.Schema{Type: "string", Enum: []string{WindowHour, WindowDay, WindowAll}}, false),
+			openapi.Query("kind", "", &openapi.Schema{Type: "string", Enum: []string{KindUser, KindFaction}}, false),
+			openapi.Query("limit", "", integer, false),
+		},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The top placers", Content: openapi.JSON(openapi.ArrayOf(leaderboardEntry))},
+		},
+	})
+	spec.Describe("GET", "/api/schedule", &openapi.Operation{
+		OperationId: "getSchedule",
+		Tags:        []string{"schedule"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The current phase and the schedule", Content: openapi.JSON(schedule)},
+		},
+	})
+	spec.Describe("GET", "/api/locks", &openapi.Operation{
+		OperationId: "getLocks",
+		Tags:        []string{"moderation"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The locked regions", Content: openapi.JSON(openapi.ArrayOf(lock))},
+		},
+	})
+	spec.Describe("GET", "/api/canvas", &openapi.Operation{
+		OperationId: "getCanvas",
+		Summary:     "Name, size and palette of the canvas",
+		Tags:        []string{"canvas"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The canvas configuration", Content: openapi.JSON(canvas)},
+		},
+	})
+	spec.Describe("PUT", "/api/admin/canvas", &openapi.Operation{
+		OperationId: "resizeCanvas",
+		Summary:     "Resize the canvas",
+		Tags:        []string{"admin"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(resize)},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The resized canvas", Content: openapi.JSON(canvas)},
+			"400": {Description: "The size is out of range"},
+			"403": {Description: "The caller is not an admin"},
+		},
+	})
+	spec.Describe("GET", "/api/admin/bans", &openapi.Operation{
+		OperationId: "getBans",
+		Tags:        []string{"admin"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The bans", Content: openapi.JSON(openapi.ArrayOf(ban))},
+		},
+	})
+	spec.Describe("POST", "/api/admin/bans", &openapi.Operation{
+		OperationId: "banUser",
+		Tags:        []string{"admin"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(banRequest)},
+		Responses: map[string]*openapi.Response{
+			"201": {Description: "The ban", Content: openapi.JSON(ban)},
+		},
+	})
+	spec.Describe("POST", "/api/admin/locks", &openapi.Operation{
+		OperationId: "lockRegion",
+		Tags:        []string{"admin"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(lock)},
+		Responses: map[string]*openapi.Response{
+			"201": {Description: "The lock", Content: openapi.JSON(lock)},
+		},
+	})
+	spec.Describe("GET", "/api/admin/cache", &openapi.Operation{
+		OperationId: "getCacheKeys",
+		Tags:        []string{"admin"},
+		Parameters: []*openapi.Parameter{
+			openapi.Query("prefix", "Only list keys starting with this", str, false),
+		},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The cache keys and their sizes. Tokens are listed by their session id", Content: openapi.JSON(openapi.ArrayOf(cacheEntry))},
+		},
+	})
+	spec.Describe("GET", "/api/admin/cache/{key}", &openapi.Operation{
+		OperationId: "getCacheEntry",
+		Tags:        []string{"admin"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The cache entry, without the credential it may hold", Content: openapi.JSON(cacheEntry)},
+			"404": {Description: "There is no such key"},
+		},
+	})
+	spec.Describe("POST", "/api/admin/import", &openapi.Operation{
+		OperationId: "importImage",
+		Summary:     "Paint an image onto the canvas",
+		Description: "The image is quantized to the canvas palette and placed with its top left corner at row, col, attributed to the caller. The pixels are written in the background, in batches; the job reports how far it got. With preview set the quantized PNG is returned and nothing is written.",
+		Tags:        []string{"admin"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: map[string]*openapi.MediaType{
+			"multipart/form-data": {Schema: &openapi.Schema{Type: "object", Properties: map[string]*openapi.Schema{
+				"image":   {Type: "string", Format: "binary", Description: "PNG, JPEG or GIF"},
+				"row":     integer,
+				"col":     integer,
+				"dither":  {Type: "string", Enum: []string{DitherNone, DitherFloydSteinberg}},
+				"preview": {Type: "boolean"},
+			}, Required: []string{"image", "row", "col"}}},
+		}},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The preview, as image/png"},
+			"202": {Description: "The import job, also found under the Location header", Content: openapi.JSON(importJob)},
+			"400": {Description: "The image or the form is invalid"},
+			"403": {Description: "The caller is not an admin"},
+		},
+	})
+	spec.Describe("GET", "/api/admin/import/{id}", &openapi.Operation{
+		OperationId: "getImport",
+		Summary:     "Progress of an import",
+		Description: "A job whose instance stopped stays running. Importing the same image again finishes it, since pixels that already have the right color are skipped.",
+		Tags:        []string{"admin"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The import job", Content: openapi.JSON(importJob)},
+			"403": {Description: "The caller is not an admin"},
+			"404": {Description: "There is no such import"},
+		},
+	})
+	spec.Describe("GET", "/api/admin/suspicions", &openapi.Operation{
+		OperationId: "getSuspicions",
+		Summary:     "Accounts flagged as likely automated",
+		Description: "Scores combine timing regularity, placing right as the cooldown ends and painting neighbouring template pixels in lockstep with other accounts.",
+		Tags:        []string{"moderation"},
+		Parameters: []*openapi.Parameter{
+			openapi.Query("all", "List every scored account, not only flagged ones", &openapi.Schema{Type: "boolean"}, false),
+		},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The accounts, most suspicious first", Content: openapi.JSON(openapi.ArrayOf(suspicion))},
+			"403": {Description: "The caller is not an admin"},
+		},
+	})
+	spec.Describe("GET", "/api/admin/suspicions/{username}", &openapi.Operation{
+		OperationId: "getSuspicion",
+		Summary:     "Suspicion score of an account",
+		Tags:        []string{"moderation"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The score", Content: openapi.JSON(suspicion)},
+			"403": {Description: "The caller is not an admin"},
+			"404": {Description: "The account has not been scored"},
+		},
+	})
+	spec.Describe("DELETE", "/api/admin/suspicions/{username}", &openapi.Operation{
+		OperationId: "clearSuspicion",
+		Summary:     "Forget the score of an account",
+		Tags:        []string{"moderation"},
+		Responses: map[string]*openapi.Response{
+			"204": {Description: "The score was cleared"},
+			"403": {Description: "The caller is not an admin"},
+		},
+	})
+	spec.Describe("GET", "/api/admin/detection", &openapi.Operation{
+		OperationId: "getDetection",
+		Summary:     "Bot detection settings",
+		Tags:        []string{"moderation"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The settings", Content: openapi.JSON(detection)},
+			"403": {Description: "The caller is not an admin"},
+		},
+	})
+	spec.Describe("PUT", "/api/admin/detection", &openapi.Operation{
+		OperationId: "putDetection",
+		Summary:     "Change the bot detection settings",
+		Description: "Accounts scoring at least threshold are flagged. The action applied to them is none, slowdown, which multiplies their cooldown by slowdown_factor, or challenge, which asks for a proof of work with every placement. Fields left out keep their value.",
+		Tags:        []string{"moderation"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(detection)},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The new settings", Content: openapi.JSON(detection)},
+			"400": {Description: "The settings are invalid"},
+			"403": {Description: "The caller is not an admin"},
+		},
+	})
+	spec.Describe("GET", "/api/admin/challenge", &openapi.Operation{
+		OperationId: "getChallengeConfig",
+		Summary:     "Proof of work settings",
+		Tags:        []string{"moderation"},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The settings", Content: openapi.JSON(challengeConfig)},
+			"403": {Description: "The caller is not an admin"},
+			"404": {Description: "Challenges are not enabled"},
+		},
+	})
+	spec.Describe("PUT", "/api/admin/challenge", &openapi.Operation{
+		OperationId: "putChallengeConfig",
+		Summary:     "Change the proof of work settings",
+		Description: "mode is off, risk or always. In risk mode flagged accounts are challenged, and so is everyone while a scope sees more than high_load attempts a minute. Challenges already issued keep their difficulty. Fields left out keep their value.",
+		Tags:        []string{"moderation"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(challengeConfig)},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The new settings", Content: openapi.JSON(challengeConfig)},
+			"400": {Description: "The settings are invalid"},
+			"403": {Description: "The caller is not an admin"},
+			"404": {Description: "Challenges are not enabled"},
+		},
+	})
+}
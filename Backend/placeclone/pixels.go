@@ -3,32 +3,46 @@ package placeclone
 import (
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 )
 
 type Image struct {
-	Pixels []*Pixel `json:"pixels,omitempty"`
-	Rows   int      `json:"rows,omitempty"`
-	Cols   int      `json:"height,omitempty"`
-	Name   string   `json:"name,omitempty"`
+	Pixels  []*Pixel `json:"pixels,omitempty"`
+	Rows    int      `json:"rows,omitempty"`
+	Cols    int      `json:"cols,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Palette []string `json:"palette,omitempty"`
+
+	mu sync.RWMutex
 }
 
 type Pixel struct {
-	Pk           string
-	Sk           string
+	Pk           string `json:"-"`
+	Sk           string `json:"-"`
 	Row          int    `json:"row"`
 	Col          int    `json:"col"`
 	Color        string `json:"color,omitempty"`
 	Author       string `json:"author,omitempty"`
-	LastModified int64  `json:"last_modified,omitempty"`
+	AuthorName   string `json:"author_name,omitempty" dynamodbav:"author_name"`
+	Faction      string `json:"faction,omitempty"`
+	LastModified int64  `json:"last_modified,omitempty" dynamodbav:"last_modified"`
+	Version      int64  `json:"version"`
+	Seq          int64  `json:"seq,omitempty"`
 }
 
 func GetSortKey(row int, col int) string {
 	return fmt.Sprintf("%v#%v", row, col)
 }
 
-func (i *Image) UpdatePixel(row int, col int, color string, author string) (*Pixel, error) {
-	pixel := &Pixel{
+// NewPixel builds a pixel for this canvas without validating it; placements
+// are checked by the placement rules.
+func (i *Image) NewPixel(row int, col int, color string, author string) *Pixel {
+	if normalized, err := NormalizeColor(color); err == nil {
+		color = normalized
+	}
+
+	return &Pixel{
 		Pk:           "PIXEL#" + i.Name,
 		Sk:           GetSortKey(row, col),
 		Row:          row,
@@ -37,14 +51,18 @@ func (i *Image) UpdatePixel(row int, col int, color string, author string) (*Pix
 		Author:       author,
 		LastModified: time.Now().Unix(),
 	}
+}
+
+func (i *Image) UpdatePixel(row int, col int, color string, author string) (*Pixel, error) {
+	pixel := i.NewPixel(row, col, color, author)
 
-	ok, err := i.IsValidPixel(pixel)
+	i.mu.Lock()
+	defer i.mu.Unlock()
 
-	if !ok {
-		return nil, err
+	if !i.withinBounds(pixel) {
+		return nil, errors.New("pixel out of bounds")
 	}
-
-	i.Pixels[(row*i.Rows)+col] = pixel
+	i.Pixels[i.index(row, col)] = pixel
 	return pixel, nil
 }
 
@@ -52,6 +70,77 @@ func (i *Image) UpdatePixelFromObject(p *Pixel) (*Pixel, error) {
 	return i.UpdatePixel(p.Row, p.Col, p.Color, p.Author)
 }
 
+// SetPixel stores a pixel that has already been persisted. A pixel older
+// than the one currently held is ignored so that out of order writes can
+// never roll the in-memory canvas back.
+func (i *Image) SetPixel(p *Pixel) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if !i.withinBounds(p) {
+		return false
+	}
+	idx := i.index(p.Row, p.Col)
+	if current := i.Pixels[idx]; current != nil && current.Version > p.Version {
+		return false
+	}
+	i.Pixels[idx] = p
+	return true
+}
+
+func (i *Image) GetPixel(row int, col int) *Pixel {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	if !i.withinBounds(&Pixel{Row: row, Col: col}) {
+		return nil
+	}
+	return i.Pixels[i.index(row, col)]
+}
+
+// Placed returns the pixels placed on the canvas in row major order.
+func (i *Image) Placed() []*Pixel {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	pixels := []*Pixel{}
+	for _, p := range i.Pixels {
+		if p != nil {
+			pixels = append(pixels, p)
+		}
+	}
+	return pixels
+}
+
+// Size returns the rows and columns of the canvas.
+func (i *Image) Size() (int, int) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.Rows, i.Cols
+}
+
+// Resize changes the size of the canvas. Pixels that no longer fit are
+// dropped from memory; they stay in the table and come back if the canvas
+// grows again and is reloaded.
+func (i *Image) Resize(rows int, cols int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	pixels := make([]*Pixel, rows*cols)
+	for _, p := range i.Pixels {
+		if p != nil && p.Row < rows && p.Col < cols {
+			pixels[p.Row*cols+p.Col] = p
+		}
+	}
+	i.Pixels = pixels
+	i.Rows = rows
+	i.Cols = cols
+}
+
+func (i *Image) index(row int, col int) int {
+	return (row * i.Cols) + col
+}
+
 func (i *Image) IsValidPixel(p *Pixel) (bool, error) {
 	if !i.WithinBounds(p) {
 		return false, errors.New("pixel out of bounds")
@@ -61,6 +150,13 @@ func (i *Image) IsValidPixel(p *Pixel) (bool, error) {
 }
 
 func (i *Image) WithinBounds(p *Pixel) bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.withinBounds(p)
+}
+
+// withinBounds is WithinBounds for callers holding mu.
+func (i *Image) withinBounds(p *Pixel) bool {
 	if p.Row < i.Rows && p.Col < i.Cols && p.Row >= 0 && p.Col >= 0 {
 		return true
 	}
@@ -70,9 +166,10 @@ func (i *Image) WithinBounds(p *Pixel) bool {
 
 func NewImage(name string, width int, height int) *Image {
 	return &Image{
-		Pixels: make([]*Pixel, height*width),
-		Rows:   width,
-		Cols:   height,
-		Name:   name,
+		Pixels:  make([]*Pixel, height*width),
+		Rows:    width,
+		Cols:    height,
+		Name:    name,
+		Palette: DefaultPalette,
 	}
 }
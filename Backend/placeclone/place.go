@@ -3,17 +3,26 @@ package placeclone
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/Jonathanpatta/rplace/broker"
 	"github.com/Jonathanpatta/rplace/cache"
+	"github.com/Jonathanpatta/rplace/challenge"
 	"github.com/Jonathanpatta/rplace/middleware"
+	"github.com/Jonathanpatta/rplace/webhook"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
+	"log"
+	"math/rand"
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 )
 
 type Server struct {
@@ -21,18 +30,116 @@ type Server struct {
 	TableName    *string
 	SessionStore *sessions.CookieStore
 	Image        *Image
+	ChangeLog    *ChangeLog
+	Tiles        *TileCache
+	Templates    *Templates
+	Leaderboard  *Leaderboard
+	Events       *Events
+	Lifecycle    *Lifecycle
+	Moderation   *Moderation
+	Cooldown     *Cooldown
+	Detector     *Detector
+	Challenges   *challenge.Issuer
+	Webhooks     *webhook.Dispatcher
+	Broker       broker.Broker
 	cacheCli     *cache.Client
+	instanceId   string
+
+	listenersMu sync.RWMutex
+	listeners   []func(*Pixel)
+
+	rulesMu sync.RWMutex
+	rules   []PlacementRule
+
+	// pending tracks the background work started by placements.
+	pending sync.WaitGroup
+
+	relays    chan *Pixel
+	relayOnce sync.Once
+	resyncs   chan string
+	reloads   chan struct{}
 }
 
-func NewServer(DbCli *dynamodb.Client, store *sessions.CookieStore, client *cache.Client) Server {
+const (
+	DefaultCooldown = 5 * time.Minute
+	DefaultCanvas   = "main image"
+	DefaultRows     = 100
+	DefaultCols     = 100
+)
+
+func NewServer(DbCli *dynamodb.Client, store *sessions.CookieStore, client *cache.Client) *Server {
+	return NewCanvasServer(DbCli, store, client, DefaultCanvas)
+}
 
-	return Server{
+// NewCanvasServer returns a server for the named canvas. Its size is the
+// default until Start loads the stored configuration.
+func NewCanvasServer(DbCli *dynamodb.Client, store *sessions.CookieStore, client *cache.Client, canvas string) *Server {
+	tableName := aws.String("Place-Clone")
+	image := NewImage(canvas, DefaultRows, DefaultCols)
+	server := &Server{
 		DbCli:        DbCli,
-		TableName:    aws.String("Place-Clone"),
-		Image:        NewImage("main image", 100, 100),
+		TableName:    tableName,
+		Image:        image,
+		ChangeLog:    NewChangeLog(10000),
+		Tiles:        NewTileCache(image),
+		Templates:    NewTemplates(image),
+		Leaderboard:  NewLeaderboard(DbCli, tableName, image.Name),
+		Events:       NewEvents(),
+		Moderation:   NewModeration(DbCli, tableName, image.Name),
+		Cooldown:     NewCooldown(DefaultCooldown),
 		SessionStore: store,
 		cacheCli:     client,
+		instanceId:   uuid.New().String(),
+		relays:       make(chan *Pixel, relayQueueSize),
+		resyncs:      make(chan string, 1),
+		reloads:      make(chan struct{}, 1),
 	}
+	server.OnPixel(server.Tiles.Invalidate)
+	server.OnPixel(server.Templates.Update)
+	server.OnPixel(server.Events.PublishPixel)
+	server.OnPixel(server.Cooldown.Record)
+	server.Detector = NewDetector(server.Cooldown, server.Templates)
+	server.Detector.OnFlag = server.publishFlag
+	server.OnPixel(server.Detector.Record)
+	server.Lifecycle = NewLifecycle(server.publishPhase)
+
+	server.RegisterRule(BoundsRule(image))
+	server.RegisterRule(PaletteRule(image))
+	server.RegisterRule(PhaseRule(server.Lifecycle))
+	server.RegisterRule(server.Moderation.BanRule())
+	server.RegisterRule(server.Moderation.LockRule())
+	server.RegisterRule(server.Cooldown)
+	server.RegisterRule(server.Detector)
+	server.RegisterRule(PlacementRuleFunc(server.checkChallenge))
+
+	return server
+}
+
+// OnPixel registers fn to be called with every pixel applied to the canvas.
+func (s *Server) OnPixel(fn func(*Pixel)) {
+	s.listenersMu.Lock()
+	s.listeners = append(s.listeners, fn)
+	s.listenersMu.Unlock()
+}
+
+// ApplyPixel puts a persisted pixel on the in-memory canvas and notifies the
+// listeners. Pixels older than the one already held are dropped, but still
+// go in the change log, which needs every sequence number. The log comes
+// second, so that a snapshot of the canvas holds every pixel up to the
+// latest sequence number of the log.
+func (s *Server) ApplyPixel(p *Pixel) bool {
+	applied := s.Image.SetPixel(p)
+	s.ChangeLog.Add(p)
+	if !applied {
+		return false
+	}
+
+	s.listenersMu.RLock()
+	defer s.listenersMu.RUnlock()
+	for _, fn := range s.listeners {
+		fn(p)
+	}
+	return true
 }
 
 func (s *Server) Ping(w http.ResponseWriter, r *http.Request) {
@@ -43,90 +150,564 @@ func (s *Server) Home(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "HOME")
 }
 
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	fmt.Fprint(w, string(out))
+}
+
+type UpdatePixelRequest struct {
+	Pixel
+	ExpectedVersion *int64 `json:"expected_version,omitempty"`
+}
+
+var (
+	ErrStalePixel    = errors.New("pixel has been modified since the expected version")
+	ErrPixelNotFound = errors.New("pixel not found")
+)
+
 func (s *Server) UpdatePixel(w http.ResponseWriter, r *http.Request) {
-	var p Pixel
+	var p UpdatePixelRequest
 	err := json.NewDecoder(r.Body).Decode(&p)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	updatedPixel, err := s.Image.UpdatePixelFromObject(&p)
+	author, authorName, ok := middleware.Identity(r)
+	if !ok {
+		http.Error(w, "unknown user", http.StatusUnauthorized)
+		return
+	}
+
+	ctx := challenge.WithProof(r.Context(), r.Header.Get(challenge.Header))
+	updatedPixel, rejection, err := s.PlaceAs(ctx, author, authorName, p.Row, p.Col, p.Color, p.ExpectedVersion)
+	if rejection != nil {
+		writeRejection(w, rejection)
+		return
+	}
+	if errors.Is(err, ErrStalePixel) {
+		writeJson(w, http.StatusConflict, updatedPixel)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	_, err = s.DbCli.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		Item: map[string]types.AttributeValue{
-			"PK":            &types.AttributeValueMemberS{Value: updatedPixel.Pk},
-			"SK":            &types.AttributeValueMemberS{Value: updatedPixel.Sk},
-			"row":           &types.AttributeValueMemberN{Value: strconv.Itoa(updatedPixel.Row)},
-			"col":           &types.AttributeValueMemberN{Value: strconv.Itoa(updatedPixel.Col)},
-			"color":         &types.AttributeValueMemberS{Value: updatedPixel.Color},
-			"last_modified": &types.AttributeValueMemberN{Value: strconv.Itoa(int(updatedPixel.LastModified))},
+
+	writeJson(w, http.StatusOK, updatedPixel)
+}
+
+// PlaceAs places a pixel on behalf of a user after checking it against the
+// placement rules. A refused placement is reported through the rejection;
+// on ErrStalePixel the current pixel is returned.
+func (s *Server) PlaceAs(ctx context.Context, author string, authorName string, row int, col int, color string, expectedVersion *int64) (*Pixel, *Rejection, error) {
+	pixel := s.Image.NewPixel(row, col, color, author)
+	placement := &Placement{
+		Pixel: pixel,
+		User:  author,
+		Time:  time.Unix(pixel.LastModified, 0),
+	}
+	rejection := s.CheckPlacement(ctx, placement)
+	if rejection != nil {
+		return nil, rejection, nil
+	}
+
+	var err error
+	pixel.AuthorName = authorName
+	pixel.Faction, err = s.UserFaction(ctx, author)
+	if err != nil {
+		s.ReleasePlacement(placement)
+		return nil, nil, err
+	}
+
+	updatedPixel, err := s.Place(ctx, pixel, expectedVersion)
+	if err != nil {
+		s.ReleasePlacement(placement)
+	}
+	return updatedPixel, nil, err
+}
+
+// PutPixel writes a pixel so that a stale write can never replace a newer
+// one. Without an expected version the write only has to be at least as
+// recent as the stored pixel; with one, the stored version has to match
+// exactly. The written pixel is returned along with the one it replaced, if
+// any. On conflict the current pixel is returned together with
+// ErrStalePixel.
+//
+// The pixel takes the next sequence number of the canvas in the same
+// transaction that writes it, so placements commit in sequence order and a
+// write that fails never uses one up. Concurrent writers race for the
+// counter and the losers try again.
+func (s *Server) PutPixel(ctx context.Context, p *Pixel, expectedVersion *int64) (*Pixel, *Pixel, error) {
+	for attempt := 1; ; attempt++ {
+		seq, stored, err := s.readForPut(ctx, []*Pixel{p})
+		if err != nil {
+			return nil, nil, err
+		}
+		previous := stored[0]
+
+		current := previous
+		if current == nil {
+			// A pixel that was never placed is at version 0, which is what
+			// an expected version has to be for it.
+			current = &Pixel{Pk: p.Pk, Sk: p.Sk, Row: p.Row, Col: p.Col}
+		}
+		if expectedVersion != nil && current.Version != *expectedVersion {
+			return current, nil, ErrStalePixel
+		}
+		if expectedVersion == nil && current.LastModified > p.LastModified {
+			return current, nil, ErrStalePixel
+		}
+
+		err = s.writePixels(ctx, []pixelWrite{{pixel: p, version: current.Version}}, seq)
+		if errors.Is(err, errPutRaced) && attempt < putAttempts {
+			time.Sleep(time.Duration(rand.Intn(10*attempt)) * time.Millisecond)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		updatedPixel := *p
+		updatedPixel.Seq = seq + 1
+		updatedPixel.Version = current.Version + 1
+		return &updatedPixel, previous, nil
+	}
+}
+
+// PutPixels writes a batch of pixels in one transaction, each as PutPixel
+// does without an expected version, taking consecutive sequence numbers.
+// Pixels whose stored one is newer are left out. The written pixels are
+// returned along with the ones they replaced, which are nil for pixels
+// never placed before.
+func (s *Server) PutPixels(ctx context.Context, pixels []*Pixel) ([]*Pixel, []*Pixel, error) {
+	for attempt := 1; ; attempt++ {
+		seq, stored, err := s.readForPut(ctx, pixels)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var writes []pixelWrite
+		var previous []*Pixel
+		for i, p := range pixels {
+			var version int64
+			if stored[i] != nil {
+				if stored[i].LastModified > p.LastModified {
+					continue
+				}
+				version = stored[i].Version
+			}
+			writes = append(writes, pixelWrite{pixel: p, version: version})
+			previous = append(previous, stored[i])
+		}
+		if len(writes) == 0 {
+			return nil, nil, nil
+		}
+
+		err = s.writePixels(ctx, writes, seq)
+		if errors.Is(err, errPutRaced) && attempt < putAttempts {
+			time.Sleep(time.Duration(rand.Intn(10*attempt)) * time.Millisecond)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		written := make([]*Pixel, len(writes))
+		for i, write := range writes {
+			updatedPixel := *write.pixel
+			updatedPixel.Seq = seq + 1 + int64(i)
+			updatedPixel.Version = write.version + 1
+			written[i] = &updatedPixel
+		}
+		return written, previous, nil
+	}
+}
+
+const (
+	putAttempts = 20
+	// maxPutBatch is how many pixels PutPixels takes. Along with the
+	// counter they fill a transaction, which holds at most 25 items.
+	maxPutBatch = 24
+)
+
+// errPutRaced means another placement took the sequence number or changed
+// the pixel between reading and writing them.
+var errPutRaced = errors.New("placement raced another one")
+
+func (s *Server) seqKey() map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: "CANVAS#" + s.Image.Name},
+		"SK": &types.AttributeValueMemberS{Value: "SEQ"},
+	}
+}
+
+// readForPut reads the sequence counter and the stored pixels in one
+// consistent snapshot. Pixels that were never placed are nil.
+func (s *Server) readForPut(ctx context.Context, pixels []*Pixel) (int64, []*Pixel, error) {
+	gets := []types.TransactGetItem{
+		{Get: &types.Get{TableName: s.TableName, Key: s.seqKey()}},
+	}
+	for _, p := range pixels {
+		gets = append(gets, types.TransactGetItem{Get: &types.Get{TableName: s.TableName, Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: p.Pk},
+			"SK": &types.AttributeValueMemberS{Value: p.Sk},
+		}}})
+	}
+	out, err := s.DbCli.TransactGetItems(ctx, &dynamodb.TransactGetItemsInput{
+		TransactItems: gets,
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var counter struct {
+		Seq int64
+	}
+	err = attributevalue.UnmarshalMap(out.Responses[0].Item, &counter)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	stored := make([]*Pixel, len(pixels))
+	for i, response := range out.Responses[1:] {
+		if len(response.Item) == 0 {
+			continue
+		}
+		var previous Pixel
+		err = attributevalue.UnmarshalMap(response.Item, &previous)
+		if err != nil {
+			return 0, nil, err
+		}
+		stored[i] = &previous
+	}
+	return counter.Seq, stored, nil
+}
+
+// pixelWrite is a pixel to write over the stored one at version.
+type pixelWrite struct {
+	pixel   *Pixel
+	version int64
+}
+
+// writePixels writes each pixel at its version+1, numbering them on from
+// seq, provided the counter is still at seq and every pixel still at its
+// version.
+func (s *Server) writePixels(ctx context.Context, writes []pixelWrite, seq int64) error {
+	counterCondition := "#seq = :previous"
+	counterValues := map[string]types.AttributeValue{
+		":seq": &types.AttributeValueMemberN{Value: strconv.FormatInt(seq+int64(len(writes)), 10)},
+	}
+	if seq == 0 {
+		counterCondition = "attribute_not_exists(#seq)"
+	} else {
+		counterValues[":previous"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(seq, 10)}
+	}
+
+	items := []types.TransactWriteItem{
+		{
+			Update: &types.Update{
+				TableName:           s.TableName,
+				Key:                 s.seqKey(),
+				UpdateExpression:    aws.String("SET #seq = :seq"),
+				ConditionExpression: aws.String(counterCondition),
+				ExpressionAttributeNames: map[string]string{
+					"#seq": "seq",
+				},
+				ExpressionAttributeValues: counterValues,
+			},
 		},
-		TableName: s.TableName,
+	}
+	for i, write := range writes {
+		items = append(items, s.pixelUpdate(write.pixel, write.version, seq+1+int64(i)))
+	}
+
+	_, err := s.DbCli.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
 	})
 
+	var canceled *types.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		for _, reason := range canceled.CancellationReasons {
+			switch aws.ToString(reason.Code) {
+			case "ConditionalCheckFailed", "TransactionConflict":
+				return errPutRaced
+			}
+		}
+	}
+	var conflict *types.TransactionConflictException
+	if errors.As(err, &conflict) {
+		return errPutRaced
+	}
+	return err
+}
+
+// pixelUpdate writes p at version+1 with sequence number seq, provided the
+// pixel is still at version.
+func (s *Server) pixelUpdate(p *Pixel, version int64, seq int64) types.TransactWriteItem {
+	pixelCondition := "#version = :version"
+	if version == 0 {
+		pixelCondition = "attribute_not_exists(#version)"
+	}
+
+	pixelValues := map[string]types.AttributeValue{
+		":row":           &types.AttributeValueMemberN{Value: strconv.Itoa(p.Row)},
+		":col":           &types.AttributeValueMemberN{Value: strconv.Itoa(p.Col)},
+		":color":         &types.AttributeValueMemberS{Value: p.Color},
+		":author":        &types.AttributeValueMemberS{Value: p.Author},
+		":author_name":   &types.AttributeValueMemberS{Value: p.AuthorName},
+		":faction":       &types.AttributeValueMemberS{Value: p.Faction},
+		":last_modified": &types.AttributeValueMemberN{Value: strconv.Itoa(int(p.LastModified))},
+		":seq":           &types.AttributeValueMemberN{Value: strconv.FormatInt(seq, 10)},
+		":next":          &types.AttributeValueMemberN{Value: strconv.FormatInt(version+1, 10)},
+	}
+	if version != 0 {
+		pixelValues[":version"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(version, 10)}
+	}
+
+	return types.TransactWriteItem{
+		Update: &types.Update{
+			TableName: s.TableName,
+			Key: map[string]types.AttributeValue{
+				"PK": &types.AttributeValueMemberS{Value: p.Pk},
+				"SK": &types.AttributeValueMemberS{Value: p.Sk},
+			},
+			UpdateExpression:    aws.String("SET #row = :row, #col = :col, #color = :color, #author = :author, #author_name = :author_name, #faction = :faction, #last_modified = :last_modified, #seq = :seq, #version = :next"),
+			ConditionExpression: aws.String(pixelCondition),
+			ExpressionAttributeNames: map[string]string{
+				"#row":           "row",
+				"#col":           "col",
+				"#color":         "color",
+				"#author":        "author",
+				"#author_name":   "author_name",
+				"#faction":       "faction",
+				"#last_modified": "last_modified",
+				"#version":       "version",
+				"#seq":           "seq",
+			},
+			ExpressionAttributeValues: pixelValues,
+		},
+	}
+}
+
+// Place persists a pixel, puts it on the in-memory canvas and records it in
+// the leaderboard. Every accepted placement goes through here.
+func (s *Server) Place(ctx context.Context, p *Pixel, expectedVersion *int64) (*Pixel, error) {
+	updatedPixel, previousPixel, err := s.PutPixel(ctx, p, expectedVersion)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return updatedPixel, err
 	}
 
-	outputPixel, err := json.Marshal(updatedPixel)
+	s.ApplyPixel(updatedPixel)
+	s.relayPixel(updatedPixel)
+	s.pending.Add(1)
+	go func() {
+		defer s.pending.Done()
+		s.Leaderboard.Record(updatedPixel, previousPixel)
+	}()
+	s.Webhooks.Publish(webhook.EventPixelPlaced, updatedPixel)
+
+	return updatedPixel, nil
+}
+
+// PlaceBatch is Place for a batch of at most maxPutBatch pixels written in
+// one transaction. Pixels whose stored one is newer are left out, and the
+// placed ones returned.
+func (s *Server) PlaceBatch(ctx context.Context, pixels []*Pixel) ([]*Pixel, error) {
+	written, previous, err := s.PutPixels(ctx, pixels)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
-	fmt.Fprint(w, string(outputPixel))
+	for _, p := range written {
+		s.ApplyPixel(p)
+		s.relayPixel(p)
+		s.Webhooks.Publish(webhook.EventPixelPlaced, p)
+	}
+	s.pending.Add(1)
+	go func() {
+		defer s.pending.Done()
+		for i := range written {
+			s.Leaderboard.Record(written[i], previous[i])
+		}
+	}()
+	return written, nil
 }
 
-func (s *Server) GetPixels(w http.ResponseWriter, r *http.Request) {
-	_, err := json.Marshal(s.Image)
+// Wait blocks until the leaderboard updates and relays started by earlier
+// placements are done. Short lived callers such as rplacectl use it before
+// exiting.
+func (s *Server) Wait() {
+	s.pending.Wait()
+}
+
+// LoadImage fills the in-memory canvas from the table and starts the change
+// log at the current sequence number.
+func (s *Server) LoadImage(ctx context.Context) error {
+	out, err := s.DbCli.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: s.TableName,
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: "CANVAS#" + s.Image.Name},
+			"SK": &types.AttributeValueMemberS{Value: "SEQ"},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	out, err := s.DbCli.Query(context.TODO(), &dynamodb.QueryInput{
+	var counter struct {
+		Seq int64
+	}
+	err = attributevalue.UnmarshalMap(out.Item, &counter)
+	if err != nil {
+		return err
+	}
+	// Placements committed from here on come through ApplyPixel while the
+	// pixels load, and go in the log after the counter.
+	s.ChangeLog.Reset(counter.Seq)
+
+	paginator := dynamodb.NewQueryPaginator(s.DbCli, &dynamodb.QueryInput{
 		TableName:              s.TableName,
 		KeyConditionExpression: aws.String("#PK = :name"),
-		FilterExpression:       aws.String("(#row between :zero and :rows) and (#col between :zero and :cols)"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
 			":name": &types.AttributeValueMemberS{Value: "PIXEL#" + s.Image.Name},
-			":rows": &types.AttributeValueMemberN{Value: strconv.Itoa(s.Image.Rows)},
-			":cols": &types.AttributeValueMemberN{Value: strconv.Itoa(s.Image.Cols)},
-			":zero": &types.AttributeValueMemberN{Value: strconv.Itoa(0)},
 		},
 		ExpressionAttributeNames: map[string]string{
-			"#PK":  "PK",
-			"#row": "row",
-			"#col": "col",
+			"#PK": "PK",
 		},
 	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		var pixels []*Pixel
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &pixels)
+		if err != nil {
+			return err
+		}
+		for _, p := range pixels {
+			s.Image.SetPixel(p)
+		}
+	}
+
+	s.Tiles.Clear()
+	s.Templates.RefreshAll()
+	return nil
+}
+
+type ChangesResponse struct {
+	Seq    int64    `json:"seq"`
+	Reload bool     `json:"reload,omitempty"`
+	Pixels []*Pixel `json:"pixels"`
+}
 
+func (s *Server) GetChanges(w http.ResponseWriter, r *http.Request) {
+	since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "since must be a sequence number", http.StatusBadRequest)
 		return
 	}
 
-	var pixels []Pixel
-	err = attributevalue.UnmarshalListOfMaps(out.Items, &pixels)
+	pixels, latest, ok := s.ChangeLog.Since(since)
+	response := ChangesResponse{
+		Seq:    latest,
+		Reload: !ok,
+		Pixels: pixels,
+	}
 
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusGone
+	}
+	writeJson(w, status, response)
+}
+
+type PixelInfo struct {
+	Row        int    `json:"row"`
+	Col        int    `json:"col"`
+	Color      string `json:"color,omitempty"`
+	Author     string `json:"author,omitempty"`
+	AuthorName string `json:"author_name,omitempty"`
+	Faction    string `json:"faction,omitempty"`
+	PlacedAt   string `json:"placed_at,omitempty"`
+}
+
+func (s *Server) GetPixel(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	row, errRow := strconv.Atoi(vars["row"])
+	col, errCol := strconv.Atoi(vars["col"])
+	if errRow != nil || errCol != nil {
+		http.Error(w, "invalid pixel coordinates", http.StatusBadRequest)
 		return
 	}
 
-	pixelArray, err := json.Marshal(pixels)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	pixel := s.Image.GetPixel(row, col)
+	if pixel == nil {
+		http.Error(w, "pixel not found", http.StatusNotFound)
 		return
 	}
 
-	fmt.Fprint(w, string(pixelArray))
+	info := PixelInfo{
+		Row:        pixel.Row,
+		Col:        pixel.Col,
+		Color:      pixel.Color,
+		Author:     pixel.Author,
+		AuthorName: pixel.AuthorName,
+		Faction:    pixel.Faction,
+	}
+	if info.AuthorName == "" {
+		info.AuthorName = info.Author
+	}
+	if pixel.LastModified != 0 {
+		info.PlacedAt = time.Unix(pixel.LastModified, 0).UTC().Format(time.RFC3339)
+	}
 
+	writeJson(w, http.StatusOK, info)
+}
+
+func (s *Server) GetStoredPixel(ctx context.Context, row int, col int) (*Pixel, error) {
+	out, err := s.DbCli.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: s.TableName,
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: "PIXEL#" + s.Image.Name},
+			"SK": &types.AttributeValueMemberS{Value: GetSortKey(row, col)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out.Item == nil {
+		return nil, ErrPixelNotFound
+	}
+
+	var pixel Pixel
+	err = attributevalue.UnmarshalMap(out.Item, &pixel)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pixel, nil
+}
+
+// GetPixels serves every placed pixel from the in-memory canvas, along with
+// the sequence number to ask for changes after. The number is read first, so
+// the snapshot holds at least every pixel up to it.
+func (s *Server) GetPixels(w http.ResponseWriter, r *http.Request) {
+	seq := s.ChangeLog.Latest()
+	pixels := s.Image.Placed()
+
+	w.Header().Set("X-Canvas-Seq", strconv.FormatInt(seq, 10))
+	writeJson(w, http.StatusOK, pixels)
 }
 
 type Options struct {
@@ -134,32 +715,143 @@ type Options struct {
 	Store          *sessions.CookieStore
 	CacheCli       *cache.Client
 	AuthMiddleware *middleware.AuthMiddlewareServer
-}
 
-func NewRouter(o *Options) *mux.Router {
-	server := NewServer(o.DbCli, o.Store, o.CacheCli)
+	// Canvas names the canvas to serve, DefaultCanvas when empty.
+	Canvas string
+	// Cooldown overrides DefaultCooldown when set.
+	Cooldown time.Duration
+	// Rules are checked after the built in placement rules.
+	Rules []PlacementRule
+	// Detection overrides the default bot detection settings when set.
+	Detection *DetectionConfig
+	// Challenges asks for a proof of work with placements when set.
+	Challenges *challenge.Issuer
+	// Webhooks receives placement and moderation events when set.
+	Webhooks *webhook.Dispatcher
+	// Broker relays placements between instances serving the same canvas.
+	Broker broker.Broker
+}
 
-	r := mux.NewRouter()
+func NewServerFromOptions(o *Options) *Server {
+	canvas := o.Canvas
+	if canvas == "" {
+		canvas = DefaultCanvas
+	}
+	server := NewCanvasServer(o.DbCli, o.Store, o.CacheCli, canvas)
+	if o.Cooldown != 0 {
+		server.Cooldown.Duration = o.Cooldown
+	}
+	for _, rule := range o.Rules {
+		server.RegisterRule(rule)
+	}
+	if o.Detection != nil {
+		err := server.Detector.Configure(*o.Detection)
+		if err != nil {
+			log.Printf("ignoring bot detection settings for %s: %s", canvas, err.Error())
+		}
+	}
+	server.Webhooks = o.Webhooks
+	server.Challenges = o.Challenges
+	server.Broker = o.Broker
 
-	r.HandleFunc("/ping", server.Ping).Methods("GET")
-	r.HandleFunc("/", server.Home).Methods("GET")
-	r.HandleFunc("/pixels", server.GetPixels).Methods("GET")
-	r.HandleFunc("/updatePixel", server.UpdatePixel).Methods("POST")
+	return server
+}
 
-	return r
+// Start loads the canvas state from the table, starts the schedule and
+// subscribes to the placements of other instances. The subscription comes
+// before the pixels are loaded so that no placement falls in between.
+func (s *Server) Start(ctx context.Context) {
+	err := s.LoadCanvas(ctx)
+	if err != nil {
+		log.Printf("could not load the configuration of %s: %s", s.Image.Name, err.Error())
+	}
+	err = s.LoadDetection(ctx)
+	if err != nil {
+		log.Printf("could not load bot detection settings of %s: %s", s.Image.Name, err.Error())
+	}
+	err = s.LoadChallengeConfig(ctx)
+	if err != nil {
+		log.Printf("could not load challenge settings of %s: %s", s.Image.Name, err.Error())
+	}
+	err = s.RunBackplane(ctx)
+	if err != nil {
+		log.Printf("could not subscribe to placements on %s: %s", s.Image.Name, err.Error())
+	}
+	err = s.LoadImage(ctx)
+	if err != nil {
+		log.Printf("could not load canvas %s: %s", s.Image.Name, err.Error())
+	}
+	err = s.LoadTemplates(ctx)
+	if err != nil {
+		log.Printf("could not load templates of %s: %s", s.Image.Name, err.Error())
+	}
+	err = s.LoadSchedule(ctx)
+	if err != nil {
+		log.Printf("could not load schedule of %s: %s", s.Image.Name, err.Error())
+	}
+	err = s.Moderation.Load(ctx)
+	if err != nil {
+		log.Printf("could not load bans and locks of %s: %s", s.Image.Name, err.Error())
+	}
+	go s.RunSchedule(ctx)
+	go s.watchChangeLog(ctx)
+	go s.watchConfig(ctx)
 }
 
-func AddSubrouter(o *Options, r *mux.Router) {
+// AddSubrouter mounts the canvas API under /api and returns the server
+// behind it, so other transports can share its canvas.
+func AddSubrouter(o *Options, r *mux.Router) *Server {
 
-	server := NewServer(o.DbCli, o.Store, o.CacheCli)
+	server := NewServerFromOptions(o)
+	server.Start(context.Background())
 
 	router := r.PathPrefix("/api").Subrouter()
 
-	router.Use(o.AuthMiddleware.JwtAuthorization)
+	router.Use(o.AuthMiddleware.Authenticate, middleware.Scoped)
 
 	router.HandleFunc("/ping", server.Ping).Methods("GET", "OPTIONS")
 	router.HandleFunc("/", server.Home).Methods("GET", "OPTIONS")
 	router.HandleFunc("/pixels", server.GetPixels).Methods("GET", "OPTIONS")
+	router.HandleFunc("/pixels/changes", server.GetChanges).Methods("GET", "OPTIONS")
+	router.HandleFunc("/pixels/{row:[0-9]+}/{col:[0-9]+}", server.GetPixel).Methods("GET", "OPTIONS")
+	router.HandleFunc("/tiles/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{format:png|bin}", server.GetTile).Methods("GET", "OPTIONS")
+	router.HandleFunc("/templates", server.GetTemplates).Methods("GET", "OPTIONS")
+	router.HandleFunc("/templates", server.CreateTemplate).Methods("POST", "OPTIONS")
+	router.HandleFunc("/templates/{id}", server.DeleteTemplate).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/templates/{id}/diff", server.GetTemplateDiff).Methods("GET", "OPTIONS")
+	router.HandleFunc("/factions", server.CreateFactionHandler).Methods("POST", "OPTIONS")
+	router.HandleFunc("/factions/{name}", server.GetFactionHandler).Methods("GET", "OPTIONS")
+	router.HandleFunc("/factions/{name}/stats", server.GetFactionStats).Methods("GET", "OPTIONS")
+	router.HandleFunc("/leaderboard", server.GetLeaderboard).Methods("GET", "OPTIONS")
+	router.HandleFunc("/events", server.StreamEvents).Methods("GET", "OPTIONS")
+	router.HandleFunc("/schedule", server.GetSchedule).Methods("GET", "OPTIONS")
+	router.HandleFunc("/admin/schedule", server.PutSchedule).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/admin/phase", server.OverridePhase).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/admin/bans", server.GetBans).Methods("GET", "OPTIONS")
+	router.HandleFunc("/admin/bans", server.BanUser).Methods("POST", "OPTIONS")
+	router.HandleFunc("/admin/bans/{username}", server.UnbanUser).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/locks", server.GetLocks).Methods("GET", "OPTIONS")
+	router.HandleFunc("/admin/locks", server.LockRegion).Methods("POST", "OPTIONS")
+	router.HandleFunc("/admin/locks/{id}", server.UnlockRegion).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/factions/{name}/join", server.JoinFactionHandler).Methods("POST", "OPTIONS")
+	router.HandleFunc("/factions/{name}/leave", server.LeaveFactionHandler).Methods("POST", "OPTIONS")
+	router.HandleFunc("/factions/{name}/members/{username}", server.RemoveFactionMember).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/factions/{name}/owner", server.TransferFactionHandler).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/factions/{name}", server.DisbandFactionHandler).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/canvas", server.GetCanvasHandler).Methods("GET", "OPTIONS")
+	router.HandleFunc("/admin/canvas", server.ResizeCanvas).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/admin/cache", server.GetCacheKeys).Methods("GET", "OPTIONS")
+	router.HandleFunc("/admin/import", server.ImportImage).Methods("POST", "OPTIONS")
+	router.HandleFunc("/admin/import/{id}", server.GetImport).Methods("GET", "OPTIONS")
+	router.HandleFunc("/admin/cache/{key:.+}", server.GetCacheEntry).Methods("GET", "OPTIONS")
+	router.HandleFunc("/admin/suspicions", server.GetSuspicions).Methods("GET", "OPTIONS")
+	router.HandleFunc("/admin/suspicions/{username}", server.GetSuspicion).Methods("GET", "OPTIONS")
+	router.HandleFunc("/admin/suspicions/{username}", server.ClearSuspicion).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/admin/detection", server.GetDetection).Methods("GET", "OPTIONS")
+	router.HandleFunc("/admin/detection", server.PutDetection).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/admin/challenge", server.GetChallengeConfig).Methods("GET", "OPTIONS")
+	router.HandleFunc("/admin/challenge", server.PutChallengeConfig).Methods("PUT", "OPTIONS")
 	router.HandleFunc("/updatePixel", server.UpdatePixel).Methods("POST", "OPTIONS")
 
+	return server
 }
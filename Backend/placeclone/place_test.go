@@ -0,0 +1,165 @@
+package placeclone
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Jonathanpatta/rplace/internal/dynamotest"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestGetPixelsSnapshot(t *testing.T) {
+	s := NewCanvasServer(nil, nil, nil, "test")
+	s.ChangeLog.Reset(0)
+
+	for i, p := range []*Pixel{
+		{Row: 1, Col: 2, Color: "#ff0000", Version: 1, Seq: 1},
+		{Row: 0, Col: 5, Color: "#00ff00", Version: 1, Seq: 2},
+		// Seq 3 has not arrived, so the snapshot is only good up to 2 even
+		// though it holds pixel 4.
+		{Row: 7, Col: 7, Color: "#0000ff", Version: 1, Seq: 4},
+	} {
+		if !s.ApplyPixel(p) {
+			t.Fatalf("pixel %d was not applied", i)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.GetPixels(rec, httptest.NewRequest("GET", "/api/pixels", nil))
+	if seq := rec.Header().Get("X-Canvas-Seq"); seq != "2" {
+		t.Fatalf("got seq %s, want 2", seq)
+	}
+
+	var pixels []Pixel
+	err := json.NewDecoder(rec.Body).Decode(&pixels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pixels) != 3 || pixels[0].Row != 0 || pixels[1].Row != 1 || pixels[2].Row != 7 {
+		t.Fatalf("got %+v", pixels)
+	}
+}
+
+func newTableServer(t *testing.T) *Server {
+	t.Helper()
+	table := dynamotest.Start()
+	t.Cleanup(table.Close)
+	s := NewCanvasServer(table.Client(), nil, nil, "test")
+	s.ChangeLog.Reset(0)
+	return s
+}
+
+func TestPutPixel(t *testing.T) {
+	s := newTableServer(t)
+	ctx := context.Background()
+	version := func(v int64) *int64 { return &v }
+	pixel := func(row int, color string, at int64) *Pixel {
+		p := s.Image.NewPixel(row, 0, color, "alice")
+		p.LastModified = at
+		return p
+	}
+
+	tests := []struct {
+		name     string
+		pixel    *Pixel
+		expected *int64
+		err      error
+		version  int64
+		seq      int64
+	}{
+		{"first placement", pixel(0, "#ff0000", 100), nil, nil, 1, 1},
+		{"expected version matches", pixel(0, "#00ff00", 101), version(1), nil, 2, 2},
+		{"expected version is stale", pixel(0, "#0000ff", 102), version(1), ErrStalePixel, 2, 2},
+		{"older than the stored pixel", pixel(0, "#0000ff", 99), nil, ErrStalePixel, 2, 2},
+		{"as old as the stored pixel", pixel(0, "#0000ff", 101), nil, nil, 3, 3},
+		{"never placed expecting version 0", pixel(1, "#ff0000", 100), version(0), nil, 1, 4},
+		{"never placed expecting version 1", pixel(2, "#ff0000", 100), version(1), ErrStalePixel, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			written, _, err := s.PutPixel(ctx, test.pixel, test.expected)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got %v, want %v", err, test.err)
+			}
+			// On conflict the current pixel comes back instead.
+			if written.Version != test.version || written.Seq != test.seq {
+				t.Fatalf("got version %d seq %d, want %d %d", written.Version, written.Seq, test.version, test.seq)
+			}
+		})
+	}
+}
+
+func TestPutPixelRacing(t *testing.T) {
+	s := newTableServer(t)
+
+	// Writers racing for the counter all get a sequence number of their
+	// own, with none skipped.
+	const writers = 8
+	seqs := make(chan int64, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			written, _, err := s.PutPixel(context.Background(), s.Image.NewPixel(i, i, "#ff0000", "alice"), nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			seqs <- written.Seq
+		}(i)
+	}
+	wg.Wait()
+	close(seqs)
+
+	seen := make(map[int64]bool)
+	for seq := range seqs {
+		if seen[seq] || seq < 1 || seq > writers {
+			t.Fatalf("sequence number %d given out twice or out of range", seq)
+		}
+		seen[seq] = true
+	}
+	if len(seen) != writers {
+		t.Fatalf("got %d sequence numbers, want %d", len(seen), writers)
+	}
+}
+
+func TestPutPixels(t *testing.T) {
+	s := newTableServer(t)
+	ctx := context.Background()
+
+	newer := s.Image.NewPixel(1, 1, "#ff0000", "alice")
+	newer.LastModified = 200
+	_, _, err := s.PutPixel(ctx, newer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var batch []*Pixel
+	for i := 0; i < 3; i++ {
+		p := s.Image.NewPixel(i, i, "#00ff00", "bob")
+		p.LastModified = 100
+		batch = append(batch, p)
+	}
+	written, previous, err := s.PutPixels(ctx, batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The pixel at 1,1 is newer than the one in the batch and stays.
+	if len(written) != 2 || written[0].Row != 0 || written[1].Row != 2 {
+		t.Fatalf("got %+v", written)
+	}
+	if written[0].Seq != 2 || written[1].Seq != 3 || previous[0] != nil || previous[1] != nil {
+		t.Fatalf("got seqs %d %d and previous %v", written[0].Seq, written[1].Seq, previous)
+	}
+	seq, stored, err := s.readForPut(ctx, []*Pixel{batch[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 3 || stored[0].Color != "#ff0000" || stored[0].Version != 1 {
+		t.Fatalf("got seq %d and %+v", seq, stored[0])
+	}
+}
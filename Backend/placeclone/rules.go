@@ -0,0 +1,253 @@
+package placeclone
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type RejectionCode string
+
+const (
+	RejectOutOfBounds  RejectionCode = "out_of_bounds"
+	RejectInvalidColor RejectionCode = "invalid_color"
+	RejectClosed       RejectionCode = "canvas_closed"
+	RejectRestricted   RejectionCode = "color_restricted"
+	RejectBanned       RejectionCode = "banned"
+	RejectLocked       RejectionCode = "region_locked"
+	RejectCooldown     RejectionCode = "cooldown"
+)
+
+// Rejection explains why a placement was refused. RetryAfter is set when
+// the same placement may succeed later.
+type Rejection struct {
+	Code       RejectionCode `json:"code"`
+	Reason     string        `json:"reason"`
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (r *Rejection) Error() string {
+	return r.Reason
+}
+
+// Placement is a pixel a user asked to place, as seen by the rules.
+type Placement struct {
+	Pixel *Pixel
+	User  string
+	Time  time.Time
+}
+
+// PlacementRule decides whether a placement may be written. Rules are run in
+// order and the first rejection wins.
+type PlacementRule interface {
+	Check(ctx context.Context, p *Placement) *Rejection
+}
+
+// ReservingRule is a rule that holds something for the placements it lets
+// through, such as a cooldown slot. Release gives it back when the
+// placement is refused by a later rule or fails to be written.
+type ReservingRule interface {
+	PlacementRule
+	Release(p *Placement)
+}
+
+type PlacementRuleFunc func(ctx context.Context, p *Placement) *Rejection
+
+func (f PlacementRuleFunc) Check(ctx context.Context, p *Placement) *Rejection {
+	return f(ctx, p)
+}
+
+// RegisterRule appends a rule to the ones checked before every placement on
+// this canvas.
+func (s *Server) RegisterRule(rule PlacementRule) {
+	s.rulesMu.Lock()
+	s.rules = append(s.rules, rule)
+	s.rulesMu.Unlock()
+}
+
+func (s *Server) CheckPlacement(ctx context.Context, p *Placement) *Rejection {
+	s.rulesMu.RLock()
+	rules := s.rules
+	s.rulesMu.RUnlock()
+
+	for i, rule := range rules {
+		if rejection := rule.Check(ctx, p); rejection != nil {
+			releasePlacement(rules[:i], p)
+			return rejection
+		}
+	}
+	return nil
+}
+
+// ReleasePlacement gives back what the rules hold for a placement they let
+// through that was not written.
+func (s *Server) ReleasePlacement(p *Placement) {
+	s.rulesMu.RLock()
+	rules := s.rules
+	s.rulesMu.RUnlock()
+
+	releasePlacement(rules, p)
+}
+
+func releasePlacement(rules []PlacementRule, p *Placement) {
+	for _, rule := range rules {
+		if reserving, ok := rule.(ReservingRule); ok {
+			reserving.Release(p)
+		}
+	}
+}
+
+// RejectionStatus maps a rejection to the HTTP status it is reported with.
+// Codes added by custom rules are reported as forbidden.
+func RejectionStatus(code RejectionCode) int {
+	switch code {
+	case RejectOutOfBounds, RejectInvalidColor:
+		return http.StatusBadRequest
+	case RejectCooldown, RejectSlowdown:
+		return http.StatusTooManyRequests
+	case RejectChallenge:
+		return http.StatusPreconditionRequired
+	}
+	return http.StatusForbidden
+}
+
+func writeRejection(w http.ResponseWriter, rejection *Rejection) {
+	if rejection.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rejection.RetryAfter.Seconds()))))
+	}
+
+	writeJson(w, RejectionStatus(rejection.Code), rejection)
+}
+
+func BoundsRule(img *Image) PlacementRule {
+	return PlacementRuleFunc(func(ctx context.Context, p *Placement) *Rejection {
+		ok, err := img.IsValidPixel(p.Pixel)
+		if !ok {
+			return &Rejection{Code: RejectOutOfBounds, Reason: err.Error()}
+		}
+		return nil
+	})
+}
+
+func PaletteRule(img *Image) PlacementRule {
+	return PlacementRuleFunc(func(ctx context.Context, p *Placement) *Rejection {
+		color, err := NormalizeColor(p.Pixel.Color)
+		if err == nil {
+			for _, entry := range img.Palette {
+				if c, _ := NormalizeColor(entry); c == color {
+					return nil
+				}
+			}
+		}
+		return &Rejection{Code: RejectInvalidColor, Reason: fmt.Sprintf("%q is not in the canvas palette", p.Pixel.Color)}
+	})
+}
+
+func PhaseRule(lifecycle *Lifecycle) PlacementRule {
+	return PlacementRuleFunc(func(ctx context.Context, p *Placement) *Rejection {
+		switch lifecycle.Allows(p.Pixel.Color) {
+		case nil:
+			return nil
+		case ErrColorRestricted:
+			return &Rejection{Code: RejectRestricted, Reason: ErrColorRestricted.Error()}
+		}
+		return &Rejection{Code: RejectClosed, Reason: ErrCanvasClosed.Error()}
+	})
+}
+
+// Cooldown limits every user to one placement per Duration. It learns about
+// placements from the pixels applied to the canvas, so placements relayed
+// from other instances count as well.
+//
+// A placement that passes Check reserves the slot until it is recorded or
+// released, so concurrent requests of a user cannot all pass before the
+// first one is written.
+type Cooldown struct {
+	Duration time.Duration
+
+	mu       sync.Mutex
+	last     map[string]time.Time
+	reserved map[string]time.Time
+}
+
+func NewCooldown(duration time.Duration) *Cooldown {
+	return &Cooldown{
+		Duration: duration,
+		last:     make(map[string]time.Time),
+		reserved: make(map[string]time.Time),
+	}
+}
+
+func (c *Cooldown) Check(ctx context.Context, p *Placement) *Rejection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	since := c.last[p.User]
+	if reserved := c.reserved[p.User]; reserved.After(since) {
+		since = reserved
+	}
+	wait := since.Add(c.Duration).Sub(p.Time)
+	if wait > 0 {
+		return &Rejection{
+			Code:       RejectCooldown,
+			Reason:     fmt.Sprintf("next placement allowed in %s", wait.Round(time.Second)),
+			RetryAfter: wait,
+		}
+	}
+	c.reserved[p.User] = p.Time
+	return nil
+}
+
+// Release frees the slot reserved for a placement that was not written.
+func (c *Cooldown) Release(p *Placement) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if reserved, ok := c.reserved[p.User]; ok && reserved.Equal(p.Time) {
+		delete(c.reserved, p.User)
+	}
+}
+
+// Record notes a placement. Older placements than the one held are ignored.
+func (c *Cooldown) Record(p *Pixel) {
+	if p.Author == "" {
+		return
+	}
+	placed := time.Unix(p.LastModified, 0)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if placed.After(c.last[p.Author]) {
+		c.last[p.Author] = placed
+	}
+	if reserved, ok := c.reserved[p.Author]; ok && !reserved.After(placed) {
+		delete(c.reserved, p.Author)
+	}
+}
+
+// Last is when user last placed a pixel, zero if never.
+func (c *Cooldown) Last(user string) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last[user]
+}
+
+// Remaining is how long user still has to wait before placing again.
+func (c *Cooldown) Remaining(user string, now time.Time) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	since := c.last[user]
+	if reserved := c.reserved[user]; reserved.After(since) {
+		since = reserved
+	}
+	wait := since.Add(c.Duration).Sub(now)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
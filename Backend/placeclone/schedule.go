@@ -0,0 +1,376 @@
+package placeclone
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Jonathanpatta/rplace/middleware"
+	"github.com/Jonathanpatta/rplace/webhook"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Phase string
+
+const (
+	PhasePending    Phase = "pending"
+	PhaseOpen       Phase = "open"
+	PhaseRestricted Phase = "restricted"
+	PhaseArchived   Phase = "archived"
+)
+
+var (
+	ErrCanvasClosed    = errors.New("canvas is not open for placements")
+	ErrColorRestricted = errors.New("color is not allowed in the current phase")
+)
+
+func (p Phase) Valid() bool {
+	switch p {
+	case PhasePending, PhaseOpen, PhaseRestricted, PhaseArchived:
+		return true
+	}
+	return false
+}
+
+// Schedule describes when a canvas moves between phases. Times are unix
+// seconds and a zero time means the phase is not scheduled. Override pins
+// the canvas to a phase regardless of the times until it is cleared.
+// UpdatedAt is when an admin last changed it.
+type Schedule struct {
+	OpensAt          int64    `json:"opens_at,omitempty" dynamodbav:"opens_at"`
+	RestrictedAt     int64    `json:"restricted_at,omitempty" dynamodbav:"restricted_at"`
+	ArchivedAt       int64    `json:"archived_at,omitempty" dynamodbav:"archived_at"`
+	RestrictedColors []string `json:"restricted_colors,omitempty" dynamodbav:"restricted_colors"`
+	Override         Phase    `json:"override,omitempty"`
+	UpdatedAt        int64    `json:"updated_at,omitempty" dynamodbav:"updated_at"`
+}
+
+func (sc Schedule) PhaseAt(t time.Time) Phase {
+	now := t.Unix()
+	switch {
+	case sc.Override != "":
+		return sc.Override
+	case sc.ArchivedAt != 0 && now >= sc.ArchivedAt:
+		return PhaseArchived
+	case sc.RestrictedAt != 0 && now >= sc.RestrictedAt:
+		return PhaseRestricted
+	case sc.OpensAt != 0 && now < sc.OpensAt:
+		return PhasePending
+	}
+	return PhaseOpen
+}
+
+// Validate checks that the scheduled phases follow each other without
+// overlapping and that the restricted colors are in palette. A canvas that
+// can become restricted needs at least one color to be restricted to,
+// since none would leave nothing to place.
+func (sc Schedule) Validate(palette []string) error {
+	restricted := sc.Override == PhaseRestricted || (sc.Override == "" && sc.RestrictedAt != 0)
+	if restricted && len(sc.RestrictedColors) == 0 {
+		return errors.New("restricted_colors must name at least one color when the canvas can be restricted")
+	}
+
+	times := []struct {
+		name string
+		at   int64
+	}{
+		{"opens_at", sc.OpensAt},
+		{"restricted_at", sc.RestrictedAt},
+		{"archived_at", sc.ArchivedAt},
+	}
+	var previous string
+	var last int64
+	for _, t := range times {
+		if t.at == 0 {
+			continue
+		}
+		if t.at < 0 {
+			return fmt.Errorf("%s must be a unix time", t.name)
+		}
+		if previous != "" && t.at <= last {
+			return fmt.Errorf("%s must come after %s", t.name, previous)
+		}
+		previous, last = t.name, t.at
+	}
+
+	for _, color := range sc.RestrictedColors {
+		normalized, err := NormalizeColor(color)
+		if err != nil {
+			return fmt.Errorf("invalid restricted color %q", color)
+		}
+		found := false
+		for _, entry := range palette {
+			if c, _ := NormalizeColor(entry); c == normalized {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("restricted color %q is not in the canvas palette", color)
+		}
+	}
+	return nil
+}
+
+type PhaseChange struct {
+	Phase            Phase    `json:"phase"`
+	Previous         Phase    `json:"previous,omitempty"`
+	RestrictedColors []string `json:"restricted_colors,omitempty"`
+	ChangedAt        int64    `json:"changed_at"`
+}
+
+// Lifecycle tracks the phase of a canvas from its schedule and reports every
+// change.
+type Lifecycle struct {
+	mu       sync.RWMutex
+	schedule Schedule
+	phase    Phase
+	onChange func(PhaseChange)
+}
+
+func NewLifecycle(onChange func(PhaseChange)) *Lifecycle {
+	return &Lifecycle{
+		phase:    PhaseOpen,
+		onChange: onChange,
+	}
+}
+
+func (l *Lifecycle) Schedule() Schedule {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.schedule
+}
+
+func (l *Lifecycle) Phase() Phase {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.phase
+}
+
+func (l *Lifecycle) SetSchedule(sc Schedule) {
+	l.mu.Lock()
+	l.schedule = sc
+	l.mu.Unlock()
+	l.Tick(time.Now())
+}
+
+// Tick moves the canvas to the phase its schedule calls for at t.
+func (l *Lifecycle) Tick(t time.Time) {
+	l.mu.Lock()
+	phase := l.schedule.PhaseAt(t)
+	if phase == l.phase {
+		l.mu.Unlock()
+		return
+	}
+	change := PhaseChange{
+		Phase:     phase,
+		Previous:  l.phase,
+		ChangedAt: t.Unix(),
+	}
+	if phase == PhaseRestricted {
+		change.RestrictedColors = l.schedule.RestrictedColors
+	}
+	l.phase = phase
+	l.mu.Unlock()
+
+	if l.onChange != nil {
+		l.onChange(change)
+	}
+}
+
+// Allows reports whether a pixel of the given color may be placed now.
+func (l *Lifecycle) Allows(color string) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	switch l.phase {
+	case PhaseOpen:
+		return nil
+	case PhaseRestricted:
+		normalized, err := NormalizeColor(color)
+		if err != nil {
+			return ErrColorRestricted
+		}
+		for _, allowed := range l.schedule.RestrictedColors {
+			if c, err := NormalizeColor(allowed); err == nil && c == normalized {
+				return nil
+			}
+		}
+		return ErrColorRestricted
+	}
+	return ErrCanvasClosed
+}
+
+func (s *Server) SaveSchedule(ctx context.Context, sc Schedule) error {
+	item, err := attributevalue.MarshalMap(sc)
+	if err != nil {
+		return err
+	}
+	item["PK"] = &types.AttributeValueMemberS{Value: "CANVAS#" + s.Image.Name}
+	item["SK"] = &types.AttributeValueMemberS{Value: "SCHEDULE"}
+
+	_, err = s.DbCli.PutItem(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: s.TableName,
+	})
+	return err
+}
+
+func (s *Server) LoadSchedule(ctx context.Context) error {
+	out, err := s.DbCli.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: s.TableName,
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: "CANVAS#" + s.Image.Name},
+			"SK": &types.AttributeValueMemberS{Value: "SCHEDULE"},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	var sc Schedule
+	err = attributevalue.UnmarshalMap(out.Item, &sc)
+	if err != nil {
+		return err
+	}
+
+	s.Lifecycle.SetSchedule(sc)
+	return nil
+}
+
+// RunSchedule switches phases at their configured times. The schedule is
+// re-read every so often so that changes made through another instance are
+// picked up.
+func (s *Server) RunSchedule(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	reload := time.NewTicker(30 * time.Second)
+	defer reload.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.Lifecycle.Tick(now)
+		case <-reload.C:
+			err := s.LoadSchedule(ctx)
+			if err != nil {
+				log.Printf("could not reload schedule of %s: %s", s.Image.Name, err.Error())
+			}
+		}
+	}
+}
+
+type ScheduleResponse struct {
+	Phase    Phase    `json:"phase"`
+	Schedule Schedule `json:"schedule"`
+}
+
+func (s *Server) GetSchedule(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, ScheduleResponse{
+		Phase:    s.Lifecycle.Phase(),
+		Schedule: s.Lifecycle.Schedule(),
+	})
+}
+
+func (s *Server) PutSchedule(w http.ResponseWriter, r *http.Request) {
+	if !middleware.IsAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return
+	}
+
+	var sc Schedule
+	err := json.NewDecoder(r.Body).Decode(&sc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if sc.Override != "" && !sc.Override.Valid() {
+		http.Error(w, "unknown phase "+strconv.Quote(string(sc.Override)), http.StatusBadRequest)
+		return
+	}
+	err = sc.Validate(s.Image.Palette)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sc.UpdatedAt = time.Now().Unix()
+
+	err = s.SaveSchedule(r.Context(), sc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.Lifecycle.SetSchedule(sc)
+	s.announce(controlReload, reloadSchedule)
+
+	s.GetSchedule(w, r)
+}
+
+type PhaseOverrideRequest struct {
+	Phase Phase `json:"phase"`
+}
+
+// OverridePhase pins the canvas to a phase. An empty phase hands control
+// back to the schedule.
+func (s *Server) OverridePhase(w http.ResponseWriter, r *http.Request) {
+	if !middleware.IsAdmin(r) {
+		http.Error(w, "admin only", http.StatusForbidden)
+		return
+	}
+
+	var req PhaseOverrideRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Phase != "" && !req.Phase.Valid() {
+		http.Error(w, "unknown phase "+strconv.Quote(string(req.Phase)), http.StatusBadRequest)
+		return
+	}
+
+	sc := s.Lifecycle.Schedule()
+	sc.Override = req.Phase
+	err = sc.Validate(s.Image.Palette)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sc.UpdatedAt = time.Now().Unix()
+	err = s.SaveSchedule(r.Context(), sc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.Lifecycle.SetSchedule(sc)
+	s.announce(controlReload, reloadSchedule)
+
+	s.GetSchedule(w, r)
+}
+
+// publishPhase tells the clients of this instance about a phase change.
+// Every instance changes phase on its own, so the webhook goes out from the
+// first one to claim the phase under the current schedule.
+func (s *Server) publishPhase(change PhaseChange) {
+	s.Events.Publish(Event{Type: EventPhase, Phase: &change})
+
+	sc := s.Lifecycle.Schedule()
+	key := fmt.Sprintf("%s#%d#%s", s.Image.Name, sc.UpdatedAt, change.Phase)
+	s.pending.Add(1)
+	go func() {
+		defer s.pending.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Webhooks.PublishOnce(ctx, key, webhook.EventPhaseChanged, change)
+	}()
+}
@@ -0,0 +1,31 @@
+package placeclone
+
+import (
+	"testing"
+)
+
+func TestScheduleValidate(t *testing.T) {
+	palette := []string{"#ff0000", "#00ff00"}
+	tests := []struct {
+		name     string
+		schedule Schedule
+		ok       bool
+	}{
+		{"empty", Schedule{}, true},
+		{"in order", Schedule{OpensAt: 10, RestrictedAt: 20, ArchivedAt: 30, RestrictedColors: []string{"#ff0000"}}, true},
+		{"out of order", Schedule{OpensAt: 20, ArchivedAt: 10}, false},
+		{"restricted without colors", Schedule{RestrictedAt: 20}, false},
+		{"restricted override without colors", Schedule{Override: PhaseRestricted}, false},
+		{"restricted override with colors", Schedule{Override: PhaseRestricted, RestrictedColors: []string{"#00FF00"}}, true},
+		{"restricted time overridden", Schedule{RestrictedAt: 20, Override: PhaseOpen}, true},
+		{"color outside the palette", Schedule{RestrictedAt: 20, RestrictedColors: []string{"#0000ff"}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.schedule.Validate(palette)
+			if (err == nil) != test.ok {
+				t.Fatalf("got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,437 @@
+package placeclone
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Jonathanpatta/rplace/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxTemplateSize bounds the PNG of a template, which is stored in a single
+// item and DynamoDB caps items at 400 KB.
+const maxTemplateSize = 350 << 10
+
+var ErrTemplateTooLarge = errors.New("the template is larger than the canvas")
+
+// Template is an overlay a community wants painted on the canvas, anchored
+// with its top left corner at Row, Col. Colors holds the template quantized
+// to the canvas palette in row major order; transparent pixels are empty
+// and do not take part in the diff.
+type Template struct {
+	Id        string   `json:"id"`
+	Name      string   `json:"name,omitempty"`
+	Owner     string   `json:"owner,omitempty"`
+	Row       int      `json:"row"`
+	Col       int      `json:"col"`
+	Width     int      `json:"width"`
+	Height    int      `json:"height"`
+	CreatedAt int64    `json:"created_at,omitempty" dynamodbav:"created_at"`
+	Colors    []string `json:"-" dynamodbav:"-"`
+	Png       []byte   `json:"-"`
+
+	mu         sync.RWMutex
+	mismatched map[int]bool
+	total      int
+}
+
+type TemplatePixel struct {
+	Row      int    `json:"row"`
+	Col      int    `json:"col"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+type TemplateDiff struct {
+	Id         string          `json:"id"`
+	Total      int             `json:"total"`
+	Correct    int             `json:"correct"`
+	Completion float64         `json:"completion"`
+	Pixels     []TemplatePixel `json:"pixels"`
+}
+
+// decodeTemplate decodes a PNG of at most rows by cols pixels. The size is
+// read from the header first, so an image claiming to be huge is refused
+// before anything is allocated for it.
+func decodeTemplate(data []byte, rows int, cols int) (image.Image, error) {
+	config, err := png.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width > cols || config.Height > rows {
+		return nil, ErrTemplateTooLarge
+	}
+	return png.Decode(bytes.NewReader(data))
+}
+
+// NewTemplate decodes a PNG no larger than the canvas and quantizes it to
+// the canvas palette.
+func NewTemplate(img *Image, name string, owner string, row int, col int, data []byte) (*Template, error) {
+	rows, cols := img.Size()
+	decoded, err := decodeTemplate(data, rows, cols)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := decoded.Bounds()
+	t := &Template{
+		Id:        uuid.New().String(),
+		Name:      name,
+		Owner:     owner,
+		Row:       row,
+		Col:       col,
+		Width:     bounds.Dx(),
+		Height:    bounds.Dy(),
+		CreatedAt: time.Now().Unix(),
+		Png:       data,
+	}
+	t.quantize(img, decoded)
+
+	return t, nil
+}
+
+func (t *Template) quantize(img *Image, decoded image.Image) {
+	bounds := decoded.Bounds()
+	t.Colors = make([]string, t.Width*t.Height)
+	for y := 0; y < t.Height; y++ {
+		for x := 0; x < t.Width; x++ {
+			c := decoded.At(bounds.Min.X+x, bounds.Min.Y+y)
+			if _, _, _, a := c.RGBA(); a < 0x8000 {
+				continue
+			}
+			t.Colors[y*t.Width+x] = Quantize(img.Palette, c)
+		}
+	}
+}
+
+// Refresh recomputes the mismatched pixels from the whole canvas.
+func (t *Template) Refresh(img *Image) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.mismatched = make(map[int]bool)
+	t.total = 0
+	for idx, expected := range t.Colors {
+		row, col := t.Row+idx/t.Width, t.Col+idx%t.Width
+		if expected == "" || !img.WithinBounds(&Pixel{Row: row, Col: col}) {
+			continue
+		}
+		t.total++
+		if FormatColor(pixelColor(img.GetPixel(row, col))) != expected {
+			t.mismatched[idx] = true
+		}
+	}
+}
+
+// Update re-checks a single changed pixel.
+func (t *Template) Update(p *Pixel) {
+	row, col := p.Row-t.Row, p.Col-t.Col
+	if row < 0 || col < 0 || row >= t.Height || col >= t.Width {
+		return
+	}
+
+	idx := row*t.Width + col
+	expected := t.Colors[idx]
+	if expected == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if FormatColor(pixelColor(p)) != expected {
+		t.mismatched[idx] = true
+	} else {
+		delete(t.mismatched, idx)
+	}
+}
+
+// Expected is the color the template wants at a canvas position, empty when
+// the position is outside the template or transparent in it.
+func (t *Template) Expected(row int, col int) string {
+	row, col = row-t.Row, col-t.Col
+	if row < 0 || col < 0 || row >= t.Height || col >= t.Width {
+		return ""
+	}
+	return t.Colors[row*t.Width+col]
+}
+
+func (t *Template) Diff(img *Image) TemplateDiff {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	diff := TemplateDiff{
+		Id:      t.Id,
+		Total:   t.total,
+		Correct: t.total - len(t.mismatched),
+		Pixels:  make([]TemplatePixel, 0, len(t.mismatched)),
+	}
+	if t.total > 0 {
+		diff.Completion = float64(diff.Correct) * 100 / float64(t.total)
+	}
+	for idx := range t.mismatched {
+		row, col := t.Row+idx/t.Width, t.Col+idx%t.Width
+		diff.Pixels = append(diff.Pixels, TemplatePixel{
+			Row:      row,
+			Col:      col,
+			Expected: t.Colors[idx],
+			Actual:   FormatColor(pixelColor(img.GetPixel(row, col))),
+		})
+	}
+
+	return diff
+}
+
+// Templates holds the templates of one canvas and keeps their diffs current
+// as pixels change.
+type Templates struct {
+	Image *Image
+
+	mu        sync.RWMutex
+	templates map[string]*Template
+}
+
+func NewTemplates(img *Image) *Templates {
+	return &Templates{
+		Image:     img,
+		templates: make(map[string]*Template),
+	}
+}
+
+func (ts *Templates) Add(t *Template) {
+	t.Refresh(ts.Image)
+
+	ts.mu.Lock()
+	ts.templates[t.Id] = t
+	ts.mu.Unlock()
+}
+
+func (ts *Templates) Get(id string) (*Template, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	t, ok := ts.templates[id]
+	return t, ok
+}
+
+func (ts *Templates) Remove(id string) {
+	ts.mu.Lock()
+	delete(ts.templates, id)
+	ts.mu.Unlock()
+}
+
+func (ts *Templates) List() []*Template {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	templates := make([]*Template, 0, len(ts.templates))
+	for _, t := range ts.templates {
+		templates = append(templates, t)
+	}
+	return templates
+}
+
+func (ts *Templates) Update(p *Pixel) {
+	for _, t := range ts.List() {
+		t.Update(p)
+	}
+}
+
+// Follows reports whether a pixel matches what one of the templates wants
+// at its position, and which template that is.
+func (ts *Templates) Follows(p *Pixel) (string, bool) {
+	color := FormatColor(pixelColor(p))
+	for _, t := range ts.List() {
+		if expected := t.Expected(p.Row, p.Col); expected != "" && expected == color {
+			return t.Id, true
+		}
+	}
+	return "", false
+}
+
+func (ts *Templates) RefreshAll() {
+	for _, t := range ts.List() {
+		t.Refresh(ts.Image)
+	}
+}
+
+func (s *Server) PutTemplate(ctx context.Context, t *Template) error {
+	_, err := s.DbCli.PutItem(ctx, &dynamodb.PutItemInput{
+		Item: map[string]types.AttributeValue{
+			"PK":         &types.AttributeValueMemberS{Value: "TEMPLATE#" + s.Image.Name},
+			"SK":         &types.AttributeValueMemberS{Value: t.Id},
+			"id":         &types.AttributeValueMemberS{Value: t.Id},
+			"name":       &types.AttributeValueMemberS{Value: t.Name},
+			"owner":      &types.AttributeValueMemberS{Value: t.Owner},
+			"row":        &types.AttributeValueMemberN{Value: strconv.Itoa(t.Row)},
+			"col":        &types.AttributeValueMemberN{Value: strconv.Itoa(t.Col)},
+			"width":      &types.AttributeValueMemberN{Value: strconv.Itoa(t.Width)},
+			"height":     &types.AttributeValueMemberN{Value: strconv.Itoa(t.Height)},
+			"created_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(t.CreatedAt, 10)},
+			"png":        &types.AttributeValueMemberB{Value: t.Png},
+		},
+		TableName: s.TableName,
+	})
+	return err
+}
+
+// LoadTemplates brings the templates in line with the table: new ones are
+// added and deleted ones removed. Templates never change once created, so
+// the ones already held are kept as they are.
+func (s *Server) LoadTemplates(ctx context.Context) error {
+	started := time.Now().Unix()
+	stored := make(map[string]bool)
+	paginator := dynamodb.NewQueryPaginator(s.DbCli, &dynamodb.QueryInput{
+		TableName:              s.TableName,
+		KeyConditionExpression: aws.String("#PK = :name"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":name": &types.AttributeValueMemberS{Value: "TEMPLATE#" + s.Image.Name},
+		},
+		ExpressionAttributeNames: map[string]string{
+			"#PK": "PK",
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		var templates []*Template
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &templates)
+		if err != nil {
+			return err
+		}
+		for _, t := range templates {
+			stored[t.Id] = true
+			if _, ok := s.Templates.Get(t.Id); ok {
+				continue
+			}
+			decoded, err := decodeTemplate(t.Png, MaxCanvasSize, MaxCanvasSize)
+			if err != nil {
+				return fmt.Errorf("template %s: %w", t.Id, err)
+			}
+			t.quantize(s.Image, decoded)
+			s.Templates.Add(t)
+		}
+	}
+
+	// Templates created while the table was read are not in it yet.
+	for _, t := range s.Templates.List() {
+		if !stored[t.Id] && t.CreatedAt < started {
+			s.Templates.Remove(t.Id)
+		}
+	}
+	return nil
+}
+
+func (s *Server) CreateTemplate(w http.ResponseWriter, r *http.Request) {
+	owner, _, ok := middleware.Identity(r)
+	if !ok {
+		http.Error(w, "unknown user", http.StatusUnauthorized)
+		return
+	}
+
+	err := r.ParseMultipartForm(maxTemplateSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	row, errRow := strconv.Atoi(r.FormValue("row"))
+	col, errCol := strconv.Atoi(r.FormValue("col"))
+	if errRow != nil || errCol != nil {
+		http.Error(w, "row and col must be numbers", http.StatusBadRequest)
+		return
+	}
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxTemplateSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxTemplateSize {
+		http.Error(w, fmt.Sprintf("template images are limited to %d KB", maxTemplateSize>>10), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	template, err := NewTemplate(s.Image, r.FormValue("name"), owner, row, col, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.PutTemplate(r.Context(), template)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.Templates.Add(template)
+	s.announce(controlReload, reloadTemplates)
+
+	writeJson(w, http.StatusCreated, template)
+}
+
+func (s *Server) GetTemplates(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, s.Templates.List())
+}
+
+func (s *Server) GetTemplateDiff(w http.ResponseWriter, r *http.Request) {
+	template, ok := s.Templates.Get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "template not found", http.StatusNotFound)
+		return
+	}
+
+	writeJson(w, http.StatusOK, template.Diff(s.Image))
+}
+
+func (s *Server) DeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	owner, _, ok := middleware.Identity(r)
+	if !ok {
+		http.Error(w, "unknown user", http.StatusUnauthorized)
+		return
+	}
+
+	template, ok := s.Templates.Get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "template not found", http.StatusNotFound)
+		return
+	}
+	if template.Owner != owner {
+		http.Error(w, "only the owner can delete a template", http.StatusForbidden)
+		return
+	}
+
+	_, err := s.DbCli.DeleteItem(r.Context(), &dynamodb.DeleteItemInput{
+		TableName: s.TableName,
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: "TEMPLATE#" + s.Image.Name},
+			"SK": &types.AttributeValueMemberS{Value: template.Id},
+		},
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.Templates.Remove(template.Id)
+	s.announce(controlReload, reloadTemplates)
+
+	w.WriteHeader(http.StatusNoContent)
+}
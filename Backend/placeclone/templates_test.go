@@ -0,0 +1,50 @@
+package placeclone
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func encodePNG(t *testing.T, width int, height int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	img.Set(0, 0, color.NRGBA{R: 0xff, A: 0xff})
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestNewTemplateSize(t *testing.T) {
+	img := NewImage("test", 8, 6)
+
+	tests := []struct {
+		name          string
+		width, height int
+		err           error
+	}{
+		{"fits", 6, 8, nil},
+		{"too wide", 7, 2, ErrTemplateTooLarge},
+		{"too high", 2, 9, ErrTemplateTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			template, err := NewTemplate(img, "", "alice", 0, 0, encodePNG(t, test.width, test.height))
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got %v, want %v", err, test.err)
+			}
+			if err == nil && len(template.Colors) != test.width*test.height {
+				t.Fatalf("got %d colors", len(template.Colors))
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package placeclone
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"image"
+	"image/png"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const TileSize = 256
+
+type TileFormat string
+
+const (
+	TileFormatPNG    TileFormat = "png"
+	TileFormatBinary TileFormat = "bin"
+)
+
+type TileKey struct {
+	Z      int
+	X      int
+	Y      int
+	Format TileFormat
+}
+
+type Tile struct {
+	Data []byte
+	ETag string
+}
+
+// TileCache serves a map style pyramid of an Image. The highest zoom level
+// draws one canvas pixel per tile pixel and every level below halves the
+// resolution, down to zoom 0 where a single tile covers the whole canvas.
+// Rendered tiles are kept until a pixel inside them changes.
+type TileCache struct {
+	Image *Image
+
+	mu    sync.Mutex
+	tiles map[TileKey]*Tile
+	gen   uint64
+}
+
+func NewTileCache(img *Image) *TileCache {
+	return &TileCache{
+		Image: img,
+		tiles: make(map[TileKey]*Tile),
+	}
+}
+
+func (t *TileCache) MaxZoom() int {
+	size, cols := t.Image.Size()
+	if cols > size {
+		size = cols
+	}
+
+	zoom := 0
+	for TileSize<<zoom < size {
+		zoom++
+	}
+	return zoom
+}
+
+// scale is the number of canvas pixels along one side of a tile pixel.
+func (t *TileCache) scale(z int) int {
+	return 1 << (t.MaxZoom() - z)
+}
+
+func (t *TileCache) validTile(z int, x int, y int) bool {
+	if z < 0 || z > t.MaxZoom() || x < 0 || y < 0 {
+		return false
+	}
+	span := TileSize * t.scale(z)
+	rows, cols := t.Image.Size()
+	return x*span < cols && y*span < rows
+}
+
+func (t *TileCache) Get(key TileKey) (*Tile, error) {
+	if !t.validTile(key.Z, key.X, key.Y) {
+		return nil, errors.New("tile out of bounds")
+	}
+
+	t.mu.Lock()
+	tile, ok := t.tiles[key]
+	gen := t.gen
+	t.mu.Unlock()
+	if ok {
+		return tile, nil
+	}
+
+	tile, err := t.render(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// A pixel may have changed while rendering, in which case the tile is
+	// served once but not kept.
+	t.mu.Lock()
+	if gen == t.gen {
+		t.tiles[key] = tile
+	}
+	t.mu.Unlock()
+	return tile, nil
+}
+
+// Invalidate drops the tile holding the pixel at every zoom level.
+func (t *TileCache) Invalidate(p *Pixel) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.gen++
+	for z := 0; z <= t.MaxZoom(); z++ {
+		span := TileSize * t.scale(z)
+		for _, format := range []TileFormat{TileFormatPNG, TileFormatBinary} {
+			delete(t.tiles, TileKey{Z: z, X: p.Col / span, Y: p.Row / span, Format: format})
+		}
+	}
+}
+
+func (t *TileCache) Clear() {
+	t.mu.Lock()
+	t.tiles = make(map[TileKey]*Tile)
+	t.gen++
+	t.mu.Unlock()
+}
+
+func (t *TileCache) render(key TileKey) (*Tile, error) {
+	img := t.Draw(key.Z, key.X, key.Y)
+
+	var data []byte
+	switch key.Format {
+	case TileFormatPNG:
+		buf := new(bytes.Buffer)
+		err := png.Encode(buf, img)
+		if err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	case TileFormatBinary:
+		data = img.Pix
+	default:
+		return nil, fmt.Errorf("unknown tile format %q", key.Format)
+	}
+
+	sum := sha1.Sum(data)
+	return &Tile{
+		Data: data,
+		ETag: `"` + hex.EncodeToString(sum[:]) + `"`,
+	}, nil
+}
+
+// Draw renders one tile as RGBA, averaging the canvas pixels each tile pixel
+// covers. Tile pixels past the edge of the canvas stay transparent.
+func (t *TileCache) Draw(z int, x int, y int) *image.RGBA {
+	scale := t.scale(z)
+	originRow := y * TileSize * scale
+	originCol := x * TileSize * scale
+	img := image.NewRGBA(image.Rect(0, 0, TileSize, TileSize))
+
+	t.Image.mu.RLock()
+	defer t.Image.mu.RUnlock()
+
+	for ty := 0; ty < TileSize; ty++ {
+		for tx := 0; tx < TileSize; tx++ {
+			var r, g, b, n int
+			for row := originRow + ty*scale; row < originRow+(ty+1)*scale && row < t.Image.Rows; row++ {
+				for col := originCol + tx*scale; col < originCol+(tx+1)*scale && col < t.Image.Cols; col++ {
+					c := pixelColor(t.Image.Pixels[t.Image.index(row, col)])
+					r += int(c.R)
+					g += int(c.G)
+					b += int(c.B)
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+
+			offset := img.PixOffset(tx, ty)
+			img.Pix[offset] = uint8(r / n)
+			img.Pix[offset+1] = uint8(g / n)
+			img.Pix[offset+2] = uint8(b / n)
+			img.Pix[offset+3] = 255
+		}
+	}
+
+	return img
+}
+
+func (s *Server) GetTile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	z, errZ := strconv.Atoi(vars["z"])
+	x, errX := strconv.Atoi(vars["x"])
+	y, errY := strconv.Atoi(vars["y"])
+	if errZ != nil || errX != nil || errY != nil {
+		http.Error(w, "invalid tile coordinates", http.StatusBadRequest)
+		return
+	}
+
+	key := TileKey{Z: z, X: x, Y: y, Format: TileFormat(vars["format"])}
+	tile, err := s.Tiles.Get(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("ETag", tile.ETag)
+	// A tile is the same for everyone who may see the canvas, so CDNs and
+	// other shared caches may keep it even though it is served behind
+	// authentication. They revalidate with the ETag on every request,
+	// which is cheap next to rendering or sending the tile again.
+	w.Header().Set("Cache-Control", "public, no-cache")
+	if r.Header.Get("If-None-Match") == tile.ETag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if key.Format == TileFormatPNG {
+		w.Header().Set("Content-Type", "image/png")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(tile.Data)))
+	w.Write(tile.Data)
+}
@@ -0,0 +1,4 @@
+// Package placepb holds the gRPC definitions of the canvas API.
+package placepb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative place.proto
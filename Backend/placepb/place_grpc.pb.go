@@ -0,0 +1,263 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             v3.19.4
+// source: place.proto
+
+package placepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// PlaceClient is the client API for Place service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type PlaceClient interface {
+	// PlacePixel runs the same placement rules as /updatePixel. Refusals come
+	// back as INVALID_ARGUMENT, PERMISSION_DENIED or RESOURCE_EXHAUSTED with
+	// an ErrorInfo detail carrying the rejection code, and a RetryInfo detail
+	// when the placement may succeed later. A stale expected_version gives
+	// ABORTED.
+	PlacePixel(ctx context.Context, in *PlacePixelRequest, opts ...grpc.CallOption) (*PlacePixelResponse, error)
+	// GetCanvas describes the canvas without its pixels, which are read with
+	// GetRegion.
+	GetCanvas(ctx context.Context, in *GetCanvasRequest, opts ...grpc.CallOption) (*Canvas, error)
+	// GetRegion reads the pixels of at most 16384 (128 * 128) cells at a
+	// time. Larger regions give INVALID_ARGUMENT.
+	GetRegion(ctx context.Context, in *GetRegionRequest, opts ...grpc.CallOption) (*Region, error)
+	// Subscribe streams the pixels placed from now on, optionally limited to
+	// a region.
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Place_SubscribeClient, error)
+}
+
+type placeClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPlaceClient(cc grpc.ClientConnInterface) PlaceClient {
+	return &placeClient{cc}
+}
+
+func (c *placeClient) PlacePixel(ctx context.Context, in *PlacePixelRequest, opts ...grpc.CallOption) (*PlacePixelResponse, error) {
+	out := new(PlacePixelResponse)
+	err := c.cc.Invoke(ctx, "/rplace.place.v1.Place/PlacePixel", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *placeClient) GetCanvas(ctx context.Context, in *GetCanvasRequest, opts ...grpc.CallOption) (*Canvas, error) {
+	out := new(Canvas)
+	err := c.cc.Invoke(ctx, "/rplace.place.v1.Place/GetCanvas", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *placeClient) GetRegion(ctx context.Context, in *GetRegionRequest, opts ...grpc.CallOption) (*Region, error) {
+	out := new(Region)
+	err := c.cc.Invoke(ctx, "/rplace.place.v1.Place/GetRegion", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *placeClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Place_SubscribeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Place_ServiceDesc.Streams[0], "/rplace.place.v1.Place/Subscribe", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &placeSubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Place_SubscribeClient interface {
+	Recv() (*PixelEvent, error)
+	grpc.ClientStream
+}
+
+type placeSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *placeSubscribeClient) Recv() (*PixelEvent, error) {
+	m := new(PixelEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// PlaceServer is the server API for Place service.
+// All implementations must embed UnimplementedPlaceServer
+// for forward compatibility
+type PlaceServer interface {
+	// PlacePixel runs the same placement rules as /updatePixel. Refusals come
+	// back as INVALID_ARGUMENT, PERMISSION_DENIED or RESOURCE_EXHAUSTED with
+	// an ErrorInfo detail carrying the rejection code, and a RetryInfo detail
+	// when the placement may succeed later. A stale expected_version gives
+	// ABORTED.
+	PlacePixel(context.Context, *PlacePixelRequest) (*PlacePixelResponse, error)
+	// GetCanvas describes the canvas without its pixels, which are read with
+	// GetRegion.
+	GetCanvas(context.Context, *GetCanvasRequest) (*Canvas, error)
+	// GetRegion reads the pixels of at most 16384 (128 * 128) cells at a
+	// time. Larger regions give INVALID_ARGUMENT.
+	GetRegion(context.Context, *GetRegionRequest) (*Region, error)
+	// Subscribe streams the pixels placed from now on, optionally limited to
+	// a region.
+	Subscribe(*SubscribeRequest, Place_SubscribeServer) error
+	mustEmbedUnimplementedPlaceServer()
+}
+
+// UnimplementedPlaceServer must be embedded to have forward compatible implementations.
+type UnimplementedPlaceServer struct {
+}
+
+func (UnimplementedPlaceServer) PlacePixel(context.Context, *PlacePixelRequest) (*PlacePixelResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PlacePixel not implemented")
+}
+func (UnimplementedPlaceServer) GetCanvas(context.Context, *GetCanvasRequest) (*Canvas, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCanvas not implemented")
+}
+func (UnimplementedPlaceServer) GetRegion(context.Context, *GetRegionRequest) (*Region, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetRegion not implemented")
+}
+func (UnimplementedPlaceServer) Subscribe(*SubscribeRequest, Place_SubscribeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+func (UnimplementedPlaceServer) mustEmbedUnimplementedPlaceServer() {}
+
+// UnsafePlaceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PlaceServer will
+// result in compilation errors.
+type UnsafePlaceServer interface {
+	mustEmbedUnimplementedPlaceServer()
+}
+
+func RegisterPlaceServer(s grpc.ServiceRegistrar, srv PlaceServer) {
+	s.RegisterService(&Place_ServiceDesc, srv)
+}
+
+func _Place_PlacePixel_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PlacePixelRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PlaceServer).PlacePixel(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rplace.place.v1.Place/PlacePixel",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PlaceServer).PlacePixel(ctx, req.(*PlacePixelRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Place_GetCanvas_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetCanvasRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PlaceServer).GetCanvas(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rplace.place.v1.Place/GetCanvas",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PlaceServer).GetCanvas(ctx, req.(*GetCanvasRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Place_GetRegion_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRegionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PlaceServer).GetRegion(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rplace.place.v1.Place/GetRegion",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PlaceServer).GetRegion(ctx, req.(*GetRegionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Place_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PlaceServer).Subscribe(m, &placeSubscribeServer{stream})
+}
+
+type Place_SubscribeServer interface {
+	Send(*PixelEvent) error
+	grpc.ServerStream
+}
+
+type placeSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *placeSubscribeServer) Send(m *PixelEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Place_ServiceDesc is the grpc.ServiceDesc for Place service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Place_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "rplace.place.v1.Place",
+	HandlerType: (*PlaceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "PlacePixel",
+			Handler:    _Place_PlacePixel_Handler,
+		},
+		{
+			MethodName: "GetCanvas",
+			Handler:    _Place_GetCanvas_Handler,
+		},
+		{
+			MethodName: "GetRegion",
+			Handler:    _Place_GetRegion_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _Place_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "place.proto",
+}
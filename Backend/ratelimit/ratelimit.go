@@ -0,0 +1,309 @@
+// Package ratelimit limits requests per client IP with token buckets. A
+// bucket holds up to Burst tokens and refills at Rate tokens a second; each
+// request takes one.
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Jonathanpatta/rplace/cache"
+	"github.com/syndtr/goleveldb/leveldb"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Code is the rejection code sent with a 429.
+const Code = "rate_limited"
+
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// PerMinute allows n requests a minute with bursts of up to burst.
+func PerMinute(n int, burst int) Limit {
+	return Limit{Rate: float64(n) / 60, Burst: burst}
+}
+
+// PerHour allows n requests an hour with bursts of up to burst.
+func PerHour(n int, burst int) Limit {
+	return Limit{Rate: float64(n) / 3600, Burst: burst}
+}
+
+// sweepEvery is how many takes a store lets pass between sweeps of the
+// buckets that refilled.
+const sweepEvery = 1000
+
+// Bucket is the state kept per route and client. Full is when it will have
+// refilled, after which it is no different from a new one; it is zero for
+// buckets that never refill and ones kept before it was recorded.
+type Bucket struct {
+	Tokens  float64
+	Updated time.Time
+	Full    time.Time
+}
+
+// refilled reports whether the bucket is full again by now and can be
+// dropped. Buckets that do not know when they refill are dropped once idle
+// for an hour.
+func (b *Bucket) refilled(now time.Time) bool {
+	if b.Full.IsZero() {
+		return now.Sub(b.Updated) > time.Hour
+	}
+	return !now.Before(b.Full)
+}
+
+// take refills the bucket up to now and takes a token if there is one.
+// Otherwise it returns how long until there is.
+func (b *Bucket) take(limit Limit, now time.Time) (bool, time.Duration) {
+	if b.Updated.IsZero() {
+		b.Tokens = float64(limit.Burst)
+	} else if elapsed := now.Sub(b.Updated).Seconds(); elapsed > 0 {
+		b.Tokens = math.Min(float64(limit.Burst), b.Tokens+elapsed*limit.Rate)
+	}
+	b.Updated = now
+
+	allowed := b.Tokens >= 1
+	if allowed {
+		b.Tokens--
+	}
+	if limit.Rate <= 0 {
+		b.Full = time.Time{}
+		if allowed {
+			return true, 0
+		}
+		return false, time.Hour
+	}
+	b.Full = now.Add(time.Duration((float64(limit.Burst) - b.Tokens) / limit.Rate * float64(time.Second)))
+	if allowed {
+		return true, 0
+	}
+	return false, time.Duration((1 - b.Tokens) / limit.Rate * float64(time.Second))
+}
+
+// Store keeps the buckets.
+type Store interface {
+	Take(key string, limit Limit, now time.Time) (bool, time.Duration, error)
+}
+
+// MemoryStore keeps the buckets in process.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*Bucket
+	takes   int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*Bucket)}
+}
+
+func (m *MemoryStore) Take(key string, limit Limit, now time.Time) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Buckets that refilled are dropped now and then, since a new bucket
+	// starts full anyway.
+	m.takes++
+	if m.takes%sweepEvery == 0 {
+		for k, b := range m.buckets {
+			if b.refilled(now) {
+				delete(m.buckets, k)
+			}
+		}
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &Bucket{}
+		m.buckets[key] = b
+	}
+	allowed, wait := b.take(limit, now)
+	return allowed, wait, nil
+}
+
+// CacheStore keeps the buckets in the leveldb cache under RATELIMIT#, where
+// every limiter of the process shares them and they can be inspected.
+type CacheStore struct {
+	Cache *cache.Client
+
+	mu    sync.Mutex
+	takes int
+}
+
+func NewCacheStore(c *cache.Client) *CacheStore {
+	return &CacheStore{Cache: c}
+}
+
+func (c *CacheStore) Take(key string, limit Limit, now time.Time) (bool, time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.takes++
+	if c.takes%sweepEvery == 0 {
+		c.sweep(now)
+	}
+
+	key = "RATELIMIT#" + key
+	var b Bucket
+	err := c.Cache.Get(key, &b)
+	if err != nil && err != leveldb.ErrNotFound {
+		return false, 0, err
+	}
+
+	allowed, wait := b.take(limit, now)
+	err = c.Cache.Put(key, b)
+	if err != nil {
+		return false, 0, err
+	}
+	return allowed, wait, nil
+}
+
+// sweep deletes the buckets that refilled, as MemoryStore drops them, so
+// that the cache does not keep one for every client ever seen.
+func (c *CacheStore) sweep(now time.Time) {
+	keys, err := c.Cache.Keys("RATELIMIT#")
+	if err != nil {
+		return
+	}
+	for key := range keys {
+		var b Bucket
+		if c.Cache.Get(key, &b) == nil && b.refilled(now) {
+			c.Cache.Delete(key)
+		}
+	}
+}
+
+// Limiter applies limits to routes, keyed by the client IP. The address of
+// the peer is used unless it is one of the trusted proxies, in which case
+// the client is taken from X-Forwarded-For.
+type Limiter struct {
+	Store Store
+
+	proxies []*net.IPNet
+}
+
+// New returns a limiter trusting the proxies given as IPs or CIDRs.
+func New(store Store, trustedProxies []string) (*Limiter, error) {
+	l := &Limiter{Store: store}
+	for _, proxy := range trustedProxies {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", proxy, err)
+		}
+		l.proxies = append(l.proxies, network)
+	}
+	return l, nil
+}
+
+func (l *Limiter) trusted(ip net.IP) bool {
+	for _, network := range l.proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP is the address a request is limited by. X-Forwarded-For is read
+// from the right, skipping trusted proxies, so a client cannot pick its own
+// address by sending the header itself.
+func (l *Limiter) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !l.trusted(ip) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		host = hop.String()
+		if !l.trusted(hop) {
+			break
+		}
+	}
+	return host
+}
+
+// Wrap limits next to limit requests per client. The route name keeps the
+// buckets of different routes apart. A nil limiter lets everything through.
+func (l *Limiter) Wrap(route string, limit Limit, next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed, wait, err := l.Store.Take(route+"#"+l.ClientIP(r), limit, time.Now())
+		if err != nil {
+			// The limiter failing is no reason to turn everyone away.
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !allowed {
+			WriteLimited(w, wait)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// WrapFunc is Wrap for handler functions.
+func (l *Limiter) WrapFunc(route string, limit Limit, next http.HandlerFunc) http.Handler {
+	return l.Wrap(route, limit, next)
+}
+
+// LimitedError is returned by code that applies a limit outside of Wrap,
+// for the caller to answer with WriteLimited.
+type LimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LimitedError) Error() string {
+	return fmt.Sprintf("rate limited, retry after %s", e.RetryAfter)
+}
+
+// WriteLimited answers a request that went over its limit.
+func WriteLimited(w http.ResponseWriter, wait time.Duration) {
+	out, err := json.Marshal(map[string]string{
+		"code":   Code,
+		"reason": "too many requests, try again later",
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprint(w, string(out))
+}
@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	l, err := New(NewMemoryStore(), []string{"10.0.0.1", "192.168.0.0/16", " ", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		ip        string
+	}{
+		{"direct", "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"untrusted peer sending the header", "203.0.113.5:1234", []string{"198.51.100.7"}, "203.0.113.5"},
+		{"behind a trusted proxy", "10.0.0.1:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"client picking its own address", "10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.7"}, "198.51.100.7"},
+		{"behind a chain of proxies", "10.0.0.1:1234", []string{"198.51.100.7, 192.168.4.4"}, "198.51.100.7"},
+		{"hops split across headers", "10.0.0.1:1234", []string{"198.51.100.7", "192.168.4.4"}, "198.51.100.7"},
+		{"only trusted hops", "10.0.0.1:1234", []string{"192.168.4.4"}, "192.168.4.4"},
+		{"garbage hop", "10.0.0.1:1234", []string{"198.51.100.7, nonsense"}, "10.0.0.1"},
+		{"trusted proxy without the header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"IPv6 proxy", "[fd00::1]:1234", []string{"2001:db8::5"}, "2001:db8::5"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = test.remote
+			for _, header := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+			if ip := l.ClientIP(r); ip != test.ip {
+				t.Fatalf("got %s, want %s", ip, test.ip)
+			}
+		})
+	}
+}
+
+func TestNewRejectsBadProxies(t *testing.T) {
+	_, err := New(NewMemoryStore(), []string{"10.0.0.0/33"})
+	if err == nil {
+		t.Fatal("accepted a bad proxy")
+	}
+}
+
+func TestBucketTake(t *testing.T) {
+	limit := PerMinute(60, 2)
+	now := time.Unix(1000, 0)
+
+	tests := []struct {
+		name    string
+		after   time.Duration
+		allowed bool
+		wait    time.Duration
+	}{
+		{"first of the burst", 0, true, 0},
+		{"second of the burst", 0, true, 0},
+		{"burst spent", 0, false, time.Second},
+		{"half refilled", 500 * time.Millisecond, false, 500 * time.Millisecond},
+		{"refilled one", 500 * time.Millisecond, true, 0},
+		{"long idle refills up to the burst", time.Hour, true, 0},
+		{"rest of the burst", 0, true, 0},
+		{"spent again", 0, false, time.Second},
+	}
+	var b Bucket
+	for _, test := range tests {
+		now = now.Add(test.after)
+		allowed, wait := b.take(limit, now)
+		if allowed != test.allowed || wait != test.wait {
+			t.Fatalf("%s: got %v, %s, want %v, %s", test.name, allowed, wait, test.allowed, test.wait)
+		}
+	}
+}
+
+func TestMemoryStoreKeepsKeysApart(t *testing.T) {
+	m := NewMemoryStore()
+	limit := PerHour(1, 1)
+	now := time.Now()
+
+	if allowed, _, _ := m.Take("place#1.2.3.4", limit, now); !allowed {
+		t.Fatal("first request limited")
+	}
+	if allowed, _, _ := m.Take("place#1.2.3.4", limit, now); allowed {
+		t.Fatal("second request allowed")
+	}
+	if allowed, _, _ := m.Take("place#5.6.7.8", limit, now); !allowed {
+		t.Fatal("another client limited")
+	}
+	if allowed, _, _ := m.Take("login#1.2.3.4", limit, now); !allowed {
+		t.Fatal("another route limited")
+	}
+}
+
+func TestWrap(t *testing.T) {
+	l, err := New(NewMemoryStore(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := l.Wrap("test", PerHour(1, 1), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	codes := []int{http.StatusOK, http.StatusTooManyRequests}
+	for i, code := range codes {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+		if w.Code != code {
+			t.Fatalf("request %d: got %d, want %d", i, w.Code, code)
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("preflight got %d", w.Code)
+	}
+}
@@ -0,0 +1,92 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+)
+
+var ErrForbiddenTarget = errors.New("webhooks cannot be sent to loopback, link-local or private addresses")
+
+// forbiddenIP reports whether ip is an address webhooks are kept from
+// reaching, so that a subscription cannot be used to probe the network the
+// server runs in.
+func forbiddenIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsPrivate() || ip.IsUnspecified() || ip.IsInterfaceLocalMulticast()
+}
+
+// ValidateURL checks that raw is an absolute http or https URL. Unless
+// allowPrivate is set, its host must not resolve to an address forbiddenIP
+// refuses.
+func ValidateURL(ctx context.Context, raw string, allowPrivate bool) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("url must be http or https")
+	}
+	if u.Hostname() == "" {
+		return errors.New("url must have a host")
+	}
+	if u.User != nil {
+		return errors.New("url must not carry credentials")
+	}
+	if allowPrivate {
+		return nil
+	}
+
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		if forbiddenIP(ip) {
+			return ErrForbiddenTarget
+		}
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("could not resolve %s", u.Hostname())
+	}
+	for _, addr := range addrs {
+		if forbiddenIP(addr.IP) {
+			return ErrForbiddenTarget
+		}
+	}
+	return nil
+}
+
+// newHttpClient returns the client deliveries are posted with. The address
+// is checked again when connecting, since a host may resolve differently by
+// then and redirects are followed.
+func (d *Dispatcher) newHttpClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: deliveryTimeout,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			if d.AllowPrivateTargets {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || forbiddenIP(ip) {
+				return ErrForbiddenTarget
+			}
+			return nil
+		},
+	}
+
+	// Deliveries connect directly, so that the check sees the address of
+	// the target rather than that of a proxy.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   deliveryTimeout,
+		Transport: transport,
+	}
+}
@@ -0,0 +1,686 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Jonathanpatta/rplace/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	EventPixelPlaced    = "pixel.placed"
+	EventPhaseChanged   = "canvas.phase_changed"
+	EventUserBanned     = "user.banned"
+	EventUserUnbanned   = "user.unbanned"
+	EventRegionLocked   = "region.locked"
+	EventRegionUnlocked = "region.unlocked"
+	EventUserFlagged    = "user.flagged"
+)
+
+const (
+	maxAttempts      = 6
+	baseBackoff      = 2 * time.Second
+	deliveryTimeout  = 10 * time.Second
+	defaultBatchSize = 100
+	logRetention     = 7 * 24 * time.Hour
+	// reloadInterval is how often the subscriptions are read again, which
+	// picks up the ones added or removed through another instance.
+	reloadInterval = 30 * time.Second
+)
+
+type Event struct {
+	Id    string      `json:"id"`
+	Type  string      `json:"type"`
+	Time  int64       `json:"time"`
+	Count int         `json:"count,omitempty"`
+	Data  interface{} `json:"data"`
+}
+
+// Subscription sends the events listed in Events to Url. An empty list
+// subscribes to everything. With BatchSeconds set, pixel placements are
+// collected and sent together at that interval or once BatchSize of them
+// have piled up.
+type Subscription struct {
+	Id           string   `json:"id"`
+	Url          string   `json:"url"`
+	Secret       string   `json:"secret,omitempty"`
+	Events       []string `json:"events,omitempty"`
+	BatchSeconds int      `json:"batch_seconds,omitempty" dynamodbav:"batch_seconds"`
+	BatchSize    int      `json:"batch_size,omitempty" dynamodbav:"batch_size"`
+	CreatedBy    string   `json:"created_by,omitempty" dynamodbav:"created_by"`
+	CreatedAt    int64    `json:"created_at,omitempty" dynamodbav:"created_at"`
+}
+
+func (s *Subscription) Wants(eventType string) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery is one attempt log entry of sending an event to a subscription.
+type Delivery struct {
+	Id           string `json:"id"`
+	Subscription string `json:"subscription"`
+	Event        string `json:"event"`
+	EventType    string `json:"event_type" dynamodbav:"event_type"`
+	Attempt      int    `json:"attempt"`
+	Status       int    `json:"status,omitempty"`
+	Error        string `json:"error,omitempty"`
+	Delivered    bool   `json:"delivered"`
+	Time         int64  `json:"time"`
+}
+
+// DeadLetter keeps an event that could not be delivered after every retry.
+type DeadLetter struct {
+	Subscription string `json:"subscription"`
+	Event        string `json:"event"`
+	Payload      string `json:"payload"`
+	Error        string `json:"error,omitempty"`
+	Time         int64  `json:"time"`
+}
+
+type delivery struct {
+	subscription *Subscription
+	event        Event
+	payload      []byte
+	attempt      int
+}
+
+type batch struct {
+	pixels  []interface{}
+	started time.Time
+}
+
+// Dispatcher signs and delivers events to the webhook subscriptions,
+// retrying failed deliveries with exponential backoff.
+type Dispatcher struct {
+	DbCli      *dynamodb.Client
+	TableName  *string
+	HttpClient *http.Client
+	// AllowPrivateTargets lets subscriptions reach loopback, link-local
+	// and private addresses, for trying webhooks out locally.
+	AllowPrivateTargets bool
+
+	mu            sync.RWMutex
+	subscriptions map[string]*Subscription
+	batches       map[string]*batch
+
+	queue chan *delivery
+}
+
+func NewDispatcher(DbCli *dynamodb.Client) *Dispatcher {
+	d := &Dispatcher{
+		DbCli:         DbCli,
+		TableName:     aws.String("Place-Clone"),
+		subscriptions: make(map[string]*Subscription),
+		batches:       make(map[string]*batch),
+		queue:         make(chan *delivery, 1024),
+	}
+	d.HttpClient = d.newHttpClient()
+	return d
+}
+
+// Start runs the delivery workers until ctx is done and loads the
+// subscriptions, reloading them every reloadInterval.
+func (d *Dispatcher) Start(ctx context.Context, workers int) error {
+	for i := 0; i < workers; i++ {
+		go d.work(ctx)
+	}
+	go d.flushBatches(ctx)
+	go d.reload(ctx)
+
+	return d.Load(ctx)
+}
+
+func (d *Dispatcher) reload(ctx context.Context) {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := d.Load(ctx)
+			if err != nil {
+				log.Printf("could not reload webhook subscriptions: %s", err.Error())
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) Load(ctx context.Context) error {
+	paginator := dynamodb.NewQueryPaginator(d.DbCli, &dynamodb.QueryInput{
+		TableName:              d.TableName,
+		KeyConditionExpression: aws.String("#PK = :pk"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk": &types.AttributeValueMemberS{Value: "WEBHOOK"},
+		},
+		ExpressionAttributeNames: map[string]string{
+			"#PK": "PK",
+		},
+	})
+
+	var subscriptions []*Subscription
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		var found []*Subscription
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &found)
+		if err != nil {
+			return err
+		}
+		subscriptions = append(subscriptions, found...)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.subscriptions = make(map[string]*Subscription)
+	for _, sub := range subscriptions {
+		d.subscriptions[sub.Id] = sub
+	}
+	return nil
+}
+
+// Publish hands an event to every subscription that wants it. It never
+// blocks on delivery.
+func (d *Dispatcher) Publish(eventType string, data interface{}) {
+	if d == nil {
+		return
+	}
+
+	event := Event{
+		Id:   uuid.New().String(),
+		Type: eventType,
+		Time: time.Now().Unix(),
+		Data: data,
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, sub := range d.subscriptions {
+		if !sub.Wants(eventType) {
+			continue
+		}
+		if eventType == EventPixelPlaced && sub.BatchSeconds > 0 {
+			d.addToBatch(sub, data)
+			continue
+		}
+		d.enqueue(sub, event)
+	}
+}
+
+// PublishOnce publishes an event that every instance sees happen, such as
+// a phase change, from the first instance to claim key. The claims expire
+// with the delivery logs.
+func (d *Dispatcher) PublishOnce(ctx context.Context, key string, eventType string, data interface{}) {
+	if d == nil {
+		return
+	}
+
+	_, err := d.DbCli.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: d.TableName,
+		Item: map[string]types.AttributeValue{
+			"PK":         &types.AttributeValueMemberS{Value: "WEBHOOKONCE"},
+			"SK":         &types.AttributeValueMemberS{Value: eventType + "#" + key},
+			"expires_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(logRetention).Unix(), 10)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return
+	}
+	if err != nil {
+		log.Printf("could not claim webhook event %s: %s", eventType, err.Error())
+		return
+	}
+
+	d.Publish(eventType, data)
+}
+
+// addToBatch must be called with d.mu held.
+func (d *Dispatcher) addToBatch(sub *Subscription, data interface{}) {
+	b, ok := d.batches[sub.Id]
+	if !ok {
+		b = &batch{started: time.Now()}
+		d.batches[sub.Id] = b
+	}
+	b.pixels = append(b.pixels, data)
+
+	size := sub.BatchSize
+	if size <= 0 {
+		size = defaultBatchSize
+	}
+	if len(b.pixels) >= size {
+		d.sendBatch(sub)
+	}
+}
+
+// sendBatch must be called with d.mu held.
+func (d *Dispatcher) sendBatch(sub *Subscription) {
+	b, ok := d.batches[sub.Id]
+	if !ok || len(b.pixels) == 0 {
+		return
+	}
+	delete(d.batches, sub.Id)
+
+	d.enqueue(sub, Event{
+		Id:    uuid.New().String(),
+		Type:  EventPixelPlaced,
+		Time:  time.Now().Unix(),
+		Count: len(b.pixels),
+		Data:  b.pixels,
+	})
+}
+
+func (d *Dispatcher) flushBatches(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			d.mu.Lock()
+			for id, b := range d.batches {
+				sub, ok := d.subscriptions[id]
+				if !ok {
+					delete(d.batches, id)
+					continue
+				}
+				if now.Sub(b.started) >= time.Duration(sub.BatchSeconds)*time.Second {
+					d.sendBatch(sub)
+				}
+			}
+			d.mu.Unlock()
+		}
+	}
+}
+
+func (d *Dispatcher) enqueue(sub *Subscription, event Event) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("could not encode webhook event %s: %s", event.Id, err.Error())
+		return
+	}
+
+	d.push(&delivery{subscription: sub, event: event, payload: payload, attempt: 1})
+}
+
+func (d *Dispatcher) push(del *delivery) {
+	select {
+	case d.queue <- del:
+	default:
+		// Publish holds d.mu while it pushes, so the write is left to its
+		// own goroutine.
+		go d.deadLetter(del, "delivery queue is full")
+	}
+}
+
+func (d *Dispatcher) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case del := <-d.queue:
+			d.deliver(ctx, del)
+		}
+	}
+}
+
+// Sign returns the signature sent in the X-Rplace-Signature header: the hex
+// HMAC-SHA256 of the timestamp, a dot and the body, keyed with the secret.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, del *delivery) {
+	status, err := d.post(ctx, del)
+
+	entry := Delivery{
+		Id:           uuid.New().String(),
+		Subscription: del.subscription.Id,
+		Event:        del.event.Id,
+		EventType:    del.event.Type,
+		Attempt:      del.attempt,
+		Status:       status,
+		Delivered:    err == nil,
+		Time:         time.Now().Unix(),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	d.logDelivery(ctx, entry)
+
+	if err == nil {
+		return
+	}
+	if del.attempt >= maxAttempts {
+		d.deadLetter(del, err.Error())
+		return
+	}
+
+	backoff := baseBackoff << (del.attempt - 1)
+	del.attempt++
+	time.AfterFunc(backoff, func() {
+		d.push(del)
+	})
+}
+
+func (d *Dispatcher) post(ctx context.Context, del *delivery) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, del.subscription.Url, bytes.NewReader(del.payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Rplace-Event", del.event.Type)
+	req.Header.Set("X-Rplace-Delivery", del.event.Id)
+	req.Header.Set("X-Rplace-Timestamp", timestamp)
+	req.Header.Set("X-Rplace-Signature", Sign(del.subscription.Secret, timestamp, del.payload))
+
+	resp, err := d.HttpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (d *Dispatcher) logDelivery(ctx context.Context, entry Delivery) {
+	item, err := attributevalue.MarshalMap(entry)
+	if err != nil {
+		log.Printf("could not encode webhook delivery: %s", err.Error())
+		return
+	}
+	item["PK"] = &types.AttributeValueMemberS{Value: "WEBHOOKLOG#" + entry.Subscription}
+	item["SK"] = &types.AttributeValueMemberS{Value: fmt.Sprintf("%020d#%s", time.Now().UnixNano(), entry.Id)}
+	item["expires_at"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(logRetention).Unix(), 10)}
+
+	_, err = d.DbCli.PutItem(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: d.TableName,
+	})
+	if err != nil {
+		log.Printf("could not log webhook delivery: %s", err.Error())
+	}
+}
+
+func (d *Dispatcher) deadLetter(del *delivery, reason string) {
+	letter := DeadLetter{
+		Subscription: del.subscription.Id,
+		Event:        del.event.Id,
+		Payload:      string(del.payload),
+		Error:        reason,
+		Time:         time.Now().Unix(),
+	}
+	item, err := attributevalue.MarshalMap(letter)
+	if err != nil {
+		log.Printf("could not encode dead letter: %s", err.Error())
+		return
+	}
+	item["PK"] = &types.AttributeValueMemberS{Value: "WEBHOOKDLQ"}
+	item["SK"] = &types.AttributeValueMemberS{Value: fmt.Sprintf("%020d#%s", time.Now().UnixNano(), del.event.Id)}
+
+	_, err = d.DbCli.PutItem(context.Background(), &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: d.TableName,
+	})
+	if err != nil {
+		log.Printf("could not store dead letter for %s: %s", del.event.Id, err.Error())
+	}
+}
+
+func (d *Dispatcher) Subscribe(ctx context.Context, sub *Subscription) error {
+	item, err := attributevalue.MarshalMap(sub)
+	if err != nil {
+		return err
+	}
+	item["PK"] = &types.AttributeValueMemberS{Value: "WEBHOOK"}
+	item["SK"] = &types.AttributeValueMemberS{Value: sub.Id}
+
+	_, err = d.DbCli.PutItem(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: d.TableName,
+	})
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.subscriptions[sub.Id] = sub
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *Dispatcher) Unsubscribe(ctx context.Context, id string) error {
+	_, err := d.DbCli.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: d.TableName,
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: "WEBHOOK"},
+			"SK": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	delete(d.subscriptions, id)
+	delete(d.batches, id)
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *Dispatcher) Subscriptions() []*Subscription {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	subscriptions := make([]*Subscription, 0, len(d.subscriptions))
+	for _, sub := range d.subscriptions {
+		redacted := *sub
+		redacted.Secret = ""
+		subscriptions = append(subscriptions, &redacted)
+	}
+	return subscriptions
+}
+
+func (d *Dispatcher) recent(ctx context.Context, pk string, out interface{}) error {
+	result, err := d.DbCli.Query(ctx, &dynamodb.QueryInput{
+		TableName:              d.TableName,
+		KeyConditionExpression: aws.String("#PK = :pk"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk": &types.AttributeValueMemberS{Value: pk},
+		},
+		ExpressionAttributeNames: map[string]string{
+			"#PK": "PK",
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int32(100),
+	})
+	if err != nil {
+		return err
+	}
+
+	return attributevalue.UnmarshalListOfMaps(result.Items, out)
+}
+
+func (d *Dispatcher) Deliveries(ctx context.Context, id string) ([]Delivery, error) {
+	deliveries := []Delivery{}
+	err := d.recent(ctx, "WEBHOOKLOG#"+id, &deliveries)
+	return deliveries, err
+}
+
+func (d *Dispatcher) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	letters := []DeadLetter{}
+	err := d.recent(ctx, "WEBHOOKDLQ", &letters)
+	return letters, err
+}
+
+type Server struct {
+	Dispatcher *Dispatcher
+}
+
+func NewServer(dispatcher *Dispatcher) *Server {
+	return &Server{
+		Dispatcher: dispatcher,
+	}
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	fmt.Fprint(w, string(out))
+}
+
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *Server) CreateSubscription(w http.ResponseWriter, r *http.Request) {
+	var sub Subscription
+	err := json.NewDecoder(r.Body).Decode(&sub)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if sub.Url == "" {
+		http.Error(w, "url is required", http.StatusBadRequest)
+		return
+	}
+	err = ValidateURL(r.Context(), sub.Url, s.Dispatcher.AllowPrivateTargets)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if sub.Secret == "" {
+		sub.Secret, err = newSecret()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	sub.Id = uuid.New().String()
+	sub.CreatedBy, _, _ = middleware.Identity(r)
+	sub.CreatedAt = time.Now().Unix()
+
+	err = s.Dispatcher.Subscribe(r.Context(), &sub)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, http.StatusCreated, sub)
+}
+
+func (s *Server) GetSubscriptions(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, s.Dispatcher.Subscriptions())
+}
+
+func (s *Server) DeleteSubscription(w http.ResponseWriter, r *http.Request) {
+	err := s.Dispatcher.Unsubscribe(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) GetDeliveries(w http.ResponseWriter, r *http.Request) {
+	deliveries, err := s.Dispatcher.Deliveries(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, http.StatusOK, deliveries)
+}
+
+func (s *Server) GetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	letters, err := s.Dispatcher.DeadLetters(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, http.StatusOK, letters)
+}
+
+func adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions && !middleware.IsAdmin(r) {
+			http.Error(w, "admin only", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type Options struct {
+	Dispatcher     *Dispatcher
+	AuthMiddleware *middleware.AuthMiddlewareServer
+}
+
+func AddSubrouter(o *Options, r *mux.Router) {
+	server := NewServer(o.Dispatcher)
+
+	router := r.PathPrefix("/api/webhooks").Subrouter()
+
+	router.Use(o.AuthMiddleware.Authenticate, middleware.Scoped)
+	router.Use(adminOnly)
+
+	router.HandleFunc("", server.GetSubscriptions).Methods("GET", "OPTIONS")
+	router.HandleFunc("", server.CreateSubscription).Methods("POST", "OPTIONS")
+	router.HandleFunc("/dead-letters", server.GetDeadLetters).Methods("GET", "OPTIONS")
+	router.HandleFunc("/{id}", server.DeleteSubscription).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/{id}/deliveries", server.GetDeliveries).Methods("GET", "OPTIONS")
+}